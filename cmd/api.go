@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+var apiCmd = &cobra.Command{
+	Use:   "api",
+	Short: "Call TrueNAS API methods directly, eg. ones that no other command covers",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.HelpFunc()(cmd, args)
+			return
+		}
+	},
+}
+
+var apiCallCmd = &cobra.Command{
+	Use:   "call <method> [<json-params>]",
+	Short: "Call a method and print its result",
+	Long: "Call a method and print its result, eg.\n" +
+		"  truenas_incus_ctl api call pool.dataset.query '[[[\"pool\",\"=\",\"dozer\"]],{\"select\":[\"id\"]}]'\n" +
+		"The params are a JSON list of the method's arguments. Any other JSON value is passed as the only argument.\n" +
+		"Use - or --params-file to read them from stdin or a file instead.",
+	Args: cobra.RangeArgs(1, 2),
+}
+
+var apiJobCmd = &cobra.Command{
+	Use:   "job <method> [<json-params>]",
+	Short: "Start a method as a job, wait for it to finish and print its result",
+	Long: "Start a method as a job, wait for it to finish and print its result, eg.\n" +
+		"  truenas_incus_ctl api job pool.dataset.delete '[\"dozer/old\",{\"recursive\":true}]'\n" +
+		"The params are given as with \"api call\". Exits with status 2 if the job failed.",
+	Args: cobra.RangeArgs(1, 2),
+}
+
+var apiMethodsCmd = &cobra.Command{
+	Use:   "methods [<prefix>...]",
+	Short: "List the methods that TrueNAS provides, optionally only those starting with one of the prefixes",
+	Long: "List the methods that TrueNAS provides, optionally only those starting with one of the prefixes.\n" +
+		"Use --format=json or --format=yaml to include the schemas of their arguments and results.",
+}
+
+var g_apiCallEnums map[string][]string
+var g_apiJobEnums map[string][]string
+var g_apiMethodsEnums map[string][]string
+
+func init() {
+	apiCallCmd.RunE = WrapCommandFunc(callApiMethod)
+	apiJobCmd.RunE = WrapCommandFunc(callApiJob)
+	apiMethodsCmd.RunE = WrapCommandFunc(listApiMethods)
+
+	apiCallCmd.Flags().StringP("params-file", "f", "", "Read the params from this file, or from stdin if it is -")
+	apiCallCmd.Flags().StringP("timeout", "t", "", "Give up waiting for the result after this duration, eg. 10m")
+	apiCallCmd.Flags().String("format", "json", "Output format. Defaults to \"json\" "+
+		AddFlagsEnum(&g_apiCallEnums, "format", []string{"json", "yaml"}))
+
+	apiJobCmd.Flags().StringP("params-file", "f", "", "Read the params from this file, or from stdin if it is -")
+	apiJobCmd.Flags().String("format", "json", "Output format. Defaults to \"json\" "+
+		AddFlagsEnum(&g_apiJobEnums, "format", []string{"json", "yaml"}))
+
+	apiMethodsCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	apiMethodsCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	apiMethodsCmd.Flags().String("format", "table", "Output table format. Defaults to \"table\" "+
+		AddFlagsEnum(&g_apiMethodsEnums, "format", []string{"csv", "json", "yaml", "table", "compact"}))
+
+	allowAsync(apiJobCmd)
+
+	apiCmd.AddCommand(apiCallCmd)
+	apiCmd.AddCommand(apiJobCmd)
+	apiCmd.AddCommand(apiMethodsCmd)
+	rootCmd.AddCommand(apiCmd)
+}
+
+func callApiMethod(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_apiCallEnums)
+	if err != nil {
+		return err
+	}
+
+	params, err := readApiParams(cmd, args, options.allFlags["params_file"])
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(defaultCallTimeout) * time.Second
+	if timeoutStr := options.allFlags["timeout"]; timeoutStr != "" {
+		if timeout, err = time.ParseDuration(timeoutStr); err != nil {
+			return fmt.Errorf("Failed to parse --timeout: %v", err)
+		}
+	}
+
+	cmd.SilenceUsage = true
+
+	ctx, cancel := context.WithTimeout(getCommandContext(cmd), timeout)
+	defer cancel()
+
+	out, err := core.ApiCallCtx(ctx, api, args[0], params)
+	if err != nil {
+		return err
+	}
+
+	var response map[string]interface{}
+	if err = decodeJsonNumbers(out, &response); err != nil {
+		return err
+	}
+	return printApiValue(api, response["result"], options.allFlags["format"])
+}
+
+func callApiJob(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_apiJobEnums)
+	if err != nil {
+		return err
+	}
+
+	params, err := readApiParams(cmd, args, options.allFlags["params_file"])
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	ctx := getCommandContext(cmd)
+	jobId, err := core.ApiCallAsyncCtx(ctx, api, args[0], params, !isAsync())
+	if err != nil {
+		return err
+	}
+	if isAsync() {
+		detachJob(api, jobId)
+		return nil
+	}
+
+	out, err := waitForJobWithProgressCtx(ctx, api, jobId)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return &exitCodeError{code: EXIT_CODE_JOB_FAILED, err: fmt.Errorf("job %d failed: %v", jobId, err)}
+	}
+
+	var result interface{}
+	if err = decodeJsonNumbers(out, &result); err != nil {
+		return err
+	}
+	return printApiValue(api, result, options.allFlags["format"])
+}
+
+func listApiMethods(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_apiMethodsEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	out, err := core.ApiCall(api, "core.get_methods", defaultCallTimeout, []interface{}{})
+	if err != nil {
+		return err
+	}
+
+	var response map[string]interface{}
+	if err = decodeJsonNumbers(out, &response); err != nil {
+		return err
+	}
+	allMethods, ok := response["result"].(map[string]interface{})
+	if !ok {
+		return errors.New("core.get_methods: Expected an object of methods")
+	}
+
+	methods := make(map[string]interface{})
+	for name, method := range allMethods {
+		if len(args) == 0 || hasAnyPrefix(name, args) {
+			methods[name] = method
+		}
+	}
+
+	if f := strings.ToLower(format); f == "json" || f == "yaml" {
+		return printApiValue(api, methods, f)
+	}
+
+	rows := make([]map[string]interface{}, 0, len(methods))
+	for _, name := range core.GetKeysSorted(methods) {
+		method, _ := methods[name].(map[string]interface{})
+		description, _ := method["description"].(string)
+		description, _, _ = strings.Cut(strings.TrimSpace(description), "\n")
+		rows = append(rows, map[string]interface{}{
+			"method":      name,
+			"job":         core.IsValueTrue(method, "job"),
+			"description": description,
+		})
+	}
+
+	return PrintTableData(api, format, "methods", []string{"method", "job", "description"}, rows)
+}
+
+func hasAnyPrefix(str string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(str, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readApiParams reads the params of "api call" or "api job" from their second argument, --params-file or stdin.
+func readApiParams(cmd *cobra.Command, args []string, paramsFile string) ([]interface{}, error) {
+	var data []byte
+	var err error
+	if paramsFile != "" && len(args) > 1 {
+		return nil, errors.New("The params can be given as an argument or with --params-file, but not both")
+	} else if paramsFile == "-" || (len(args) > 1 && args[1] == "-") {
+		data, err = io.ReadAll(cmd.InOrStdin())
+	} else if paramsFile != "" {
+		data, err = os.ReadFile(paramsFile)
+	} else if len(args) > 1 {
+		data = []byte(args[1])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read params: %v", err)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []interface{}{}, nil
+	}
+	var params interface{}
+	if err = decodeJsonNumbers(data, &params); err != nil {
+		return nil, fmt.Errorf("Failed to parse params: %v", err)
+	}
+	if list, isList := params.([]interface{}); isList {
+		return list, nil
+	}
+	return []interface{}{params}, nil
+}
+
+// decodeJsonNumbers decodes data, keeping numbers as they were written rather than converting them to float64, eg. so that large IDs aren't rounded.
+func decodeJsonNumbers(data []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(value); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("Unexpected data after the JSON value")
+	}
+	return nil
+}
+
+func printApiValue(api core.Session, value interface{}, format string) error {
+	var builder strings.Builder
+	if strings.ToLower(format) == "yaml" {
+		core.WriteYaml(&builder, value)
+	} else {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		builder.Write(data)
+		builder.WriteString("\n")
+	}
+	PrintTable(api, builder.String())
+	return nil
+}
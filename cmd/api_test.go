@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApiCall(t *testing.T) {
+	FailIf(t, DoTest(
+		t,
+		apiCallCmd,
+		callApiMethod,
+		map[string]interface{}{},
+		[]string{"pool.dataset.query", "[[[\"pool\",\"=\",\"dozer\"]],{\"select\":[\"id\"]}]"},
+		[]string{"[[[\"pool\",\"=\",\"dozer\"]],{\"select\":[\"id\"]}]"},
+		[]string{"{\"jsonrpc\":\"2.0\",\"result\":[{\"id\":\"dozer\"}],\"id\":2}"},
+		"[\n"+
+		"  {\n"+
+		"    \"id\": \"dozer\"\n"+
+		"  }\n"+
+		"]\n",
+	))
+}
+
+func TestApiCallYamlFromStdin(t *testing.T) {
+	apiCallCmd.SetIn(strings.NewReader("\"dozer\"\n"))
+	defer apiCallCmd.SetIn(nil)
+
+	FailIf(t, DoTest(
+		t,
+		apiCallCmd,
+		callApiMethod,
+		map[string]interface{}{"format":"yaml"},
+		[]string{"pool.dataset.get_instance", "-"},
+		[]string{"[\"dozer\"]"},
+		[]string{"{\"jsonrpc\":\"2.0\",\"result\":{\"id\":\"dozer\",\"children\":[],\"comments\":\"\",\"createtxg\":18446744073709551615,"+
+			"\"used\":{\"parsed\":1024,\"value\":\"1K\"},\"readonly\":{\"value\":\"OFF\"},\"encryption_root\":null},\"id\":2}"},
+		"children: []\n"+
+		"comments: \"\"\n"+
+		"createtxg: 18446744073709551615\n"+
+		"encryption_root: null\n"+
+		"id: dozer\n"+
+		"readonly:\n"+
+		"  value: \"OFF\"\n"+
+		"used:\n"+
+		"  parsed: 1024\n"+
+		"  value: 1K\n",
+	))
+}
+
+func TestApiCallParamsTwice(t *testing.T) {
+	FailIf(t, DoSimpleTest(
+		t,
+		apiCallCmd,
+		callApiMethod,
+		map[string]interface{}{"params-file":"params.json"},
+		[]string{"pool.dataset.query", "[]"},
+		"The params can be given as an argument or with --params-file, but not both",
+	))
+}
+
+func TestApiJob(t *testing.T) {
+	FailIf(t, DoReplayTest(
+		t,
+		apiJobCmd,
+		callApiJob,
+		map[string]interface{}{},
+		[]string{"pool.dataset.delete", "[\"dozer/old\",{\"recursive\":true}]"},
+		"api_job.jsonl",
+		"true\n",
+	))
+}
+
+func TestApiMethods(t *testing.T) {
+	FailIf(t, DoTest(
+		t,
+		apiMethodsCmd,
+		listApiMethods,
+		map[string]interface{}{},
+		[]string{"pool.dataset.c"},
+		[]string{"[]"},
+		[]string{"{\"jsonrpc\":\"2.0\",\"result\":{"+
+			"\"pool.dataset.create\":{\"description\":\"Creates a dataset/zvol.\\n\\n`volsize` is required for type=VOLUME.\",\"job\":false},"+
+			"\"pool.dataset.change_key\":{\"description\":\"Change encryption properties for `id` encrypted dataset.\",\"job\":true},"+
+			"\"pool.dataset.delete\":{\"description\":\"Delete dataset/zvol `id`.\",\"job\":false}"+
+			"},\"id\":2}"},
+		"         method          |  job  |                       description                        \n"+
+		"-------------------------+-------+----------------------------------------------------------\n"+
+		" pool.dataset.change_key | true  | Change encryption properties for `id` encrypted dataset. \n"+
+		" pool.dataset.create     | false | Creates a dataset/zvol.                                  \n",
+	))
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+// Commands marked with this annotation accept --async.
+const ASYNC_ANNOTATION = "async"
+
+var g_async string
+
+// Jobs that were started by the current command and left running because of --async.
+var g_asyncJobIds []int64
+
+func allowAsync(cmds ...*cobra.Command) {
+	for _, cmd := range cmds {
+		if cmd.Annotations == nil {
+			cmd.Annotations = make(map[string]string)
+		}
+		cmd.Annotations[ASYNC_ANNOTATION] = "true"
+	}
+}
+
+// isAsync reports whether jobs should be left running instead of being waited for.
+func isAsync() bool {
+	return g_async != ""
+}
+
+func checkAsyncFlag(cmd *cobra.Command) error {
+	if !isAsync() {
+		return nil
+	}
+	if g_async != "text" && g_async != "json" {
+		return fmt.Errorf("Unrecognised --async format \"%s\", expected text or json", g_async)
+	}
+	if cmd.Annotations[ASYNC_ANNOTATION] != "true" {
+		return fmt.Errorf("%s does not support --async", cmd.CommandPath())
+	}
+	return nil
+}
+
+// detachJob stops the session from waiting for the job when it is closed, and records it to be reported once the command has finished.
+func detachJob(api core.Session, jobId int64) {
+	api.SkipWaitingJobOnClose(jobId)
+	recordAsyncJob(api, jobId)
+}
+
+// recordAsyncJob records a job that was already detached, eg. by tnc.BulkCall, to be reported once the command has finished.
+// Jobs started on one of several hosts are reported with the rest of that host's output.
+func recordAsyncJob(api core.Session, jobId int64) {
+	if host, isHostSession := api.(*hostSession); isHostSession {
+		host.recordAsyncJob(jobId)
+		return
+	}
+	g_asyncJobIds = append(g_asyncJobIds, jobId)
+}
+
+func printAsyncJobs() error {
+	jobIds := g_asyncJobIds
+	g_asyncJobIds = nil
+	return writeAsyncJobs(os.Stdout, jobIds)
+}
+
+func writeAsyncJobs(w io.Writer, jobIds []int64) error {
+	if g_async == "json" {
+		if jobIds == nil {
+			jobIds = make([]int64, 0)
+		}
+		data, err := json.Marshal(map[string]interface{}{"jobs": jobIds})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+		return nil
+	}
+
+	for _, jobId := range jobIds {
+		fmt.Fprintln(w, jobId)
+	}
+	return nil
+}
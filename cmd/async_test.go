@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestAsyncFlag(t *testing.T) {
+	defer func() { g_async = "" }()
+
+	g_async = "json"
+	FailIf(t, checkAsyncFlag(datasetDeleteCmd))
+	FailUnless(t, checkAsyncFlag(datasetListCmd))
+
+	g_async = "yaml"
+	FailUnless(t, checkAsyncFlag(datasetDeleteCmd))
+}
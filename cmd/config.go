@@ -33,6 +33,9 @@ Available Commands:
   # Add a new connection non-interactively
   truenas_incus_ctl config add prod-server --host 192.168.0.31 --api-key "api-key-goes-here"
 
+  # Add a new connection with a username and password, storing an API key created for the user instead
+  truenas_incus_ctl config add prod-server --host 192.168.0.31 --username admin --create-api-key
+
   # List all saved connections
   truenas_incus_ctl config list
 
@@ -97,6 +100,13 @@ func init() {
 	_configEditCommands := []*cobra.Command {configAddCmd, configSetCmd}
 	for _, c := range _configEditCommands {
 		c.Flags().Bool("no-verify", false, "Don't verify the new host and API key before updating the config")
+		c.Flags().Bool("create-api-key", false, "Log in with --username and --password, then store a new API key for the user instead of them")
+		c.Flags().String("api-key-file", "", "Store a reference to a file holding the API key, rather than the key itself")
+		c.Flags().String("api-key-command", "", "Store a command that prints the API key, eg. \"pass show truenas/nas1\", rather than the key itself")
+		c.Flags().String("api-key-env", "", "Store the name of an environment variable holding the API key, rather than the key itself")
+	}
+	for _, c := range append(_configEditCommands, configLoginCmd) {
+		c.Flags().Bool("encrypt", false, "Encrypt the stored API key or password with a keyfile, which is created next to the config file if there isn't one")
 	}
 
 	configCmd.AddCommand(configLoginCmd)
@@ -122,13 +132,13 @@ func showConfig(cmd *cobra.Command, api core.Session, args []string) error {
 	}
 
 	// Pretty print the JSON
-	var jsonObj interface{}
+	var jsonObj map[string]interface{}
 	if err := json.Unmarshal(data, &jsonObj); err != nil {
 		return fmt.Errorf("Failed to parse config file %s: %v", configPath, err)
 	}
 
-	// Pretty print the JSON with indentation
-	prettyJSON, err := json.MarshalIndent(jsonObj, "", "  ")
+	// Pretty print the JSON with indentation, without any secrets
+	prettyJSON, err := json.MarshalIndent(redactSecrets(jsonObj), "", "  ")
 	if err != nil {
 		return fmt.Errorf("Failed to format config file: %v", err)
 	}
@@ -145,6 +155,8 @@ func addHost(cmd *cobra.Command, api core.Session, args []string) error {
 	name := args[0]
 	hostname := options.allFlags["host"]
 	apiKey := options.allFlags["api_key"]
+	username := options.allFlags["username"]
+	password := options.allFlags["password"]
 	strDebug, passedDebug := options.usedFlags["debug"]
 	strInsecure, passedInsecure := options.usedFlags["allow_insecure"]
 	sockPath, passedSockPath := options.usedFlags["daemon_socket"]
@@ -154,14 +166,42 @@ func addHost(cmd *cobra.Command, api core.Session, args []string) error {
 	if hostname == "" {
 		return fmt.Errorf("Hostname cannot be empty")
 	}
-	if apiKey == "" {
-		return fmt.Errorf("API key cannot be empty")
+
+	refSetting, refValue, err := getApiKeyReference(options.allFlags)
+	if err != nil {
+		return err
+	}
+	if refSetting != "" {
+		if apiKey, err = readSecret(strings.TrimPrefix(refSetting, "api_key"), refValue, ""); err != nil {
+			return fmt.Errorf("Failed to get the API key with --%s: %v", strings.ReplaceAll(refSetting, "_", "-"), err)
+		}
+	}
+	if apiKey == "" && username == "" {
+		return fmt.Errorf("API key cannot be empty, unless --username is given")
+	}
+
+	password, err = checkPasswordFlags(options.allFlags, apiKey, username, password)
+	if err != nil {
+		return err
+	}
+	shouldCreateApiKey := core.IsStringTrue(options.allFlags, "create_api_key")
+
+	tlsOptions := truenas_api.TLSOptions{
+		AllowInsecure:   isInsecure,
+		CaFile:          options.allFlags["ca_file"],
+		CertFingerprint: options.allFlags["cert_fingerprint"],
+		ClientCert:      options.allFlags["client_cert"],
+		ClientKey:       options.allFlags["client_key"],
 	}
 
 	if !core.IsStringTrue(options.allFlags, "no_verify") {
-		if err := verifyHost(hostname, apiKey, isInsecure); err != nil {
+		newKey, err := verifyHost(hostname, apiKey, username, password, tlsOptions, shouldCreateApiKey)
+		if err != nil {
 			return err
 		}
+		if shouldCreateApiKey {
+			apiKey = newKey
+		}
 	}
 
 	// Get the config file path
@@ -175,8 +215,10 @@ func addHost(cmd *cobra.Command, api core.Session, args []string) error {
 	// Add or update host entry with URL including API endpoint
 	// Store the complete URL with /api/current path under the name
 	hostConfig := map[string]interface{}{
-		"url":     hostname,
-		"api_key": apiKey,
+		"url": hostname,
+	}
+	if err = storeConfigCredentials(hostConfig, apiKey, username, password, refSetting, refValue, options.allFlags, getKeyFilePath(configs, configPath)); err != nil {
+		return err
 	}
 	if passedDebug {
 		hostConfig["debug"] = strDebug == "true"
@@ -184,6 +226,7 @@ func addHost(cmd *cobra.Command, api core.Session, args []string) error {
 	if passedInsecure {
 		hostConfig["allow_insecure"] = isInsecure
 	}
+	setConfigTLSOptions(hostConfig, options.usedFlags)
 	if passedSockPath {
 		hostConfig["daemon_socket"] = sockPath
 	}
@@ -206,10 +249,29 @@ func setConfig(cmd *cobra.Command, api core.Session, args []string) error {
 	name := args[0]
 	hostname := options.allFlags["host"]
 	apiKey := options.allFlags["api_key"]
+	username := options.allFlags["username"]
+	password := options.allFlags["password"]
 	strDebug, passedDebug := options.usedFlags["debug"]
 	strInsecure, passedInsecure := options.usedFlags["allow_insecure"]
 	sockPath, passedSockPath := options.usedFlags["daemon_socket"]
 
+	refSetting, refValue, err := getApiKeyReference(options.allFlags)
+	if err != nil {
+		return err
+	}
+	if refSetting != "" {
+		if apiKey, err = readSecret(strings.TrimPrefix(refSetting, "api_key"), refValue, ""); err != nil {
+			return fmt.Errorf("Failed to get the API key with --%s: %v", strings.ReplaceAll(refSetting, "_", "-"), err)
+		}
+	}
+	hasNewCredentials := apiKey != "" || username != ""
+
+	password, err = checkPasswordFlags(options.allFlags, apiKey, username, password)
+	if err != nil {
+		return err
+	}
+	shouldCreateApiKey := core.IsStringTrue(options.allFlags, "create_api_key")
+
 	// Get the config file path
 	configPath := g_configFileName
 	if configPath == "" {
@@ -217,6 +279,9 @@ func setConfig(cmd *cobra.Command, api core.Session, args []string) error {
 	}
 
 	configs, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
 
 	hosts, _ := configs["hosts"].(map[string]interface{})
 	if len(hosts) == 0 {
@@ -236,13 +301,21 @@ func setConfig(cmd *cobra.Command, api core.Session, args []string) error {
 		profile["url"] = hostname
 	}
 
-	if apiKey == "" {
-		apiKey, _ = profile["api_key"].(string)
+	// new credentials replace the old ones, whichever kind they were
+	keyFile := getKeyFilePath(configs, configPath)
+	if !hasNewCredentials {
+		if apiKey, err = resolveSecret(profile, "api_key", keyFile, configPath); err != nil {
+			return err
+		}
 		if apiKey == "" {
-			return fmt.Errorf("API key cannot be empty")
+			username, _ = profile["username"].(string)
+			if password, err = resolveSecret(profile, "password", keyFile, configPath); err != nil {
+				return err
+			}
+		}
+		if apiKey == "" && (username == "" || password == "") {
+			return fmt.Errorf("API key cannot be empty, unless --username is given")
 		}
-	} else {
-		profile["api_key"] = apiKey
 	}
 
 	isInsecure := false
@@ -252,8 +325,25 @@ func setConfig(cmd *cobra.Command, api core.Session, args []string) error {
 		isInsecure, _ = profile["allow_insecure"].(bool)
 	}
 
+	setConfigTLSOptions(profile, options.usedFlags)
+	tlsOptions := truenas_api.TLSOptions{AllowInsecure: isInsecure}
+	tlsOptions.CaFile, _ = profile["ca_file"].(string)
+	tlsOptions.CertFingerprint, _ = profile["cert_fingerprint"].(string)
+	tlsOptions.ClientCert, _ = profile["client_cert"].(string)
+	tlsOptions.ClientKey, _ = profile["client_key"].(string)
+
 	if !core.IsStringTrue(options.allFlags, "no_verify") {
-		if err := verifyHost(hostname, apiKey, isInsecure); err != nil {
+		newKey, err := verifyHost(hostname, apiKey, username, password, tlsOptions, shouldCreateApiKey)
+		if err != nil {
+			return err
+		}
+		if shouldCreateApiKey {
+			apiKey = newKey
+		}
+	}
+	// the credentials are left as they were stored unless they changed, or are to be encrypted
+	if hasNewCredentials || core.IsStringTrue(options.allFlags, "encrypt") {
+		if err = storeConfigCredentials(profile, apiKey, username, password, refSetting, refValue, options.allFlags, keyFile); err != nil {
 			return err
 		}
 	}
@@ -408,37 +498,183 @@ func loadConfig(configPath string) (map[string]interface{}, error) {
 	return configs, nil
 }
 
-func verifyHost(hostname, apiKey string, allowInsecure bool) error {
+// verifyHost logs in to the host with an API key, or with a username and password, and pings it.
+// If shouldCreateApiKey is set, it then creates an API key for the user and returns it.
+func verifyHost(hostname, apiKey, username, password string, tlsOptions truenas_api.TLSOptions, shouldCreateApiKey bool) (string, error) {
 	// Construct the WebSocket URL with API endpoint
 	url := core.GetApiUrlFromHostName(hostname)
 	fmt.Printf("Testing connection to %s...\n", url)
 
-	client, err := truenas_api.NewClient(url, allowInsecure)
+	client, err := truenas_api.NewClientWithOptions(url, tlsOptions, nil)
 	if err != nil {
-		return fmt.Errorf("Failed to create connection to %s: %v", url, err)
+		return "", fmt.Errorf("Failed to create connection to %s: %v", url, err)
 	}
 	defer client.Close()
 
-	// Attempt to login to verify API key
-	err = client.Login("", "", apiKey)
+	// Attempt to login to verify the credentials
+	err = loginClient(client, apiKey, username, password)
 	if err != nil {
-		return fmt.Errorf("Failed to login to %s: %v", url, err)
+		return "", fmt.Errorf("Failed to login to %s: %v", url, err)
 	}
 
 	// Test basic connectivity with a ping
 	result, err := client.Ping()
 	if err != nil {
-		return fmt.Errorf("Failed to ping %s: %v", url, err)
+		return "", fmt.Errorf("Failed to ping %s: %v", url, err)
 	}
 
 	if result != "pong" {
-		return fmt.Errorf("Unexpected ping response from %s: %s", url, result)
+		return "", fmt.Errorf("Unexpected ping response from %s: %s", url, result)
 	}
 
 	fmt.Printf("Successfully connected to %s\n", url)
+
+	if !shouldCreateApiKey {
+		return "", nil
+	}
+	return createApiKey(client, username)
+}
+
+// setConfigTLSOptions stores --ca-file, --cert-fingerprint, --client-cert and --client-key in a host's config
+// if they were given, or removes them if they were given empty.
+func setConfigTLSOptions(hostConfig map[string]interface{}, usedFlags map[string]string) {
+	for _, key := range []string{"ca_file", "cert_fingerprint", "client_cert", "client_key"} {
+		if value, passed := usedFlags[key]; passed && value != "" {
+			hostConfig[key] = value
+		} else if passed {
+			delete(hostConfig, key)
+		}
+	}
+}
+
+// checkPasswordFlags checks that the credentials given to "config add" or "config set" go together,
+// and asks for the password if only the username was given.
+func checkPasswordFlags(flags map[string]string, apiKey, username, password string) (string, error) {
+	if apiKey != "" && username != "" {
+		return "", fmt.Errorf("--api-key and --username cannot be used together")
+	}
+	if core.IsStringTrue(flags, "create_api_key") {
+		if username == "" {
+			return "", fmt.Errorf("--create-api-key requires --username")
+		}
+		if core.IsStringTrue(flags, "no_verify") {
+			return "", fmt.Errorf("--create-api-key cannot be used with --no-verify, since it logs in to create the key")
+		}
+	}
+	if username != "" && password == "" {
+		return promptForPassword("Enter the password for " + username + ": ")
+	}
+	return password, nil
+}
+
+// setConfigCredentials stores an API key in a host's config, or a username and password if there is no API key,
+// replacing however its credentials were stored before.
+func setConfigCredentials(hostConfig map[string]interface{}, apiKey, username, password string) {
+	clearSecrets(hostConfig)
+	delete(hostConfig, "username")
+	if apiKey != "" {
+		hostConfig["api_key"] = apiKey
+	} else {
+		hostConfig["username"] = username
+		hostConfig["password"] = password
+	}
+}
+
+// storeConfigCredentials stores the credentials given to "config add" or "config set", as a reference to the API key
+// if one of --api-key-file, --api-key-command or --api-key-env was given, or encrypted with --encrypt.
+func storeConfigCredentials(hostConfig map[string]interface{}, apiKey, username, password, refSetting, refValue string, flags map[string]string, keyFile string) error {
+	setConfigCredentials(hostConfig, apiKey, username, password)
+	if refSetting != "" {
+		delete(hostConfig, "api_key")
+		hostConfig[refSetting] = refValue
+	}
+	if core.IsStringTrue(flags, "encrypt") {
+		return encryptSecrets(hostConfig, keyFile)
+	}
 	return nil
 }
 
+// loginClient logs in with an API key if there is one, or else with a username and password,
+// asking for a one-time password if the user needs one.
+func loginClient(client *truenas_api.Client, apiKey, username, password string) error {
+	if apiKey != "" {
+		return client.Login("", "", apiKey)
+	}
+	return client.LoginWithPassword(username, password, getOtpToken)
+}
+
+// promptForPassword reads a password from the terminal without echoing it.
+func promptForPassword(prompt string) (string, error) {
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		return "", fmt.Errorf("A password is needed, but stdin is not a terminal to ask for it. Use --password or store it in the config")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("Error reading password: %v", err)
+	}
+	return string(bytePassword), nil
+}
+
+// getOtpToken returns the one-time password given with --otp, or else asks for one if stdin is a terminal.
+func getOtpToken() (string, error) {
+	if g_otp != "" {
+		return g_otp, nil
+	}
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		return "", fmt.Errorf("%w. Use --otp to give it", truenas_api.ErrOtpRequired)
+	}
+	var otp string
+	fmt.Fprint(os.Stderr, "Enter your one-time password: ")
+	fmt.Scanln(&otp)
+	return otp, nil
+}
+
+// createApiKey creates an API key for a user on the host that the client is logged in to.
+func createApiKey(client *truenas_api.Client, username string) (string, error) {
+	fmt.Println("Generating API key...")
+	currentTime := time.Now().Format("2006-01-02")
+	keyName := fmt.Sprintf("Auto-Generated by truenas_incus_ctl %s", currentTime)
+
+	params := []interface{}{
+		map[string]interface{}{
+			"name":     keyName,
+			"username": username,
+		},
+	}
+
+	res, err := client.Call("api_key.create", 30, params)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create API key: %v", err)
+	}
+
+	// Parse the response to get the API key
+	var response map[string]interface{}
+	if err := json.Unmarshal(res, &response); err != nil {
+		return "", fmt.Errorf("Failed to parse API key creation response: %v", err)
+	}
+
+	// Check for errors in the response
+	if errorData, exists := response["error"]; exists {
+		return "", fmt.Errorf("API key creation error: %v", errorData)
+	}
+
+	// Extract the API key from the result
+	result, ok := response["result"].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("Unexpected response format for API key creation")
+	}
+
+	apiKey, ok := result["key"].(string)
+	if !ok {
+		return "", fmt.Errorf("Could not extract API key from response")
+	}
+
+	fmt.Println("API key successfully generated")
+	return apiKey, nil
+}
+
 // loginToHost implements the login subcommand functionality
 func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 	// Note: 'api' parameter will be nil for this command, which is expected
@@ -502,20 +738,21 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 		break
 	}
 
-	var allowInsecureStr string
-	allowInsecure := false
-	for {
-		fmt.Print("Allow self-signed certificates [y/n]: ")
-		fmt.Scanln(&allowInsecureStr)
-		lower := strings.ToLower(allowInsecureStr)
-		if lower == "y" || lower == "yes" {
-			allowInsecure = true
-		} else if lower == "n" || lower == "no" {
-			allowInsecure = false
-		} else {
-			continue
+	// Construct the WebSocket URL with API endpoint
+	url := core.GetApiUrlFromHostName(hostname)
+
+	tlsOptions := truenas_api.TLSOptions{
+		AllowInsecure:   g_allowInsecure,
+		CaFile:          g_caFile,
+		CertFingerprint: g_certFingerprint,
+		ClientCert:      g_clientCert,
+		ClientKey:       g_clientKey,
+	}
+	isVerificationSet := tlsOptions.AllowInsecure || tlsOptions.CaFile != "" || tlsOptions.CertFingerprint != ""
+	if !isVerificationSet && strings.HasPrefix(url, "wss://") {
+		if err = trustOnFirstUse(url, &tlsOptions); err != nil {
+			return err
 		}
-		break
 	}
 
 	fmt.Printf("Setting up connection to TrueNAS host: %s\n", hostname)
@@ -532,17 +769,17 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 		break
 	}
 
-	// Construct the WebSocket URL with API endpoint
-	url := core.GetApiUrlFromHostName(hostname)
 	fmt.Printf("Testing connection to %s...\n", url)
 
 	// Test the connection by creating a temporary client
-	client, err := truenas_api.NewClient(url, allowInsecure)
+	client, err := truenas_api.NewClientWithOptions(url, tlsOptions, nil)
 	if err != nil {
 		return fmt.Errorf("Failed to create connection to %s: %v", url, err)
 	}
 
 	var apiKey string
+	var storedUsername string
+	var storedPassword string
 	if authMethod == "1" {
 		// Prompt for API key
 		for {
@@ -595,59 +832,34 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 			break
 		}
 
-		// Attempt to login with username and password
-		err = client.Login(username, password, "")
+		// Attempt to login with username and password, and a one-time password if the user needs one
+		err = client.LoginWithPassword(username, password, getOtpToken)
 		if err != nil {
 			client.Close()
 			return fmt.Errorf("Failed to login to %s with username/password: %v", url, err)
 		}
 
-		// Generate an API key using api_key.create
-		fmt.Println("Generating API key...")
-		currentTime := time.Now().Format("2006-01-02")
-		keyName := fmt.Sprintf("Auto-Generated by truenas_incus_ctl %s", currentTime)
-
-		// Create API key
-		params := []interface{}{
-			map[string]interface{}{
-				"name":     keyName,
-				"username": username,
-			},
-		}
-
-		res, err := client.Call("api_key.create", 30, params)
-		if err != nil {
-			client.Close()
-			return fmt.Errorf("Failed to create API key: %v", err)
-		}
-
-		// Parse the response to get the API key
-		var response map[string]interface{}
-		if err := json.Unmarshal(res, &response); err != nil {
-			client.Close()
-			return fmt.Errorf("Failed to parse API key creation response: %v", err)
-		}
-
-		// Check for errors in the response
-		if errorData, exists := response["error"]; exists {
-			client.Close()
-			return fmt.Errorf("API key creation error: %v", errorData)
-		}
-
-		// Extract the API key from the result
-		result, ok := response["result"].(map[string]interface{})
-		if !ok {
-			client.Close()
-			return fmt.Errorf("Unexpected response format for API key creation")
+		var storeMethod string
+		for {
+			fmt.Print("Choose what to store in the config (1 for a new API key for this user, 2 for the username and password): ")
+			fmt.Scanln(&storeMethod)
+			if storeMethod != "1" && storeMethod != "2" {
+				fmt.Println("Please enter either 1 or 2.")
+				continue
+			}
+			break
 		}
 
-		apiKey, ok = result["key"].(string)
-		if !ok {
-			client.Close()
-			return fmt.Errorf("Could not extract API key from response")
+		if storeMethod == "1" {
+			apiKey, err = createApiKey(client, username)
+			if err != nil {
+				client.Close()
+				return err
+			}
+		} else {
+			storedUsername = username
+			storedPassword = password
 		}
-
-		fmt.Println("API key successfully generated")
 	}
 
 	// Test basic connectivity with a ping
@@ -675,8 +887,23 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 	// Store the complete URL with /api/current path under the name
 	hostConfig := map[string]interface{}{
 		"url":     url, // Using the same URL with /api/current path
-		"api_key": apiKey,
-		"allow_insecure": allowInsecure,
+		"allow_insecure": tlsOptions.AllowInsecure,
+	}
+	if tlsOptions.CaFile != "" {
+		hostConfig["ca_file"] = tlsOptions.CaFile
+	}
+	if tlsOptions.CertFingerprint != "" {
+		hostConfig["cert_fingerprint"] = tlsOptions.CertFingerprint
+	}
+	if tlsOptions.ClientCert != "" {
+		hostConfig["client_cert"] = tlsOptions.ClientCert
+		hostConfig["client_key"] = tlsOptions.ClientKey
+	}
+	setConfigCredentials(hostConfig, apiKey, storedUsername, storedPassword)
+	if encrypt, _ := cmd.Flags().GetBool("encrypt"); encrypt {
+		if err = encryptSecrets(hostConfig, getKeyFilePath(config, configPath)); err != nil {
+			return err
+		}
 	}
 	hosts[name] = hostConfig
 
@@ -693,3 +920,46 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 	fmt.Printf("Configuration for '%s' (connecting to %s) saved to %s\n", name, hostname, configPath)
 	return nil
 }
+
+// trustOnFirstUse checks whether the system trusts the host's certificate, and if not, shows it and offers to pin its fingerprint,
+// so that a host with a self-signed certificate doesn't have to be connected to insecurely.
+func trustOnFirstUse(url string, tlsOptions *truenas_api.TLSOptions) error {
+	cert, isTrusted, err := truenas_api.FetchServerCertificate(url, *tlsOptions)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to %s: %v", url, err)
+	}
+	if isTrusted {
+		return nil
+	}
+
+	fmt.Println("The host's certificate is not trusted by this system:")
+	fmt.Printf("  Subject:             %s\n", cert.Subject)
+	fmt.Printf("  Issuer:              %s\n", cert.Issuer)
+	fmt.Printf("  Expires:             %s\n", cert.NotAfter.Format(time.RFC3339))
+	fmt.Printf("  SHA-256 fingerprint: %s\n", truenas_api.CertFingerprint(cert))
+	fmt.Println("Check the fingerprint against the one shown by TrueNAS (System > Certificates) before trusting it.")
+
+	if promptYesNo("Trust this certificate, and only this certificate, for this host [y/n]: ") {
+		tlsOptions.CertFingerprint = truenas_api.CertFingerprint(cert)
+		return nil
+	}
+	if promptYesNo("Connect without verifying the host's certificate at all (insecure) [y/n]: ") {
+		tlsOptions.AllowInsecure = true
+		return nil
+	}
+	return fmt.Errorf("The certificate of %s is not trusted. Use --ca-file to trust the CA that issued it", url)
+}
+
+func promptYesNo(prompt string) bool {
+	for {
+		var answer string
+		fmt.Print(prompt)
+		fmt.Scanln(&answer)
+		lower := strings.ToLower(answer)
+		if lower == "y" || lower == "yes" {
+			return true
+		} else if lower == "n" || lower == "no" {
+			return false
+		}
+	}
+}
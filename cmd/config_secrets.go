@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"truenas/truenas_incus_ctl/core"
+)
+
+// A secret such as "api_key" or "password" can be stored in a host's config as itself, or with one of these settings instead:
+//
+//	<name>_file       a file holding the secret
+//	<name>_command    a command that prints the secret, eg. "pass show truenas/nas1", run with sh -c
+//	<name>_env        an environment variable holding the secret
+//	<name>_encrypted  the secret encrypted with the local keyfile, see encryptSecret
+var secretSuffixes = []string{"", "_file", "_command", "_env", "_encrypted"}
+
+// The secrets that can be stored in a host's config
+var secretNames = []string{"api_key", "password"}
+
+// Secrets from these settings belong to the session of the user that runs the client, such as their environment or an agent
+// that prompts on their terminal. The client resolves them itself and sends them to the daemon, which never does.
+var callerSecretSuffixes = []string{"_command", "_env"}
+
+const KEYFILE_SIZE = 32
+
+// resolveSecret returns a secret from a host's config, or an empty string if it isn't there.
+func resolveSecret(config map[string]interface{}, name string, keyFile string, fileName string) (string, error) {
+	var settings []string
+	for _, suffix := range secretSuffixes {
+		if _, exists := config[name+suffix]; exists {
+			settings = append(settings, name+suffix)
+		}
+	}
+	if len(settings) == 0 {
+		return "", nil
+	}
+	if len(settings) > 1 {
+		return "", fmt.Errorf("Only one of %s can be set for a host in config \"%s\"", strings.Join(settings, ", "), fileName)
+	}
+
+	setting := settings[0]
+	value, err := getNonEmptyStringFromMapAny(config, setting, fileName)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := readSecret(strings.TrimPrefix(setting, name), value, keyFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get %s from %s in config \"%s\": %v", name, setting, fileName, err)
+	}
+	return secret, nil
+}
+
+// getCallerSecretSetting returns the first setting of a host's config whose secret only the client can resolve, if any.
+func getCallerSecretSetting(config map[string]interface{}) string {
+	for _, name := range secretNames {
+		for _, suffix := range callerSecretSuffixes {
+			if _, exists := config[name+suffix]; exists {
+				return name + suffix
+			}
+		}
+	}
+	return ""
+}
+
+// readSecret gets a secret from the value of a setting with one of the secretSuffixes.
+func readSecret(suffix string, value string, keyFile string) (string, error) {
+	var secret string
+	var err error
+	switch suffix {
+	case "":
+		return value, nil
+	case "_file":
+		var data []byte
+		if data, err = os.ReadFile(value); err == nil {
+			secret = strings.TrimSpace(string(data))
+		}
+	case "_command":
+		var stderr bytes.Buffer
+		command := exec.Command("sh", "-c", value)
+		command.Stderr = &stderr
+		var out []byte
+		if out, err = command.Output(); err != nil {
+			err = fmt.Errorf("%v %s", err, strings.TrimSpace(stderr.String()))
+		}
+		secret = strings.TrimSpace(string(out))
+	case "_env":
+		secret = os.Getenv(value)
+	case "_encrypted":
+		var key []byte
+		if key, err = readKeyFile(keyFile, false); err == nil {
+			secret, err = decryptSecret(key, value)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", errors.New("the secret was empty")
+	}
+	return secret, nil
+}
+
+// getApiKeyReference returns the setting and value of --api-key-file, --api-key-command or --api-key-env, if one was given,
+// so that "config add" and "config set" can store the reference rather than the key.
+func getApiKeyReference(flags map[string]string) (string, string, error) {
+	var setting, value string
+	for _, suffix := range []string{"_file", "_command", "_env"} {
+		if flags["api_key"+suffix] == "" {
+			continue
+		}
+		if setting != "" {
+			return "", "", fmt.Errorf("Only one of --api-key-file, --api-key-command and --api-key-env can be given")
+		}
+		setting = "api_key" + suffix
+		value = flags[setting]
+	}
+	if setting == "" {
+		return "", "", nil
+	}
+	if flags["api_key"] != "" || flags["username"] != "" {
+		return "", "", fmt.Errorf("--%s cannot be used with --api-key or --username", strings.ReplaceAll(setting, "_", "-"))
+	}
+	if core.IsStringTrue(flags, "encrypt") {
+		return "", "", fmt.Errorf("--encrypt only applies to secrets that are stored in the config, not with --%s", strings.ReplaceAll(setting, "_", "-"))
+	}
+	return setting, value, nil
+}
+
+// clearSecrets removes every way that secrets were stored in a host's config, before new ones are stored.
+func clearSecrets(config map[string]interface{}) {
+	for _, name := range secretNames {
+		for _, suffix := range secretSuffixes {
+			delete(config, name+suffix)
+		}
+	}
+}
+
+// encryptSecrets replaces the secrets stored as themselves in a host's config with encrypted ones.
+func encryptSecrets(config map[string]interface{}, keyFile string) error {
+	for _, name := range secretNames {
+		secret, ok := config[name].(string)
+		if !ok || secret == "" {
+			continue
+		}
+		key, err := readKeyFile(keyFile, true)
+		if err != nil {
+			return err
+		}
+		encrypted, err := encryptSecret(key, secret)
+		if err != nil {
+			return err
+		}
+		delete(config, name)
+		config[name+"_encrypted"] = encrypted
+	}
+	return nil
+}
+
+// redactSecrets makes a copy of the config that is safe to print.
+// Secrets stored as themselves or encrypted are hidden, while references to them (files, commands and variables) are kept.
+func redactSecrets(configs map[string]interface{}) map[string]interface{} {
+	redacted, _ := core.DeepCopy(configs).(map[string]interface{})
+	hosts, _ := redacted["hosts"].(map[string]interface{})
+	for _, host := range hosts {
+		hostConfig, ok := host.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, name := range secretNames {
+			for _, setting := range []string{name, name + "_encrypted"} {
+				if _, exists := hostConfig[setting]; exists {
+					hostConfig[setting] = core.REDACTED_STRING
+				}
+			}
+		}
+	}
+	return redacted
+}
+
+// getKeyFilePath returns the keyfile that encrypted secrets use: the top-level "keyfile" in the config,
+// or else "keyfile" next to the config file.
+func getKeyFilePath(configs map[string]interface{}, configPath string) string {
+	if keyFile, _ := configs["keyfile"].(string); keyFile != "" {
+		return keyFile
+	}
+	return filepath.Join(filepath.Dir(configPath), "keyfile")
+}
+
+// readKeyFile reads the key that secrets are encrypted with, creating it if it doesn't exist and shouldCreate is set.
+// Like an SSH private key, it must only be readable by its owner.
+func readKeyFile(keyFile string, shouldCreate bool) ([]byte, error) {
+	info, err := os.Stat(keyFile)
+	if os.IsNotExist(err) && shouldCreate {
+		return createKeyFile(keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read keyfile: %v", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("Keyfile \"%s\" must not be accessible by other users (mode %o). Run: chmod 600 \"%s\"",
+			keyFile, info.Mode().Perm(), keyFile)
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read keyfile: %v", err)
+	}
+	if len(key) != KEYFILE_SIZE {
+		return nil, fmt.Errorf("Keyfile \"%s\" should hold %d bytes, but it holds %d", keyFile, KEYFILE_SIZE, len(key))
+	}
+	return key, nil
+}
+
+func createKeyFile(keyFile string) ([]byte, error) {
+	key := make([]byte, KEYFILE_SIZE)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create keyfile: %v", err)
+	}
+	file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create keyfile: %v", err)
+	}
+	_, err = file.Write(key)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(keyFile)
+		return nil, fmt.Errorf("Failed to write keyfile: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Created keyfile %s. Secrets encrypted with it can't be read without it\n", keyFile)
+	return key, nil
+}
+
+// encryptSecret encrypts a secret with AES-256-GCM, returning the nonce and ciphertext in base64.
+func encryptSecret(key []byte, secret string) (string, error) {
+	gcm, err := newKeyFileCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(key []byte, encrypted string) (string, error) {
+	gcm, err := newKeyFileCipher(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("the encrypted secret is too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("the secret could not be decrypted with the keyfile")
+	}
+	return string(plain), nil
+}
+
+func newKeyFileCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
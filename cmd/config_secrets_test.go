@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecretSources(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "key.txt")
+	if err := os.WriteFile(secretFile, []byte("1-fromfile\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TNC_TEST_API_KEY", "1-fromenv")
+
+	keyFile := filepath.Join(dir, "keyfile")
+	key, err := readKeyFile(keyFile, true)
+	FailIf(t, err)
+	encrypted, err := encryptSecret(key, "1-encrypted")
+	FailIf(t, err)
+
+	cases := map[string]map[string]interface{}{
+		"1-plain":     {"api_key": "1-plain"},
+		"1-fromfile":  {"api_key_file": secretFile},
+		"1-fromcmd":   {"api_key_command": "echo 1-fromcmd"},
+		"1-fromenv":   {"api_key_env": "TNC_TEST_API_KEY"},
+		"1-encrypted": {"api_key_encrypted": encrypted},
+		"":            {"url": "nas"},
+	}
+	for expected, config := range cases {
+		secret, err := resolveSecret(config, "api_key", keyFile, "config.json")
+		FailIf(t, err)
+		if secret != expected {
+			t.Errorf("expected %q from %v, got %q", expected, config, secret)
+		}
+	}
+
+	failures := []map[string]interface{}{
+		{"api_key": "1-plain", "api_key_env": "TNC_TEST_API_KEY"},
+		{"api_key_command": "exit 1"},
+		{"api_key_env": "TNC_TEST_MISSING"},
+		{"api_key_file": filepath.Join(dir, "missing")},
+		{"api_key_encrypted": encrypted[:len(encrypted)-4] + "AAAA"},
+	}
+	for _, config := range failures {
+		if _, err = resolveSecret(config, "api_key", keyFile, "config.json"); err == nil {
+			t.Errorf("expected %v to fail", config)
+		}
+	}
+}
+
+func TestKeyFileMustBePrivate(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keyfile")
+	_, err := readKeyFile(keyFile, false)
+	FailUnless(t, err)
+
+	_, err = readKeyFile(keyFile, true)
+	FailIf(t, err)
+	FailIf(t, os.Chmod(keyFile, 0644))
+	_, err = readKeyFile(keyFile, false)
+	if err == nil || !strings.Contains(err.Error(), "chmod 600") {
+		t.Errorf("expected a readable keyfile to be rejected, got %v", err)
+	}
+}
+
+func TestFindCredsWithEncryptedPassword(t *testing.T) {
+	dir := t.TempDir()
+	hostConfig := map[string]interface{}{"url": "nas"}
+	setConfigCredentials(hostConfig, "", "admin", "secret")
+	FailIf(t, encryptSecrets(hostConfig, filepath.Join(dir, "keyfile")))
+	if _, exists := hostConfig["password"]; exists {
+		t.Fatal("expected the password to be replaced by password_encrypted")
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"hosts": map[string]interface{}{"nas": hostConfig}})
+	fileName := filepath.Join(dir, "config.json")
+	FailIf(t, os.WriteFile(fileName, data, 0600))
+
+	_, key, _, config, err := findCredsFromConfig(fileName, "nas", "", "")
+	FailIf(t, err)
+	if key != "" || config["username"] != "admin" || config["password"] != "secret" {
+		t.Errorf("unexpected creds: %s %v", key, config)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	configs := map[string]interface{}{"hosts": map[string]interface{}{
+		"a": map[string]interface{}{"url": "nas1", "api_key": "1-abc"},
+		"b": map[string]interface{}{"url": "nas2", "username": "admin", "password_encrypted": "xyz"},
+		"c": map[string]interface{}{"url": "nas3", "api_key_command": "pass show nas3"},
+	}}
+	data, _ := json.Marshal(redactSecrets(configs))
+	str := string(data)
+	if strings.Contains(str, "1-abc") || strings.Contains(str, "xyz") || !strings.Contains(str, "pass show nas3") {
+		t.Errorf("unexpected redacted config: %s", str)
+	}
+	// the original is left alone
+	if configs["hosts"].(map[string]interface{})["a"].(map[string]interface{})["api_key"] != "1-abc" {
+		t.Error("redactSecrets changed the config it was given")
+	}
+}
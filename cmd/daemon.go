@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
+
+	"github.com/spf13/cobra"
+)
+
+var daemonStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the hosts, channels and jobs that the connection daemon is currently tracking",
+	Args:  cobra.NoArgs,
+}
+
+var daemonStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the connection daemon once its in-flight calls and jobs have completed",
+	Args:  cobra.NoArgs,
+}
+
+var daemonReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Restart the connection daemon with the current binary once its in-flight calls and jobs have completed",
+	Args:  cobra.NoArgs,
+}
+
+var g_daemonStatusEnums map[string][]string
+
+func init() {
+	daemonStatusCmd.RunE = WrapCommandFuncWithoutApi(showDaemonStatus)
+	daemonStopCmd.RunE = WrapCommandFuncWithoutApi(stopOrReloadDaemon)
+	daemonReloadCmd.RunE = WrapCommandFuncWithoutApi(stopOrReloadDaemon)
+
+	daemonStatusCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	daemonStatusCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	daemonStatusCmd.Flags().String("format", "table", "Output table format "+
+		AddFlagsEnum(&g_daemonStatusEnums, "format", []string{"csv", "json", "table", "compact"}))
+
+	_daemonShutdownCmds := []*cobra.Command{daemonStopCmd, daemonReloadCmd}
+	for _, c := range _daemonShutdownCmds {
+		c.Flags().StringP("timeout", "t", "30s", "How long to wait for in-flight calls and jobs before failing them")
+		c.Flags().Bool("no-wait", false, "Return as soon as the daemon has acknowledged the request")
+	}
+
+	daemonCmd.AddCommand(daemonStatusCmd)
+	daemonCmd.AddCommand(daemonStopCmd)
+	daemonCmd.AddCommand(daemonReloadCmd)
+}
+
+func makeDaemonClient() *core.ClientSession {
+	return &core.ClientSession{
+		SocketPath: getDaemonSocketPath(),
+		IsDebug:    g_debug,
+	}
+}
+
+func showDaemonStatus(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_daemonStatusEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	out, err := makeDaemonClient().CallDaemon("status", []interface{}{})
+	if err != nil {
+		return err
+	}
+
+	var status map[string]interface{}
+	if err = json.Unmarshal(out, &status); err != nil {
+		return fmt.Errorf("Failed to parse daemon status: %v", err)
+	}
+
+	sessions := buildDaemonSessionRows(status)
+
+	if strings.ToLower(format) == "table" {
+		fmt.Printf("pid: %v, uptime: %v, idle: %v", status["pid"], status["uptime"], status["idle"])
+		if remaining, exists := status["timeout_remaining"]; exists {
+			fmt.Printf(", exits in: %v (timeout %v)", remaining, status["timeout"])
+		}
+		if core.IsValueTrue(status, "socket_activated") {
+			fmt.Print(", socket activated")
+		}
+		fmt.Println()
+		if len(sessions) == 0 {
+			fmt.Println("No open sessions")
+			return nil
+		}
+	}
+
+	columnsList := []string{"id", "host", "channels", "calls", "jobs", "subscriptions", "reconnects", "age", "idle"}
+	str, err := core.BuildTableData(format, "sessions", columnsList, sessions)
+	PrintTable(api, str)
+	return err
+}
+
+func buildDaemonSessionRows(status map[string]interface{}) []map[string]interface{} {
+	sessionsList, _ := core.ExtractJsonArrayOfMaps(status, "sessions")
+	rows := make([]map[string]interface{}, 0, len(sessionsList))
+	for i, session := range sessionsList {
+		row := make(map[string]interface{})
+		tnc.InsertProperties(row, session, []string{"jobs", "subscriptions"}, nil)
+		row["id"] = i
+
+		jobsList, _ := core.ExtractJsonArrayOfMaps(session, "jobs")
+		jobStrings := make([]string, 0, len(jobsList))
+		for _, job := range jobsList {
+			jobStrings = append(jobStrings, fmt.Sprintf("%d:%v", core.GetIntegerFromJsonObjectOr(job, "id", -1), job["state"]))
+		}
+		if len(jobStrings) > 0 {
+			row["jobs"] = strings.Join(jobStrings, ",")
+		} else {
+			row["jobs"] = "-"
+		}
+
+		subscriptions := make([]string, 0)
+		if subList, ok := session["subscriptions"].([]interface{}); ok {
+			for _, sub := range subList {
+				subscriptions = append(subscriptions, fmt.Sprint(sub))
+			}
+		}
+		if len(subscriptions) > 0 {
+			row["subscriptions"] = strings.Join(subscriptions, ",")
+		} else {
+			row["subscriptions"] = "-"
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func stopOrReloadDaemon(cmd *cobra.Command, api core.Session, args []string) error {
+	cmdType := strings.Split(cmd.Use, " ")[0]
+	if cmdType != "stop" && cmdType != "reload" {
+		return fmt.Errorf("cmdType was not stop or reload")
+	}
+
+	options, _ := GetCobraFlags(cmd, false, nil)
+	drainTimeout, err := time.ParseDuration(options.allFlags["timeout"])
+	if err != nil {
+		return fmt.Errorf("Failed to parse --timeout: %v", err)
+	}
+
+	cmd.SilenceUsage = true
+
+	client := makeDaemonClient()
+	out, err := client.CallDaemon(cmdType, []interface{}{drainTimeout.String()})
+	if err != nil {
+		return err
+	}
+	DebugString(string(out))
+
+	if core.IsStringTrue(options.allFlags, "no_wait") {
+		return nil
+	}
+
+	// A socket-activated daemon leaves its socket to systemd, which will start it again on the next connection.
+	var response map[string]interface{}
+	if json.Unmarshal(out, &response) == nil && core.IsValueTrue(response, "socket_activated") {
+		if cmdType == "stop" {
+			fmt.Println("Daemon is stopping once drained. It is managed by systemd and will be started again on the next connection")
+		} else {
+			fmt.Println("Daemon is reloading once drained")
+		}
+		return nil
+	}
+
+	// Allow a little longer than the drain timeout, since the daemon waits a moment after failing any outstanding calls.
+	deadline := time.Now().Add(drainTimeout + time.Duration(5)*time.Second)
+	if !waitForSocketState(client.SocketPath, false, deadline) {
+		return fmt.Errorf("Timed out waiting for the daemon to shut down")
+	}
+	if cmdType == "stop" {
+		fmt.Println("Daemon stopped")
+		return nil
+	}
+
+	if !waitForSocketState(client.SocketPath, true, time.Now().Add(time.Duration(5)*time.Second)) {
+		return fmt.Errorf("Timed out waiting for the daemon to restart")
+	}
+	fmt.Println("Daemon reloaded")
+	return nil
+}
+
+func waitForSocketState(socketPath string, shouldExist bool, deadline time.Time) bool {
+	for {
+		_, err := os.Stat(socketPath)
+		if (err == nil) == shouldExist {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+}
+
+// getDaemonConfig reads the optional "daemon" section of the config file, eg.
+// "daemon": { "allow_uids": [1001, "alice"], "allow_gids": ["incus-admin"] }
+func getDaemonConfig() (core.DaemonConfig, error) {
+	fileName := resolveConfigFilePath(g_configFileName)
+	config := core.DaemonConfig{
+		ConfigFile: fileName,
+		LookupHost: func(configName string) (core.HostConfig, error) {
+			return lookupDaemonHostConfig(fileName, configName)
+		},
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return config, err
+	}
+
+	var jsonObj map[string]interface{}
+	if err = json.Unmarshal(data, &jsonObj); err != nil {
+		return config, fmt.Errorf("\"%s\": %v", fileName, err)
+	}
+	if _, exists := jsonObj["daemon"]; !exists {
+		return config, nil
+	}
+	daemonObj, err := getMapFromMapAny(jsonObj, "daemon", fileName)
+	if err != nil {
+		return config, err
+	}
+
+	if config.AllowUids, err = getIdListFromConfig(daemonObj, "allow_uids", lookupUid); err != nil {
+		return config, fmt.Errorf("\"%s\": %v", fileName, err)
+	}
+	if config.AllowGids, err = getIdListFromConfig(daemonObj, "allow_gids", lookupGid); err != nil {
+		return config, fmt.Errorf("\"%s\": %v", fileName, err)
+	}
+	if value, exists := daemonObj["metrics_listen"]; exists {
+		metricsListen, ok := value.(string)
+		if !ok {
+			return config, fmt.Errorf("\"%s\": \"metrics_listen\" should be a string", fileName)
+		}
+		config.MetricsListen = metricsListen
+	}
+	return config, nil
+}
+
+// lookupDaemonHostConfig is called by the daemon whenever a client refers to a host by its config name.
+// The file is read again each time, so that changes to it take effect without restarting the daemon.
+// Secrets from "*_command" and "*_env" are never resolved here, as they belong to the client's session.
+func lookupDaemonHostConfig(fileName string, configName string) (core.HostConfig, error) {
+	_, config, fileName, keyFile, err := findHostInConfig(fileName, configName, "", "")
+	if err != nil {
+		return core.HostConfig{}, err
+	}
+	if setting := getCallerSecretSetting(config); setting != "" {
+		return core.HostConfig{}, fmt.Errorf("\"%s\" is resolved by the client, which should send the credentials itself", setting)
+	}
+	host, key, err := resolveHostCreds(config, keyFile, fileName)
+	if err != nil {
+		return core.HostConfig{}, err
+	}
+	hostConfig := core.HostConfig{
+		Url:           core.GetApiUrlFromHostName(host),
+		ApiKey:        key,
+		AllowInsecure: core.IsValueTrue(config, "allow_insecure"),
+	}
+	hostConfig.CaFile, _ = config["ca_file"].(string)
+	hostConfig.CertFingerprint, _ = config["cert_fingerprint"].(string)
+	hostConfig.ClientCert, _ = config["client_cert"].(string)
+	hostConfig.ClientKey, _ = config["client_key"].(string)
+	if key == "" {
+		hostConfig.Username, _ = config["username"].(string)
+		hostConfig.Password, _ = config["password"].(string)
+	}
+	return hostConfig, nil
+}
+
+// getIdListFromConfig reads a list of numeric IDs and/or names, resolving the names with lookup.
+func getIdListFromConfig(dict map[string]interface{}, key string, lookup func(string) (string, error)) ([]int, error) {
+	obj, exists := dict[key]
+	if !exists {
+		return nil, nil
+	}
+	list, ok := obj.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("daemon.%s must be a list", key)
+	}
+
+	ids := make([]int, 0, len(list))
+	for _, value := range list {
+		var idStr string
+		switch v := value.(type) {
+		case float64:
+			idStr = fmt.Sprint(int(v))
+		case string:
+			var err error
+			if idStr, err = lookup(v); err != nil {
+				return nil, fmt.Errorf("daemon.%s: %v", key, err)
+			}
+		default:
+			return nil, fmt.Errorf("daemon.%s must only contain IDs or names (found %v)", key, value)
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("daemon.%s: %v", key, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func lookupUid(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGid(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+var daemonInstallSystemdCmd = &cobra.Command{
+	Use:   "install-systemd",
+	Short: "Write systemd .service and .socket units that run the connection daemon with socket activation",
+	Long: "Write systemd .service and .socket units that run the connection daemon with socket activation.\n" +
+		"By default, user units are written to ~/.config/systemd/user and the daemon listens on the usual socket path.\n" +
+		"Enable them with `systemctl --user daemon-reload && systemctl --user enable --now tncdaemon.socket`,\n" +
+		"or `systemctl` without `--user` when using --system.",
+	Args: cobra.NoArgs,
+}
+
+type systemdUnitOptions struct {
+	name       string
+	execPath   string
+	configFile string
+	socketPath string
+	timeout    string
+	runAs      string
+	isSystem   bool
+	isShared   bool
+}
+
+func init() {
+	daemonInstallSystemdCmd.RunE = WrapCommandFuncWithoutApi(installSystemdUnits)
+
+	daemonInstallSystemdCmd.Flags().Bool("system", false, "Write system units to /etc/systemd/system rather than user units")
+	daemonInstallSystemdCmd.Flags().String("name", "tncdaemon", "Name of the units, without the .service or .socket suffix")
+	daemonInstallSystemdCmd.Flags().String("output-dir", "", "Write the units to this directory instead of the systemd default")
+	daemonInstallSystemdCmd.Flags().String("run-as", "", "User that the daemon and its socket belong to, for system units")
+	daemonInstallSystemdCmd.Flags().StringP("timeout", "t", "", "Exit the daemon if no communication occurs after this duration. "+
+		"systemd starts it again on the next connection. By default the daemon keeps running")
+	daemonInstallSystemdCmd.Flags().Bool("print", false, "Print the units instead of writing them")
+	daemonInstallSystemdCmd.Flags().Bool("force", false, "Overwrite existing units")
+
+	daemonCmd.AddCommand(daemonInstallSystemdCmd)
+}
+
+func installSystemdUnits(cmd *cobra.Command, api core.Session, args []string) error {
+	options, _ := GetCobraFlags(cmd, false, nil)
+
+	unitOptions := systemdUnitOptions{
+		name:       options.allFlags["name"],
+		configFile: resolveConfigFilePath(g_configFileName),
+		timeout:    options.allFlags["timeout"],
+		runAs:      options.allFlags["run_as"],
+		isSystem:   core.IsStringTrue(options.allFlags, "system"),
+	}
+	if unitOptions.name == "" || strings.ContainsAny(unitOptions.name, "/ ") {
+		return fmt.Errorf("Invalid unit name \"%s\"", unitOptions.name)
+	}
+	if unitOptions.runAs != "" && !unitOptions.isSystem {
+		return fmt.Errorf("--run-as only applies to system units (--system)")
+	}
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if unitOptions.execPath, err = filepath.Abs(execPath); err != nil {
+		return err
+	}
+	if unitOptions.socketPath, err = filepath.Abs(getDaemonSocketPath()); err != nil {
+		return err
+	}
+
+	daemonConfig, err := getDaemonConfig()
+	if err != nil {
+		return err
+	}
+	unitOptions.isShared = len(daemonConfig.AllowUids) > 0 || len(daemonConfig.AllowGids) > 0
+
+	cmd.SilenceUsage = true
+
+	service, socket := buildSystemdUnits(unitOptions)
+	serviceName := unitOptions.name + ".service"
+	socketName := unitOptions.name + ".socket"
+
+	if core.IsStringTrue(options.allFlags, "print") {
+		fmt.Printf("# %s\n%s\n# %s\n%s", serviceName, service, socketName, socket)
+		return nil
+	}
+
+	outputDir := options.allFlags["output_dir"]
+	if outputDir == "" {
+		if outputDir, err = getSystemdUnitDir(unitOptions.isSystem); err != nil {
+			return err
+		}
+	}
+	if err = os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	units := []struct {
+		name     string
+		contents string
+	}{
+		{serviceName, service},
+		{socketName, socket},
+	}
+	isForce := core.IsStringTrue(options.allFlags, "force")
+	for _, unit := range units {
+		unitPath := filepath.Join(outputDir, unit.name)
+		if _, err := os.Stat(unitPath); err == nil && !isForce {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", unitPath)
+		}
+	}
+	for _, unit := range units {
+		unitPath := filepath.Join(outputDir, unit.name)
+		if err = os.WriteFile(unitPath, []byte(unit.contents), 0644); err != nil {
+			return err
+		}
+		fmt.Println("Wrote " + unitPath)
+	}
+
+	systemctl := "systemctl --user"
+	if unitOptions.isSystem {
+		systemctl = "systemctl"
+	}
+	fmt.Println("To start the daemon on demand, run:")
+	fmt.Printf("  %s daemon-reload && %s enable --now %s\n", systemctl, systemctl, socketName)
+	return nil
+}
+
+func getSystemdUnitDir(isSystem bool) (string, error) {
+	if isSystem {
+		return "/etc/systemd/system", nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "systemd", "user"), nil
+}
+
+// buildSystemdUnits returns the contents of the .service and .socket units.
+// The socket unit creates the daemon's socket, which RunDaemon then picks up through LISTEN_FDS.
+func buildSystemdUnits(opts systemdUnitOptions) (string, string) {
+	execArgs := []string{opts.execPath, "daemon", "--config-file", opts.configFile}
+	if opts.timeout != "" {
+		execArgs = append(execArgs, "--timeout", opts.timeout)
+	}
+	execArgs = append(execArgs, opts.socketPath)
+	for i := range execArgs {
+		execArgs[i] = quoteSystemdArg(execArgs[i])
+	}
+
+	var service strings.Builder
+	service.WriteString("[Unit]\n")
+	service.WriteString("Description=truenas_incus_ctl connection daemon\n")
+	service.WriteString("Requires=" + opts.name + ".socket\n")
+	service.WriteString("After=" + opts.name + ".socket network-online.target\n")
+	service.WriteString("Wants=network-online.target\n")
+	service.WriteString("\n[Service]\n")
+	service.WriteString("Type=simple\n")
+	service.WriteString("ExecStart=" + strings.Join(execArgs, " ") + "\n")
+	// SIGHUP makes the daemon drain its calls and re-execute itself, keeping the socket and its pid
+	service.WriteString("ExecReload=/bin/kill -HUP $MAINPID\n")
+	service.WriteString("Restart=on-failure\n")
+	service.WriteString("TimeoutStopSec=40\n")
+	if opts.runAs != "" {
+		service.WriteString("User=" + opts.runAs + "\n")
+	}
+	service.WriteString("\n[Install]\n")
+	service.WriteString("Also=" + opts.name + ".socket\n")
+
+	socketMode := "0600"
+	if opts.isShared {
+		// access is enforced by the daemon's own peer credential checks, see the "daemon" section of the config
+		socketMode = "0666"
+	}
+
+	var socket strings.Builder
+	socket.WriteString("[Unit]\n")
+	socket.WriteString("Description=truenas_incus_ctl connection daemon socket\n")
+	socket.WriteString("\n[Socket]\n")
+	socket.WriteString("ListenStream=" + opts.socketPath + "\n")
+	socket.WriteString("SocketMode=" + socketMode + "\n")
+	if opts.runAs != "" {
+		socket.WriteString("SocketUser=" + opts.runAs + "\n")
+	}
+	socket.WriteString("RemoveOnStop=yes\n")
+	socket.WriteString("\n[Install]\n")
+	socket.WriteString("WantedBy=sockets.target\n")
+
+	return service.String(), socket.String()
+}
+
+func quoteSystemdArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\$%") {
+		return arg
+	}
+	arg = strings.ReplaceAll(arg, "\\", "\\\\")
+	arg = strings.ReplaceAll(arg, "\"", "\\\"")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	return "\"" + arg + "\""
+}
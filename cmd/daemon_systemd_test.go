@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildSystemdUnits(t *testing.T) {
+	service, socket := buildSystemdUnits(systemdUnitOptions{
+		name:       "tncdaemon",
+		execPath:   "/usr/local/bin/truenas_incus_ctl",
+		configFile: "/home/incus/my config.json",
+		socketPath: "/home/incus/tncdaemon.sock",
+		timeout:    "10m",
+		runAs:      "incus",
+		isSystem:   true,
+		isShared:   true,
+	})
+
+	expectedService := []string{
+		"Requires=tncdaemon.socket\n",
+		"ExecStart=/usr/local/bin/truenas_incus_ctl daemon --config-file \"/home/incus/my config.json\" --timeout 10m /home/incus/tncdaemon.sock\n",
+		"User=incus\n",
+		"Also=tncdaemon.socket\n",
+	}
+	for _, line := range expectedService {
+		if !strings.Contains(service, line) {
+			t.Errorf("service unit is missing %q:\n%s", line, service)
+		}
+	}
+
+	expectedSocket := []string{
+		"ListenStream=/home/incus/tncdaemon.sock\n",
+		"SocketMode=0666\n",
+		"SocketUser=incus\n",
+		"WantedBy=sockets.target\n",
+	}
+	for _, line := range expectedSocket {
+		if !strings.Contains(socket, line) {
+			t.Errorf("socket unit is missing %q:\n%s", line, socket)
+		}
+	}
+
+	service, socket = buildSystemdUnits(systemdUnitOptions{
+		name:       "tncdaemon",
+		execPath:   "/usr/local/bin/truenas_incus_ctl",
+		configFile: "/root/.truenas_incus_ctl/config.json",
+		socketPath: "/root/tncdaemon.sock",
+	})
+	if strings.Contains(service, "--timeout") || strings.Contains(service, "User=") {
+		t.Error("service unit has options that were not asked for:\n" + service)
+	}
+	if !strings.Contains(socket, "SocketMode=0600\n") {
+		t.Error("socket unit should only be accessible to its owner:\n" + socket)
+	}
+}
@@ -1,12 +1,12 @@
 package cmd
 
 import (
-	//"encoding/json"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 
 	"github.com/spf13/cobra"
 )
@@ -172,6 +172,8 @@ func init() {
 
 	datasetRenameCmd.Flags().BoolP("update-shares", "s", false, "Will update any shares as part of rename")
 
+	allowAsync(datasetCreateCmd, datasetUpdateCmd, datasetDeleteCmd, datasetPromoteCmd)
+
 	datasetCmd.AddCommand(datasetCreateCmd)
 	datasetCmd.AddCommand(datasetUpdateCmd)
 	datasetCmd.AddCommand(datasetDeleteCmd)
@@ -257,61 +259,44 @@ func createOrUpdateDataset(cmd *cobra.Command, api core.Session, args []string)
 		}
 	}
 
+	var userProps []tnc.UserProperty
 	if userPropsStr != "" {
 		kvParams := ConvertParamsStringToKvArray(userPropsStr)
-		userPropsArr := make([]map[string]interface{}, 0)
 		for i := 0; i < len(kvParams); i += 2 {
 			value, err := ParseStringAndValidate(kvParams[i], kvParams[i+1], g_datasetCreateUpdateEnums)
 			if err != nil {
 				return err
 			}
-			m := make(map[string]interface{})
-			m["key"] = kvParams[i]
-			m["value"] = value
-			userPropsArr = append(userPropsArr, m)
+			userProps = append(userProps, tnc.UserProperty{Key: kvParams[i], Value: value})
 		}
-		outMap["user_properties"] = userPropsArr
 	}
 
 	cmd.SilenceUsage = true
 
+	ctx := getCommandContext(cmd)
+
 	var listToCreate []string
 	var listToUpdate []string
 
 	if cmdType == "create" {
 		listToCreate = specs
 	} else if len(specs) > 1 || flagCreate {
-		extras := typeQueryParams{
-			valueOrder:         BuildValueOrder(true),
-			shouldGetAllProps:  false,
-			shouldGetUserProps: false,
-			shouldRecurse:      false,
-		}
-		response, err := QueryApi(api, "pool.dataset", specs, types, nil, extras)
+		listToUpdate, listToCreate, err = tnc.FindDatasets(ctx, api, specs)
 		if err != nil {
 			return err
 		}
-
-		listToCreate = make([]string, 0)
-		listToUpdate = make([]string, 0)
-		for _, spec := range specs {
-			if _, exists := response.resultsMap[spec]; exists {
-				listToUpdate = append(listToUpdate, spec)
-			} else {
-				if !flagCreate {
-					return errors.New("Could not find dataset \"" + spec + "\".\n" +
-						"Try passing -c or --create to create a dataset if it doesn't exist.")
-				}
-				listToCreate = append(listToCreate, spec)
-			}
+		if len(listToCreate) > 0 && !flagCreate {
+			return errors.New("Could not find dataset \"" + listToCreate[0] + "\".\n" +
+				"Try passing -c or --create to create a dataset if it doesn't exist.")
 		}
 	} else {
 		listToUpdate = specs
 	}
 
 	if len(listToUpdate) > 0 {
-		objRemap := map[string][]interface{}{"": core.ToAnyArray(listToUpdate)}
-		out, _, err := MaybeBulkApiCall(api, "pool.dataset.update", 10, []interface{}{outMap}, objRemap, false)
+		out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+			return tnc.UpdateDatasets(ctx, api, listToUpdate, tnc.DatasetOptions{BulkOptions: opts, Params: outMap, UserProperties: userProps})
+		})
 		if err != nil {
 			return err
 		}
@@ -319,14 +304,9 @@ func createOrUpdateDataset(cmd *cobra.Command, api core.Session, args []string)
 	}
 
 	if len(listToCreate) > 0 {
-		if _, exists := outMap["volsize"]; exists {
-			outMap["type"] = "VOLUME"
-		} else {
-			outMap["type"] = "FILESYSTEM"
-		}
-
-		objRemap := map[string][]interface{}{"name": core.ToAnyArray(listToCreate)}
-		out, _, err := MaybeBulkApiCall(api, "pool.dataset.create", 10, []interface{}{outMap}, objRemap, false)
+		out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+			return tnc.CreateDatasets(ctx, api, listToCreate, tnc.DatasetOptions{BulkOptions: opts, Params: outMap, UserProperties: userProps})
+		})
 		if err != nil {
 			return err
 		}
@@ -340,28 +320,15 @@ func deleteDataset(cmd *cobra.Command, api core.Session, args []string) error {
 	cmd.SilenceUsage = true
 
 	options, _ := GetCobraFlags(cmd, false, nil)
-	timeout := int64(20)
-
-	if core.IsStringTrue(options.allFlags, "no_smart_timeout") {
-		RemoveFlag(options, "no_smart_timeout")
-	} else if core.IsStringTrue(options.allFlags, "recursive") {
-		extras := typeQueryParams{
-			valueOrder:         BuildValueOrder(true),
-			shouldGetAllProps:  false,
-			shouldGetUserProps: false,
-			shouldRecurse:      true,
-		}
-		response, err := QueryApi(api, "pool.dataset", args, core.StringRepeated("name", len(args)), []string{}, extras)
-		if err != nil {
-			return err
-		}
-		timeout = int64(10 + 10*len(response.resultsMap))
-	}
 
-	params := BuildNameStrAndPropertiesJson(options, args[0])
-
-	objRemap := map[string][]interface{}{"": core.ToAnyArray(args)}
-	out, _, err := MaybeBulkApiCall(api, "pool.dataset.delete", timeout, params, objRemap, false)
+	out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+		return tnc.DeleteDatasets(getCommandContext(cmd), api, args, tnc.DeleteDatasetOptions{
+			BulkOptions:    opts,
+			Recursive:      core.IsStringTrue(options.allFlags, "recursive"),
+			Force:          core.IsStringTrue(options.allFlags, "force"),
+			NoSmartTimeout: core.IsStringTrue(options.allFlags, "no_smart_timeout"),
+		})
+	})
 	if err != nil {
 		return err
 	}
@@ -384,37 +351,24 @@ func listDataset(cmd *cobra.Command, api core.Session, args []string) error {
 	cmd.SilenceUsage = true
 
 	properties := EnumerateOutputProperties(options.allFlags)
-	idTypes, err := getDatasetListTypes(args)
-	if err != nil {
-		return err
-	}
-
-	// `zfs list` will "recurse" if no names are specified.
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
-		shouldGetAllProps:  core.IsStringTrue(options.allFlags, "all"),
-		shouldGetUserProps: core.IsStringTrue(options.allFlags, "user_properties"),
-		shouldRecurse:      len(args) == 0 || core.IsStringTrue(options.allFlags, "recursive"),
-	}
-
-	for _, prop := range properties {
-		if strings.Index(prop, ":") >= 0 {
-			extras.shouldGetUserProps = true
-			break
-		}
+	filter := tnc.DatasetFilter{
+		Names:          args,
+		Recursive:      core.IsStringTrue(options.allFlags, "recursive"),
+		Properties:     properties,
+		AllProperties:  core.IsStringTrue(options.allFlags, "all"),
+		UserProperties: core.IsStringTrue(options.allFlags, "user_properties"),
 	}
 
-	response, err := QueryApi(api, "pool.dataset", args, idTypes, properties, extras)
+	models, err := tnc.ListDatasets(getCommandContext(cmd), api, filter)
 	if err != nil {
 		return err
 	}
 
-	datasets := GetListFromQueryResponse(&response)
-	LowerCaseValuesFromEnums(datasets, g_datasetCreateUpdateEnums)
+	datasets := GetValuesFromModels(models, core.IsStringTrue(options.allFlags, "parsable"))
 
 	required := []string{"name"}
 	var columnsList []string
-	if extras.shouldGetAllProps {
+	if filter.AllProperties {
 		columnsList = GetUsedPropertyColumns(datasets, required)
 	} else if len(properties) > 0 {
 		columnsList = properties
@@ -422,17 +376,15 @@ func listDataset(cmd *cobra.Command, api core.Session, args []string) error {
 		columnsList = required
 	}
 
-	str, err := core.BuildTableData(format, "datasets", columnsList, datasets)
-	PrintTable(api, str)
-	return err
+	return PrintTableData(api, format, "datasets", columnsList, datasets)
 }
 
 func promoteDataset(cmd *cobra.Command, api core.Session, args []string) error {
 	cmd.SilenceUsage = true
 
-	params := []interface{}{args[0]}
-	objRemap := map[string][]interface{}{"": core.ToAnyArray(args)}
-	out, _, err := MaybeBulkApiCall(api, "pool.dataset.promote", 10, params, objRemap, false)
+	out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+		return tnc.PromoteDatasets(getCommandContext(cmd), api, args, opts)
+	})
 	if err != nil {
 		return err
 	}
@@ -448,71 +400,14 @@ func renameDataset(cmd *cobra.Command, api core.Session, args []string) error {
 
 	source := args[0]
 	dest := args[1]
+	shouldUpdateShares := core.IsStringTrue(options.allFlags, "update_shares")
 
-	outMap := make(map[string]interface{})
-	outMap["new_name"] = dest
-
-	params := []interface{}{source, outMap}
-	DebugJson(params)
-
-	out, err := core.ApiCall(api, "zfs.dataset.rename", defaultCallTimeout, params)
+	updated, err := tnc.RenameDataset(getCommandContext(cmd), api, source, dest, shouldUpdateShares)
 	if err != nil {
 		return err
 	}
-	DebugString(string(out))
-
-	// no point updating the share if we're renaming a snapshot.
-	if core.IsStringTrue(options.allFlags, "update_shares") && !strings.Contains(source, "@") {
-		idStr, found, err := LookupNfsIdByPath(api, "/mnt/"+source, nil)
-		if err != nil {
-			return err
-		}
-		if !found {
-			fmt.Println("INFO: this dataset did not appear to have a share")
-			return nil
-		}
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			return fmt.Errorf("Error updating share for dataset \"%s\", nfs id \"%s\": %v", dest, idStr, err)
-		}
-
-		pathMap := make(map[string]interface{})
-		pathMap["path"] = "/mnt/" + dest
-		nfsParams := []interface{}{id, pathMap}
-
-		DebugJson(nfsParams)
-
-		out, err = core.ApiCall(api, "sharing.nfs.update", defaultCallTimeout, nfsParams)
-		if err != nil {
-			return err
-		}
-		DebugString(string(out))
-	}
-
-	return err
-}
-
-func getDatasetListTypes(args []string) ([]string, error) {
-	var typeList []string
-	if len(args) == 0 {
-		return typeList, nil
+	if shouldUpdateShares && !updated && !strings.Contains(source, "@") {
+		PrintLine(api, "INFO: this dataset did not appear to have a share")
 	}
-
-	typeList = make([]string, len(args), len(args))
-	for i := 0; i < len(args); i++ {
-		t, value := core.IdentifyObject(args[i])
-		if t == "id" || t == "share" {
-			return nil, errors.New("querying datasets based on mount point is not yet supported")
-		} else if t == "snapshot" || t == "snapshot_only" {
-			return nil, errors.New("querying datasets based on shapshot is not yet supported")
-		} else if t == "dataset" {
-			t = "name"
-		} else if t != "pool" {
-			return nil, errors.New("Unrecognised namespec \"" + args[i] + "\"")
-		}
-		typeList[i] = t
-		args[i] = value
-	}
-
-	return typeList, nil
+	return nil
 }
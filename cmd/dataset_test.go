@@ -158,6 +158,19 @@ func TestDatasetDelete(t *testing.T) {
 	))
 }
 
+func TestDatasetDeleteAsync(t *testing.T) {
+	g_async = "text"
+	defer func() { g_async = "" }()
+	FailIf(t, DoSimpleTest(
+		t,
+		datasetDeleteCmd,
+		deleteDataset,
+		map[string]interface{}{"no-smart-timeout":true},
+		[]string{"dozer/testing/test"},
+		"[\"pool.dataset.delete\",[[\"dozer/testing/test\",{}]]]",
+	))
+}
+
 func TestDatasetDeleteRecursive(t *testing.T) {
 	FailIf(t, DoSimpleTest(
 		t,
@@ -243,6 +256,24 @@ func TestDatasetListWithProperties(t *testing.T) {
 	))
 }
 
+func TestDatasetListLowerCasesEnums(t *testing.T) {
+	FailIf(t, DoTest(
+		t,
+		datasetListCmd,
+		listDataset,
+		map[string]interface{}{"output":"name,type,compression,used"},
+		[]string{"dozer/testing/test"},
+		[]string{"[[[\"name\",\"in\",[\"dozer/testing/test\"]]],{\"extra\":{\"flat\":false,"+
+			"\"properties\":[\"name\",\"type\",\"compression\",\"used\"],\"retrieve_children\":false,\"user_properties\":false}}]"},
+		[]string{"{\"jsonrpc\":\"2.0\",\"result\":[{\"id\":\"dozer/testing/test\",\"name\":\"dozer/testing/test\",\"type\":\"FILESYSTEM\","+
+			"\"compression\":{\"rawvalue\":\"lz4\",\"value\":\"LZ4\",\"parsed\":\"lz4\",\"source\":\"INHERITED\"},"+
+			"\"used\":{\"rawvalue\":\"1536\",\"value\":\"1.50K\",\"parsed\":1536,\"source\":\"NONE\"}}],\"id\":2}"},
+		"        name        |    type    | compression | used  \n" +
+		"--------------------+------------+-------------+-------\n" +
+		" dozer/testing/test | filesystem | lz4         | 1.50K \n",
+	))
+}
+
 func TestDatasetPromote(t *testing.T) {
 	FailIf(t, DoSimpleTest(
 		t,
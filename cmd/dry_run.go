@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+var g_dryRun string
+
+// isDryRun reports whether calls that change anything should be printed instead of sent.
+func isDryRun() bool {
+	return g_dryRun != ""
+}
+
+func checkDryRunFlag(cmd *cobra.Command) error {
+	if !isDryRun() {
+		return nil
+	}
+	if g_dryRun != "text" && g_dryRun != "json" {
+		return fmt.Errorf("Unrecognised --dry-run format \"%s\", expected text or json", g_dryRun)
+	}
+	// iscsiadm changes this machine whatever the session does, and its results decide what the command does next
+	if isLocalIscsi(cmd) {
+		return fmt.Errorf("%s runs iscsiadm, so it does not support --dry-run", cmd.CommandPath())
+	}
+	return nil
+}
+
+// printDryRun prints the calls that a dry run did not send, as a numbered plan or as a JSON object.
+func printDryRun(w io.Writer, api *core.DryRunSession) error {
+	planned := api.Planned()
+
+	if g_dryRun == "json" {
+		data, err := json.Marshal(map[string]interface{}{"calls": planned})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+		return nil
+	}
+
+	if len(planned) == 0 {
+		fmt.Fprintln(w, "Dry run: nothing would be changed")
+		return nil
+	}
+	fmt.Fprintln(w, "Dry run: nothing was changed. The command would call:")
+	for i, call := range planned {
+		suffix := ""
+		if call.Job {
+			suffix = " (job)"
+		}
+		fmt.Fprintf(w, "%3d. %s %s%s\n", i+1, call.Method, string(call.Params), suffix)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"testing"
+	"truenas/truenas_incus_ctl/core"
+)
+
+func TestDryRunFlag(t *testing.T) {
+	defer func() { g_dryRun = "" }()
+
+	g_dryRun = "json"
+	FailIf(t, checkDryRunFlag(datasetDeleteCmd))
+	FailUnless(t, checkDryRunFlag(iscsiActivateCmd))
+	FailIf(t, checkDryRunFlag(iscsiCreateCmd))
+
+	g_dryRun = "yaml"
+	FailUnless(t, checkDryRunFlag(datasetDeleteCmd))
+}
+
+func TestDryRunNfsUpdateOrCreate(t *testing.T) {
+	SetAuxCobraFlag(nfsUpdateCmd, "create", true)
+	SetAuxCobraFlag(nfsUpdateCmd, "comment", "bar")
+	defer ResetAuxCobraFlags(nfsUpdateCmd)
+
+	// only the query is sent, the update and create are planned
+	api := core.NewDryRunSession(SetupMultiTest(
+		t,
+		[]string{"[[[\"path\",\"in\",[\"/mnt/dozer/testing/test4\",\"/mnt/dozer/testing/test5\"]]]]"},
+		[]string{"{\"jsonrpc\":\"2.0\",\"result\":[{\"comment\":\"foo\",\"id\":4,\"path\":\"/mnt/dozer/testing/test4\"}],\"id\":2}"},
+		"",
+	))
+	FailIf(t, updateNfs(nfsUpdateCmd, api, []string{"dozer/testing/test4", "/mnt/dozer/testing/test5"}))
+
+	planned := api.Planned()
+	if len(planned) != 2 {
+		t.Fatalf("expected 2 planned calls, got %d", len(planned))
+	}
+	if planned[0].Method != "sharing.nfs.update" || string(planned[0].Params) != "[4,{\"comment\":\"bar\"}]" {
+		t.Errorf("unexpected first call: %s %s", planned[0].Method, string(planned[0].Params))
+	}
+	if planned[1].Method != "sharing.nfs.create" || string(planned[1].Params) != "[{\"comment\":\"bar\",\"path\":\"/mnt/dozer/testing/test5\"}]" {
+		t.Errorf("unexpected second call: %s %s", planned[1].Method, string(planned[1].Params))
+	}
+}
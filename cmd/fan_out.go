@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var g_allConfigs bool
+
+// hostSession is the session of one of several hosts that a command runs against at once.
+// It keeps what the command prints, so that the output of every host can be reported together once they have all finished.
+type hostSession struct {
+	core.Session
+	configName  string
+	output      strings.Builder
+	table       *hostTable
+	asyncJobIds []int64
+	err         error
+}
+
+// hostTable holds the rows that a list command printed for one host, to be merged with the rows of the other hosts.
+type hostTable struct {
+	format      string
+	jsonName    string
+	columnsList []string
+	rows        []map[string]interface{}
+}
+
+func (h *hostSession) recordAsyncJob(jobId int64) {
+	h.asyncJobIds = append(h.asyncJobIds, jobId)
+}
+
+// getFanOutConfigNames returns the configs that the command should run against at once,
+// or nil if it runs against a single host as usual.
+func getFanOutConfigNames(cmd *cobra.Command) ([]string, error) {
+	var names []string
+	if g_allConfigs {
+		if g_configName != "" {
+			return nil, errors.New("--all-configs and --config cannot be used together")
+		}
+		var err error
+		if names, err = getConfigNames(g_configFileName); err != nil {
+			return nil, fmt.Errorf("Failed to parse config: %v", err)
+		}
+	} else if strings.Contains(g_configName, ",") {
+		for _, name := range strings.Split(g_configName, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	} else {
+		return nil, nil
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("No configs to run the command against")
+	}
+	if g_hostName != "" || g_apiKey != "" {
+		return nil, errors.New("--host and --api-key cannot be used with several configs")
+	}
+	if g_recordFile != "" {
+		return nil, errors.New("--record cannot be used with several configs")
+	}
+	if isLocalIscsi(cmd) {
+		return nil, fmt.Errorf("%s runs iscsiadm on this machine, so it cannot be run on several configs", cmd.CommandPath())
+	}
+	if cmd == watchCmd {
+		return nil, fmt.Errorf("%s prints events as they arrive, so it cannot be run on several configs", cmd.CommandPath())
+	}
+	return names, nil
+}
+
+// getConfigNames returns the names of every host in the config file, in order.
+func getConfigNames(fileName string) ([]string, error) {
+	fileName = resolveConfigFilePath(fileName)
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var jsonObj map[string]interface{}
+	if err = json.Unmarshal(data, &jsonObj); err != nil {
+		return nil, fmt.Errorf("\"%s\": %v", fileName, err)
+	}
+	hosts, err := getMapFromMapAny(jsonObj, "hosts", fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// prepareCommandForHosts does what would otherwise be done lazily by the first host to run the command.
+// pflag sorts the command's flags the first time they are visited, which the hosts must not race to do.
+func prepareCommandForHosts(cmd *cobra.Command) {
+	cmd.Flags().Visit(func(*pflag.Flag) {})
+	cmd.Flags().VisitAll(func(*pflag.Flag) {})
+}
+
+// newHostSessions creates a session for each of the named configs, prompting for any passwords that are missing
+// before the command starts. A config that cannot be used is reported as a failure of that host alone.
+func newHostSessions(ctx context.Context, names []string) []*hostSession {
+	hosts := make([]*hostSession, 0, len(names))
+	for _, name := range names {
+		host := &hostSession{configName: name}
+		hosts = append(hosts, host)
+
+		opts, err := getApiClientOptions(name)
+		if err == nil && opts.needsPassword() {
+			opts.password, err = promptForPassword("Password for " + opts.username + " on " + name + ": ")
+		}
+		if err == nil {
+			host.Session, err = newApiClient(ctx, opts)
+		}
+		host.err = err
+	}
+	return hosts
+}
+
+// runOnHosts runs cmdFunc on every host at once, then writes the output of the hosts to w and whether
+// the command succeeded on each of them to errW. It fails if the command failed on any host.
+// Each host is given its own copy of cmd, as commands set fields such as SilenceUsage while they run.
+func runOnHosts(ctx context.Context, w io.Writer, errW io.Writer, cmd *cobra.Command, hosts []*hostSession, cmdFunc func(*cobra.Command, core.Session) error) error {
+	var wg sync.WaitGroup
+	hostCmds := make([]cobra.Command, len(hosts))
+	for i, host := range hosts {
+		if host.err != nil {
+			continue
+		}
+		hostCmds[i] = *cmd
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			host.err = runOnHost(ctx, host, func(api core.Session) error {
+				return cmdFunc(&hostCmds[i], api)
+			})
+		}()
+	}
+	wg.Wait()
+	for i := range hostCmds {
+		cmd.SilenceUsage = cmd.SilenceUsage || hostCmds[i].SilenceUsage
+	}
+
+	if err := writeHostOutput(w, hosts); err != nil {
+		return err
+	}
+
+	nFailed := 0
+	for _, host := range hosts {
+		if host.err != nil {
+			fmt.Fprintf(errW, "%s: failed: %s\n", host.configName, flattenErrorMessage(host.err))
+			nFailed++
+		} else {
+			fmt.Fprintf(errW, "%s: ok\n", host.configName)
+		}
+	}
+	if nFailed == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("Failed on %d of %d hosts", nFailed, len(hosts))
+	if ctx.Err() != nil {
+		return &exitCodeError{code: EXIT_CODE_INTERRUPTED, err: err}
+	}
+	return err
+}
+
+// flattenErrorMessage puts an error on one line, as the errors of closing a session come one per line.
+func flattenErrorMessage(err error) string {
+	var lines []string
+	for _, line := range strings.Split(err.Error(), "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "Error: ")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "; ")
+}
+
+// runOnHost runs cmdFunc on one host and closes its session, keeping the dry run's plan or the IDs of
+// the jobs that were left running with the rest of the host's output.
+func runOnHost(ctx context.Context, host *hostSession, cmdFunc func(core.Session) error) error {
+	err := cmdFunc(host)
+	if ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		err = errors.New("Interrupted")
+	}
+	if err = host.Close(err); err != nil {
+		return err
+	}
+	if dryRun, isDryRunSession := host.Session.(*core.DryRunSession); isDryRunSession {
+		host.asyncJobIds = nil
+		return printDryRun(&host.output, dryRun)
+	}
+	if isAsync() {
+		return writeAsyncJobs(&host.output, host.asyncJobIds)
+	}
+	return nil
+}
+
+// writeHostOutput writes the tables of a list command as one table with a host column,
+// and anything else that was printed under the name of each host in turn.
+func writeHostOutput(w io.Writer, hosts []*hostSession) error {
+	str, err := mergeHostTables(hosts)
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, str)
+
+	for _, host := range hosts {
+		if host.output.Len() > 0 {
+			fmt.Fprintf(w, "== %s ==\n", host.configName)
+			io.WriteString(w, host.output.String())
+		}
+	}
+	return nil
+}
+
+// mergeHostTables builds one table from the rows that each host printed, with the name of the host's config in the first column.
+// As rows are only unique within a host, a JSON table is keyed by host and then by ID.
+func mergeHostTables(hosts []*hostSession) (string, error) {
+	var first *hostTable
+	columnsList := []string{"host"}
+	for _, host := range hosts {
+		if host.err != nil || host.table == nil {
+			continue
+		}
+		if first == nil {
+			first = host.table
+		}
+		for _, c := range host.table.columnsList {
+			if !slices.Contains(columnsList, c) {
+				columnsList = append(columnsList, c)
+			}
+		}
+	}
+	if first == nil {
+		return "", nil
+	}
+	isJson := strings.EqualFold(first.format, "json")
+
+	var allRows []map[string]interface{}
+	jsonObj := make(map[string]json.RawMessage)
+	for _, host := range hosts {
+		if host.err != nil || host.table == nil {
+			continue
+		}
+		rows := make([]map[string]interface{}, 0, len(host.table.rows))
+		for _, row := range host.table.rows {
+			hostRow := make(map[string]interface{}, len(row)+1)
+			for key, value := range row {
+				hostRow[key] = value
+			}
+			hostRow["host"] = host.configName
+			rows = append(rows, hostRow)
+		}
+		allRows = append(allRows, rows...)
+
+		if isJson {
+			str, err := core.BuildTableData("json", first.jsonName, columnsList, rows)
+			if err != nil {
+				return "", err
+			}
+			var hostObj map[string]json.RawMessage
+			if err = json.Unmarshal([]byte(str), &hostObj); err != nil {
+				return "", err
+			}
+			jsonObj[host.configName] = hostObj[first.jsonName]
+		}
+	}
+
+	if isJson {
+		data, err := json.Marshal(map[string]interface{}{first.jsonName: jsonObj})
+		if err != nil {
+			return "", err
+		}
+		return string(data) + "\n", nil
+	}
+	return core.BuildTableData(first.format, first.jsonName, columnsList, allRows)
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+func TestGetFanOutConfigNames(t *testing.T) {
+	defer func() {
+		g_configFileName = ""
+		g_configName = ""
+		g_allConfigs = false
+		g_hostName = ""
+	}()
+	g_configFileName = writeTestConfig(t, `{"hosts": {
+		"nas2": {"url": "nas2", "api_key": "2-abc"},
+		"nas1": {"url": "nas1", "api_key": "1-abc"}
+	}}`)
+
+	names, err := getFanOutConfigNames(snapshotListCmd)
+	FailIf(t, err)
+	if names != nil {
+		t.Errorf("expected a single host without --all-configs, got %v", names)
+	}
+
+	g_configName = "nas1"
+	names, err = getFanOutConfigNames(snapshotListCmd)
+	FailIf(t, err)
+	if names != nil {
+		t.Errorf("expected a single host for one config, got %v", names)
+	}
+
+	g_configName = "nas2, nas1,nas2"
+	names, err = getFanOutConfigNames(snapshotListCmd)
+	FailIf(t, err)
+	if !slices.Equal(names, []string{"nas2", "nas1"}) {
+		t.Errorf("unexpected configs for --config: %v", names)
+	}
+
+	g_allConfigs = true
+	_, err = getFanOutConfigNames(snapshotListCmd)
+	FailUnless(t, err)
+
+	g_configName = ""
+	names, err = getFanOutConfigNames(snapshotListCmd)
+	FailIf(t, err)
+	if !slices.Equal(names, []string{"nas1", "nas2"}) {
+		t.Errorf("unexpected configs for --all-configs: %v", names)
+	}
+
+	_, err = getFanOutConfigNames(iscsiActivateCmd)
+	FailUnless(t, err)
+	_, err = getFanOutConfigNames(watchCmd)
+	FailUnless(t, err)
+
+	g_hostName = "nas3"
+	_, err = getFanOutConfigNames(snapshotListCmd)
+	FailUnless(t, err)
+}
+
+func TestRunOnHostsMergesTables(t *testing.T) {
+	expect := []string{"[[],{\"extra\":{\"flat\":false,\"properties\":[\"createtxg\"],\"retrieve_children\":true,\"user_properties\":false}}]"}
+	hosts := []*hostSession{
+		{
+			configName: "nas1",
+			Session: SetupMultiTest(t, expect, []string{"{\"jsonrpc\":\"2.0\",\"result\":[" +
+				"{\"id\":\"dozer/test4@readonly\",\"name\":\"dozer/test4@readonly\"}],\"id\":2}"}, ""),
+		},
+		{
+			configName: "nas2",
+			Session: SetupMultiTest(t, expect, []string{"{\"jsonrpc\":\"2.0\",\"result\":[" +
+				"{\"id\":\"dozer/test4@readonly\",\"name\":\"dozer/test4@readonly\"}," +
+				"{\"id\":\"dozer/test5@readonly\",\"name\":\"dozer/test5@readonly\"}],\"id\":2}"}, ""),
+		},
+		{
+			configName: "nas3",
+			err:        errors.New("Could not find \"api_key\""),
+		},
+	}
+
+	var out, errOut strings.Builder
+	prepareCommandForHosts(snapshotListCmd)
+	err := runOnHosts(context.Background(), &out, &errOut, snapshotListCmd, hosts, func(cmd *cobra.Command, api core.Session) error {
+		return listSnapshot(cmd, api, []string{})
+	})
+	FailUnless(t, err)
+
+	tableExpected := " host |         name         \n" +
+		"------+----------------------\n" +
+		" nas1 | dozer/test4@readonly \n" +
+		" nas2 | dozer/test4@readonly \n" +
+		" nas2 | dozer/test5@readonly \n"
+	if out.String() != tableExpected {
+		t.Errorf("table:\n%sdid not match expected:\n%s", out.String(), tableExpected)
+	}
+	summaryExpected := "nas1: ok\n" +
+		"nas2: ok\n" +
+		"nas3: failed: Could not find \"api_key\"\n"
+	if errOut.String() != summaryExpected {
+		t.Errorf("summary:\n%sdid not match expected:\n%s", errOut.String(), summaryExpected)
+	}
+}
+
+func TestMergeHostTablesJson(t *testing.T) {
+	rows := []map[string]interface{}{{"id": "dozer/test4@readonly", "name": "dozer/test4@readonly"}}
+	hosts := []*hostSession{
+		{configName: "nas1", table: &hostTable{format: "json", jsonName: "snapshots", columnsList: []string{"name"}, rows: rows}},
+		{configName: "nas2", table: &hostTable{format: "json", jsonName: "snapshots", columnsList: []string{"name"}, rows: rows}},
+	}
+
+	str, err := mergeHostTables(hosts)
+	FailIf(t, err)
+	expected := "{\"snapshots\":{" +
+		"\"nas1\":{\"dozer/test4@readonly\":{\"host\":\"nas1\",\"name\":\"dozer/test4@readonly\"}}," +
+		"\"nas2\":{\"dozer/test4@readonly\":{\"host\":\"nas2\",\"name\":\"dozer/test4@readonly\"}}}}\n"
+	if str != expected {
+		t.Errorf("json:\n%sdid not match expected:\n%s", str, expected)
+	}
+}
@@ -2,12 +2,14 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os/user"
 	"path"
 	"strings"
 	"time"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 
 	"github.com/spf13/cobra"
 )
@@ -75,6 +77,23 @@ var iscsiDeleteCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(1),
 }
 
+// Commands marked with this annotation run iscsiadm, which changes the iSCSI nodes and sessions of this machine rather than anything on the host.
+const LOCAL_ISCSI_ANNOTATION = "local_iscsi"
+
+func markLocalIscsi(cmds ...*cobra.Command) {
+	for _, cmd := range cmds {
+		if cmd.Annotations == nil {
+			cmd.Annotations = make(map[string]string)
+		}
+		cmd.Annotations[LOCAL_ISCSI_ANNOTATION] = "true"
+	}
+}
+
+// isLocalIscsi reports whether the command runs iscsiadm.
+func isLocalIscsi(cmd *cobra.Command) bool {
+	return cmd.Annotations[LOCAL_ISCSI_ANNOTATION] == "true"
+}
+
 func init() {
 	iscsiCreateCmd.RunE = WrapCommandFunc(createIscsi)
 	iscsiActivateCmd.RunE = WrapCommandFunc(activateIscsi)
@@ -85,6 +104,7 @@ func init() {
 	iscsiLocateCmd.RunE = WrapCommandFunc(locateIscsi)
 	iscsiDeactivateCmd.RunE = WrapCommandFunc(deactivateIscsi)
 	iscsiDeleteCmd.RunE = WrapCommandFunc(deleteIscsi)
+	markLocalIscsi(iscsiActivateCmd, iscsiTestCmd, iscsiSetupCmd, iscsiRefreshCmd, iscsiLocateCmd, iscsiDeactivateCmd, iscsiDeleteCmd)
 
 	iscsiCreateCmd.Flags().Bool("readonly", false, "Ensure the new iSCSI extent is read-only. Ignored for snapshots.")
 
@@ -135,7 +155,7 @@ func createIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	maybeHashedToVolumeMap := make(map[string]string)
 	volumeToMaybeHashedMap := make(map[string]string)
 	for _, vol := range args {
-		hashed := MaybeHashIscsiNameFromVolumePath(prefixName, vol)
+		hashed := tnc.MaybeHashIscsiNameFromVolumePath(prefixName, vol)
 		if _, exists := maybeHashedToVolumeMap[hashed]; exists {
 			return fmt.Errorf("There are duplicates in the provided list of datasets")
 		}
@@ -143,11 +163,11 @@ func createIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 		volumeToMaybeHashedMap[vol] = hashed
 	}
 
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(true),
-		shouldGetAllProps:  true,
-		shouldGetUserProps: false,
-		shouldRecurse:      false,
+	extras := tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(true),
+		ShouldGetAllProps:  true,
+		ShouldGetUserProps: false,
+		ShouldRecurse:      false,
 	}
 	responseTargetQuery, err := QueryApi(api, "iscsi.target", args, core.StringRepeated("alias", len(args)), nil, extras)
 	if err != nil {
@@ -165,7 +185,7 @@ func createIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	}
 
 	toUpdateMap := make(map[string]interface{})
-	for _, target := range responseTargetQuery.resultsMap {
+	for _, target := range responseTargetQuery.ResultsMap {
 		if targetAlias, _ := target["alias"].(string); targetAlias != "" {
 			toUpdateMap[targetAlias] = core.GetIdFromObject(target)
 		}
@@ -193,7 +213,7 @@ func createIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 
 	if len(targetUpdates) == 0 && len(targetCreates) == 0 {
 		if !core.IsStringTrue(options.allFlags, "parsable") {
-			fmt.Println("iSCSI targets, portal and initiator groups are up to date for", args)
+			PrintLine(api, "iSCSI targets, portal and initiator groups are up to date for", args)
 		}
 		return nil
 	}
@@ -242,7 +262,7 @@ func createIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	jobIdCreate = jobIdCreate
 	rawResultsTargetUpdate = rawResultsTargetUpdate
 
-	allTargets := GetListFromQueryResponse(&responseTargetQuery)
+	allTargets := tnc.GetListFromQueryResponse(&responseTargetQuery)
 	for _, t := range resultsTargetCreate {
 		if tMap, ok := t.(map[string]interface{}); ok {
 			allTargets = append(allTargets, tMap)
@@ -266,7 +286,7 @@ func createIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 		return err
 	}
 
-	extentsByDisk := GetMapFromQueryResponseKeyedOn(&responseExtentQuery, "disk")
+	extentsByDisk := tnc.GetMapFromQueryResponseKeyedOn(&responseExtentQuery, "disk")
 
 	extentsCreate := make([]string, 0)
 	extentsIqnCreate := make([]string, 0)
@@ -337,7 +357,7 @@ func createIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	if err != nil {
 		return err
 	}
-	for _, te := range responseTeQuery.resultsMap {
+	for _, te := range responseTeQuery.ResultsMap {
 		key := fmt.Sprintf("%v-%v", te["target"], te["extent"])
 		delete(teCreateMap, key)
 	}
@@ -359,12 +379,12 @@ func createIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	if strings.HasPrefix(cmd.Use, "locate") || !core.IsStringTrue(options.allFlags, "parsable") {
 		for _, target := range allTargets {
 			vol, _ := target["alias"].(string)
-			fmt.Println("created\t" + vol)
+			PrintLine(api, "created\t"+vol)
 		}
 	} else {
 		for _, target := range allTargets {
 			vol, _ := target["alias"].(string)
-			fmt.Println(vol)
+			PrintLine(api, vol)
 		}
 	}
 
@@ -422,7 +442,7 @@ func setupIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 
 func testIscsiImpl(api core.Session, options FlagMap, checkedServiceState bool) error {
 	if !checkedServiceState {
-		msg, err := CheckRemoteIscsiServiceIsRunning(api)
+		msg, err := tnc.CheckRemoteIscsiServiceIsRunning(getSessionContext(api), api)
 		if err != nil {
 			return err
 		}
@@ -431,25 +451,25 @@ func testIscsiImpl(api core.Session, options FlagMap, checkedServiceState bool)
 		}
 	}
 
-	ipPortalAddr, err := MaybeLookupIpPortFromPortal(api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
+	ipPortalAddr, err := tnc.MaybeLookupIpPortFromPortal(getSessionContext(api), api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
 	if err != nil {
 		return err
 	}
 
-	discoveryOutput, err := TestIscsiDiscovery(api, ipPortalAddr)
+	discoveryOutput, err := tnc.TestIscsiDiscovery(getSessionContext(api), api, ipPortalAddr)
 	if err != nil {
 		return err
 	}
 
 	if !core.IsStringTrue(options.allFlags, "parsable") {
-		fmt.Println(discoveryOutput)
+		PrintLine(api, discoveryOutput)
 	}
 	return nil
 }
 
 func setupIscsiImpl(api core.Session, options FlagMap) error {
 	isMinimal := core.IsStringTrue(options.allFlags, "parsable")
-	msg, err := CheckRemoteIscsiServiceIsRunning(api)
+	msg, err := tnc.CheckRemoteIscsiServiceIsRunning(getSessionContext(api), api)
 	if err != nil {
 		return err
 	}
@@ -460,9 +480,9 @@ func setupIscsiImpl(api core.Session, options FlagMap) error {
 		}
 		if !isMinimal {
 			if isEnable {
-				fmt.Println("Started and enabled iscsitarget service")
+				PrintLine(api, "Started and enabled iscsitarget service")
 			} else {
-				fmt.Println("Started iscsitarget service")
+				PrintLine(api, "Started iscsitarget service")
 			}
 		}
 	}
@@ -472,7 +492,7 @@ func setupIscsiImpl(api core.Session, options FlagMap) error {
 		return err
 	}
 	if !isMinimal {
-		fmt.Println("Portal ID:", portalId)
+		PrintLine(api, "Portal ID:", portalId)
 	}
 
 	initiatorId, err := LookupInitiatorOrCreateBlank(api, options.allFlags["initiator"])
@@ -480,16 +500,16 @@ func setupIscsiImpl(api core.Session, options FlagMap) error {
 		return err
 	}
 	if !isMinimal {
-		fmt.Println("Initiator ID:", initiatorId)
+		PrintLine(api, "Initiator ID:", initiatorId)
 	}
 
 	return nil
 }
 
 func listIscsi(cmd *cobra.Command, api core.Session, args []string) error {
-	IterateActivatedIscsiShares("", func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
+	tnc.IterateActivatedIscsiShares("", func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
 		fullPath := path.Join(root, fullName)
-		fmt.Println(fullPath)
+		PrintLine(api, fullPath)
 	})
 	return nil
 }
@@ -513,7 +533,7 @@ func refreshIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	}
 
 	// this will rescan the activated targets, and should pick up any size changes
-	_, err = RunIscsiAdminTool(api, []string{"-m", "node", "-R"})
+	_, err = tnc.RunIscsiAdminTool(getSessionContext(api), api, []string{"-m", "node", "-R"})
 
 	return err
 }
@@ -525,7 +545,7 @@ func getIscsiSharesFromSessionAndDiscovery(options FlagMap, api core.Session, ar
 	missingShares := make(map[string]string)
 
 	for _, vol := range args {
-		maybeHashed := MaybeHashIscsiNameFromVolumePath(prefixName, vol)
+		maybeHashed := tnc.MaybeHashIscsiNameFromVolumePath(prefixName, vol)
 		maybeHashedToVolumeMap[maybeHashed] = vol
 		missingShares[maybeHashed] = vol
 	}
@@ -542,17 +562,17 @@ func getIscsiSharesFromSessionAndDiscovery(options FlagMap, api core.Session, ar
 
 	isCreate := core.IsStringTrue(options.allFlags, "create")
 
-	sessionTargets, err := GetIscsiTargetsFromSession(api, maybeHashedToVolumeMap)
+	sessionTargets, err := tnc.GetIscsiTargetsFromSession(getSessionContext(api), api, maybeHashedToVolumeMap)
 	if !isCreate && err != nil && !strings.Contains(strings.ToLower(err.Error()), "no active sessions") {
 		return nil, nil, err
 	}
 
-	discoveryTargets, err := GetIscsiTargetsFromDiscovery(api, maybeHashedToVolumeMap, portalAddr)
+	discoveryTargets, err := tnc.GetIscsiTargetsFromDiscovery(getSessionContext(api), api, maybeHashedToVolumeMap, portalAddr)
 	if !isCreate && err != nil {
 		return nil, nil, err
 	}
 
-	targets := make([]typeIscsiLoginSpec, 0)
+	targets := make([]tnc.IscsiLoginSpec, 0)
 	targets = append(targets, sessionTargets...)
 	targets = append(targets, discoveryTargets...)
 
@@ -562,8 +582,8 @@ func getIscsiSharesFromSessionAndDiscovery(options FlagMap, api core.Session, ar
 
 	shares := make(map[string]bool)
 	for _, t := range targets {
-		shares[t.iqn+":"+t.target] = true
-		delete(missingShares, t.target)
+		shares[t.IqnTarget()] = true
+		delete(missingShares, t.Target)
 	}
 
 	return shares, missingShares, nil
@@ -581,7 +601,7 @@ func locateIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 
 	options, _ := GetCobraFlags(cmd, false, nil)
 
-	ipPortalAddr, err := MaybeLookupIpPortFromPortal(api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
+	ipPortalAddr, err := tnc.MaybeLookupIpPortFromPortal(getSessionContext(api), api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
 	if err != nil {
 		return err
 	}
@@ -619,7 +639,7 @@ func locateIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	toDeactivateIqnTargets := make([]string, 0)
 	toDeactivateTargetsOnly := make([]string, 0)
 
-	IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipAddr string, iqnTargetName string, targetOnlyName string) {
+	tnc.IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipAddr string, iqnTargetName string, targetOnlyName string) {
 		if _, exists := shares[iqnTargetName]; !exists {
 			return
 		}
@@ -628,20 +648,20 @@ func locateIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 			toDeactivateTargetsOnly = append(toDeactivateTargetsOnly, targetOnlyName)
 		} else {
 			fullPath := path.Join(root, fullName)
-			fmt.Println("located\t" + fullPath)
+			PrintLine(api, "located\t"+fullPath)
 		}
 		delete(shares, iqnTargetName)
 	})
 
 	if shouldActivate {
-		var remainingTargets []typeIscsiLoginSpec
+		var remainingTargets []tnc.IscsiLoginSpec
 		if shouldCreate {
-			remainingTargets, err = GetIscsiTargetsFromDiscovery(api, missingShares, ipPortalAddr)
+			remainingTargets, err = tnc.GetIscsiTargetsFromDiscovery(getSessionContext(api), api, missingShares, ipPortalAddr)
 			if err != nil {
 				return err
 			}
 		} else {
-			remainingTargets = make([]typeIscsiLoginSpec, 0)
+			remainingTargets = make([]tnc.IscsiLoginSpec, 0)
 		}
 		for share := range shares {
 			parts := strings.Split(share, ":")
@@ -650,10 +670,10 @@ func locateIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 			if len(parts) > 1 {
 				target = strings.Join(parts[1:], ":")
 			}
-			t := typeIscsiLoginSpec{
-				remoteIp: ipPortalAddr,
-				iqn:      iqn,
-				target:   target,
+			t := tnc.IscsiLoginSpec{
+				RemoteIp: ipPortalAddr,
+				Iqn:      iqn,
+				Target:   target,
 			}
 			remainingTargets = append(remainingTargets, t)
 		}
@@ -670,27 +690,22 @@ func locateIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 			return err
 		}
 		for _, t := range toDeactivateIqnTargets {
-			fmt.Println("deactivated\t" + t)
+			PrintLine(api, "deactivated\t"+t)
 		}
 	} else if shouldDeactivate {
 		shouldWait := core.IsStringTrue(options.allFlags, "wait")
-		successList, errorList := DeactivateIscsiTargetList(api, ipPortalAddr, toDeactivateIqnTargets, shouldWait)
+		successList, errorList := tnc.DeactivateIscsiTargetList(getSessionContext(api), api, ipPortalAddr, toDeactivateIqnTargets, shouldWait)
 		for _, t := range successList {
-			fmt.Println("deactivated\t" + t)
+			PrintLine(api, "deactivated\t"+t)
 		}
 		for _, e := range errorList {
-			fmt.Printf("failed\t%v", e) // %s\t%v\n", t, err)
+			PrintLine(api, fmt.Sprintf("failed\t%v", e))
 		}
 	}
 
 	return nil
 }
 
-type typeIscsiPathAndIqnTarget struct {
-	fullPath      string
-	iqnTargetName string
-}
-
 func activateIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	cmd.SilenceUsage = true
 
@@ -703,7 +718,7 @@ func activateIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 
 	options, _ := GetCobraFlags(cmd, false, nil)
 
-	ipPortalAddr, err := MaybeLookupIpPortFromPortal(api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
+	ipPortalAddr, err := tnc.MaybeLookupIpPortFromPortal(getSessionContext(api), api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
 	if err != nil {
 		return err
 	}
@@ -718,7 +733,7 @@ func activateIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 
 	isMinimal := core.IsStringTrue(options.allFlags, "parsable")
 
-	targets := make([]typeIscsiLoginSpec, 0)
+	targets := make([]tnc.IscsiLoginSpec, 0)
 	for share := range shares {
 		parts := strings.Split(share, ":")
 		iqn := parts[0]
@@ -726,108 +741,39 @@ func activateIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 		if len(parts) > 1 {
 			target = strings.Join(parts[1:], ":")
 		}
-		targets = append(targets, typeIscsiLoginSpec{
-			remoteIp: ipPortalAddr,
-			iqn:      iqn,
-			target:   target,
+		targets = append(targets, tnc.IscsiLoginSpec{
+			RemoteIp: ipPortalAddr,
+			Iqn:      iqn,
+			Target:   target,
 		})
 	}
 
 	return doIscsiActivate(api, targets, ipPortalAddr, isMinimal, false)
 }
 
-func doIscsiActivate(api core.Session, targets []typeIscsiLoginSpec, ipAddr string, isMinimal bool, shouldPrintStatus bool) error {
-	outerMap := make(map[string]bool)
-
-	for _, t := range targets {
-		iqnTarget := t.iqn + ":" + t.target
-		if t.remoteIp != ipAddr {
-			if !isMinimal {
-				fmt.Println("IP MISMATCH:", t.remoteIp, "!=", ipAddr)
-			}
-			continue
-		}
-		loginParams := []string{
-			"--mode",
-			"node",
-			"--targetname",
-			iqnTarget,
-			"--portal",
-			ipAddr,
-			"--login",
-		}
-		DebugString(strings.Join(loginParams, " "))
-		_, err := RunIscsiAdminTool(api, loginParams)
-		if err == nil {
-			outerMap[iqnTarget] = true
+func doIscsiActivate(api core.Session, targets []tnc.IscsiLoginSpec, ipAddr string, isMinimal bool, shouldPrintStatus bool) error {
+	result, err := tnc.ActivateIscsiTargets(getSessionContext(api), api, ipAddr, targets, func(iqnTarget, devicePath string) {
+		if !isMinimal || shouldPrintStatus {
+			PrintLine(api, "activated\t"+devicePath)
 		} else {
-			return fmt.Errorf("failed\t%s\t%v", iqnTarget, err)
+			PrintLine(api, devicePath)
 		}
-	}
-
-	if len(outerMap) == 0 {
-		if !isMinimal || !shouldPrintStatus {
-			return fmt.Errorf("No matching iscsi shares were found")
+	})
+	if !isMinimal {
+		for _, t := range result.Skipped {
+			PrintLine(api, "IP MISMATCH:", t.RemoteIp, "!=", ipAddr)
 		}
-		return nil
 	}
-
-	innerMap := make(map[string]bool)
-	for key, value := range outerMap {
-		innerMap[key] = value
+	if errors.Is(err, tnc.ErrNoMatchingIscsiTargets) && isMinimal && shouldPrintStatus {
+		return nil
 	}
-
-	shareCh := make(chan typeIscsiPathAndIqnTarget)
-	go func() {
-		err := core.WaitForCreatedDeletedFiles("/dev/disk/by-path", func(fname string, wasCreate, wasDelete bool) bool {
-			IterateActivatedIscsiShares(ipAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
-				shareCh <- typeIscsiPathAndIqnTarget{
-					fullPath:      path.Join(root, fullName),
-					iqnTargetName: iqnTargetName,
-				}
-				delete(innerMap, iqnTargetName)
-			})
-			return len(innerMap) == 0
-		})
-		if err != nil && !isMinimal {
-			fmt.Println("error\t", err)
-		}
-		close(shareCh)
-	}()
-
-	const maxTries = 30
-	for i := 0; i < maxTries; i++ {
-		select {
-		case names := <-shareCh:
-			if _, exists := outerMap[names.iqnTargetName]; exists {
-				if !isMinimal || shouldPrintStatus {
-					fmt.Println("activated\t" + names.fullPath)
-				} else {
-					fmt.Println(names.fullPath)
-				}
-				delete(outerMap, names.iqnTargetName)
-			}
-		case <-time.After(time.Duration(1000) * time.Millisecond):
-			IterateActivatedIscsiShares(ipAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
-				if _, exists := outerMap[iqnTargetName]; exists {
-					fullPath := path.Join(root, fullName)
-					if !isMinimal || shouldPrintStatus {
-						fmt.Println("activated\t" + fullPath)
-					} else {
-						fmt.Println(fullPath)
-					}
-					delete(outerMap, iqnTargetName)
-				}
-			})
-		}
-		if len(outerMap) == 0 {
-			break
-		}
+	if err != nil {
+		return err
 	}
 
 	if !isMinimal {
-		for iqnTargetName := range outerMap {
-			fmt.Println("timed-out\t" + iqnTargetName)
+		for _, iqnTargetName := range result.TimedOut {
+			PrintLine(api, "timed-out\t"+iqnTargetName)
 		}
 	}
 
@@ -849,7 +795,7 @@ func deactivateIscsi(cmd *cobra.Command, api core.Session, args []string) error
 
 	maybeHashedToVolumeMap := make(map[string]string)
 	for _, vol := range args {
-		maybeHashed := MaybeHashIscsiNameFromVolumePath(prefixName, vol)
+		maybeHashed := tnc.MaybeHashIscsiNameFromVolumePath(prefixName, vol)
 		maybeHashedToVolumeMap[maybeHashed] = vol
 	}
 
@@ -857,7 +803,7 @@ func deactivateIscsi(cmd *cobra.Command, api core.Session, args []string) error
 		return err
 	}
 
-	ipPortalAddr, err := MaybeLookupIpPortFromPortal(api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
+	ipPortalAddr, err := tnc.MaybeLookupIpPortFromPortal(getSessionContext(api), api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
 	if err != nil {
 		return err
 	}
@@ -874,7 +820,7 @@ func deactivateIscsi(cmd *cobra.Command, api core.Session, args []string) error
 			delete(maybeHashedToVolumeMap, vol)
 		}
 		for _, vol := range maybeHashedToVolumeMap {
-			fmt.Println("not-found\t" + vol)
+			PrintLine(api, "not-found\t"+vol)
 		}
 	}
 
@@ -906,7 +852,7 @@ func deleteIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 		diskNames = append(diskNames, "zvol/"+vol)
 		diskNameIndex["zvol/"+vol] = i
 		argsMapIndex[vol] = i
-		maybeHashed := MaybeHashIscsiNameFromVolumePath(prefixName, vol)
+		maybeHashed := tnc.MaybeHashIscsiNameFromVolumePath(prefixName, vol)
 		maybeHashedToVolumeMap[maybeHashed] = vol
 	}
 
@@ -919,18 +865,18 @@ func deleteIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 		return err
 	}
 
-	ipPortalAddr, err := MaybeLookupIpPortFromPortal(api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
+	ipPortalAddr, err := tnc.MaybeLookupIpPortFromPortal(getSessionContext(api), api, DEFAULT_ISCSI_PORT, options.allFlags["portal"])
 	if err != nil {
 		return err
 	}
 
 	_ = DeactivateMatchingIscsiTargets(api, ipPortalAddr, maybeHashedToVolumeMap, true, true, true)
 
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(true),
-		shouldGetAllProps:  true,
-		shouldGetUserProps: false,
-		shouldRecurse:      false,
+	extras := tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(true),
+		ShouldGetAllProps:  true,
+		ShouldGetUserProps: false,
+		ShouldRecurse:      false,
 	}
 
 	responseTarget, err := QueryApi(api, "iscsi.target", args, core.StringRepeated("alias", len(args)), nil, extras)
@@ -939,11 +885,11 @@ func deleteIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	}
 
 	isMinimal := core.IsStringTrue(options.allFlags, "parsable")
-	targetIds, targetNames := GetIdsOrderedByArgsFromResponse(responseTarget, "alias", args, argsMapIndex, isMinimal)
+	targetIds, targetNames := GetIdsOrderedByArgsFromResponse(api, responseTarget, "alias", args, argsMapIndex, isMinimal)
 
 	if len(targetIds) == 0 {
 		if !isMinimal {
-			fmt.Println("Could not find any shares to delete")
+			PrintLine(api, "Could not find any shares to delete")
 		}
 		return nil
 	}
@@ -955,15 +901,15 @@ func deleteIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 
 	timeout := int64(10 + 10*len(targetIdsDelete))
 
-	extras = typeQueryParams{
-		valueOrder:         BuildValueOrder(true),
-		shouldGetAllProps:  false,
-		shouldGetUserProps: false,
-		shouldRecurse:      true,
+	extras = tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(true),
+		ShouldGetAllProps:  false,
+		ShouldGetUserProps: false,
+		ShouldRecurse:      true,
 	}
 	responseDatasets, err := QueryApi(api, "pool.dataset", args, core.StringRepeated("name", len(args)), []string{}, extras)
 	if err == nil {
-		timeout = int64(10 + 10*len(responseDatasets.resultsMap))
+		timeout = int64(10 + 10*len(responseDatasets.ResultsMap))
 	}
 
 	_, _, err = MaybeBulkApiCallArray(api, "iscsi.target.delete", int64(timeout), targetIdsDelete, true)
@@ -974,7 +920,7 @@ func deleteIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	//_ = changeServiceStateSimple(api, "reload", "iscsitarget")
 
 	for _, name := range targetNames {
-		fmt.Println("deleted\t" + name)
+		PrintLine(api, "deleted\t"+name)
 	}
 
 	return nil
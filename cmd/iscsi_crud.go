@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 
 	"github.com/spf13/cobra"
 )
@@ -98,23 +99,17 @@ var iscsiCrudFeatureMap = map[string]map[string]iscsiCrudFeature{
 
 func WrapIscsiCrudFunc(cmdFunc func(*cobra.Command, string, core.Session, []string) error, category string) func(*cobra.Command, []string) error {
 	return func(cmd *cobra.Command, args []string) error {
-		api := InitializeApiClient()
-		if api == nil {
-			return nil
-		}
-		err := cmdFunc(cmd, category, api, args)
-		return api.Close(err)
+		return runWithApiClient(cmd, func(cmd *cobra.Command, api core.Session) error {
+			return cmdFunc(cmd, category, api, args)
+		})
 	}
 }
 
 func WrapIscsiCrudFuncNoArgs(cmdFunc func(*cobra.Command, string, core.Session) error, category string) func(*cobra.Command, []string) error {
 	return func(cmd *cobra.Command, args []string) error {
-		api := InitializeApiClient()
-		if api == nil {
-			return nil
-		}
-		err := cmdFunc(cmd, category, api)
-		return api.Close(err)
+		return runWithApiClient(cmd, func(cmd *cobra.Command, api core.Session) error {
+			return cmdFunc(cmd, category, api)
+		})
 	}
 }
 
@@ -197,7 +192,7 @@ func AddIscsiCrudCommands(parentCmd *cobra.Command) {
 	}
 }
 
-func iscsiCrudQuery(api core.Session, category string, values []string, properties []string, extras typeQueryParams) (typeQueryResponse, error) {
+func iscsiCrudQuery(api core.Session, category string, values []string, properties []string, extras tnc.QueryParams) (tnc.QueryResponse, error) {
 	if len(values) == 0 {
 		return QueryApi(api, "iscsi."+category, nil, nil, properties, extras)
 	}
@@ -240,16 +235,16 @@ func iscsiCrudQuery(api core.Session, category string, values []string, properti
 	return QueryApi(api, "iscsi."+category, queryValues, queryAttrs, properties, extras)
 }
 
-func iscsiQueryTargetExtentWithJoin(api core.Session, values []string, properties []string, extras typeQueryParams) (typeQueryResponse, error) {
-	emptyResponse := typeQueryResponse{}
+func iscsiQueryTargetExtentWithJoin(api core.Session, values []string, properties []string, extras tnc.QueryParams) (tnc.QueryResponse, error) {
+	emptyResponse := tnc.QueryResponse{}
 
 	response, err := iscsiCrudQuery(api, "targetextent", nil, properties, extras)
 	if err != nil {
 		return emptyResponse, err
 	}
 
-	oldShouldGetAll := extras.shouldGetAllProps
-	extras.shouldGetAllProps = false
+	oldShouldGetAll := extras.ShouldGetAllProps
+	extras.ShouldGetAllProps = false
 
 	targetResponse, err := iscsiCrudQuery(api, "target", values, nil, extras)
 	if err != nil {
@@ -263,23 +258,23 @@ func iscsiQueryTargetExtentWithJoin(api core.Session, values []string, propertie
 	missingTargets := make(map[string]string)
 	missingExtents := make(map[string]string)
 	listToRemove := make([]string, 0)
-	for k, _ := range response.resultsMap {
+	for k, _ := range response.ResultsMap {
 		found := false
 		missingTarget := ""
 		missingExtent := ""
-		if targetId, ok := response.resultsMap[k]["target"]; ok {
+		if targetId, ok := response.ResultsMap[k]["target"]; ok {
 			idStr := fmt.Sprint(targetId)
-			if target, ok := targetResponse.resultsMap[idStr]; ok {
-				response.resultsMap[k]["target_name"], _ = target["name"]
+			if target, ok := targetResponse.ResultsMap[idStr]; ok {
+				response.ResultsMap[k]["target_name"], _ = target["name"]
 				found = true
 			} else {
 				missingTarget = idStr
 			}
 		}
-		if extentId, ok := response.resultsMap[k]["extent"]; ok {
+		if extentId, ok := response.ResultsMap[k]["extent"]; ok {
 			idStr := fmt.Sprint(extentId)
-			if extent, ok := extentResponse.resultsMap[idStr]; ok {
-				response.resultsMap[k]["extent_name"], _ = extent["name"]
+			if extent, ok := extentResponse.ResultsMap[idStr]; ok {
+				response.ResultsMap[k]["extent_name"], _ = extent["name"]
 				found = true
 			} else {
 				missingExtent = idStr
@@ -294,7 +289,7 @@ func iscsiQueryTargetExtentWithJoin(api core.Session, values []string, propertie
 		}
 	}
 
-	DeleteResponseEntries(&response, listToRemove)
+	tnc.DeleteResponseEntries(&response, listToRemove)
 
 	listMissingTargets := make([]string, 0)
 	for k, _ := range missingTargets {
@@ -307,21 +302,21 @@ func iscsiQueryTargetExtentWithJoin(api core.Session, values []string, propertie
 
 	if len(listMissingTargets) > 0 {
 		subRes, _ := QueryApi(api, "iscsi.target", listMissingTargets, core.StringRepeated("id", len(listMissingTargets)), nil, extras)
-		for targetId, obj := range subRes.resultsMap {
+		for targetId, obj := range subRes.ResultsMap {
 			if teId, ok := missingTargets[targetId]; ok {
-				response.resultsMap[teId]["target_name"], _ = obj["name"]
+				response.ResultsMap[teId]["target_name"], _ = obj["name"]
 			}
 		}
 	}
 	if len(listMissingExtents) > 0 {
 		subRes, _ := QueryApi(api, "iscsi.extent", listMissingExtents, core.StringRepeated("id", len(listMissingExtents)), nil, extras)
-		for extentId, obj := range subRes.resultsMap {
+		for extentId, obj := range subRes.ResultsMap {
 			if teId, ok := missingExtents[extentId]; ok {
-				response.resultsMap[teId]["extent_name"], _ = obj["name"]
+				response.ResultsMap[teId]["extent_name"], _ = obj["name"]
 			}
 		}
 	}
-	extras.shouldGetAllProps = oldShouldGetAll
+	extras.ShouldGetAllProps = oldShouldGetAll
 	return response, nil
 }
 
@@ -340,14 +335,14 @@ func iscsiCrudList(cmd *cobra.Command, category string, api core.Session, args [
 
 	properties := EnumerateOutputProperties(options.allFlags)
 
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
-		shouldGetAllProps:  core.IsStringTrue(options.allFlags, "all") || (category == "targetextent" && len(properties) == 0),
-		shouldGetUserProps: false,
-		shouldRecurse:      false,
+	extras := tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
+		ShouldGetAllProps:  core.IsStringTrue(options.allFlags, "all") || (category == "targetextent" && len(properties) == 0),
+		ShouldGetUserProps: false,
+		ShouldRecurse:      false,
 	}
 
-	var response typeQueryResponse
+	var response tnc.QueryResponse
 
 	if category == "targetextent" {
 		response, err = iscsiQueryTargetExtentWithJoin(api, args, properties, extras)
@@ -359,11 +354,14 @@ func iscsiCrudList(cmd *cobra.Command, category string, api core.Session, args [
 		return err
 	}
 
-	results := GetListFromQueryResponse(&response)
+	results, err := getIscsiCrudListValues(category, &response, core.IsStringTrue(options.allFlags, "parsable"))
+	if err != nil {
+		return err
+	}
 
 	required := iscsiCrudIdentifierMap[category]
 	var columnsList []string
-	if extras.shouldGetAllProps {
+	if extras.ShouldGetAllProps {
 		columnsList = GetUsedPropertyColumns(results, required)
 	} else if len(properties) > 0 {
 		columnsList = properties
@@ -371,9 +369,38 @@ func iscsiCrudList(cmd *cobra.Command, category string, api core.Session, args [
 		columnsList = required
 	}
 
-	str, err := core.BuildTableData(format, category+"s", columnsList, results)
-	PrintTable(api, str)
-	return err
+	return PrintTableData(api, format, category+"s", columnsList, results)
+}
+
+func getIscsiCrudListValues(category string, response *tnc.QueryResponse, parsed bool) ([]map[string]interface{}, error) {
+	switch category {
+	case "target":
+		models, err := tnc.DecodeQueryResponse(response, tnc.DecodeIscsiTarget)
+		if err != nil {
+			return nil, err
+		}
+		return GetValuesFromModels(models, parsed), nil
+	case "extent":
+		models, err := tnc.DecodeQueryResponse(response, tnc.DecodeIscsiExtent)
+		if err != nil {
+			return nil, err
+		}
+		return GetValuesFromModels(models, parsed), nil
+	case "initiator":
+		models, err := tnc.DecodeQueryResponse(response, tnc.DecodeInitiator)
+		if err != nil {
+			return nil, err
+		}
+		return GetValuesFromModels(models, parsed), nil
+	case "portal":
+		models, err := tnc.DecodeQueryResponse(response, tnc.DecodePortal)
+		if err != nil {
+			return nil, err
+		}
+		return GetValuesFromModels(models, parsed), nil
+	}
+	// targetextent results are joined with their target and extent names, and auth has no model
+	return tnc.GetListFromQueryResponse(response), nil
 }
 
 func iscsiCrudUpdateCreate(cmd *cobra.Command, category string, api core.Session) error {
@@ -523,9 +550,9 @@ func iscsiCrudUpdateCreate(cmd *cobra.Command, category string, api core.Session
 		existingId, _ := resultsList[0]["id"]
 
 		if len(queryFilter) == len(outMap) {
-			fmt.Println("Only identifiable parameters for the " + category + " were specified,\n" +
-				"and no id was provided, therefore no change would take place.\n" +
-				"The id for this " + category + " is " + fmt.Sprint(existingId) +
+			PrintLine(api, "Only identifiable parameters for the "+category+" were specified,\n"+
+				"and no id was provided, therefore no change would take place.\n"+
+				"The id for this "+category+" is "+fmt.Sprint(existingId)+
 				"\nExiting.")
 			return nil
 		}
@@ -551,11 +578,11 @@ func iscsiCrudDelete(cmd *cobra.Command, category string, api core.Session, args
 
 	cmd.SilenceUsage = true
 
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(true),
-		shouldGetAllProps:  false,
-		shouldGetUserProps: false,
-		shouldRecurse:      false,
+	extras := tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(true),
+		ShouldGetAllProps:  false,
+		ShouldGetUserProps: false,
+		ShouldRecurse:      false,
 	}
 
 	response, err := iscsiCrudQuery(api, category, args, nil, extras)
@@ -564,7 +591,7 @@ func iscsiCrudDelete(cmd *cobra.Command, category string, api core.Session, args
 	}
 
 	idsToDelete := make([]interface{}, 0)
-	for idKey, _ := range response.resultsMap {
+	for idKey, _ := range response.ResultsMap {
 		if n, errNotNumber := strconv.Atoi(idKey); errNotNumber == nil {
 			idsToDelete = append(idsToDelete, []interface{}{n})
 		} else {
@@ -578,6 +605,6 @@ func iscsiCrudDelete(cmd *cobra.Command, category string, api core.Session, args
 		}
 		DebugString(string(out))
 	}
-	fmt.Printf("Deleted %d %ss\n", len(idsToDelete), category)
+	PrintLine(api, fmt.Sprintf("Deleted %d %ss", len(idsToDelete), category))
 	return nil
 }
@@ -2,25 +2,16 @@ package cmd
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"os/exec"
-	"path"
 	"strconv"
 	"strings"
-	"time"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 )
 
-type typeIscsiLoginSpec struct {
-	remoteIp string
-	iqn      string
-	target   string
-}
-
 type typeApiCallRecord struct {
 	endpoint   string
 	params     []interface{}
@@ -63,7 +54,7 @@ func LookupPortalIdOrCreate(api core.Session, defaultPort int, spec string) (int
 	hostName, _, err := net.SplitHostPort(api.GetHostName())
 	if err != nil {
 		// assume no port present
-		hostName = stripIpV6Brackets(api.GetHostName())
+		hostName = tnc.StripIpV6Brackets(api.GetHostName())
 	}
 
 	ipPortStr := core.IpPortToJsonString(spec, hostName, defaultPort)
@@ -107,79 +98,6 @@ func LookupPortalIdOrCreate(api core.Session, defaultPort int, spec string) (int
 	return portalId, nil
 }
 
-func MaybeLookupIpPortFromPortal(api core.Session, defaultPort int, spec string) (string, error) {
-	if spec == "" {
-		return "", fmt.Errorf("Portal was not specified (use ':' for the default portal)")
-	}
-
-	var ipPortObjMap map[string]interface{}
-	if asInt, errNotNumber := strconv.Atoi(spec); errNotNumber == nil {
-		queryFilter := []interface{}{[]interface{}{"id", "=", asInt}}
-		queryParams := []interface{}{
-			queryFilter,
-			make(map[string]interface{}),
-		}
-		out, err := core.ApiCall(api, "iscsi.portal.query", defaultCallTimeout, queryParams)
-		if err != nil {
-			return "", err
-		}
-		var response map[string]interface{}
-		if err = json.Unmarshal(out, &response); err != nil {
-			return "", err
-		}
-		results, _ := response["result"].([]interface{})
-		for i := 0; i < len(results); i++ {
-			if obj, ok := results[i].(map[string]interface{}); ok {
-				if listenArray, ok := obj["listen"].([]interface{}); ok && len(listenArray) > 0 {
-					ipPortObjMap, _ = listenArray[0].(map[string]interface{})
-					break
-				} else if listenMap, ok := obj["listen"].(map[string]interface{}); ok {
-					ipPortObjMap = listenMap
-					break
-				}
-			}
-		}
-	}
-
-	if ipPortObjMap == nil {
-		ipPortStr := core.IpPortToJsonString(spec, api.GetHostName(), defaultPort)
-		var obj interface{}
-		if err := json.Unmarshal([]byte(ipPortStr), &obj); err != nil {
-			return "", err
-		}
-		if objArray, isArray := obj.([]interface{}); isArray {
-			if len(objArray) > 0 {
-				obj = objArray[0]
-			} else {
-				return "", fmt.Errorf("listen object was empty")
-			}
-		}
-		if objMap, isMap := obj.(map[string]interface{}); isMap {
-			ipPortObjMap = objMap
-		} else {
-			return "", fmt.Errorf("listen object was not a map or array of map")
-		}
-	}
-
-	ip, exists := ipPortObjMap["ip"]
-	if !exists {
-		ip = core.ResolvedIpv4OrVerbatim(api.GetHostName())
-	}
-	port, exists := ipPortObjMap["port"]
-	if !exists {
-		port = defaultPort
-	}
-
-	// Prepare to output ip:port, but we need to wrap IPv6 in []
-	ipStr := fmt.Sprintf("%v", ip)
-	if strings.Contains(ipStr, ":") {
-		// we're about to add a port, we need to wrap the IP.
-		ipStr = fmt.Sprintf("[%s]", stripIpV6Brackets(ipStr))
-	}
-
-	return fmt.Sprintf("%s:%v", ipStr, port), nil
-}
-
 func LookupInitiatorByFilter(api core.Session, queryFilter []interface{}) (int, error) {
 	queryParams := []interface{}{
 		queryFilter,
@@ -246,37 +164,6 @@ func GetIscsiTargetPrefixOrExit(options map[string]string) string {
 	return prefix
 }
 
-func MakeIscsiTargetNameFromVolumePath(prefix, vol string) string {
-	var substituted strings.Builder
-	for _, r := range vol {
-		if r == ':' || r == '.' || r == '_' {
-			r = '-'
-		}
-		if r == '/' || r == '@' {
-			r = ':'
-		}
-		substituted.WriteRune(r)
-	}
-	if prefix == "" {
-		return strings.ToLower(substituted.String())
-	}
-	return strings.ToLower(prefix + ":" + substituted.String())
-}
-
-func MaybeHashIscsiNameFromVolumePath(prefix, vol string) string {
-	iscsiName := MakeIscsiTargetNameFromVolumePath(prefix, vol)
-	if len(iscsiName) > 64 {
-		var begin string
-		if prefix == "" {
-			begin = "-:"
-		} else {
-			begin = prefix + ":-:"
-		}
-		return begin + core.MakeHashedString(vol, 64-len(begin))
-	}
-	return iscsiName
-}
-
 func AddIscsiInitiator(initiators map[string]int, resultRow map[string]interface{}) (string, error) {
 	id := 0
 	if idValue, exists := resultRow["id"]; exists {
@@ -298,144 +185,6 @@ func AddIscsiInitiator(initiators map[string]int, resultRow map[string]interface
 	return name, nil
 }
 
-// Normalize IPv6 portal: remove brackets if present
-func stripIpV6Brackets(ipv6Addr string) string {
-	s := strings.ReplaceAll(ipv6Addr, "[", "")
-	s = strings.ReplaceAll(s, "]", "")
-
-	return s
-}
-
-func IterateActivatedIscsiShares(optIpPortalAddr string, callback func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string)) {
-	diskEntries, err := os.ReadDir("/dev/disk/by-path")
-	if err != nil {
-		return
-	}
-
-	// Normalize IPv6 portal. The brackets are not used in the /dev/disk/by-path node
-	optIpPortalAddr = stripIpV6Brackets(optIpPortalAddr)
-
-	for _, e := range diskEntries {
-		name := e.Name()
-		suffix := "-lun-0"
-		if !strings.HasSuffix(name, suffix) {
-			continue
-		}
-
-		pathPrefix := "ip-" + optIpPortalAddr
-		if !strings.HasPrefix(name, pathPrefix) {
-			continue
-		}
-
-		iqnPathStart := "-iscsi-iqn."
-		var pathStartPos int
-		var ipPortalAddr string
-
-		if len(optIpPortalAddr) == 0 {
-			pathStartPos = strings.Index(name, iqnPathStart)
-			if pathStartPos == -1 {
-				continue
-			}
-			ipPortalAddr = name[3:pathStartPos]
-		} else {
-			pathStartPos = len(pathPrefix)
-			if !strings.HasPrefix(name[pathStartPos:], iqnPathStart) {
-				continue
-			}
-			ipPortalAddr = optIpPortalAddr
-		}
-
-		iqnStart := pathStartPos + len(iqnPathStart) - 4
-		iqnTargetName := name[iqnStart : len(name)-len(suffix)]
-		targetOnlyName := iqnTargetName[strings.Index(iqnTargetName, ":")+1:]
-
-		callback("/dev/disk/by-path", name, ipPortalAddr, iqnTargetName, targetOnlyName)
-	}
-}
-
-func DeactivateIscsiTargetList(api core.Session, ipPortalAddr string, toDeactivate []string, shouldWait bool) ([]string, []error) {
-	results := make([]string, 0)
-	errs := make([]error, 0)
-
-	toDeactivateMap := make(map[string]bool)
-	for _, t := range toDeactivate {
-		toDeactivateMap[t] = true
-	}
-
-	toSyncList := make([]string, 0)
-	IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
-		if _, exists := toDeactivateMap[iqnTargetName]; exists {
-			fullPath := path.Join(root, fullName)
-			toSyncList = append(toSyncList, fullPath)
-		}
-	})
-
-	if len(toSyncList) > 0 {
-		_, _ = core.RunCommand("sync", append([]string{"-f"}, toSyncList...)...)
-	}
-
-	for _, t := range toDeactivate {
-		if err := RunIscsiDeactivate(api, t, ipPortalAddr); err != nil {
-			errs = append(errs, fmt.Errorf("%s\t%v", t, err.Error()))
-		} else {
-			results = append(results, t)
-		}
-	}
-	if len(results) == 0 {
-		results = nil
-	}
-	if len(errs) == 0 {
-		errs = nil
-	}
-
-	if !shouldWait || results == nil {
-		return results, errs
-	}
-
-	statusCh := make(chan bool)
-	innerMap := make(map[string]bool)
-	outerMap := make(map[string]bool)
-	for _, t := range results {
-		innerMap[t] = true
-		outerMap[t] = true
-	}
-
-	go func() {
-		core.WaitForCreatedDeletedFiles("/dev/disk/by-path", func(fname string, wasCreate, wasDelete bool) bool {
-			isDone := true
-			IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
-				if _, exists := innerMap[iqnTargetName]; exists {
-					isDone = false
-				}
-			})
-			statusCh <- isDone
-			return isDone
-		})
-	}()
-
-	const maxTries = 30
-	for i := 0; i < maxTries; i++ {
-		select {
-		case isDone := <-statusCh:
-			if isDone {
-				return results, errs
-			}
-		case <-time.After(time.Duration(1000) * time.Millisecond):
-			isDone := true
-			IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
-				if _, exists := outerMap[iqnTargetName]; exists {
-					isDone = false
-				}
-			})
-			if isDone {
-				return results, errs
-			}
-		}
-	}
-
-	return results, errs
-}
-
 func DeactivateMatchingIscsiTargets(
 	api core.Session,
 	ipPortalAddr string,
@@ -446,26 +195,26 @@ func DeactivateMatchingIscsiTargets(
 ) []string {
 	toDeactivateMap := make(map[string]string)
 	toDeactivateIqnTargets := make([]string, 0)
-	IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
+	tnc.IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
 		if _, exists := maybeHashedToVolumeMap[targetOnlyName]; exists {
 			toDeactivateMap[iqnTargetName] = targetOnlyName
 			toDeactivateIqnTargets = append(toDeactivateIqnTargets, iqnTargetName)
 		} else if !isMinimal {
-			fmt.Println("not-found\t" + targetOnlyName)
+			PrintLine(api, "not-found\t"+targetOnlyName)
 		}
 	})
 
-	deactivatedIqnTargetList, errorList := DeactivateIscsiTargetList(api, ipPortalAddr, toDeactivateIqnTargets, shouldWait)
+	deactivatedIqnTargetList, errorList := tnc.DeactivateIscsiTargetList(getSessionContext(api), api, ipPortalAddr, toDeactivateIqnTargets, shouldWait)
 	for _, e := range errorList {
-		fmt.Printf("failed\t%v\n", e)
+		PrintLine(api, fmt.Sprintf("failed\t%v", e))
 	}
 
 	deactivatedTargets := make([]string, 0)
 	for _, t := range deactivatedIqnTargetList {
 		if shouldPrintStatus || !isMinimal {
-			fmt.Println("deactivated\t", t)
+			PrintLine(api, "deactivated\t", t)
 		} else {
-			fmt.Println(t)
+			PrintLine(api, t)
 		}
 		deactivatedTargets = append(deactivatedTargets, toDeactivateMap[t])
 	}
@@ -473,127 +222,6 @@ func DeactivateMatchingIscsiTargets(
 	return deactivatedTargets
 }
 
-func GetIscsiTargetsFromDiscovery(api core.Session, maybeHashedToVolumeMap map[string]string, portalAddr string) ([]typeIscsiLoginSpec, error) {
-	out, err := RunIscsiDiscover(api, portalAddr)
-	if err != nil {
-		return nil, err
-	}
-
-	targets := make([]typeIscsiLoginSpec, 0)
-	lines := strings.Split(out, "\n")
-	for _, l := range lines {
-		spacePos := strings.Index(l, " ")
-		if spacePos == -1 {
-			continue
-		}
-		commaPos := strings.Index(l, ",")
-		if commaPos == -1 || commaPos > spacePos {
-			commaPos = spacePos
-		}
-		iqnSepPos := strings.Index(l[commaPos:], ":")
-		if iqnSepPos == -1 {
-			continue
-		}
-
-		targetName := l[commaPos+iqnSepPos+1:]
-		if _, exists := maybeHashedToVolumeMap[targetName]; exists {
-			t := typeIscsiLoginSpec{}
-			t.remoteIp = l[0:commaPos]
-			t.iqn = l[spacePos+1 : commaPos+iqnSepPos]
-			t.target = targetName
-			targets = append(targets, t)
-		}
-	}
-
-	return targets, nil
-}
-
-func GetIscsiTargetsFromSession(api core.Session, maybeHashedToVolumeMap map[string]string) ([]typeIscsiLoginSpec, error) {
-	out, err := RunIscsiAdminTool(api, []string{"--mode", "session"})
-	if err != nil {
-		return nil, err
-	}
-
-	targets := make([]typeIscsiLoginSpec, 0)
-	lines := strings.Split(out, "\n")
-	for _, l := range lines {
-		firstEndBracket := strings.Index(l, "]")
-		if firstEndBracket == -1 {
-			continue
-		}
-		addrStart := firstEndBracket + 2
-		firstSpacePos := strings.Index(l[addrStart:], " ")
-		if firstSpacePos == -1 {
-			continue
-		}
-		firstCommaPos := strings.Index(l[addrStart:], ",")
-		if firstCommaPos == -1 || firstCommaPos > firstSpacePos {
-			firstCommaPos = firstSpacePos
-		}
-		lastSpacePos := strings.LastIndex(l, " ")
-		if lastSpacePos == firstSpacePos {
-			lastSpacePos = len(l)
-		}
-		ipPortalAddr := l[addrStart : addrStart+firstCommaPos]
-		fullName := l[addrStart+firstSpacePos+1 : lastSpacePos]
-		firstColon := strings.Index(fullName, ":")
-		if firstColon == -1 {
-			continue
-		}
-		targetName := fullName[firstColon+1:]
-
-		if _, exists := maybeHashedToVolumeMap[targetName]; exists {
-			iqnName := fullName[0:firstColon]
-			targets = append(targets, typeIscsiLoginSpec{
-				remoteIp: ipPortalAddr,
-				iqn:      iqnName,
-				target:   targetName,
-			})
-		}
-	}
-
-	return targets, nil
-}
-
-func CheckRemoteIscsiServiceIsRunning(api core.Session) (string, error) {
-	out, err := core.ApiCall(api, "service.started", defaultCallTimeout, []interface{}{"iscsitarget"})
-	if err != nil {
-		return "", err
-	}
-	var response map[string]interface{}
-	if err = json.Unmarshal(out, &response); err != nil {
-		return "", err
-	}
-	if !core.IsValueTrue(response, "result") {
-		return "The iSCSI service has not been started\nRun this tool with:\nservice start --enable iscsitarget\nTo start the service", nil
-	}
-	return "", nil
-}
-
-func RunIscsiDeactivate(api core.Session, iqnTargetName string, ipPortalAddr string) error {
-	logoutParams := []string{
-		"--mode",
-		"node",
-		"--targetname",
-		iqnTargetName,
-		"--portal",
-		ipPortalAddr,
-		"--logout",
-	}
-	DebugString(strings.Join(logoutParams, " "))
-	_, err := RunIscsiAdminTool(api, logoutParams)
-	return err
-}
-
-func RunIscsiDiscover(api core.Session, portalAddr string) (string, error) {
-	return RunIscsiAdminTool(api, []string{"--mode", "discoverydb", "--type", "sendtargets", "--discover", "--portal", portalAddr})
-}
-
-func TestIscsiDiscovery(api core.Session, portalAddr string) (string, error) {
-	RunIscsiDiscover(api, portalAddr)
-	return RunIscsiAdminTool(api, []string{"--mode", "discovery", "--portal", portalAddr})
-}
-
 func CheckIscsiAdminToolExists() error {
 	_, err := exec.LookPath("iscsiadm")
 	if err != nil {
@@ -611,27 +239,3 @@ func MaybeLaunchIscsiDaemon() error {
 	return nil
 }
 
-func RunIscsiAdminTool(api core.Session, args []string) (string, error) {
-	retriesLeft := 10
-begin:
-	out, err := core.RunCommand("iscsiadm", args...)
-	// "Could not stat" seems to happen when iscsiadm decides to delete a node... and another instance deletes the node, a retry should resolve.
-	if err != nil && (strings.HasPrefix(err.Error(), "iscsiadm: Could not scan /sys/class/iscsi_transport") || strings.HasPrefix(err.Error(), "iscsiadm: Could not stat")) {
-		time.Sleep(time.Duration(500) * time.Millisecond)
-		retriesLeft--
-		if retriesLeft > 0 {
-			goto begin
-		}
-	}
-	if err != nil {
-		msg, apiErr := CheckRemoteIscsiServiceIsRunning(api)
-		if apiErr == nil {
-			if msg != "" {
-				err = errors.New(err.Error() + "\n" + msg)
-			} else {
-				err = errors.New(err.Error() + "\nThe remote iscsitarget service is running. It may need to be restarted with:\nservice restart iscsitarget")
-			}
-		}
-	}
-	return out, err
-}
@@ -0,0 +1,395 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+var jobCmd = &cobra.Command{
+	Use:   "job",
+	Short: "Inspect, wait for and abort TrueNAS jobs",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.HelpFunc()(cmd, args)
+			return
+		}
+	},
+}
+
+var jobListCmd = &cobra.Command{
+	Use:     "list [<id>...]",
+	Short:   "List recent jobs, optionally filtered by method and state",
+	Aliases: []string{"ls"},
+}
+
+var jobShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Show the progress, result and logs of a job",
+	Args:  cobra.ExactArgs(1),
+}
+
+var jobWaitCmd = &cobra.Command{
+	Use:   "wait <id>...",
+	Short: "Wait for one or more jobs to finish",
+	Long: "Wait for one or more jobs to finish, showing their progress.\n" +
+		"Exits with status 0 if every job succeeded, 2 if any job failed or was aborted,\n" +
+		"and 3 if --timeout elapsed first.",
+	Args: cobra.MinimumNArgs(1),
+}
+
+var jobAbortCmd = &cobra.Command{
+	Use:   "abort <id>...",
+	Short: "Abort one or more running jobs",
+	Args:  cobra.MinimumNArgs(1),
+}
+
+var g_jobListEnums map[string][]string
+var g_jobShowEnums map[string][]string
+
+const (
+	EXIT_CODE_JOB_FAILED  = 2
+	EXIT_CODE_JOB_TIMEOUT = 3
+)
+
+var g_jobStates = []string{"waiting", "running", "success", "failed", "aborted"}
+
+func init() {
+	jobListCmd.RunE = WrapCommandFunc(listJobs)
+	jobShowCmd.RunE = WrapCommandFunc(showJob)
+	jobWaitCmd.RunE = WrapCommandFunc(waitForJobs)
+	jobAbortCmd.RunE = WrapCommandFunc(abortJobs)
+
+	jobListCmd.Flags().StringP("method", "m", "", "Only list jobs calling these methods (comma-separated)")
+	jobListCmd.Flags().StringP("state", "s", "", "Only list jobs in these states (comma-separated): "+strings.Join(g_jobStates, ", "))
+	jobListCmd.Flags().IntP("limit", "n", 50, "List at most this many of the most recent jobs. 0 lists all of them")
+	jobListCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	jobListCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	jobListCmd.Flags().String("format", "table", "Output table format. Defaults to \"table\" "+
+		AddFlagsEnum(&g_jobListEnums, "format", []string{"csv", "json", "table", "compact"}))
+	jobListCmd.Flags().StringP("output", "o", "", "Output property list")
+
+	jobShowCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	jobShowCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	jobShowCmd.Flags().String("format", "table", "Output table format. Defaults to \"table\" "+
+		AddFlagsEnum(&g_jobShowEnums, "format", []string{"csv", "json", "table", "compact"}))
+
+	jobWaitCmd.Flags().StringP("timeout", "t", "", "Give up waiting after this duration, eg. 10m")
+
+	jobCmd.AddCommand(jobListCmd)
+	jobCmd.AddCommand(jobShowCmd)
+	jobCmd.AddCommand(jobWaitCmd)
+	jobCmd.AddCommand(jobAbortCmd)
+	rootCmd.AddCommand(jobCmd)
+}
+
+func listJobs(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_jobListEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	filters := make([]interface{}, 0)
+	if len(args) > 0 {
+		ids, err := parseJobIds(args)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, []interface{}{"id", "in", core.ToAnyArray(ids)})
+	}
+	if methodStr := options.allFlags["method"]; methodStr != "" {
+		filters = append(filters, []interface{}{"method", "in", core.ToAnyArray(splitAndTrim(methodStr))})
+	}
+	if stateStr := options.allFlags["state"]; stateStr != "" {
+		states := make([]string, 0)
+		for _, state := range splitAndTrim(stateStr) {
+			if !slices.Contains(g_jobStates, strings.ToLower(state)) {
+				return fmt.Errorf("Unrecognised job state \"%s\", expected one of: %s", state, strings.Join(g_jobStates, ", "))
+			}
+			states = append(states, strings.ToUpper(state))
+		}
+		filters = append(filters, []interface{}{"state", "in", core.ToAnyArray(states)})
+	}
+
+	queryOptions := map[string]interface{}{"order_by": []interface{}{"-id"}}
+	limit, err := strconv.Atoi(options.allFlags["limit"])
+	if err != nil {
+		return fmt.Errorf("Failed to parse --limit: %v", err)
+	}
+	if limit > 0 {
+		queryOptions["limit"] = limit
+	}
+
+	cmd.SilenceUsage = true
+
+	jobs, err := queryJobs(api, filters, queryOptions)
+	if err != nil {
+		return err
+	}
+	// the most recent jobs were asked for, but are listed oldest first
+	slices.Reverse(jobs)
+
+	rows := make([]map[string]interface{}, 0, len(jobs))
+	for _, job := range jobs {
+		rows = append(rows, buildJobRow(job))
+	}
+
+	columnsList := []string{"id", "method", "state", "percent", "progress", "started", "finished"}
+	if properties := EnumerateOutputProperties(options.allFlags); len(properties) > 0 {
+		columnsList = properties
+	}
+
+	return PrintTableData(api, format, "jobs", columnsList, rows)
+}
+
+func showJob(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_jobShowEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	ids, err := parseJobIds(args)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	job, err := getJob(api, ids[0])
+	if err != nil {
+		return err
+	}
+
+	row := buildJobRow(job)
+	row["abortable"] = core.IsValueTrue(job, "abortable")
+	row["arguments"] = job["arguments"]
+	row["result"] = job["result"]
+	row["logs"], _ = job["logs_excerpt"].(string)
+
+	columnsList := []string{"id", "method", "state", "percent", "progress", "started", "finished", "abortable", "error"}
+	isTable := format == "TABLE"
+	if !isTable {
+		columnsList = append(columnsList, "arguments", "result", "logs")
+	}
+
+	str, err := core.BuildTableData(format, "jobs", columnsList, []map[string]interface{}{row})
+	PrintTable(api, str)
+	if err != nil {
+		return err
+	}
+
+	if isTable {
+		if args, ok := job["arguments"]; ok {
+			if data, err := json.Marshal(args); err == nil {
+				PrintLine(api, "\narguments: "+string(data))
+			}
+		}
+		if logs, _ := job["logs_excerpt"].(string); logs != "" {
+			PrintLine(api, "\nlogs:\n"+strings.TrimRight(logs, "\n"))
+		}
+	}
+	return nil
+}
+
+func waitForJobs(cmd *cobra.Command, api core.Session, args []string) error {
+	options, _ := GetCobraFlags(cmd, false, nil)
+
+	ctx := getCommandContext(cmd)
+	if timeoutStr := options.allFlags["timeout"]; timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return fmt.Errorf("Failed to parse --timeout: %v", err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ids, err := parseJobIds(args)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	failures := make([]string, 0)
+	for _, id := range ids {
+		job, err := getJob(api, id)
+		if err != nil {
+			return err
+		}
+
+		if !isJobFinished(job) {
+			if _, err = waitForJobWithProgressCtx(ctx, api, id); err != nil {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return &exitCodeError{code: EXIT_CODE_JOB_TIMEOUT, err: fmt.Errorf("Timed out waiting for job %d", id)}
+				} else if ctx.Err() != nil {
+					return err
+				}
+				DebugString(fmt.Sprintf("waiting for job %d: %v", id, err))
+			}
+
+			// the job's own record says how it finished, even if the wait itself failed along with the job
+			if job, err = getJob(api, id); err != nil {
+				return err
+			}
+		}
+
+		state, _ := job["state"].(string)
+		if state != "SUCCESS" {
+			failures = append(failures, fmt.Sprintf("job %d %s: %v", id, strings.ToLower(state), job["error"]))
+		} else if method, _ := job["method"].(string); method == "core.bulk" {
+			// core.bulk succeeds even when the calls it made did not, eg. the ones started with --async
+			for _, errMsg := range getBulkJobErrors(job) {
+				failures = append(failures, fmt.Sprintf("job %d failed: %s", id, errMsg))
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return &exitCodeError{code: EXIT_CODE_JOB_FAILED, err: errors.New(strings.Join(failures, "\n"))}
+	}
+	return nil
+}
+
+func getBulkJobErrors(job map[string]interface{}) []string {
+	results, _ := job["result"].([]interface{})
+	errorList := make([]string, 0)
+	for _, r := range results {
+		if resultMap, ok := r.(map[string]interface{}); ok && resultMap["error"] != nil {
+			errorList = append(errorList, fmt.Sprint(resultMap["error"]))
+		}
+	}
+	return errorList
+}
+
+func abortJobs(cmd *cobra.Command, api core.Session, args []string) error {
+	ids, err := parseJobIds(args)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	for _, id := range ids {
+		out, err := core.ApiCall(api, "core.job_abort", 10, []interface{}{id})
+		if err != nil {
+			return fmt.Errorf("Failed to abort job %d: %v", id, err)
+		}
+		DebugString(string(out))
+	}
+	return nil
+}
+
+func parseJobIds(args []string) ([]int64, error) {
+	ids := make([]int64, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseInt(strings.TrimPrefix(arg, "#"), 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("\"%s\" is not a job number", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func queryJobs(api core.Session, filters []interface{}, queryOptions map[string]interface{}) ([]map[string]interface{}, error) {
+	out, err := core.ApiCall(api, "core.get_jobs", 20, []interface{}{filters, queryOptions})
+	if err != nil {
+		return nil, err
+	}
+
+	var response map[string]interface{}
+	if err = json.Unmarshal(out, &response); err != nil {
+		return nil, fmt.Errorf("Failed to parse job list: %v", err)
+	}
+	jobs, errMsg := core.ExtractJsonArrayOfMaps(response, "result")
+	if errMsg != "" {
+		return nil, fmt.Errorf("Failed to parse job list: %s", errMsg)
+	}
+	return jobs, nil
+}
+
+func getJob(api core.Session, id int64) (map[string]interface{}, error) {
+	jobs, err := queryJobs(api, []interface{}{[]interface{}{"id", "=", id}}, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("Job %d could not be found", id)
+	}
+	return jobs[0], nil
+}
+
+func isJobFinished(job map[string]interface{}) bool {
+	state, _ := job["state"].(string)
+	return state == "SUCCESS" || state == "FAILED" || state == "ABORTED"
+}
+
+// buildJobRow flattens the progress and timestamps of a job from core.get_jobs into table columns.
+func buildJobRow(job map[string]interface{}) map[string]interface{} {
+	row := make(map[string]interface{})
+	row["id"] = core.GetIntegerFromJsonObjectOr(job, "id", -1)
+	row["method"] = job["method"]
+	row["state"] = job["state"]
+	row["description"] = job["description"]
+
+	row["percent"] = "-"
+	row["progress"] = ""
+	if progress, ok := job["progress"].(map[string]interface{}); ok {
+		if percent, ok := progress["percent"].(float64); ok {
+			row["percent"] = fmt.Sprintf("%.0f%%", percent)
+		}
+		row["progress"], _ = progress["description"].(string)
+	}
+
+	row["started"] = formatJobTime(job["time_started"])
+	row["finished"] = formatJobTime(job["time_finished"])
+
+	row["error"] = ""
+	if errStr, ok := job["error"].(string); ok {
+		row["error"] = errStr
+	}
+	return row
+}
+
+// formatJobTime converts the {"$date": <milliseconds>} timestamps used by the middleware into local time.
+func formatJobTime(value interface{}) string {
+	dateObj, ok := value.(map[string]interface{})
+	if !ok {
+		return "-"
+	}
+	ms, ok := dateObj["$date"].(float64)
+	if !ok {
+		return "-"
+	}
+	return time.UnixMilli(int64(ms)).Local().Format(time.DateTime)
+}
+
+func splitAndTrim(str string) []string {
+	list := make([]string, 0)
+	for _, part := range strings.Split(str, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			list = append(list, part)
+		}
+	}
+	return list
+}
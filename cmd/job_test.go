@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJobList(t *testing.T) {
+	FailIf(t, DoReplayTest(
+		t,
+		jobListCmd,
+		listJobs,
+		map[string]interface{}{"method":"pool.dataset.delete,replication.run_onetime","state":"running,failed","limit":2},
+		[]string{},
+		"job_list.jsonl",
+		" id |         method          |  state  | percent | progress | started | finished \n"+
+		"----+-------------------------+---------+---------+----------+---------+----------\n"+
+		" 10 | pool.dataset.delete     | FAILED  | 100%    |          | -       | -        \n"+
+		" 12 | replication.run_onetime | RUNNING | 40%     | Sending  | -       | -        \n",
+	))
+}
+
+func TestJobListBadState(t *testing.T) {
+	FailIf(t, DoSimpleTest(
+		t,
+		jobListCmd,
+		listJobs,
+		map[string]interface{}{"state":"exploded"},
+		[]string{},
+		"Unrecognised job state \"exploded\", expected one of: waiting, running, success, failed, aborted",
+	))
+}
+
+func TestJobAbort(t *testing.T) {
+	FailIf(t, DoReplayTest(
+		t,
+		jobAbortCmd,
+		abortJobs,
+		map[string]interface{}{},
+		[]string{"12", "#13"},
+		"job_abort.jsonl",
+		"",
+	))
+}
+
+func TestJobWaitFailed(t *testing.T) {
+	api := SetupMultiTest(
+		t,
+		[]string{"[[[\"id\",\"=\",12]],{}]"},
+		[]string{"{\"jsonrpc\":\"2.0\",\"result\":[{\"id\":12,\"method\":\"pool.dataset.delete\",\"state\":\"FAILED\",\"error\":\"[EBUSY] dataset is busy\"}],\"id\":2}"},
+		"",
+	)
+	err := waitForJobs(jobWaitCmd, api, []string{"12"})
+	var exitErr *exitCodeError
+	if !errors.As(err, &exitErr) || exitErr.code != EXIT_CODE_JOB_FAILED {
+		t.Errorf("expected exit code %d, got: %v", EXIT_CODE_JOB_FAILED, err)
+	}
+}
+
+func TestJobWaitBulkFailed(t *testing.T) {
+	api := SetupMultiTest(
+		t,
+		[]string{"[[[\"id\",\"=\",14]],{}]"},
+		[]string{"{\"jsonrpc\":\"2.0\",\"result\":[{\"id\":14,\"method\":\"core.bulk\",\"state\":\"SUCCESS\",\"result\":["+
+			"{\"job_id\":null,\"result\":null,\"error\":null},{\"job_id\":null,\"result\":null,\"error\":\"[ENOENT] dozer/b not found\"}]}],\"id\":2}"},
+		"",
+	)
+	err := waitForJobs(jobWaitCmd, api, []string{"14"})
+	var exitErr *exitCodeError
+	if !errors.As(err, &exitErr) || exitErr.code != EXIT_CODE_JOB_FAILED || exitErr.Error() != "job 14 failed: [ENOENT] dozer/b not found" {
+		t.Errorf("expected exit code %d, got: %v", EXIT_CODE_JOB_FAILED, err)
+	}
+}
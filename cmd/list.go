@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 
 	"github.com/spf13/cobra"
 )
@@ -184,18 +185,18 @@ func doList(cmd *cobra.Command, api core.Session, args []string) error {
 		properties = core.AppendIfMissing(properties, "type")
 	}
 
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
-		shouldSkipKeyBuild: true,
-		shouldGetAllProps:  core.IsStringTrue(options.allFlags, "all"),
-		shouldGetUserProps: false,
-		shouldRecurse:      len(args) == 0 || core.IsStringTrue(options.allFlags, "recursive"),
+	extras := tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
+		ShouldSkipKeyBuild: true,
+		ShouldGetAllProps:  core.IsStringTrue(options.allFlags, "all"),
+		ShouldGetUserProps: false,
+		ShouldRecurse:      len(args) == 0 || core.IsStringTrue(options.allFlags, "recursive"),
 	}
 
-	combinedResponse := typeQueryResponse{}
-	combinedResponse.resultsMap = make(map[string]map[string]interface{})
-	combinedResponse.intKeys = make([]int, 0)
-	combinedResponse.strKeys = make([]string, 0)
+	combinedResponse := tnc.QueryResponse{}
+	combinedResponse.ResultsMap = make(map[string]map[string]interface{})
+	combinedResponse.IntKeys = make([]int, 0)
+	combinedResponse.StrKeys = make([]string, 0)
 
 	for _, qType := range allTypes {
 		var category string
@@ -221,7 +222,7 @@ func doList(cmd *cobra.Command, api core.Session, args []string) error {
 			}
 		}
 
-		for key, r := range response.resultsMap {
+		for key, r := range response.ResultsMap {
 			shouldAdd := true
 			if qType == "nfs" {
 				r["type"] = "nfs"
@@ -231,29 +232,30 @@ func doList(cmd *cobra.Command, api core.Session, args []string) error {
 				}
 			}
 			if shouldAdd {
-				combinedResponse.resultsMap[key] = r
+				combinedResponse.ResultsMap[key] = r
 				if number, errNotNumber := strconv.Atoi(key); errNotNumber == nil {
-					combinedResponse.intKeys = append(combinedResponse.intKeys, number)
+					combinedResponse.IntKeys = append(combinedResponse.IntKeys, number)
 				} else {
-					combinedResponse.strKeys = append(combinedResponse.strKeys, key)
+					combinedResponse.StrKeys = append(combinedResponse.StrKeys, key)
 				}
 			}
 		}
 	}
 
-	allResults := GetListFromQueryResponse(&combinedResponse)
+	allResults := tnc.GetListFromQueryResponse(&combinedResponse)
 
 	required := []string{"id"}
 	if _, exists := qEntriesMap["nfs"]; exists {
 		required = append(required, "path")
 	}
 
-	LowerCaseValuesFromEnums(allResults, g_datasetCreateUpdateEnums)
-	//LowerCaseValuesFromEnums(allResults, g_snapshotCreateUpdateEnums)
-	LowerCaseValuesFromEnums(allResults, g_nfsCreateUpdateEnums)
+	for _, r := range allResults {
+		tnc.LowerCaseEnumValues(r, tnc.DatasetEnumProperties)
+		tnc.LowerCaseEnumValues(r, tnc.NfsShareEnumProperties)
+	}
 
 	var columnsList []string
-	if extras.shouldGetAllProps {
+	if extras.ShouldGetAllProps {
 		columnsList = GetUsedPropertyColumns(allResults, required)
 	} else if len(properties) > 0 {
 		columnsList = outProps
@@ -261,9 +263,7 @@ func doList(cmd *cobra.Command, api core.Session, args []string) error {
 		columnsList = required
 	}
 
-	str, err := core.BuildTableData(format, "all", columnsList, allResults)
-	PrintTable(api, str)
-	return err
+	return PrintTableData(api, format, "all", columnsList, allResults)
 }
 
 func addEntriesFromInto(allValues, allTypes map[string][]string, srcKey, dstKey string, shouldCreateAnyway bool) {
@@ -1,11 +1,13 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 
 	"github.com/spf13/cobra"
 )
@@ -88,6 +90,8 @@ func init() {
 	nfsListCmd.Flags().BoolP("parsable", "p", false, "Show raw values instead of the already parsed values")
 	nfsListCmd.Flags().BoolP("all", "a", false, "Output all properties")
 
+	allowAsync(nfsCreateCmd, nfsUpdateCmd, nfsDeleteCmd)
+
 	nfsCmd.AddCommand(nfsCreateCmd)
 	nfsCmd.AddCommand(nfsUpdateCmd)
 	nfsCmd.AddCommand(nfsDeleteCmd)
@@ -129,12 +133,11 @@ func createNfs(cmd *cobra.Command, api core.Session, args []string) error {
 		return err
 	}
 
-	params := []interface{}{propsMap}
-
 	cmd.SilenceUsage = true
 
-	objRemap := map[string][]interface{}{"path": core.ToAnyArray(paths)}
-	out, _, err := MaybeBulkApiCall(api, "sharing.nfs.create", 10, params, objRemap, false)
+	out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+		return tnc.CreateNfsShares(getCommandContext(cmd), api, paths, tnc.NfsShareOptions{BulkOptions: opts, Params: propsMap})
+	})
 	if err != nil {
 		return err
 	}
@@ -163,11 +166,11 @@ func updateNfs(cmd *cobra.Command, api core.Session, args []string) error {
 
 	cmd.SilenceUsage = true
 
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(true),
-		shouldGetAllProps:  true,
-		shouldGetUserProps: false,
-		shouldRecurse:      false,
+	extras := tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(true),
+		ShouldGetAllProps:  true,
+		ShouldGetUserProps: false,
+		ShouldRecurse:      false,
 	}
 	response, err := QueryApi(api, "sharing.nfs", specs.specs, specs.types, nil, extras)
 	if err != nil {
@@ -176,7 +179,7 @@ func updateNfs(cmd *cobra.Command, api core.Session, args []string) error {
 
 	foundIds := make(map[string]string)
 	foundPaths := make(map[string]string)
-	for _, r := range response.resultsMap {
+	for _, r := range response.ResultsMap {
 		id := fmt.Sprint(r["id"])
 		path := fmt.Sprint(r["path"])
 		foundIds[id] = path
@@ -208,7 +211,7 @@ func updateNfs(cmd *cobra.Command, api core.Session, args []string) error {
 			listToCreate = append(listToCreate, s)
 		} else {
 			anyDiffs := false
-			props := response.resultsMap[idStr]
+			props := response.ResultsMap[idStr]
 			for key, value := range options.usedFlags {
 				if elem, exists := props[key]; exists {
 					if elem != value {
@@ -228,11 +231,12 @@ func updateNfs(cmd *cobra.Command, api core.Session, args []string) error {
 		}
 	}
 
-	params := []interface{}{propsMap}
+	ctx := getCommandContext(cmd)
 
 	if len(listToUpdate) > 0 {
-		objRemap := map[string][]interface{}{"": core.ToAnyArray(listToUpdate)}
-		out, _, err := MaybeBulkApiCall(api, "sharing.nfs.update", 10, params, objRemap, false)
+		out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+			return tnc.UpdateNfsShares(ctx, api, listToUpdate, tnc.NfsShareOptions{BulkOptions: opts, Params: propsMap})
+		})
 		if err != nil {
 			return err
 		}
@@ -242,8 +246,9 @@ func updateNfs(cmd *cobra.Command, api core.Session, args []string) error {
 	}
 
 	if len(listToCreate) > 0 {
-		objRemap := map[string][]interface{}{"path": core.ToAnyArray(listToCreate)}
-		out, _, err := MaybeBulkApiCall(api, "sharing.nfs.create", 10, params, objRemap, false)
+		out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+			return tnc.CreateNfsShares(ctx, api, listToCreate, tnc.NfsShareOptions{BulkOptions: opts, Params: propsMap})
+		})
 		if err != nil {
 			return err
 		}
@@ -292,27 +297,25 @@ func deleteNfs(cmd *cobra.Command, api core.Session, args []string) error {
 		for i, idStr := range specs.idList {
 			idListInts[i], _ = strconv.Atoi(idStr)
 		}
-		params := []interface{}{idListInts[0]}
-		DebugJson(params)
-
-		objRemap := map[string][]interface{}{"": core.ToAnyArray(idListInts)}
-		_, _, err := MaybeBulkApiCall(api, "sharing.nfs.delete", 10, params, objRemap, false)
+		_, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+			return tnc.DeleteNfsShares(getCommandContext(cmd), api, idListInts, opts)
+		})
 		return err
 	}
 
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(true),
-		shouldGetAllProps:  true,
-		shouldGetUserProps: false,
-		shouldRecurse:      false,
+	extras := tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(true),
+		ShouldGetAllProps:  true,
+		ShouldGetUserProps: false,
+		ShouldRecurse:      false,
 	}
 	response, err := QueryApi(api, "sharing.nfs", specs.specs, specs.types, nil, extras)
 	if err != nil {
 		return err
 	}
 
-	responseIdList := make([]interface{}, len(specs.specs))
-	for _, r := range response.resultsMap {
+	responseIdList := make([]int, len(specs.specs))
+	for _, r := range response.ResultsMap {
 		idStr := fmt.Sprint(r["id"])
 		path := fmt.Sprint(r["path"])
 		idx := -1
@@ -324,11 +327,11 @@ func deleteNfs(cmd *cobra.Command, api core.Session, args []string) error {
 		if idx < 0 {
 			return fmt.Errorf("Could not find %s or %s in API response", idStr, path)
 		}
-		if n, errNotNumber := strconv.Atoi(idStr); errNotNumber == nil {
-			responseIdList[idx] = n
-		} else {
-			responseIdList[idx] = idStr
+		n, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("Invalid NFS share ID %s in API response", idStr)
 		}
+		responseIdList[idx] = n
 	}
 
 	if len(responseIdList) == 0 {
@@ -336,9 +339,9 @@ func deleteNfs(cmd *cobra.Command, api core.Session, args []string) error {
 		return nil
 	}
 
-	params := []interface{}{responseIdList[0]}
-	objRemap := map[string][]interface{}{"": responseIdList}
-	out, _, err := MaybeBulkApiCall(api, "sharing.nfs.delete", 10, params, objRemap, false)
+	out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+		return tnc.DeleteNfsShares(getCommandContext(cmd), api, responseIdList, opts)
+	})
 	if err != nil {
 		return err
 	}
@@ -409,11 +412,11 @@ func listNfs(cmd *cobra.Command, api core.Session, args []string) error {
 		return err
 	}
 
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
-		shouldGetAllProps:  core.IsStringTrue(options.allFlags, "all"),
-		shouldGetUserProps: false,
-		shouldRecurse:      len(args) == 0 || core.IsStringTrue(options.allFlags, "recursive"),
+	extras := tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
+		ShouldGetAllProps:  core.IsStringTrue(options.allFlags, "all"),
+		ShouldGetUserProps: false,
+		ShouldRecurse:      len(args) == 0 || core.IsStringTrue(options.allFlags, "recursive"),
 	}
 
 	response, err := QueryApi(api, "sharing.nfs", args, idTypes, properties, extras)
@@ -421,12 +424,16 @@ func listNfs(cmd *cobra.Command, api core.Session, args []string) error {
 		return err
 	}
 
-	shares := GetListFromQueryResponse(&response)
-	LowerCaseValuesFromEnums(shares, g_nfsCreateUpdateEnums)
+	models, err := tnc.DecodeQueryResponse(&response, tnc.DecodeNfsShare)
+	if err != nil {
+		return err
+	}
+
+	shares := GetValuesFromModels(models, core.IsStringTrue(options.allFlags, "parsable"))
 
 	required := []string{"id", "path"}
 	var columnsList []string
-	if extras.shouldGetAllProps {
+	if extras.ShouldGetAllProps {
 		columnsList = GetUsedPropertyColumns(shares, required)
 	} else if len(properties) > 0 {
 		columnsList = properties
@@ -434,9 +441,7 @@ func listNfs(cmd *cobra.Command, api core.Session, args []string) error {
 		columnsList = required
 	}
 
-	str, err := core.BuildTableData(format, "shares", columnsList, shares)
-	PrintTable(api, str)
-	return err
+	return PrintTableData(api, format, "shares", columnsList, shares)
 }
 
 func getNfsListTypes(args []string) ([]string, error) {
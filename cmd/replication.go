@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -92,6 +93,9 @@ func init() {
 		AddFlagsEnum(&g_replStartEnums, "logging-level", []string{"debug","info","warning","error"}))
 	replStartCmd.Flags().Bool("exclude-mountpoint-property", true, "")
 	replStartCmd.Flags().Bool("only-from-scratch", false, "")
+	replStartCmd.Flags().BoolP("wait", "w", false, "Wait for the replication to finish, showing its progress")
+
+	allowAsync(replStartCmd)
 
 	replCmd.AddCommand(replStartCmd)
 	rootCmd.AddCommand(replCmd)
@@ -171,6 +175,12 @@ func startReplication(cmd *cobra.Command, api core.Session, args []string) error
 		delete(options.usedFlags, "options")
 	}
 
+	shouldWait := core.IsStringTrue(options.allFlags, "wait")
+	delete(options.usedFlags, "wait")
+	if shouldWait && isAsync() {
+		return errors.New("--wait and --async are incompatible")
+	}
+
 	for key, valueStr := range options.usedFlags {
 		if _, exists := outMap[key]; exists {
 			continue
@@ -221,12 +231,33 @@ func startReplication(cmd *cobra.Command, api core.Session, args []string) error
 
 	cmd.SilenceUsage = true
 
-	jobId, err := core.ApiCallAsync(api, "replication.run_onetime", params, false)
+	jobId, err := core.ApiCallAsync(api, "replication.run_onetime", params, shouldWait)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(jobId)
+	if isAsync() {
+		detachJob(api, jobId)
+		return nil
+	}
+
+	PrintLine(api, jobId)
+	if !shouldWait {
+		return nil
+	}
+
+	out, err := waitForJobWithProgress(api, jobId)
+	if err != nil {
+		return err
+	}
+	DebugString(string(out))
+
+	var job map[string]interface{}
+	if err = json.Unmarshal(out, &job); err == nil {
+		if state, _ := job["state"].(string); state == "FAILED" {
+			return fmt.Errorf("Replication job %d failed: %v", jobId, job["error"])
+		}
+	}
 	return nil
 }
 
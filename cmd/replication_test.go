@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -15,3 +16,48 @@ func TestReplicationStart(t *testing.T) {
 			"\"source_datasets\":[\"dozer/testing/test1\"],\"target_dataset\":\"dozer/testing/test2\",\"transport\":\"LOCAL\"}]",
 	))
 }
+
+// jobTestSession starts a job for each async call, and records whether the command waited for it or left it running.
+type jobTestSession struct {
+	*UnitTestSession
+	jobId         int64
+	waitedJobIds  []int64
+	skippedJobIds []int64
+}
+
+func (s *jobTestSession) CallAsyncRaw(method string, params interface{}) (int64, error) {
+	if _, err := s.UnitTestSession.CallAsyncRaw(method, params); err != nil {
+		return -1, err
+	}
+	return s.jobId, nil
+}
+
+func (s *jobTestSession) WaitForJob(jobId int64) (json.RawMessage, error) {
+	s.waitedJobIds = append(s.waitedJobIds, jobId)
+	return []byte("{\"state\":\"SUCCESS\"}"), nil
+}
+
+func (s *jobTestSession) SkipWaitingJobOnClose(jobId int64) {
+	s.skippedJobIds = append(s.skippedJobIds, jobId)
+}
+
+func TestReplicationStartDoesNotWait(t *testing.T) {
+	SetAuxCobraFlag(replStartCmd, "name_regex", ".*")
+	defer ResetAuxCobraFlags(replStartCmd)
+	expect := "[{\"direction\":\"PUSH\",\"name_regex\":\".*\",\"recursive\":false,\"retention_policy\":\"NONE\"," +
+		"\"source_datasets\":[\"dozer/testing/test1\"],\"target_dataset\":\"dozer/testing/test2\",\"transport\":\"LOCAL\"}]"
+	args := []string{"dozer/testing/test1", "dozer/testing/test2"}
+
+	api := &jobTestSession{UnitTestSession: SetupSimpleTest(t, expect, "{}"), jobId: 12}
+	FailIf(t, startReplication(replStartCmd, api, args))
+	if len(api.waitedJobIds) != 0 || len(api.skippedJobIds) != 1 || api.skippedJobIds[0] != 12 {
+		t.Errorf("expected job 12 to be left running, waited for %v and left %v", api.waitedJobIds, api.skippedJobIds)
+	}
+
+	SetAuxCobraFlag(replStartCmd, "wait", true)
+	api = &jobTestSession{UnitTestSession: SetupSimpleTest(t, expect, "{}"), jobId: 12}
+	FailIf(t, startReplication(replStartCmd, api, args))
+	if len(api.waitedJobIds) != 1 || len(api.skippedJobIds) != 0 {
+		t.Errorf("expected job 12 to be waited for with --wait, waited for %v and left %v", api.waitedJobIds, api.skippedJobIds)
+	}
+}
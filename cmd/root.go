@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 
 	"github.com/spf13/cobra"
 )
@@ -25,29 +29,78 @@ var daemonCmd = &cobra.Command{
 
 var g_debug bool
 var g_allowInsecure bool
+var g_caFile string
+var g_certFingerprint string
+var g_clientCert string
+var g_clientKey string
 var g_daemonSocketOverride string
 var g_configFileName string
 var g_configName string
 var g_hostName string
 var g_apiKey string
+var g_username string
+var g_password string
+var g_otp string
+var g_recordFile string
 
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
+		var exitErr *exitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
 		os.Exit(1)
 	}
 }
 
+// The conventional status of a process interrupted by SIGINT
+const EXIT_CODE_INTERRUPTED = 130
+
+// exitCodeError makes the process exit with a specific status, for commands whose status is meaningful to scripts.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
 func init() {
 	rootCmd.PersistentFlags().BoolVar(&g_debug, "debug", false, "Enable debug logs")
 	rootCmd.PersistentFlags().BoolVar(&g_allowInsecure, "allow-insecure", false, "Allow self-signed or non-trusted SSL certificates")
+	rootCmd.PersistentFlags().StringVar(&g_caFile, "ca-file", "", "Verify the host's certificate with the CAs in this PEM file rather than the system's")
+	rootCmd.PersistentFlags().StringVar(&g_certFingerprint, "cert-fingerprint", "", "Only trust the host's certificate if it has this SHA-256 fingerprint, eg. for a self-signed certificate")
+	rootCmd.PersistentFlags().StringVar(&g_clientCert, "client-cert", "", "PEM file with a client certificate to present to the host, eg. for a reverse proxy that requires one")
+	rootCmd.PersistentFlags().StringVar(&g_clientKey, "client-key", "", "PEM file with the private key of --client-cert")
 	rootCmd.PersistentFlags().StringVar(&g_daemonSocketOverride, "daemon-socket", "", "Override the default daemon socket path (~/tncdaemon.sock)")
 	rootCmd.PersistentFlags().StringVarP(&g_configFileName, "config-file", "F", "", "Override config filename (~/.truenas_incus_ctl/config.json)")
-	rootCmd.PersistentFlags().StringVarP(&g_configName, "config", "C", "", "Name of config to look up in config.json, defaults to first entry")
+	rootCmd.PersistentFlags().StringVarP(&g_configName, "config", "C", "", "Name of config to look up in config.json, defaults to first entry. Several comma-separated names run the command on each of their hosts at once")
+	rootCmd.PersistentFlags().BoolVar(&g_allConfigs, "all-configs", false, "Run the command on the hosts of every config in config.json at once")
 	rootCmd.PersistentFlags().StringVarP(&g_hostName, "host", "H", "", "Server hostname or ip with optional port or URL")
 	rootCmd.PersistentFlags().StringVarP(&g_apiKey, "api-key", "K", "", "API key")
+	rootCmd.PersistentFlags().StringVar(&g_username, "username", "", "Log in with this username instead of an API key. The password is prompted for if --password is not given")
+	rootCmd.PersistentFlags().StringVar(&g_password, "password", "", "Password for --username")
+	rootCmd.PersistentFlags().StringVar(&g_otp, "otp", "", "One-time password, for users with two-factor authentication")
+	rootCmd.PersistentFlags().StringVar(&g_async, "async", "", "Don't wait for jobs to finish, print their IDs instead. Use --async=json for a JSON object")
+	rootCmd.PersistentFlags().Lookup("async").NoOptDefVal = "text"
+	rootCmd.PersistentFlags().StringVar(&g_dryRun, "dry-run", "", "Print the calls that would change anything instead of making them. Use --dry-run=json for a JSON object")
+	rootCmd.PersistentFlags().Lookup("dry-run").NoOptDefVal = "text"
+	rootCmd.PersistentFlags().StringVar(&g_recordFile, "record", "", "Record every API call, response and job event to this JSONL cassette file, for replaying in tests")
+
+	tnc.DebugLog = DebugString
 
 	daemonCmd.Flags().StringP("timeout", "t", "", "Exit the daemon if no communication occurs after this duration")
+	daemonCmd.Flags().String("log-level", "info", "Minimum level of daemon log messages: debug, info, warn or error")
+	daemonCmd.Flags().String("log-format", "text", "Daemon log format: text or json")
+	daemonCmd.Flags().String("log-file", "", "Append the daemon's log to this file instead of writing it to stderr")
+	daemonCmd.Flags().String("heartbeat", "30s", "How often to ping each TrueNAS connection. Connections that miss two pings in a row are dropped. 0 disables")
+	daemonCmd.Flags().String("metrics-listen", "", "Serve Prometheus metrics at /metrics on this TCP address (host:port) or unix socket (unix:/path). Overrides \"metrics_listen\" in the config file")
 
 	rootCmd.AddCommand(daemonCmd)
 }
@@ -55,11 +108,22 @@ func init() {
 func RemoveGlobalFlags(flags map[string]string) {
 	core.DeleteSnakeKebab(flags, "debug")
 	core.DeleteSnakeKebab(flags, "allow-insecure")
+	core.DeleteSnakeKebab(flags, "ca-file")
+	core.DeleteSnakeKebab(flags, "cert-fingerprint")
+	core.DeleteSnakeKebab(flags, "client-cert")
+	core.DeleteSnakeKebab(flags, "client-key")
 	core.DeleteSnakeKebab(flags, "daemon-socket")
 	core.DeleteSnakeKebab(flags, "config-file")
 	core.DeleteSnakeKebab(flags, "config")
+	core.DeleteSnakeKebab(flags, "all-configs")
 	core.DeleteSnakeKebab(flags, "host")
 	core.DeleteSnakeKebab(flags, "api-key")
+	core.DeleteSnakeKebab(flags, "username")
+	core.DeleteSnakeKebab(flags, "password")
+	core.DeleteSnakeKebab(flags, "otp")
+	core.DeleteSnakeKebab(flags, "async")
+	core.DeleteSnakeKebab(flags, "dry-run")
+	core.DeleteSnakeKebab(flags, "record")
 }
 
 func runDaemon(cmd *cobra.Command, args []string) {
@@ -68,95 +132,259 @@ func runDaemon(cmd *cobra.Command, args []string) {
 	if f != nil {
 		globalTimeoutStr = f.Value.String()
 	}
+	var heartbeatStr string
+	f = cmd.Flags().Lookup("heartbeat")
+	if f != nil {
+		heartbeatStr = f.Value.String()
+	}
 	serverSockAddr := args[0]
 	if serverSockAddr == "" {
 		log.Fatal("Error: path to server socket was not provided")
 	}
-	core.RunDaemon(serverSockAddr, globalTimeoutStr)
+	config, err := getDaemonConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.TimeoutStr = globalTimeoutStr
+	config.HeartbeatStr = heartbeatStr
+	config.LogLevel, _ = cmd.Flags().GetString("log-level")
+	config.LogFormat, _ = cmd.Flags().GetString("log-format")
+	config.LogFile, _ = cmd.Flags().GetString("log-file")
+	if metricsListen, _ := cmd.Flags().GetString("metrics-listen"); metricsListen != "" {
+		config.MetricsListen = metricsListen
+	}
+	core.RunDaemon(serverSockAddr, config)
 }
 
-func InitializeApiClient() core.Session {
-	var api core.Session
-	if g_hostName == "" || g_apiKey == "" {
-		host, key, config, err := findCredsFromConfig(g_configFileName, g_configName, g_hostName, g_apiKey)
-		if err != nil {
-			log.Fatal(fmt.Errorf("Failed to parse config: %v", err))
-		}
-		g_hostName = host
-		g_apiKey = key
-		if _, exists := config["debug"]; exists {
-			g_debug = core.IsValueTrue(config, "debug")
+// apiClientOptions holds everything that a session needs to reach one host, from the global flags and the host's config.
+type apiClientOptions struct {
+	configName      string
+	hostName        string
+	apiKey          string
+	username        string
+	password        string
+	otpToken        string
+	isDebug         bool
+	allowInsecure   bool
+	caFile          string
+	certFingerprint string
+	clientCert      string
+	clientKey       string
+	daemonSocket    string
+}
+
+// getApiClientOptions combines the global flags with the settings of the named config, or of the default config if name is empty.
+// The globals are left as they are, so that the options of several configs can be looked up in turn.
+func getApiClientOptions(name string) (apiClientOptions, error) {
+	opts := apiClientOptions{
+		hostName:        g_hostName,
+		apiKey:          g_apiKey,
+		username:        g_username,
+		password:        g_password,
+		otpToken:        g_otp,
+		isDebug:         g_debug,
+		allowInsecure:   g_allowInsecure,
+		caFile:          g_caFile,
+		certFingerprint: g_certFingerprint,
+		clientCert:      g_clientCert,
+		clientKey:       g_clientKey,
+		daemonSocket:    g_daemonSocketOverride,
+	}
+	if opts.hostName != "" && (opts.apiKey != "" || opts.username != "") {
+		return opts, nil
+	}
+
+	host, key, configName, config, err := findCredsFromConfig(g_configFileName, name, opts.hostName, opts.apiKey)
+	if err != nil {
+		return opts, fmt.Errorf("Failed to parse config: %v", err)
+	}
+	opts.hostName = host
+	// a username given on the command line takes the place of the credentials in the config
+	if opts.username == "" {
+		opts.apiKey = key
+		if getCallerSecretSetting(config) == "" {
+			opts.configName = configName
 		}
-		if _, exists := config["allow_insecure"]; exists {
-			g_allowInsecure = core.IsValueTrue(config, "allow_insecure")
+		if key == "" {
+			opts.username, _ = config["username"].(string)
+			opts.password, _ = config["password"].(string)
 		}
-		if obj, exists := config["daemon_socket"]; exists {
-			g_daemonSocketOverride, _ = obj.(string)
+	}
+	if _, exists := config["debug"]; exists {
+		opts.isDebug = core.IsValueTrue(config, "debug")
+	}
+	if _, exists := config["allow_insecure"]; exists {
+		opts.allowInsecure = core.IsValueTrue(config, "allow_insecure")
+	}
+	if obj, exists := config["daemon_socket"]; exists {
+		opts.daemonSocket, _ = obj.(string)
+	}
+	if opts.caFile == "" {
+		opts.caFile, _ = config["ca_file"].(string)
+	}
+	if opts.certFingerprint == "" {
+		opts.certFingerprint, _ = config["cert_fingerprint"].(string)
+	}
+	if opts.clientCert == "" && opts.clientKey == "" {
+		opts.clientCert, _ = config["client_cert"].(string)
+		opts.clientKey, _ = config["client_key"].(string)
+	}
+	return opts, nil
+}
+
+// needsPassword reports whether the password has to be prompted for before logging in.
+func (opts *apiClientOptions) needsPassword() bool {
+	return opts.apiKey == "" && opts.username != "" && opts.password == ""
+}
+
+// InitializeApiClient creates a session whose calls are bounded by ctx unless they are given a context of their own.
+func InitializeApiClient(ctx context.Context) core.Session {
+	opts, err := getApiClientOptions(g_configName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	g_debug = opts.isDebug
+	g_daemonSocketOverride = opts.daemonSocket
+
+	if opts.needsPassword() {
+		password, err := promptForPassword("Password for " + opts.username + ": ")
+		if err != nil {
+			log.Fatal(err)
 		}
+		opts.password = password
 	}
+
+	api, err := newApiClient(ctx, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return api
+}
+
+// newApiClient creates a session for the host described by opts, wrapped for --record and --dry-run.
+func newApiClient(ctx context.Context, opts apiClientOptions) (core.Session, error) {
+	var api core.Session
 	if USE_DAEMON {
-		socketPath := g_daemonSocketOverride
+		socketPath := opts.daemonSocket
 		if socketPath == "" {
-			p, err := getHomeDirWithFallback()
-			if err != nil {
-				log.Fatal(err)
-			}
-			socketPath = path.Join(p, "tncdaemon.sock")
+			socketPath = getDaemonSocketPath()
 		}
-		api = &core.ClientSession{
-			HostName:      g_hostName,
-			ApiKey:        g_apiKey,
-			SocketPath:    socketPath,
-			IsDebug:       g_debug,
-			AllowInsecure: g_allowInsecure,
+		clientSession := &core.ClientSession{
+			HostName:        opts.hostName,
+			ApiKey:          opts.apiKey,
+			Username:        opts.username,
+			Password:        opts.password,
+			OtpToken:        opts.otpToken,
+			SocketPath:      socketPath,
+			IsDebug:         opts.isDebug,
+			AllowInsecure:   opts.allowInsecure,
+			CaFile:          opts.caFile,
+			CertFingerprint: opts.certFingerprint,
+			ClientCert:      opts.clientCert,
+			ClientKey:       opts.clientKey,
+			Context:         ctx,
 		}
+		if opts.configName != "" {
+			clientSession.ConfigName = opts.configName
+			clientSession.ConfigFile = resolveConfigFilePath(g_configFileName)
+		}
+		api = clientSession
 	} else {
 		api = &core.RealSession{
-			HostName:      g_hostName,
-			ApiKey:        g_apiKey,
-			IsDebug:       g_debug,
-			AllowInsecure: g_allowInsecure,
+			HostName:        opts.hostName,
+			ApiKey:          opts.apiKey,
+			Username:        opts.username,
+			Password:        opts.password,
+			OtpToken:        opts.otpToken,
+			IsDebug:         opts.isDebug,
+			AllowInsecure:   opts.allowInsecure,
+			CaFile:          opts.caFile,
+			CertFingerprint: opts.certFingerprint,
+			ClientCert:      opts.clientCert,
+			ClientKey:       opts.clientKey,
+			Context:         ctx,
 		}
 	}
 
-	return api
+	if g_recordFile != "" {
+		recorder, err := core.NewRecordingSession(api, g_recordFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create cassette: %v", err)
+		}
+		api = recorder
+	}
+	if isDryRun() {
+		api = core.NewDryRunSession(api)
+	}
+	return api, nil
+}
+
+func getDaemonSocketPath() string {
+	if g_daemonSocketOverride != "" {
+		return g_daemonSocketOverride
+	}
+	p, err := getHomeDirWithFallback()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return path.Join(p, "tncdaemon.sock")
+}
+
+// resolveConfigFilePath returns the config file that will be read, falling back to the default path
+// if the given file doesn't exist.
+func resolveConfigFilePath(fileName string) string {
+	if fileName != "" {
+		if _, err := os.Stat(fileName); err == nil {
+			if absPath, err := filepath.Abs(fileName); err == nil {
+				return absPath
+			}
+			return fileName
+		}
+	}
+	return getDefaultConfigPath()
 }
 
 // This method is called assuming that we're missing either a hostname or api key.
 // Additionally, we might not know the config path (in which case we use the default),
 // or the name (in which case we just pick the first config in the list)
-func findCredsFromConfig(fileName, name, existingHost, existingApiKey string) (string, string, map[string]interface{}, error) {
-	var data []byte
-	var err error
-
-	if fileName == "" {
-		fileName = getDefaultConfigPath()
-		data, err = os.ReadFile(fileName)
-	} else {
-		data, err = os.ReadFile(fileName)
-		if err != nil {
-			fileName = getDefaultConfigPath()
-			data, err = os.ReadFile(fileName)
-		}
+//
+// findCredsFromConfig returns the URL, API key and name of the matching host in the config, along with its settings.
+// The API key is empty if the host is logged in with the "username" and "password" in its settings instead.
+// Secrets that the config refers to, eg. with "api_key_file", are resolved. See resolveSecret.
+func findCredsFromConfig(fileName, name, existingHost, existingApiKey string) (string, string, string, map[string]interface{}, error) {
+	name, config, fileName, keyFile, err := findHostInConfig(fileName, name, existingHost, existingApiKey)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	u, apiKey, err := resolveHostCreds(config, keyFile, fileName)
+	if err != nil {
+		return "", "", "", nil, err
 	}
+	return u, apiKey, name, config, nil
+}
 
+// findHostInConfig returns the name and settings of the matching host in the config, without resolving its secrets,
+// along with the path of the config file and of its keyfile.
+func findHostInConfig(fileName, name, existingHost, existingApiKey string) (string, map[string]interface{}, string, string, error) {
+	fileName = resolveConfigFilePath(fileName)
+	data, err := os.ReadFile(fileName)
 	if err != nil {
-		return "", "", nil, err
+		return "", nil, "", "", err
 	}
 
 	var obj interface{}
 	if err = json.Unmarshal(data, &obj); err != nil {
-		return "", "", nil, fmt.Errorf("\"%s\": %v", fileName, err)
+		return "", nil, "", "", fmt.Errorf("\"%s\": %v", fileName, err)
 	}
 
 	jsonObj, ok := obj.(map[string]interface{})
 	if !ok {
-		return "", "", nil, fmt.Errorf("Config was not a JSON object \"%s\"", fileName)
+		return "", nil, "", "", fmt.Errorf("Config was not a JSON object \"%s\"", fileName)
 	}
 
 	hosts, err := getMapFromMapAny(jsonObj, "hosts", fileName)
 	if err != nil {
-		return "", "", nil, err
+		return "", nil, "", "", err
 	}
 
 	if name == "" {
@@ -189,26 +417,42 @@ func findCredsFromConfig(fileName, name, existingHost, existingApiKey string) (s
 			}
 		}
 		if name == "" {
-			return "", "", nil, fmt.Errorf("Could not find any matching hosts in config \"%s\"", fileName)
+			return "", nil, "", "", fmt.Errorf("Could not find any matching hosts in config \"%s\"", fileName)
 		}
 	}
 
 	config, err := getMapFromMapAny(hosts, name, fileName)
 	if err != nil {
-		return "", "", nil, err
+		return "", nil, "", "", err
 	}
+	return name, config, fileName, getKeyFilePath(jsonObj, fileName), nil
+}
 
-	apiKey, err := getNonEmptyStringFromMapAny(config, "api_key", fileName)
+// resolveHostCreds returns the URL and API key of a host from its settings, resolving the secrets that they refer to.
+// The API key is empty if the host is logged in with its "username" and "password", in which case the password
+// is put in the settings, wherever it was stored.
+func resolveHostCreds(config map[string]interface{}, keyFile string, fileName string) (string, string, error) {
+	apiKey, err := resolveSecret(config, "api_key", keyFile, fileName)
 	if err != nil {
-		return "", "", nil, err
+		return "", "", err
+	}
+	if apiKey == "" {
+		username, _ := config["username"].(string)
+		password, err := resolveSecret(config, "password", keyFile, fileName)
+		if err != nil {
+			return "", "", err
+		}
+		if username == "" || password == "" {
+			return "", "", fmt.Errorf("Could not find \"api_key\" in config \"%s\", nor \"username\" and \"password\"", fileName)
+		}
+		config["password"] = password
 	}
 
 	u, err := getNonEmptyStringFromMapAny(config, "url", fileName)
 	if err != nil {
-		return "", "", nil, err
+		return "", "", err
 	}
-
-	return u, apiKey, config, nil
+	return u, apiKey, nil
 }
 
 func getHomeDirWithFallback() (string, error) {
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, data string) string {
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(fileName, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestFindCredsWithUsernameAndPassword(t *testing.T) {
+	fileName := writeTestConfig(t, `{"hosts": {
+		"key": {"url": "nas1", "api_key": "1-abc"},
+		"user": {"url": "nas2", "username": "admin", "password": "secret"},
+		"blank": {"url": "nas3", "username": "admin"}
+	}}`)
+
+	host, key, _, _, err := findCredsFromConfig(fileName, "key", "", "")
+	FailIf(t, err)
+	if host != "nas1" || key != "1-abc" {
+		t.Errorf("unexpected creds for \"key\": %s %s", host, key)
+	}
+
+	host, key, _, config, err := findCredsFromConfig(fileName, "user", "", "")
+	FailIf(t, err)
+	if host != "nas2" || key != "" || config["password"] != "secret" {
+		t.Errorf("unexpected creds for \"user\": %s %s %v", host, key, config)
+	}
+
+	_, _, _, _, err = findCredsFromConfig(fileName, "blank", "", "")
+	FailUnless(t, err)
+
+	hostConfig, err := lookupDaemonHostConfig(fileName, "user")
+	FailIf(t, err)
+	if hostConfig.Username != "admin" || hostConfig.Password != "secret" || hostConfig.ApiKey != "" {
+		t.Errorf("unexpected daemon host config: %+v", hostConfig)
+	}
+}
+
+func TestCallerSecretsAreResolvedByTheClient(t *testing.T) {
+	defer func() { g_configFileName = "" }()
+	t.Setenv("TNC_TEST_API_KEY", "1-env")
+	g_configFileName = writeTestConfig(t, `{"hosts": {
+		"env": {"url": "nas1", "api_key_env": "TNC_TEST_API_KEY"},
+		"plain": {"url": "nas2", "api_key": "2-abc"}
+	}}`)
+
+	opts, err := getApiClientOptions("env")
+	FailIf(t, err)
+	if opts.apiKey != "1-env" || opts.configName != "" {
+		t.Errorf("the client did not resolve api_key_env itself: %+v", opts)
+	}
+	_, err = lookupDaemonHostConfig(g_configFileName, "env")
+	FailUnless(t, err)
+
+	opts, err = getApiClientOptions("plain")
+	FailIf(t, err)
+	if opts.configName != "plain" {
+		t.Errorf("the daemon was not left to look up \"plain\": %+v", opts)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 	"github.com/spf13/cobra"
 )
 
@@ -81,6 +82,8 @@ func init() {
 		cmd.Flags().Bool("ha-propagate", false, "pass ha_propagate flag to server")
 	}
 
+	allowAsync(serviceReloadCmd, serviceRestartCmd, serviceStartCmd, serviceStopCmd, serviceEnableCmd, serviceDisableCmd)
+
 	serviceCmd.AddCommand(serviceListCmd)
 	serviceCmd.AddCommand(serviceReloadCmd)
 	serviceCmd.AddCommand(serviceRestartCmd)
@@ -106,11 +109,11 @@ func listService(cmd *cobra.Command, api core.Session, args []string) error {
 
 	properties := EnumerateOutputProperties(options.allFlags)
 
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
-		shouldGetAllProps:  core.IsStringTrue(options.allFlags, "all"),
-		shouldGetUserProps: false,
-		shouldRecurse:      false,
+	extras := tnc.QueryParams{
+		ValueOrder:         tnc.BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
+		ShouldGetAllProps:  core.IsStringTrue(options.allFlags, "all"),
+		ShouldGetUserProps: false,
+		ShouldRecurse:      false,
 	}
 
 	response, err := QueryApi(api, "service", args, core.StringRepeated("service", len(args)), properties, extras)
@@ -118,11 +121,16 @@ func listService(cmd *cobra.Command, api core.Session, args []string) error {
 		return err
 	}
 
-	results := GetListFromQueryResponse(&response)
+	models, err := tnc.DecodeQueryResponse(&response, tnc.DecodeService)
+	if err != nil {
+		return err
+	}
+
+	results := GetValuesFromModels(models, core.IsStringTrue(options.allFlags, "parsable"))
 
 	required := []string { "id", "service", "enable", "state" }
 	var columnsList []string
-	if extras.shouldGetAllProps {
+	if extras.ShouldGetAllProps {
 		columnsList = GetUsedPropertyColumns(results, required)
 	} else if len(properties) > 0 {
 		columnsList = properties
@@ -130,9 +138,7 @@ func listService(cmd *cobra.Command, api core.Session, args []string) error {
 		columnsList = required
 	}
 
-	str, err := core.BuildTableData(format, "services", columnsList, results)
-	PrintTable(api, str)
-	return err
+	return PrintTableData(api, format, "services", columnsList, results)
 }
 
 func changeServiceState(cmd *cobra.Command, api core.Session, args []string) error {
@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"strings"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 
 	"github.com/spf13/cobra"
 )
@@ -94,6 +96,8 @@ func init() {
 	snapshotRollbackCmd.Flags().Bool("recursive-rollback", false, "perform a completem recursive rollback of each child snapshots.\n"+
 		"If any child does not have specified snapshot, this operation will fail.")
 
+	allowAsync(snapshotCreateCmd, snapshotDeleteCmd, snapshotRollbackCmd)
+
 	snapshotCmd.AddCommand(snapshotCloneCmd)
 	snapshotCmd.AddCommand(snapshotCreateCmd)
 	snapshotCmd.AddCommand(snapshotDeleteCmd)
@@ -106,76 +110,48 @@ func init() {
 func cloneSnapshot(cmd *cobra.Command, api core.Session, args []string) error {
 	cmd.SilenceUsage = true
 
-	outMap := make(map[string]interface{})
-	outMap["snapshot"] = args[0]
-	outMap["dataset_dst"] = args[1]
-	//outMap["dataset_properties"] = make(map[string]interface{})
-
-	params := []interface{}{outMap}
-	DebugJson(params)
-
-	out, err := core.ApiCall(api, "zfs.snapshot.clone", defaultCallTimeout, params)
-	if err != nil {
-		return err
-	}
-
-	DebugString(string(out))
-	return nil
+	return tnc.CloneSnapshot(getCommandContext(cmd), api, args[0], args[1])
 }
 
 func createSnapshot(cmd *cobra.Command, api core.Session, args []string) error {
 	options, _ := GetCobraFlags(cmd, false, nil)
-	datasetList := make([]string, len(args), len(args))
-	nameList := make([]string, len(args), len(args))
-
-	for i := 0; i < len(args); i++ {
-		snapshot := args[i]
-		datasetLen := strings.Index(snapshot, "@")
-		if datasetLen <= 0 || datasetLen == len(snapshot)-1 {
-			return errors.New("No dataset name was found in snapshot specifier.\nExpected <datasetname>@<snapshotname>.")
-		}
-		if snapshot[0] == '/' {
-			return errors.New("Dataset names must not start with '/'.")
-		}
-
-		dataset := snapshot[0:datasetLen]
-		snapshotIsolated := snapshot[datasetLen+1:]
 
-		datasetList[i] = dataset
-		nameList[i] = snapshotIsolated
-	}
-
-	outMap := make(map[string]interface{})
-	outMap["dataset"] = datasetList[0]
-	outMap["name"] = nameList[0]
-
-	MaybeCopyProperty(outMap, options.allFlags, "recursive")
-	MaybeCopyProperty(outMap, options.usedFlags, "suspend_vms")
-	MaybeCopyProperty(outMap, options.usedFlags, "vmware_sync")
+	params := make(map[string]interface{})
+	MaybeCopyProperty(params, options.usedFlags, "suspend_vms")
+	MaybeCopyProperty(params, options.usedFlags, "vmware_sync")
 
+	var exclude []string
 	if excludeStr := options.allFlags["exclude"]; excludeStr != "" {
-		outMap["exclude"] = strings.Split(excludeStr, ",")
+		exclude = strings.Split(excludeStr, ",")
 	}
 
 	// TODO: naming_schema
 
 	outProps := make(map[string]interface{})
 	_ = WriteKvArrayToMap(outProps, ConvertParamsStringToKvArray(options.allFlags["option"]), nil)
-	outMap["properties"] = outProps
-
-	params := []interface{}{outMap}
 
 	cmd.SilenceUsage = true
 
+	ctx := getCommandContext(cmd)
+
 	if core.IsStringTrue(options.allFlags, "delete") {
-		delMap := make(map[string]interface{})
-		delMap["recursive"] = true
-		delObjRemap := map[string][]interface{}{"": core.ToAnyArray(args)}
-		_, _, _ = MaybeBulkApiCall(api, "zfs.snapshot.delete", 10, []interface{}{args[0], delMap}, delObjRemap, true)
+		if isAsync() {
+			return errors.New("--delete and --async are incompatible, since the snapshots must be deleted before they can be created again")
+		}
+		_, _, _ = runBulk(api, true, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+			return tnc.DeleteSnapshots(ctx, api, args, tnc.DeleteSnapshotOptions{BulkOptions: opts, Recursive: true})
+		})
 	}
 
-	objRemap := map[string][]interface{}{"dataset": core.ToAnyArray(datasetList), "name": core.ToAnyArray(nameList)}
-	out, _, err := MaybeBulkApiCall(api, "zfs.snapshot.create", 10, params, objRemap, false)
+	out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+		return tnc.CreateSnapshots(ctx, api, args, tnc.SnapshotOptions{
+			BulkOptions: opts,
+			Recursive:   core.IsStringTrue(options.allFlags, "recursive"),
+			Exclude:     exclude,
+			Properties:  outProps,
+			Params:      params,
+		})
+	})
 	if err != nil {
 		return err
 	}
@@ -190,21 +166,27 @@ func deleteOrRollbackSnapshot(cmd *cobra.Command, api core.Session, args []strin
 		return errors.New("cmdType was not delete or rollback")
 	}
 
-	snapshots := args
-	for i := 0; i < len(args); i++ {
-		datasetLen := strings.Index(snapshots[i], "@")
-		if datasetLen <= 0 {
-			return errors.New("No dataset name was found in snapshot specifier.\nExpected <datasetname>@<snapshotname>.")
-		}
-	}
-
 	options, _ := GetCobraFlags(cmd, false, nil)
-	params := BuildNameStrAndPropertiesJson(options, snapshots[0])
 
 	cmd.SilenceUsage = true
 
-	objRemap := map[string][]interface{}{"": core.ToAnyArray(snapshots)}
-	out, _, err := MaybeBulkApiCall(api, "zfs.snapshot."+cmdType, 10, params, objRemap, false)
+	ctx := getCommandContext(cmd)
+	out, _, err := runBulk(api, false, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+		if cmdType == "delete" {
+			return tnc.DeleteSnapshots(ctx, api, args, tnc.DeleteSnapshotOptions{
+				BulkOptions: opts,
+				Recursive:   core.IsStringTrue(options.allFlags, "recursive"),
+				Defer:       core.IsStringTrue(options.allFlags, "defer"),
+			})
+		}
+		return tnc.RollbackSnapshots(ctx, api, args, tnc.RollbackSnapshotOptions{
+			BulkOptions:       opts,
+			Force:             core.IsStringTrue(options.allFlags, "force"),
+			Recursive:         core.IsStringTrue(options.allFlags, "recursive"),
+			RecursiveClones:   core.IsStringTrue(options.allFlags, "recursive_clones"),
+			RecursiveRollback: core.IsStringTrue(options.allFlags, "recursive_rollback"),
+		})
+	})
 	if err != nil {
 		return err
 	}
@@ -259,30 +241,23 @@ func listSnapshot(cmd *cobra.Command, api core.Session, args []string) error {
 	cmd.SilenceUsage = true
 
 	properties := EnumerateOutputProperties(options.allFlags)
-	idTypes, err := getSnapshotListTypes(args)
-	if err != nil {
-		return err
+	filter := tnc.SnapshotFilter{
+		Names:         args,
+		Recursive:     core.IsStringTrue(options.allFlags, "recursive"),
+		Properties:    properties,
+		AllProperties: core.IsStringTrue(options.allFlags, "all"),
 	}
 
-	// `zfs list` will "recurse" if no names are specified.
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(core.IsStringTrue(options.allFlags, "parsable")),
-		shouldGetAllProps:  core.IsStringTrue(options.allFlags, "all"),
-		shouldGetUserProps: false,
-		shouldRecurse:      len(args) == 0 || core.IsStringTrue(options.allFlags, "recursive"),
-	}
-
-	response, err := QueryApi(api, "zfs.snapshot", args, idTypes, properties, extras)
+	models, err := tnc.ListSnapshots(getCommandContext(cmd), api, filter)
 	if err != nil {
 		return err
 	}
 
-	snapshots := GetListFromQueryResponse(&response)
-	//LowerCaseValuesFromEnums(snapshots, g_snapshotCreateUpdateEnums)
+	snapshots := GetValuesFromModels(models, core.IsStringTrue(options.allFlags, "parsable"))
 
 	required := []string{"name"}
 	var columnsList []string
-	if extras.shouldGetAllProps {
+	if filter.AllProperties {
 		columnsList = GetUsedPropertyColumns(snapshots, required)
 	} else if len(properties) > 0 {
 		columnsList = properties
@@ -290,32 +265,5 @@ func listSnapshot(cmd *cobra.Command, api core.Session, args []string) error {
 		columnsList = required
 	}
 
-	str, err := core.BuildTableData(format, "snapshots", columnsList, snapshots)
-	PrintTable(api, str)
-	return err
-}
-
-func getSnapshotListTypes(args []string) ([]string, error) {
-	var typeList []string
-	if len(args) == 0 {
-		return typeList, nil
-	}
-
-	typeList = make([]string, len(args), len(args))
-	for i := 0; i < len(args); i++ {
-		t, value := core.IdentifyObject(args[i])
-		if t == "id" || t == "share" {
-			return nil, errors.New("querying snapshots based on mount point is not yet supported")
-		} else if t == "snapshot" {
-			t = "name"
-		} else if t == "snapshot_only" {
-			t = "snapshot_name"
-		} else if t != "dataset" && t != "pool" {
-			return nil, errors.New("Unrecognised namespec \"" + args[i] + "\"")
-		}
-		typeList[i] = t
-		args[i] = value
-	}
-
-	return typeList, nil
+	return PrintTableData(api, format, "snapshots", columnsList, snapshots)
 }
@@ -45,6 +45,19 @@ func TestSnapshotCreateDelete(t *testing.T) {
 	))
 }
 
+func TestSnapshotCreateDeleteAsync(t *testing.T) {
+	g_async = "text"
+	defer func() { g_async = "" }()
+	FailIf(t, DoSimpleTest(
+		t,
+		snapshotCreateCmd,
+		createSnapshot,
+		map[string]interface{}{"delete":true},
+		[]string{"dozer/testing/test@snap"},
+		"--delete and --async are incompatible, since the snapshots must be deleted before they can be created again",
+	))
+}
+
 func TestSnapshotCreateFlags(t *testing.T) {
 	FailIf(t, DoSimpleTest(
 		t,
@@ -4,29 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
 	"slices"
 	"strconv"
 	"strings"
 	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/tnc"
 )
 
 // defautCallTimeout should be used when calling API call functions.
-const defaultCallTimeout = 30
-
-type typeQueryParams struct {
-	valueOrder         []string
-	shouldSkipKeyBuild bool
-	shouldGetAllProps  bool
-	shouldGetUserProps bool
-	shouldRecurse      bool
-}
-
-type typeQueryResponse struct {
-	resultsMap map[string]map[string]interface{}
-	intKeys    []int
-	strKeys    []string
-}
+const defaultCallTimeout = tnc.DefaultCallTimeout
 
 func BuildNameStrAndPropertiesJson(options FlagMap, nameStr string) []interface{} {
 	outMap := make(map[string]interface{})
@@ -38,235 +24,14 @@ func BuildNameStrAndPropertiesJson(options FlagMap, nameStr string) []interface{
 	return []interface{}{nameStr, outMap}
 }
 
-func QueryApi(api core.Session, category string, entries, entryTypes, propsList []string, params typeQueryParams) (typeQueryResponse, error) {
-	response := typeQueryResponse{}
-	endpoint := category + ".query"
-	isNfs := endpoint == "sharing.nfs.query"
-
-	if len(entryTypes) != len(entries) {
-		return response, fmt.Errorf("length mismatch between entries and entry types: %d != %d", len(entries), len(entryTypes))
-	}
-
-	filter, err := makeQueryFilter(entries, entryTypes, params)
-	if err != nil {
-		return response, err
-	}
-
-	query := []interface{}{filter}
-	if !isNfs {
-		query = append(query, makeQueryOptions(propsList, params, strings.Contains(endpoint, "snapshot")))
-	}
-
-	DebugJson(query)
-
-	data, err := core.ApiCall(api, endpoint, defaultCallTimeout, query)
-	if err != nil {
-		return response, err
-	}
-
-	var jsonResponse interface{}
-	if err = json.Unmarshal(data, &jsonResponse); err != nil {
-		return response, fmt.Errorf("response error: %v", err)
-	}
-
-	responseMap, ok := jsonResponse.(map[string]interface{})
-	if !ok {
-		return response, errors.New("API response was not a JSON object")
-	}
-
-	resultsList, errMsg := core.ExtractJsonArrayOfMaps(responseMap, "result")
-	if errMsg != "" {
-		return response, errors.New("API response results: " + errMsg)
-	}
-	if len(resultsList) == 0 {
-		DebugString("resultsList was empty")
-		return response, nil
-	}
-
-	outputMap := make(map[string]map[string]interface{})
-	outputMapIntKeys := make([]int, 0, 0)
-	outputMapStrKeys := make([]string, 0, 0)
-
-	// Do not refactor this loop condition into a range!
-	// This loop modifies the size of resultsList as it iterates.
-	for i := 0; i < len(resultsList); i++ {
-		children, _ := core.ExtractJsonArrayOfMaps(resultsList[i], "children")
-		if len(children) > 0 {
-			resultsList = append(resultsList, children...)
-		}
-
-		var primary string
-		var primaryValue interface{}
-		if primaryValue, ok = resultsList[i]["id"]; ok {
-			if primaryStr, ok := primaryValue.(string); ok {
-				primary = primaryStr
-			} else {
-				primary = fmt.Sprint(primaryValue)
-			}
-		}
-		if len(primary) == 0 {
-			continue
-		}
-		if _, exists := outputMap[primary]; exists {
-			continue
-		}
-
-		dict := make(map[string]interface{})
-		dict["id"] = primaryValue
-
-		if isNfs {
-			dict["type"] = "NFS"
-		}
-
-		insertProperties(dict, resultsList[i], []string{"id", "children", "properties"}, params.valueOrder)
-		if innerProps, exists := resultsList[i]["properties"]; exists {
-			if innerPropsMap, ok := innerProps.(map[string]interface{}); ok {
-				insertProperties(dict, innerPropsMap, nil, params.valueOrder)
-			}
-		}
-		if innerProps, exists := resultsList[i]["user_properties"]; exists {
-			if innerPropsMap, ok := innerProps.(map[string]interface{}); ok {
-				insertProperties(dict, innerPropsMap, nil, params.valueOrder)
-			}
-		}
-
-		outputMap[primary] = dict
-		if !params.shouldSkipKeyBuild {
-			if primaryInt, errNotNumber := strconv.Atoi(primary); errNotNumber == nil {
-				outputMapIntKeys = append(outputMapIntKeys, primaryInt)
-			} else {
-				outputMapStrKeys = append(outputMapStrKeys, primary)
-			}
-		}
-	}
-
-	response = typeQueryResponse{
-		resultsMap: outputMap,
-		intKeys:    outputMapIntKeys,
-		strKeys:    outputMapStrKeys,
-	}
-	return response, nil
+func QueryApi(api core.Session, category string, entries, entryTypes, propsList []string, params tnc.QueryParams) (tnc.QueryResponse, error) {
+	return tnc.Query(getSessionContext(api), api, category, entries, entryTypes, propsList, params)
 }
 
-func MergeResponseInto(dst *typeQueryResponse, src *typeQueryResponse) {
-	if dst == nil || src == nil {
-		return
-	}
-
-	for k, v := range src.resultsMap {
-		if _, exists := dst.resultsMap[k]; !exists {
-			if n, errNotNumber := strconv.Atoi(k); errNotNumber == nil {
-				dst.intKeys = append(dst.intKeys, n)
-			} else {
-				dst.strKeys = append(dst.strKeys, k)
-			}
-		}
-		dst.resultsMap[k] = v
-	}
-}
-
-func DeleteResponseEntries(response *typeQueryResponse, keys []string) {
-	if response == nil || len(keys) == 0 {
-		return
-	}
-
-	anyDeletions := false
-	for _, k := range keys {
-		if _, exists := response.resultsMap[k]; exists {
-			delete(response.resultsMap, k)
-			anyDeletions = true
-		}
-	}
-
-	if anyDeletions && (len(response.intKeys) > 0 || len(response.strKeys) > 0) {
-		intKeys := make([]int, 0)
-		strKeys := make([]string, 0)
-		for k, _ := range response.resultsMap {
-			if n, errNotNumber := strconv.Atoi(k); errNotNumber == nil {
-				intKeys = append(intKeys, n)
-			} else {
-				strKeys = append(strKeys, k)
-			}
-		}
-		response.intKeys = intKeys
-		response.strKeys = strKeys
-	}
-}
-
-func GetListFromQueryResponse(response *typeQueryResponse) []map[string]interface{} {
-	if response == nil {
-		return nil
-	}
-
-	slices.Sort(response.intKeys)
-
-	slices.SortStableFunc(response.strKeys, func(a, b string) int {
-		atPosA := strings.Index(a, "@")
-		if atPosA < 0 {
-			return strings.Compare(a, b)
-		}
-		atPosB := strings.Index(b, "@")
-		if atPosB < 0 {
-			return strings.Compare(a, b)
-		}
-		if atPosA != atPosB {
-			return strings.Compare(a, b)
-		}
-		nameCompare := strings.Compare(a[0:atPosA], b[0:atPosB])
-		if nameCompare != 0 {
-			return nameCompare
-		}
-		var txgA int64
-		if res, exists := response.resultsMap[a]; exists {
-			txgA = core.GetIntegerFromJsonObjectOr(res, "createtxg", 0)
-		}
-		if txgA == 0 {
-			return 0
-		}
-		var txgB int64
-		if res, exists := response.resultsMap[b]; exists {
-			txgB = core.GetIntegerFromJsonObjectOr(res, "createtxg", 0)
-		}
-		if txgB == 0 || txgA == txgB {
-			return 0
-		}
-		if txgA < txgB {
-			return -1
-		}
-		return 1
-	})
-
-	nKeys := len(response.intKeys) + len(response.strKeys)
-	resultsList := make([]map[string]interface{}, nKeys, nKeys)
-
-	for i, _ := range response.intKeys {
-		resultsList[i] = response.resultsMap[strconv.Itoa(response.intKeys[i])]
-	}
-	for i, _ := range response.strKeys {
-		resultsList[len(response.intKeys)+i] = response.resultsMap[response.strKeys[i]]
-	}
-
-	return resultsList
-}
-
-func GetMapFromQueryResponseKeyedOn(response *typeQueryResponse, key string) map[string]map[string]interface{} {
-	outMap := make(map[string]map[string]interface{})
-	for _, data := range response.resultsMap {
-		if value, exists := data[key]; exists {
-			if valueStr, ok := value.(string); ok {
-				outMap[valueStr] = data
-			} else {
-				outMap[fmt.Sprint(value)] = data
-			}
-		}
-	}
-	return outMap
-}
-
-func GetIdsOrderedByArgsFromResponse(response typeQueryResponse, key string, valueList []string, valueMap map[string]int, isMinimal bool) ([]interface{}, []string) {
+func GetIdsOrderedByArgsFromResponse(api core.Session, response tnc.QueryResponse, key string, valueList []string, valueMap map[string]int, isMinimal bool) ([]interface{}, []string) {
 	ids := make([]interface{}, len(valueList))
 	names := make([]string, len(valueList))
-	for _, v := range response.resultsMap {
+	for _, v := range response.ResultsMap {
 		inner, _ := v[key]
 		innerStr := fmt.Sprint(inner)
 		if idx, exists := valueMap[innerStr]; exists {
@@ -279,7 +44,7 @@ func GetIdsOrderedByArgsFromResponse(response typeQueryResponse, key string, val
 	for i, id := range ids {
 		if id == nil {
 			if !isMinimal {
-				fmt.Println("Could not find", valueList[i])
+				PrintLine(api, "Could not find", valueList[i])
 			}
 		} else {
 			outIds = append(outIds, id)
@@ -289,209 +54,16 @@ func GetIdsOrderedByArgsFromResponse(response typeQueryResponse, key string, val
 	return outIds, outNames
 }
 
-func makeQueryFilter(entries, entryTypes []string, params typeQueryParams) ([]interface{}, error) {
-	for i, e := range entries {
-		if e == "" {
-			return nil, fmt.Errorf("Cannot query based on empty %s", entryTypes[i])
-		}
-	}
-
-	filter := make([]interface{}, 0)
-
-	// first arg = query-filter
-	if len(entries) == 1 {
-		filter = append(filter, makeIndividualFilter(entryTypes[0], []string{entries[0]}, params.shouldRecurse))
-	} else if len(entries) > 1 {
-		typeEntriesMap := make(map[string][]string)
-		uniqTypes := make([]string, 0, 0)
-		for i := 0; i < len(entries); i++ {
-			if _, exists := typeEntriesMap[entryTypes[i]]; !exists {
-				typeEntriesMap[entryTypes[i]] = make([]string, 0, 0)
-				uniqTypes = append(uniqTypes, entryTypes[i])
-			}
-			typeEntriesMap[entryTypes[i]] = append(typeEntriesMap[entryTypes[i]], entries[i])
-		}
-
-		filterList := make([][]interface{}, len(uniqTypes))
-		for i := 0; i < len(uniqTypes); i++ {
-			filterList[i] = makeIndividualFilter(uniqTypes[i], typeEntriesMap[uniqTypes[i]], params.shouldRecurse)
-		}
-
-		filter = append(filter, constructORChain(filterList))
-	}
-
-	return filter, nil
-}
-
-func makeIndividualFilter(key string, array []string, isRecursive bool) []interface{} {
-	if isRecursive && (key == "dataset" /* || key == "pool"*/) {
-		return constructORChain(makeRecursivePathsFilterList(key, array))
-	}
-	arr := make([]interface{}, len(array), len(array))
-	for i := 0; i < len(array); i++ {
-		if n, errNotNumber := strconv.Atoi(array[i]); errNotNumber == nil {
-			arr[i] = n
-		} else if strings.HasPrefix(array[i], "[") {
-			_ = json.Unmarshal([]byte(array[i]), &arr[i])
-		} else {
-			arr[i] = array[i]
-		}
-	}
-	return []interface{}{key, "in", arr}
-}
-
-func makeRecursivePathsFilterList(key string, paths []string) [][]interface{} {
-	filterList := make([][]interface{}, 0)
-	for i := 0; i < len(paths); i++ {
-		filterList = append(filterList, []interface{}{key, "=", paths[i]})
-		filterList = append(filterList, []interface{}{key, "^", paths[i] + "/"})
-	}
-	return filterList
-}
-
-func constructORChain(filterList [][]interface{}) []interface{} {
-	nFilters := len(filterList)
-	if nFilters == 0 {
-		return nil
-	}
-	top := [][]interface{}{filterList[0]}
-	for i := 1; i < nFilters; i++ {
-		top = append(top, filterList[i])
-		inner := []interface{}{"OR", top}
-		top = [][]interface{}{inner}
-	}
-	return top[0]
-}
-
-func makeQueryOptions(propsList []string, params typeQueryParams, isSnapshot bool) map[string]interface{} {
-	// second arg = query-options
-	options := make(map[string]interface{})
-	options["flat"] = false
-	options["retrieve_children"] = params.shouldRecurse
-	if params.shouldGetAllProps {
-		var nothing interface{}
-		options["properties"] = nothing
-	} else {
-		if propsList == nil {
-			propsList = make([]string, 0)
-		}
-		if isSnapshot {
-			propsList = core.AppendIfMissing(propsList, "createtxg")
-		}
-		options["properties"] = propsList
-	}
-	options["user_properties"] = params.shouldGetUserProps
-	return map[string]interface{}{"extra": options}
-}
-
-func insertProperties(dstMap, srcMap map[string]interface{}, excludeKeys []string, valueOrder []string) {
-	for key, value := range srcMap {
-		if _, exists := dstMap[key]; exists {
-			continue
-		}
-		shouldSkip := false
-		for _, ex := range excludeKeys {
-			if key == ex {
-				shouldSkip = true
-				break
-			}
-		}
-		if shouldSkip {
-			continue
-		}
-
-		//DebugJson(value)
-
-		var elem interface{}
-		if valueMap, ok := value.(map[string]interface{}); ok {
-			for _, t := range valueOrder {
-				if actualValue, ok := valueMap[t]; ok {
-					elem = actualValue
-					break
-				}
-			}
-
-		} else {
-			elem = value
-		}
-
-		if elem != nil {
-			if elemFloat, ok := elem.(float64); ok {
-				if elemFloat == math.Floor(elemFloat) {
-					elem = int64(elemFloat)
-				}
-			}
-			dstMap[key] = elem
-		}
-	}
-}
-
-func BuildValueOrder(parsed bool) []string {
-	if parsed {
-		return []string{"parsed", "value", "rawvalue"}
-	}
-	return []string{"value", "rawvalue", "parsed"}
-}
-
-func LowerCaseValuesFromEnums(results []map[string]interface{}, enums map[string][]string) {
-	for i, _ := range results {
-		for key, _ := range enums {
-			if value, exists := results[i][key]; exists {
-				if valueStr, ok := value.(string); ok {
-					results[i][key] = strings.ToLower(valueStr)
-				}
-			}
-		}
+func GetValuesFromModels[T interface{ Values(bool) map[string]interface{} }](models []T, parsed bool) []map[string]interface{} {
+	results := make([]map[string]interface{}, len(models))
+	for i, m := range models {
+		results[i] = m.Values(parsed)
 	}
+	return results
 }
 
 func LookupNfsIdByPath(api core.Session, sharePath string, optShareProperties map[string]string) (string, bool, error) {
-	if sharePath == "" {
-		return "", false, errors.New("Error looking up NFS share: no path was specified")
-	}
-
-	extras := typeQueryParams{
-		valueOrder:         BuildValueOrder(false),
-		shouldGetAllProps:  optShareProperties != nil,
-		shouldGetUserProps: optShareProperties != nil,
-		shouldRecurse:      false,
-	}
-
-	response, err := QueryApi(api, "sharing.nfs", []string{sharePath}, []string{"path"}, []string{"id", "path"}, extras)
-	if err != nil {
-		return "", false, errors.New("API error: " + fmt.Sprint(err))
-	}
-
-	shares := GetListFromQueryResponse(&response)
-	if len(shares) == 0 {
-		return "", false, nil
-	}
-
-	var idStr string
-	if value, exists := shares[0]["id"]; exists {
-		if valueStr, ok := value.(string); ok {
-			if _, errNotNumber := strconv.Atoi(valueStr); errNotNumber == nil {
-				idStr = valueStr
-			}
-		} else {
-			idStr = fmt.Sprint(value)
-		}
-	}
-	if idStr == "" {
-		return "", false, nil
-	}
-
-	if optShareProperties != nil {
-		for key, value := range shares[0] {
-			if valueStr, ok := value.(string); ok {
-				optShareProperties[key] = valueStr
-			} else {
-				optShareProperties[key] = fmt.Sprint(value)
-			}
-		}
-	}
-
-	return idStr, true, nil
+	return tnc.LookupNfsIdByPath(getSessionContext(api), api, sharePath, optShareProperties)
 }
 
 func ConvertParamsStringToKvArray(fullParamsStr string) []string {
@@ -637,73 +209,33 @@ func GetTableFormat(properties map[string]string) (string, error) {
 }
 
 func MaybeBulkApiCall(api core.Session, endpoint string, timeoutSeconds int64, params interface{}, remapList map[string][]interface{}, shouldWaitNow bool) (json.RawMessage, int64, error) {
-	allParams := make([][]interface{}, 0)
-	for key, valueList := range remapList {
-		for i, value := range valueList {
-			if len(allParams) <= i {
-				allParams = append(allParams, core.DeepCopy(params).([]interface{}))
-			}
-			_, isObjFirst := allParams[i][0].(map[string]interface{})
-			if key == "" {
-				if isObjFirst {
-					allParams[i] = append([]interface{}{value}, allParams[i]...)
-				} else {
-					allParams[i][0] = value
-				}
-			} else {
-				objIdx := 1
-				if isObjFirst {
-					objIdx = 0
-				}
-				allParams[i][objIdx].(map[string]interface{})[key] = value
-			}
-		}
-	}
-
-	nParams := len(allParams)
-	if nParams == 0 {
+	paramsArray := tnc.ExpandBulkParams(params.([]interface{}), remapList)
+	if len(paramsArray) == 0 {
 		return nil, -1, errors.New("MaybeBulkApiCall: Nothing to do")
-	} else if nParams == 1 {
-		DebugJson(allParams[0])
-		out, err := core.ApiCall(api, endpoint, timeoutSeconds, allParams[0])
-		return out, -1, err
-	}
-
-	methodAndParams := make([]interface{}, 0)
-	methodAndParams = append(methodAndParams, endpoint)
-	methodAndParams = append(methodAndParams, allParams)
-
-	DebugJson(methodAndParams)
-	jobId, err := core.ApiCallAsync(api, "core.bulk", methodAndParams, shouldWaitNow)
-	if !shouldWaitNow || err != nil || jobId < 0 {
-		return nil, jobId, err
 	}
-
-	out, err := api.WaitForJob(jobId)
-	return out, jobId, err
+	return MaybeBulkApiCallArray(api, endpoint, timeoutSeconds, paramsArray, shouldWaitNow)
 }
 
 func MaybeBulkApiCallArray(api core.Session, endpoint string, timeoutSeconds int64 /* see: defaultCallTimeout */, paramsArray []interface{}, shouldWaitNow bool) (json.RawMessage, int64, error) {
-	nCalls := len(paramsArray)
-	if nCalls == 0 {
+	if len(paramsArray) == 0 {
 		return nil, -1, errors.New("MaybeBulkApiCallArray: Nothing to do")
 	}
-	if nCalls == 1 {
-		DebugJson(paramsArray[0])
-		out, err := core.ApiCall(api, endpoint, timeoutSeconds, paramsArray[0])
-		return out, -1, err
-	}
-
-	methodAndParams := make([]interface{}, 0)
-	methodAndParams = append(methodAndParams, endpoint)
-	methodAndParams = append(methodAndParams, paramsArray)
+	return runBulk(api, shouldWaitNow, func(opts tnc.BulkOptions) (json.RawMessage, int64, error) {
+		return tnc.BulkCall(getSessionContext(api), api, endpoint, timeoutSeconds, paramsArray, opts)
+	})
+}
 
-	DebugJson(methodAndParams)
-	jobId, err := core.ApiCallAsync(api, "core.bulk", methodAndParams, shouldWaitNow)
-	if !shouldWaitNow || err != nil || jobId < 0 {
-		return nil, jobId, err
+// runBulk gives bulkFunc the options that match --async, and draws the progress of any job that it waits for.
+func runBulk(api core.Session, shouldWaitNow bool, bulkFunc func(tnc.BulkOptions) (json.RawMessage, int64, error)) (json.RawMessage, int64, error) {
+	opts := tnc.BulkOptions{Wait: shouldWaitNow, Detach: isAsync()}
+	if bar := makeProgressBar(api); bar != nil {
+		opts.OnProgress = bar.draw
+		defer bar.clear()
 	}
 
-	out, err := api.WaitForJob(jobId)
+	out, jobId, err := bulkFunc(opts)
+	if err == nil && jobId >= 0 && opts.Detach {
+		recordAsyncJob(api, jobId)
+	}
 	return out, jobId, err
 }
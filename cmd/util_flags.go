@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"truenas/truenas_incus_ctl/core"
 
 	"github.com/spf13/cobra"
@@ -196,13 +200,94 @@ func AddFlagsEnum(enumMap *map[string][]string, flagName string, newEnum []strin
 
 func WrapCommandFunc(cmdFunc func(*cobra.Command,core.Session,[]string)error) func(*cobra.Command,[]string)error {
 	return func(cmd *cobra.Command, args []string) error {
-		api := InitializeApiClient()
-		if api == nil {
-			return nil
-		}
-		err := cmdFunc(cmd, api, args)
-		return api.Close(err)
+		return runWithApiClient(cmd, func(cmd *cobra.Command, api core.Session) error {
+			return cmdFunc(cmd, api, args)
+		})
+	}
+}
+
+// runWithApiClient runs cmdFunc with a new session and closes it afterwards.
+// SIGINT or SIGTERM cancels the command's context, which stops the session from waiting for its calls and jobs,
+// and lets commands pass cmd.Context() on to the session's Ctx methods. A second signal kills the process as usual.
+// With several configs, cmdFunc runs on each of their hosts at once, each with its own copy of cmd.
+func runWithApiClient(cmd *cobra.Command, cmdFunc func(*cobra.Command, core.Session) error) error {
+	if err := checkAsyncFlag(cmd); err != nil {
+		return err
+	}
+	if err := checkDryRunFlag(cmd); err != nil {
+		return err
+	}
+	configNames, err := getFanOutConfigNames(cmd)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(getCommandContext(cmd), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+	cmd.SetContext(ctx)
+
+	if configNames != nil {
+		prepareCommandForHosts(cmd)
+		return runOnHosts(ctx, os.Stdout, os.Stderr, cmd, newHostSessions(ctx, configNames), cmdFunc)
+	}
+
+	api := InitializeApiClient(ctx)
+	if api == nil {
+		return nil
+	}
+	err = cmdFunc(cmd, api)
+	isInterrupted := ctx.Err() != nil
+	if isInterrupted && errors.Is(err, context.Canceled) {
+		err = errors.New("Interrupted")
+	}
+	closeErr := api.Close(err)
+	if isInterrupted && closeErr != nil {
+		return &exitCodeError{code: EXIT_CODE_INTERRUPTED, err: closeErr}
+	}
+	if dryRun, isDryRunSession := api.(*core.DryRunSession); isDryRunSession && closeErr == nil {
+		// the placeholder IDs of planned jobs are not worth printing
+		g_asyncJobIds = nil
+		return printDryRun(os.Stdout, dryRun)
+	}
+	if closeErr == nil && isAsync() {
+		return printAsyncJobs()
+	}
+	// Close() flattens the errors into one message, which would lose the exit code
+	var exitErr *exitCodeError
+	if closeErr != nil && errors.As(err, &exitErr) {
+		return &exitCodeError{code: exitErr.code, err: closeErr}
+	}
+	return closeErr
+}
+
+// getCommandContext returns the context that the command's calls should honour, which is only set once the command is running.
+func getCommandContext(cmd *cobra.Command) context.Context {
+	if ctx := cmd.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// getSessionContext returns the context that bounds the session's calls, for helpers that are not given the command.
+func getSessionContext(api core.Session) context.Context {
+	var ctx context.Context
+	switch s := api.(type) {
+	case *core.ClientSession:
+		ctx = s.Context
+	case *core.RealSession:
+		ctx = s.Context
+	case *core.RecordingSession:
+		return getSessionContext(s.Session)
+	case *core.DryRunSession:
+		return getSessionContext(s.Session)
+	case *hostSession:
+		return getSessionContext(s.Session)
+	}
+	if ctx == nil {
+		return context.Background()
 	}
+	return ctx
 }
 
 func WrapCommandFuncWithoutApi(cmdFunc func(*cobra.Command,core.Session,[]string)error) func(*cobra.Command,[]string)error {
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"truenas/truenas_incus_ctl/core"
+
+	"golang.org/x/term"
+)
+
+const progressBarWidth = 30
+
+type progressBar struct {
+	fd      int
+	lastLen int
+}
+
+// makeProgressBar returns a bar that draws job progress on stderr, or nil if stderr is not a terminal.
+// Commands that run on several hosts at once draw no bars, as they would overwrite each other.
+func makeProgressBar(api core.Session) *progressBar {
+	if _, isHostSession := api.(*hostSession); isHostSession {
+		return nil
+	}
+	fd := int(os.Stderr.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+	return &progressBar{fd: fd}
+}
+
+// waitForJobWithProgress waits for a job to complete, drawing its progress on stderr if stderr is a terminal.
+func waitForJobWithProgress(api core.Session, jobId int64) (json.RawMessage, error) {
+	bar := makeProgressBar(api)
+	if bar == nil {
+		return api.WaitForJob(jobId)
+	}
+
+	out, err := api.WaitForJobWithProgress(jobId, bar.draw)
+	bar.clear()
+	return out, err
+}
+
+// waitForJobWithProgressCtx is waitForJobWithProgress, but stops waiting once ctx is done.
+func waitForJobWithProgressCtx(ctx context.Context, api core.Session, jobId int64) (json.RawMessage, error) {
+	bar := makeProgressBar(api)
+	if bar == nil {
+		return api.WaitForJobCtx(ctx, jobId)
+	}
+
+	out, err := api.WaitForJobWithProgressCtx(ctx, jobId, bar.draw)
+	bar.clear()
+	return out, err
+}
+
+func (b *progressBar) draw(progress core.JobProgress) {
+	percent := min(max(progress.Percent, 0), 100)
+	nFilled := int(percent * progressBarWidth / 100)
+	line := fmt.Sprintf("[%s%s] %3.0f%% %s",
+		strings.Repeat("#", nFilled),
+		strings.Repeat("-", progressBarWidth-nFilled),
+		percent,
+		progress.Description,
+	)
+
+	if width, _, err := term.GetSize(b.fd); err == nil && width > 1 && len(line) >= width {
+		line = line[:width-1]
+	}
+
+	padding := ""
+	if len(line) < b.lastLen {
+		padding = strings.Repeat(" ", b.lastLen-len(line))
+	}
+	fmt.Fprint(os.Stderr, "\r"+line+padding)
+	b.lastLen = len(line)
+}
+
+func (b *progressBar) clear() {
+	if b.lastLen > 0 {
+		fmt.Fprint(os.Stderr, "\r"+strings.Repeat(" ", b.lastLen)+"\r")
+		b.lastLen = 0
+	}
+}
@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"truenas/truenas_incus_ctl/core"
 
@@ -25,6 +27,15 @@ func (s *UnitTestSession) IsLoggedIn() bool { return true }
 func (s *UnitTestSession) GetHostName() string { return "" }
 func (s *UnitTestSession) GetUrl() string { return "" }
 func (s *UnitTestSession) WaitForJob(jobId int64) (json.RawMessage, error) { return nil, nil }
+func (s *UnitTestSession) WaitForJobWithProgress(jobId int64, onProgress func(core.JobProgress)) (json.RawMessage, error) {
+	return s.WaitForJob(jobId)
+}
+func (s *UnitTestSession) WaitForJobCtx(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	return s.WaitForJob(jobId)
+}
+func (s *UnitTestSession) WaitForJobWithProgressCtx(ctx context.Context, jobId int64, onProgress func(core.JobProgress)) (json.RawMessage, error) {
+	return s.WaitForJob(jobId)
+}
 func (s *UnitTestSession) SkipWaitingJobOnClose(jobId int64) {}
 func (s *UnitTestSession) Close(internalError error) error { return nil }
 
@@ -49,11 +60,57 @@ func (s *UnitTestSession) CallAsyncRaw(method string, params interface{}) (int64
 	return -1, err
 }
 
+func (s *UnitTestSession) CallRawCtx(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	return s.CallRaw(method, 10, params)
+}
+
+func (s *UnitTestSession) CallAsyncRawCtx(ctx context.Context, method string, params interface{}) (int64, error) {
+	return s.CallAsyncRaw(method, params)
+}
+
+// ReplayTestSession serves a cassette recorded with --record, see DoReplayTest.
+type ReplayTestSession struct {
+	*core.ReplaySession
+	test *testing.T
+	tableExpected string
+}
+
 func PrintTable(api core.Session, str string) {
 	if unit, isUnitTest := api.(*UnitTestSession); isUnitTest {
 		if unit.tableExpected != str {
 			unit.test.Error(errors.New("table:\n" + str + "did not match expected:\n" + unit.tableExpected))
 		}
+	} else if replay, isReplayTest := api.(*ReplayTestSession); isReplayTest {
+		if replay.tableExpected != str {
+			replay.test.Error(errors.New("table:\n" + str + "did not match expected:\n" + replay.tableExpected))
+		}
+	} else if host, isHostSession := api.(*hostSession); isHostSession {
+		host.output.WriteString(str)
+	} else {
+		os.Stdout.WriteString(str)
+	}
+}
+
+// PrintTableData prints the rows of a list command in the given format.
+// When the command runs on several hosts at once, the rows are kept to be merged with those of the other hosts instead.
+func PrintTableData(api core.Session, format string, jsonName string, columnsList []string, rows []map[string]interface{}) error {
+	str, err := core.BuildTableData(format, jsonName, columnsList, rows)
+	if host, isHostSession := api.(*hostSession); isHostSession {
+		if err == nil {
+			host.table = &hostTable{format: format, jsonName: jsonName, columnsList: columnsList, rows: rows}
+		}
+		return err
+	}
+	PrintTable(api, str)
+	return err
+}
+
+// PrintLine prints a line of a command's output that is not part of its table.
+// When the command runs on several hosts at once, the line is kept with the rest of its host's output.
+func PrintLine(api core.Session, a ...interface{}) {
+	str := fmt.Sprintln(a...)
+	if host, isHostSession := api.(*hostSession); isHostSession {
+		host.output.WriteString(str)
 	} else {
 		os.Stdout.WriteString(str)
 	}
@@ -135,6 +192,40 @@ func DoTest(
 	return nil
 }
 
+// SetupReplayTest loads testdata/<cassetteName>, a cassette recorded with --record and trimmed down to what the test needs.
+func SetupReplayTest(t *testing.T, cassetteName string, tableExpected string) *ReplayTestSession {
+	replay, err := core.LoadCassette(filepath.Join("testdata", cassetteName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ReplayTestSession{ReplaySession: replay, test: t, tableExpected: tableExpected}
+}
+
+// DoReplayTest runs a command against a cassette instead of lists of expected params and responses.
+// The command must make every recorded call, in order, with the recorded params.
+func DoReplayTest(
+	t *testing.T,
+	cmd *cobra.Command,
+	commandFunc func(*cobra.Command,core.Session,[]string)error,
+	props map[string]interface{},
+	args []string,
+	cassetteName string,
+	tableExpected string,
+) error {
+	for key, value := range props {
+		SetAuxCobraFlag(cmd, key, value)
+	}
+	defer ResetAuxCobraFlags(cmd)
+	api := SetupReplayTest(t, cassetteName, tableExpected)
+	if err := commandFunc(cmd, api, args); err != nil {
+		return err
+	}
+	if remaining := api.Remaining(); remaining > 0 {
+		return fmt.Errorf("%d recorded call(s) in %s were not made", remaining, cassetteName)
+	}
+	return nil
+}
+
 func FailIf(t *testing.T, err error) {
 	if err != nil {
 		t.Error(err)
@@ -39,8 +39,33 @@ import (
 0.7.4 Add :port support to --host
 0.7.5 Add `share iscsi refresh` to refresh the iscsi bus
 0.7.6 Fix macos/windows compilation issues
+0.7.7 Add `daemon status` to inspect the sessions, calls and jobs held by the connection daemon
+0.7.8 Add `daemon stop` and `daemon reload`, which drain in-flight calls and jobs before exiting
+0.7.9 The daemon reconnects after losing its websocket, picking up awaited jobs and retrying pending queries
+0.7.10 The daemon pings its websocket connections and drops or reconnects ones that stop responding, see `daemon --heartbeat`
+0.7.11 Show a progress bar while waiting on jobs, relayed by the daemon through `tnc_daemon.watch_job`. Add `replication start --wait`
+0.7.12 The daemon socket is created with mode 0600 and callers are checked with SO_PEERCRED. Other users and groups can be allowed through the "daemon" section of the config
+0.7.13 Hosts from the config file are referred to by name (TNC-Config-Name), and the daemon reads their API keys itself. Session keys no longer contain credentials
+0.7.14 Structured daemon logging with levels, JSON output, request IDs, call durations and redacted parameters. Add `daemon --log-file`
+0.7.15 The daemon can serve Prometheus metrics, see `daemon --metrics-listen` and "metrics_listen" in the "daemon" section of the config
+0.7.16 The daemon supports systemd socket activation (LISTEN_FDS). Add `daemon install-systemd` to write .service and .socket units
+0.7.17 Add `watch` to stream collection events, which the daemon multiplexes over one core.subscribe per collection
+0.7.18 Add `job list`, `job show`, `job wait` and `job abort`
+0.7.19 Add the global `--async` flag, which prints the IDs of the jobs started by a command instead of waiting for them
+0.7.20 Add context-aware Session methods (CallRawCtx, WaitForJobCtx, ...). Ctrl-C cancels a command's outstanding calls, and the daemon stops waiting on behalf of clients that went away
+0.7.21 The datasets, snapshots, NFS and iSCSI logic can be used from other Go programs through the tnc package
+0.7.22 Typed models for datasets, snapshots, shares, iSCSI objects and services, which the list commands are built on
+0.7.23 An in-process fake TrueNAS server (truenastest) for testing against the websocket API without a real host
+0.7.24 --record writes a command's API traffic to a JSONL cassette, which ReplaySession serves back in tests
+0.7.25 --dry-run prints the calls that would change anything instead of making them, while read-only calls still go through
+0.7.26 Add `api call`, `api job` and `api methods` for calling any TrueNAS API method
+0.7.27 Log in with a username and password, and a one-time password for two-factor authentication, from the config or --username, --password and --otp
+0.7.28 API keys and passwords in the config can be read from a file, a command or an environment variable, or encrypted with a local keyfile. `config show` redacts them
+0.7.29 Per-host "ca_file" and "cert_fingerprint" verify self-signed certificates without --allow-insecure. `config login` offers to pin an untrusted certificate
+0.7.30 Per-host "client_cert" and "client_key" (or --client-cert and --client-key) for hosts that require mutual TLS
+0.7.31 --config with several comma-separated names, or --all-configs, runs a command on each of their hosts at once. Lists are merged with a "host" column
 */
-const VERSION = "0.7.6"
+const VERSION = "0.7.31"
 
 var versionCmd = &cobra.Command{
 	Use:   "version",
@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch <collection>...",
+	Short: "Stream ADDED, CHANGED and REMOVED events from TrueNAS collections as JSON lines",
+	Long: "Stream ADDED, CHANGED and REMOVED events from TrueNAS collections as JSON lines, eg.\n" +
+		"  truenas_incus_ctl watch zfs.snapshot.query pool.dataset.query\n" +
+		"Each collection is subscribed to once by the connection daemon, however many watchers there are.\n" +
+		"A RECONNECTED event means that events may have been missed while the connection was down.",
+	Args: cobra.MinimumNArgs(1),
+}
+
+var g_watchEnums map[string][]string
+
+const WATCH_RESUBSCRIBE_ATTEMPTS = 5
+
+func init() {
+	watchCmd.RunE = WrapCommandFunc(watchCollections)
+
+	watchCmd.Flags().String("events", "", "Comma-separated list of the events to show: added, changed, removed. Defaults to all of them")
+	watchCmd.Flags().Int("count", 0, "Exit after this many events have been shown")
+
+	rootCmd.AddCommand(watchCmd)
+}
+
+type collectionWatcher struct {
+	collection string
+	watcherId  int64
+}
+
+func watchCollections(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_watchEnums)
+	if err != nil {
+		return err
+	}
+
+	var eventTypes []string
+	if eventsStr := options.allFlags["events"]; eventsStr != "" {
+		for _, eventType := range strings.Split(eventsStr, ",") {
+			eventType = strings.ToUpper(strings.TrimSpace(eventType))
+			if !slices.Contains([]string{"ADDED", "CHANGED", "REMOVED"}, eventType) {
+				return fmt.Errorf("Unrecognised event \"%s\", expected added, changed or removed", eventType)
+			}
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+
+	var maxEvents int
+	if countStr := options.allFlags["count"]; countStr != "" {
+		if _, err = fmt.Sscan(countStr, &maxEvents); err != nil {
+			return fmt.Errorf("Failed to parse --count: %v", err)
+		}
+	}
+
+	cmd.SilenceUsage = true
+
+	if err = core.MaybeLogin(api); err != nil {
+		return err
+	}
+
+	watchers := make([]*collectionWatcher, 0, len(args))
+	defer func() {
+		// the command's context is cancelled by the signal that stops the watch, but the watchers still need removing
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, w := range watchers {
+			_, _ = api.CallRawCtx(ctx, "tnc_daemon.unsubscribe", []interface{}{w.watcherId})
+		}
+	}()
+	for _, collection := range args {
+		watcherId, err := subscribeToCollection(api, collection)
+		if err != nil {
+			return err
+		}
+		watchers = append(watchers, &collectionWatcher{collection: collection, watcherId: watcherId})
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+
+	stopCh := make(chan struct{})
+	errCh := make(chan error, len(watchers))
+	doneCh := make(chan struct{})
+	outputMtx := &sync.Mutex{}
+	nShown := 0
+
+	printEvent := func(event json.RawMessage) {
+		outputMtx.Lock()
+		defer outputMtx.Unlock()
+		if maxEvents > 0 && nShown >= maxEvents {
+			return
+		}
+		fmt.Println(string(event))
+		nShown++
+		if maxEvents > 0 && nShown == maxEvents {
+			close(doneCh)
+		}
+	}
+
+	for _, w := range watchers {
+		go func(w *collectionWatcher) {
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				events, dropped, err := pollCollectionWatcher(api, w)
+				if err != nil {
+					if err = resubscribeToCollection(api, w, stopCh); err != nil {
+						errCh <- err
+						return
+					}
+					select {
+					case <-stopCh:
+						return
+					default:
+					}
+					printEvent(makeWatchNotice(w.collection, "RECONNECTED", nil))
+					continue
+				}
+				if dropped > 0 {
+					printEvent(makeWatchNotice(w.collection, "DROPPED", map[string]interface{}{"count": dropped}))
+				}
+				for _, event := range events {
+					if len(eventTypes) > 0 {
+						var eventObj map[string]interface{}
+						_ = json.Unmarshal(event, &eventObj)
+						if eventType, _ := eventObj["event"].(string); slices.Contains([]string{"ADDED", "CHANGED", "REMOVED"}, eventType) && !slices.Contains(eventTypes, eventType) {
+							continue
+						}
+					}
+					printEvent(event)
+				}
+			}
+		}(w)
+	}
+
+	select {
+	case <-signalCh:
+		err = nil
+	case <-doneCh:
+		err = nil
+	case err = <-errCh:
+		break
+	}
+	close(stopCh)
+	return err
+}
+
+func subscribeToCollection(api core.Session, collection string) (int64, error) {
+	out, err := api.CallRaw("tnc_daemon.subscribe", 0, []interface{}{collection})
+	if err != nil {
+		if strings.Contains(err.Error(), "Unrecognised daemon command") {
+			return -1, fmt.Errorf("The connection daemon is too old to watch collections, see `daemon reload`")
+		}
+		return -1, err
+	}
+	var response map[string]interface{}
+	if err = json.Unmarshal(out, &response); err != nil {
+		return -1, fmt.Errorf("Failed to parse subscription to %s: %v", collection, err)
+	}
+	return core.GetIntegerFromJsonObjectOr(response, "watcher_id", -1), nil
+}
+
+func pollCollectionWatcher(api core.Session, w *collectionWatcher) ([]json.RawMessage, int, error) {
+	out, err := api.CallRaw("tnc_daemon.poll_events", 0, []interface{}{w.watcherId})
+	if err != nil {
+		return nil, 0, err
+	}
+	var response struct {
+		Events  []json.RawMessage `json:"events"`
+		Dropped int               `json:"dropped"`
+	}
+	if err = json.Unmarshal(out, &response); err != nil {
+		return nil, 0, err
+	}
+	return response.Events, response.Dropped, nil
+}
+
+// resubscribeToCollection replaces a watcher that the daemon no longer has, eg. because the daemon was reloaded
+// or its connection to TrueNAS was lost for good.
+func resubscribeToCollection(api core.Session, w *collectionWatcher, stopCh chan struct{}) error {
+	delay := time.Second
+	var err error
+	for attempt := 0; attempt < WATCH_RESUBSCRIBE_ATTEMPTS; attempt++ {
+		select {
+		case <-stopCh:
+			return nil
+		case <-time.After(delay):
+		}
+		var watcherId int64
+		if watcherId, err = subscribeToCollection(api, w.collection); err == nil {
+			w.watcherId = watcherId
+			return nil
+		}
+		DebugString("resubscribing to " + w.collection + ": " + err.Error())
+		delay *= 2
+	}
+	return fmt.Errorf("Lost the subscription to %s: %v", w.collection, err)
+}
+
+func makeWatchNotice(collection string, eventType string, extra map[string]interface{}) json.RawMessage {
+	notice := map[string]interface{}{
+		"collection": collection,
+		"event":      eventType,
+		"time":       time.Now().Format(time.RFC3339Nano),
+	}
+	for k, v := range extra {
+		notice[k] = v
+	}
+	data, _ := json.Marshal(notice)
+	return data
+}
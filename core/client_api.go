@@ -20,9 +20,24 @@ import (
 type ClientSession struct {
 	HostName string
 	ApiKey string
+	// Username and Password are sent when there is no API key, along with OtpToken if the user has two-factor authentication
+	Username string
+	Password string
+	OtpToken string
+	// When ConfigName is set, the daemon looks up the API key in ConfigFile itself, so that it is never sent over the socket
+	ConfigName string
+	ConfigFile string
 	SocketPath string
 	IsDebug bool
 	AllowInsecure bool
+	// CaFile and CertFingerprint verify a host whose certificate isn't trusted by the system, see truenas_api.TLSOptions
+	CaFile string
+	CertFingerprint string
+	// ClientCert and ClientKey are presented to hosts that require a client certificate
+	ClientCert string
+	ClientKey string
+	// Context bounds the calls that are not given a context of their own, eg. so that SIGINT cancels them
+	Context context.Context
 	client *http.Client
 	timeout time.Duration
 	jobsList []int64
@@ -54,8 +69,8 @@ func (s *ClientSession) Login() error {
 	if s.HostName == "" {
 		errBuilder.WriteString("Hostname was not provided\n")
 	}
-	if s.ApiKey == "" {
-		errBuilder.WriteString("API key was not provided\n")
+	if s.ApiKey == "" && s.ConfigName == "" && (s.Username == "" || s.Password == "") {
+		errBuilder.WriteString("API key was not provided, nor username and password\n")
 	}
 	if s.SocketPath == "" {
 		errBuilder.WriteString("Socket path was not provided\n")
@@ -68,7 +83,7 @@ func (s *ClientSession) Login() error {
 
 	st, err := os.Stat(s.SocketPath)
 	if err != nil {
-		if err = launchDaemonAndAwaitSocket(s.SocketPath, s.timeout, nil); err != nil {
+		if err = launchDaemonAndAwaitSocket(s.SocketPath, s.ConfigFile, s.timeout, nil); err != nil {
 			return fmt.Errorf("launchDaemonAndAwaitSocket: %v", err)
 		}
 		st, err = os.Stat(s.SocketPath)
@@ -80,18 +95,16 @@ func (s *ClientSession) Login() error {
 	if (st.Mode() & fs.ModeSocket) == 0 {
 		return fmt.Errorf("%s was not a socket", s.SocketPath)
 	}
+	// the daemon only looks up the hosts in its config for the user that runs it, so anyone else sends their own credentials
+	if s.ConfigName != "" && !isOwnedByCurrentUser(st) {
+		s.ConfigName = ""
+	}
 
 	if s.client == nil {
-		s.client = &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
-					return net.Dial("unix", s.SocketPath)
-				},
-			},
-		}
+		s.client = makeDaemonHttpClient(s.SocketPath)
 	}
 
-	request, _ := http.NewRequest("GET", "http://unix/tnc-daemon", nil)
+	request, _ := http.NewRequestWithContext(getContextOrBackground(s.Context), "GET", "http://unix/tnc-daemon", nil)
 	request.Header.Set("TNC-Call-Method", "tnc_daemon.ping")
 	data, err, _ := requestAndMaybeRetry(s, request)
 	if err != nil {
@@ -108,6 +121,27 @@ func (s *ClientSession) Login() error {
 }
 
 func (s *ClientSession) CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	var timeoutStr string
+	if timeoutSeconds > 0 {
+		timeoutStr = fmt.Sprintf("%ds", timeoutSeconds)
+	}
+	return s.callWithTimeout(getContextOrBackground(s.Context), method, timeoutStr, params)
+}
+
+// CallRawCtx passes the time left until ctx's deadline on to the daemon, which then times out the call itself.
+func (s *ClientSession) CallRawCtx(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	var timeoutStr string
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		timeoutStr = remaining.String()
+	}
+	return s.callWithTimeout(ctx, method, timeoutStr, params)
+}
+
+func (s *ClientSession) callWithTimeout(ctx context.Context, method string, timeoutStr string, params interface{}) (json.RawMessage, error) {
 	var t1 time.Time
 	if s.IsDebug {
 		t1 = time.Now()
@@ -118,13 +152,37 @@ func (s *ClientSession) CallRaw(method string, timeoutSeconds int64, params inte
 		return nil, err
 	}
 
-	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", bytes.NewReader(paramsData))
-	request.Header.Set("TNC-Host-Url", s.GetUrl())
-	request.Header.Set("TNC-Api-Key", s.ApiKey)
+	request, _ := http.NewRequestWithContext(ctx, "POST", "http://unix/tnc-daemon", bytes.NewReader(paramsData))
+	if s.ConfigName != "" {
+		request.Header.Set("TNC-Config-Name", s.ConfigName)
+		request.Header.Set("TNC-Config-File", s.ConfigFile)
+	} else {
+		request.Header.Set("TNC-Host-Url", s.GetUrl())
+		if s.ApiKey != "" {
+			request.Header.Set("TNC-Api-Key", s.ApiKey)
+		} else {
+			request.Header.Set("TNC-Username", s.Username)
+			request.Header.Set("TNC-Password", s.Password)
+		}
+	}
+	if s.OtpToken != "" {
+		request.Header.Set("TNC-Otp-Token", s.OtpToken)
+	}
 	request.Header.Set("TNC-Allow-Insecure", fmt.Sprint(s.AllowInsecure))
+	if s.CaFile != "" {
+		request.Header.Set("TNC-Ca-File", s.CaFile)
+	}
+	if s.CertFingerprint != "" {
+		request.Header.Set("TNC-Cert-Fingerprint", s.CertFingerprint)
+	}
+	if s.ClientCert != "" {
+		request.Header.Set("TNC-Client-Cert", s.ClientCert)
+		request.Header.Set("TNC-Client-Key", s.ClientKey)
+	}
 	request.Header.Set("TNC-Call-Method", method)
-	if timeoutSeconds > 0 {
-		request.Header.Set("TNC-Timeout", fmt.Sprintf("%ds", timeoutSeconds))
+	request.Header.Set("TNC-Request-Id", NewRequestId())
+	if timeoutStr != "" {
+		request.Header.Set("TNC-Timeout", timeoutStr)
 	}
 
 	data, err, completed := requestAndMaybeRetry(s, request)
@@ -132,13 +190,17 @@ func (s *ClientSession) CallRaw(method string, timeoutSeconds int64, params inte
 		return data, err
 	}
 	if s.IsDebug {
-		fmt.Println(method + ":", time.Now().Sub(t1).String())
+		fmt.Println(method + " [" + request.Header.Get("TNC-Request-Id") + "]:", time.Now().Sub(t1).String())
 	}
 	return data, err
 }
 
 func (s *ClientSession) CallAsyncRaw(method string, params interface{}) (int64, error) {
-	data, err := s.CallRaw(method, 0, params)
+	return s.CallAsyncRawCtx(getContextOrBackground(s.Context), method, params)
+}
+
+func (s *ClientSession) CallAsyncRawCtx(ctx context.Context, method string, params interface{}) (int64, error) {
+	data, err := s.CallRawCtx(ctx, method, params)
 	if err != nil {
 		return -1, err
 	}
@@ -148,10 +210,61 @@ func (s *ClientSession) CallAsyncRaw(method string, params interface{}) (int64,
 }
 
 func (s *ClientSession) WaitForJob(jobId int64) (json.RawMessage, error) {
-	return s.CallRaw("tnc_daemon.await_job", 0, []interface{} {jobId})
+	return s.WaitForJobCtx(getContextOrBackground(s.Context), jobId)
+}
+
+// WaitForJobCtx stops waiting once ctx is done, and so does the daemon, since the request is cancelled along with it.
+func (s *ClientSession) WaitForJobCtx(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	return s.CallRawCtx(ctx, "tnc_daemon.await_job", []interface{} {jobId})
+}
+
+func (s *ClientSession) WaitForJobWithProgress(jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	return s.WaitForJobWithProgressCtx(getContextOrBackground(s.Context), jobId, onProgress)
+}
+
+// WaitForJobWithProgressCtx repeatedly asks the daemon to watch the job, reporting each change in progress until it completes.
+func (s *ClientSession) WaitForJobWithProgressCtx(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	version := int64(0)
+	for {
+		data, err := s.CallRawCtx(ctx, "tnc_daemon.watch_job", []interface{}{jobId, version})
+		if err != nil {
+			if strings.Contains(err.Error(), "Unrecognised daemon command") {
+				// the daemon predates watch_job
+				return s.WaitForJobCtx(ctx, jobId)
+			}
+			return data, err
+		}
+
+		var status struct {
+			Done        bool            `json:"done"`
+			Job         json.RawMessage `json:"job"`
+			Version     int64           `json:"version"`
+			State       string          `json:"state"`
+			Percent     float64         `json:"percent"`
+			Description string          `json:"description"`
+		}
+		if err = json.Unmarshal(data, &status); err != nil {
+			return nil, err
+		}
+		if status.Done {
+			return status.Job, nil
+		}
+		if status.Version != version && onProgress != nil {
+			onProgress(JobProgress{
+				JobId:       jobId,
+				State:       status.State,
+				Percent:     status.Percent,
+				Description: status.Description,
+			})
+		}
+		version = status.Version
+	}
 }
 
 func (s *ClientSession) SkipWaitingJobOnClose(jobId int64) {
+	if s.mapSkipWaitOnClose == nil {
+		s.mapSkipWaitOnClose = make(map[int64]bool)
+	}
 	s.mapSkipWaitOnClose[jobId] = true
 }
 
@@ -165,6 +278,7 @@ func (s *ClientSession) Close(internalError error) error {
 		errorList = append(errorList, internalError)
 	}
 
+	pendingJobs := make([]int64, 0)
 	for _, jobId := range s.jobsList {
 		if jobId < 0 {
 			continue
@@ -172,8 +286,16 @@ func (s *ClientSession) Close(internalError error) error {
 		if shouldSkip, _ := s.mapSkipWaitOnClose[jobId]; shouldSkip {
 			continue
 		}
-		data, err := s.CallRaw("tnc_daemon.await_job", 0, []interface{} {jobId})
+		pendingJobs = append(pendingJobs, jobId)
+	}
+
+	for i, jobId := range pendingJobs {
+		data, err := s.WaitForJob(jobId)
 		if err != nil {
+			if ctxErr := getContextOrBackground(s.Context).Err(); ctxErr != nil {
+				errorList = append(errorList, makeInterruptedJobsError(pendingJobs[i:], ctxErr))
+				break
+			}
 			errorList = append(errorList, err)
 		} else if data != nil {
 			_, errs := GetResultsAndErrorsFromApiResponseRaw(data)
@@ -187,6 +309,55 @@ func (s *ClientSession) Close(internalError error) error {
 	return MakeErrorFromList(errorList)
 }
 
+// CallDaemon invokes a tnc_daemon.* procedure on an already running daemon.
+// Unlike CallRaw, this requires neither a hostname nor an API key, and it will not launch a new daemon.
+func (s *ClientSession) CallDaemon(proc string, params interface{}) (json.RawMessage, error) {
+	if s.SocketPath == "" {
+		return nil, fmt.Errorf("Socket path was not provided")
+	}
+	st, err := os.Stat(s.SocketPath)
+	if err != nil {
+		return nil, fmt.Errorf("The daemon does not appear to be running (%v)", err)
+	}
+	if (st.Mode() & fs.ModeSocket) == 0 {
+		return nil, fmt.Errorf("%s was not a socket", s.SocketPath)
+	}
+
+	paramsData, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", bytes.NewReader(paramsData))
+	request.Header.Set("TNC-Call-Method", TNC_PREFIX_STRING+proc)
+	request.Header.Set("TNC-Request-Id", NewRequestId())
+
+	response, err := makeDaemonHttpClient(s.SocketPath).Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to contact the daemon at %s: %v", s.SocketPath, err)
+	}
+	data, err := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 400 {
+		return nil, errors.New("Error: " + string(data))
+	}
+	return data, nil
+}
+
+func makeDaemonHttpClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+}
+
 func requestAndMaybeRetry(s *ClientSession, request *http.Request) (json.RawMessage, error, bool) {
 	retriesLeft := 10
 call:
@@ -203,10 +374,16 @@ call:
 					return nil, err, false
 				}
 			} else {
-				time.Sleep(time.Duration(500) * time.Millisecond)
+				select {
+				case <-request.Context().Done():
+					return nil, request.Context().Err(), false
+				case <-time.After(time.Duration(500) * time.Millisecond):
+				}
 			}
 			retriesLeft--
 			if retriesLeft > 0 {
+				// lets the daemon count how often clients have to retry in its metrics
+				request.Header.Set("TNC-Retry-Count", fmt.Sprint(10 - retriesLeft))
 				goto call
 			}
 		}
@@ -225,11 +402,14 @@ call:
 	return data, err, true
 }
 
-func launchDaemon(thisExec string, socketPath string, daemonTimeout time.Duration) error {
+func launchDaemon(thisExec string, socketPath string, configFile string, daemonTimeout time.Duration) error {
 	cmd := []string { "daemon" }
 	if daemonTimeout >= time.Second {
 		cmd = append(cmd, "-t", daemonTimeout.String())
 	}
+	if configFile != "" {
+		cmd = append(cmd, "--config-file", configFile)
+	}
 	cmd = append(cmd, socketPath)
 
 	if err := exec.Command(thisExec, cmd...).Start(); err != nil {
@@ -238,7 +418,7 @@ func launchDaemon(thisExec string, socketPath string, daemonTimeout time.Duratio
 	return nil
 }
 
-func launchDaemonAndAwaitSocket(socketPath string, daemonTimeout time.Duration, optWarningBuilder *strings.Builder) error {
+func launchDaemonAndAwaitSocket(socketPath string, configFile string, daemonTimeout time.Duration, optWarningBuilder *strings.Builder) error {
 	thisExec, err := os.Executable()
 	if err != nil {
 		return err
@@ -261,7 +441,7 @@ func launchDaemonAndAwaitSocket(socketPath string, daemonTimeout time.Duration,
 		})
 	}()
 
-	if err = launchDaemon(thisExec, socketPath, daemonTimeout); err != nil {
+	if err = launchDaemon(thisExec, socketPath, configFile, daemonTimeout); err != nil {
 		return err
 	}
 
@@ -1,21 +1,28 @@
 package core
 
 import (
-	"crypto/tls"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"truenas/truenas_incus_ctl/truenas_api"
 
 	"github.com/gorilla/websocket"
 )
@@ -23,25 +30,139 @@ import (
 const TNC_PREFIX_STRING = "tnc_daemon."
 const JOB_WAIT_STRING = "core.job_wait"
 const DEFAULT_CALL_TIMEOUT = "30s" // also see: cmd.defaultCallTimeout
+const DEFAULT_DRAIN_TIMEOUT = time.Duration(30) * time.Second
+
+// A TrueNAS middleware restart usually takes a minute or two, so keep trying for a little longer than that.
+const RECONNECT_INITIAL_DELAY = time.Duration(500) * time.Millisecond
+const RECONNECT_MAX_DELAY = time.Duration(30) * time.Second
+const RECONNECT_TIMEOUT = time.Duration(3) * time.Minute
+
+// Each session pings its websocket this often, and considers it dead when nothing has been heard from
+// the server in HEARTBEAT_MISSED_LIMIT intervals.
+const DEFAULT_HEARTBEAT_INTERVAL = time.Duration(30) * time.Second
+const HEARTBEAT_MISSED_LIMIT = 2
+
+// tnc_daemon.watch_job answers after this long even if nothing has changed, so that clients notice a dead daemon.
+const WATCH_JOB_INTERVAL = time.Duration(10) * time.Second
+
+var errSessionLost = errors.New("connection to TrueNAS was lost")
 
 type TruenasSession struct {
 	url             string
+	login           LoginInfo
 	conn            *websocket.Conn
 	ctx             *DaemonContext
 	sessionKey      string
 	channel         int
+	createdAt       time.Time
 	connMtx         *sync.Mutex
+	writeMtx        *sync.Mutex
+	lastUsed_       time.Time
 	callInProgress_ bool
+	isReconnecting_ bool
+	isClosed_       bool
+	reconnects_     int
 	curCallId_      int64
 	callMap_        map[int64]*Future[json.RawMessage]
+	callInfoMap_    map[int64]*pendingCall
 	jobMap_         map[int64]*Future[json.RawMessage]
+	jobProgress_    map[int64]*jobProgressEntry
+	eventSubs_      map[string]*eventSubscription
+}
+
+// jobProgressEntry holds the latest progress of a job that is being watched.
+// changedCh is closed and replaced whenever the progress changes or the job completes.
+type jobProgressEntry struct {
+	progress  JobProgress
+	version   int64
+	startedAt time.Time
+	changedCh chan struct{}
+}
+
+type pendingCall struct {
+	call    CallInfo
+	wasSent bool
+	// set once the call has been failed because it was lost in flight, so that it is neither resent nor retried
+	isAbandoned bool
 }
 
 type DaemonContext struct {
-	timeoutValue time.Duration
-	timeoutTimer *time.Timer
-	mapMtx       *sync.Mutex
-	sessionMap_  map[string][]*Future[*TruenasSession]
+	timeoutValue      time.Duration
+	heartbeat         time.Duration
+	log               *slog.Logger
+	ownerUid          int
+	allowUids         []int
+	allowGids         []int
+	configFile        string
+	lookupHost        func(configName string) (HostConfig, error)
+	lookupGroups      func(pid int) ([]int, error)
+	metrics           *daemonMetrics
+	isSocketActivated bool
+	timeoutTimer      *time.Timer
+	startTime         time.Time
+	shutdownCh        chan ShutdownRequest
+	mapMtx            *sync.Mutex
+	watcherMtx        *sync.Mutex
+	subscribeMtx      *sync.Mutex
+	isDraining_       bool
+	lastActivity_     time.Time
+	sessionMap_       map[string][]*Future[*TruenasSession]
+	// guarded by watcherMtx
+	curWatcherId_       int64
+	isExpiringWatchers_ bool
+	watcherMap_         map[int64]*eventWatcher
+	eventSubs_          map[string]*eventSubscription
+}
+
+// DaemonConfig holds the settings that the daemon is launched with.
+// AllowUids and AllowGids name other users and groups that may use the daemon besides its owner.
+type DaemonConfig struct {
+	TimeoutStr   string
+	HeartbeatStr string
+	AllowUids    []int
+	AllowGids    []int
+	ConfigFile   string
+	LookupHost   func(configName string) (HostConfig, error)
+	LogLevel     string
+	LogFormat    string
+	LogFile      string
+	// MetricsListen is a TCP address or "unix:<path>" to serve Prometheus metrics on, or empty for no metrics.
+	MetricsListen string
+}
+
+// HostConfig holds the credentials for a host that the daemon looked up in its config file.
+type HostConfig struct {
+	Url    string
+	ApiKey string
+	// Username and Password are used when there is no API key
+	Username      string
+	Password      string
+	AllowInsecure bool
+	// CaFile and CertFingerprint verify a host whose certificate isn't trusted by the system
+	CaFile          string
+	CertFingerprint string
+	// ClientCert and ClientKey are presented to a host that requires a client certificate
+	ClientCert string
+	ClientKey  string
+}
+
+// PeerCredentials identifies the process that connected to the daemon's socket.
+type PeerCredentials struct {
+	Uid int
+	Gid int
+	Pid int
+}
+
+type peerCredentialsKey struct{}
+
+type peerCredentialsResult struct {
+	cred PeerCredentials
+	err  error
+}
+
+type ShutdownRequest struct {
+	DrainTimeout time.Duration
+	ShouldReload bool
 }
 
 type CallInfo struct {
@@ -49,15 +170,26 @@ type CallInfo struct {
 	params []interface{}
 }
 
+// LoginInfo holds how a session logs in: with call, or with username and password (and otpToken) if username is set.
 type LoginInfo struct {
 	call          CallInfo
+	username      string
+	password      string
+	otpToken      string
 	serverUrl     string
 	allowInsecure bool
+	// caFile, certFingerprint, clientCert and clientKey are as in truenas_api.TLSOptions
+	caFile          string
+	certFingerprint string
+	clientCert      string
+	clientKey       string
 }
 
-func RunDaemon(serverSockAddr string, globalTimeoutStr string) {
+func RunDaemon(serverSockAddr string, config DaemonConfig) {
 	var err error
 	var daemonTimeout time.Duration
+	globalTimeoutStr := config.TimeoutStr
+	heartbeatStr := config.HeartbeatStr
 	if globalTimeoutStr != "" {
 		daemonTimeout, err = time.ParseDuration(globalTimeoutStr)
 		if err != nil {
@@ -65,82 +197,376 @@ func RunDaemon(serverSockAddr string, globalTimeoutStr string) {
 		}
 	}
 
-	fmt.Println("Serving on", serverSockAddr)
-	if daemonTimeout != 0 {
-		fmt.Println("With a daemon timeout of", daemonTimeout.String())
+	heartbeat := DEFAULT_HEARTBEAT_INTERVAL
+	if heartbeatStr != "" {
+		heartbeat, err = time.ParseDuration(heartbeatStr)
+		if err != nil {
+			log.Fatal("Error: could not parse duration \"" + heartbeatStr + "\":" + err.Error())
+		}
 	}
 
-	ls, err := net.Listen("unix", serverSockAddr)
+	logger, logCloser, err := makeDaemonLogger(config.LogLevel, config.LogFormat, config.LogFile)
+	if err != nil {
+		log.Fatal("Error: " + err.Error())
+	}
+	if logCloser != nil {
+		defer logCloser.Close()
+	}
+
+	logger.Info("tncdaemon serving", "socket", serverSockAddr, "pid", os.Getpid(), "timeout", daemonTimeout.String(), "heartbeat", heartbeat.String())
+
+	ls, err := socketActivationListener()
 	if err != nil {
-		fmt.Println("Listen error:", err)
+		logger.Error("socket activation error", "error", err)
 		return
 	}
+	isSocketActivated := ls != nil
+	if isSocketActivated {
+		// systemd owns the socket and its permissions, and keeps it after the daemon exits
+		logger.Info("using the socket passed by systemd")
+	} else {
+		isShared := len(config.AllowUids) > 0 || len(config.AllowGids) > 0
+		if isShared && !isPeerCredSupported {
+			logger.Warn("the daemon allow-list cannot be enforced on this platform, so the socket will only be accessible to its owner")
+			isShared = false
+		}
+
+		ls, err = listenDaemonSocket(serverSockAddr, isShared)
+		if err != nil {
+			logger.Error("listen error", "error", err)
+			return
+		}
+	}
 
 	var timer *time.Timer
+	var timeoutCh <-chan time.Time
 	if daemonTimeout != 0 {
 		timer = time.NewTimer(daemonTimeout)
+		timeoutCh = timer.C
 	}
 
 	daemon := &DaemonContext{
-		timeoutValue: daemonTimeout,
-		timeoutTimer: timer,
-		mapMtx:       &sync.Mutex{},
-		sessionMap_:  make(map[string][]*Future[*TruenasSession]),
+		timeoutValue:      daemonTimeout,
+		heartbeat:         heartbeat,
+		log:               logger,
+		ownerUid:          os.Getuid(),
+		allowUids:         config.AllowUids,
+		allowGids:         config.AllowGids,
+		configFile:        config.ConfigFile,
+		lookupHost:        config.LookupHost,
+		lookupGroups:      getPeerGroups,
+		metrics:           makeDaemonMetrics(),
+		isSocketActivated: isSocketActivated,
+		timeoutTimer:      timer,
+		startTime:         time.Now(),
+		shutdownCh:        make(chan ShutdownRequest, 1),
+		mapMtx:            &sync.Mutex{},
+		watcherMtx:        &sync.Mutex{},
+		subscribeMtx:      &sync.Mutex{},
+		lastActivity_:     time.Now(),
+		sessionMap_:       make(map[string][]*Future[*TruenasSession]),
+		watcherMap_:       make(map[int64]*eventWatcher),
+		eventSubs_:        make(map[string]*eventSubscription),
 	}
 
-	doneCh := make(chan os.Signal)
-	signal.Notify(doneCh, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		if daemon.timeoutTimer != nil {
-			select {
-			case <-daemon.timeoutTimer.C:
-				log.Println("tncdaemon timed out (" + daemonTimeout.String() + " elapsed)")
-				break
-			case <-doneCh:
-				log.Println("tncdaemon exiting")
-				break
+	server := daemon.makeHttpServer()
+
+	var metricsServer *http.Server
+	metricsSockPath := ""
+	if config.MetricsListen != "" {
+		var metricsLs net.Listener
+		metricsLs, metricsSockPath, err = listenMetrics(config.MetricsListen)
+		if err != nil {
+			logger.Error("metrics listen error", "address", config.MetricsListen, "error", err)
+			ls.Close()
+			if !isSocketActivated {
+				os.Remove(serverSockAddr)
 			}
-		} else {
-			<-doneCh
+			return
+		}
+		metricsServer = daemon.makeMetricsServer()
+		logger.Info("serving metrics", "address", config.MetricsListen)
+		go func() {
+			if err := metricsServer.Serve(metricsLs); err != nil && err != http.ErrServerClosed {
+				logger.Error("metrics serve error", "error", err)
+			}
+		}()
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	doneCh := make(chan ShutdownRequest)
+	go func() {
+		var req ShutdownRequest
+		select {
+		case <-timeoutCh:
+			logger.Info("tncdaemon timed out", "timeout", daemonTimeout.String())
+			req = ShutdownRequest{DrainTimeout: DEFAULT_DRAIN_TIMEOUT}
+		case sig := <-signalCh:
+			logger.Info("tncdaemon received signal", "signal", sig.String())
+			req = ShutdownRequest{DrainTimeout: DEFAULT_DRAIN_TIMEOUT, ShouldReload: sig == syscall.SIGHUP}
+		case req = <-daemon.shutdownCh:
+			break
 		}
-		_ = ls.Close()
-		sessions := make([]*Future[*TruenasSession], 0)
-		daemon.mapMtx.Lock()
-		for _, futures := range daemon.sessionMap_ {
-			sessions = append(sessions, futures...)
+		logger.Info("tncdaemon draining calls and jobs", "reload", req.ShouldReload, "drain_timeout", req.DrainTimeout.String())
+		daemon.shutdown(server, req.DrainTimeout)
+		if !isSocketActivated {
+			os.Remove(serverSockAddr)
 		}
-		daemon.mapMtx.Unlock()
-		for _, future := range sessions {
-			if future != nil {
-				_, s, _ := future.Peek()
-				if s != nil {
-					s.conn.Close()
-				}
+		if metricsServer != nil {
+			metricsServer.Close()
+			if metricsSockPath != "" {
+				os.Remove(metricsSockPath)
 			}
 		}
-		os.Remove(serverSockAddr)
-		os.Exit(0)
+		doneCh <- req
 	}()
 
-	http.Serve(ls, daemon)
+	if err = server.Serve(ls); err != nil && err != http.ErrServerClosed {
+		logger.Error("tncdaemon serve error", "error", err)
+		daemon.RequestShutdown(ShutdownRequest{DrainTimeout: DEFAULT_DRAIN_TIMEOUT})
+	}
+
+	req := <-doneCh
+	if req.ShouldReload {
+		if err = reexecDaemon(); err != nil {
+			logger.Error("tncdaemon failed to reload", "error", err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
+// RequestShutdown asks the daemon to stop accepting new calls, then exit (or re-launch itself) once
+// the outstanding calls and jobs have completed or the drain timeout has elapsed, whichever comes first.
+// Only the first request is honoured.
+func (d *DaemonContext) RequestShutdown(req ShutdownRequest) bool {
+	select {
+	case d.shutdownCh <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *DaemonContext) IsDraining() bool {
+	d.mapMtx.Lock()
+	defer d.mapMtx.Unlock()
+	return d.isDraining_
+}
+
+func (d *DaemonContext) shutdown(server *http.Server, drainTimeout time.Duration) {
+	d.mapMtx.Lock()
+	d.isDraining_ = true
+	d.mapMtx.Unlock()
+
+	// http.Server.Shutdown closes the listener, then waits for every in-flight request to be answered.
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	err := server.Shutdown(ctx)
+	cancel()
+
+	sessions := d.getAllSessions()
+
+	if err != nil {
+		nFailed := 0
+		drainErr := fmt.Errorf("tncdaemon is shutting down: call abandoned after waiting %s", drainTimeout.String())
+		for _, s := range sessions {
+			nFailed += s.failPendingFutures(drainErr)
+		}
+		d.logger().Warn("tncdaemon drain timed out", "failed", nFailed)
+
+		// give the failed requests a moment to report back to their clients
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(2)*time.Second)
+		if server.Shutdown(ctx) != nil {
+			_ = server.Close()
+		}
+		cancel()
+	}
+
+	for _, s := range sessions {
+		s.close()
+	}
+}
+
+func (d *DaemonContext) getAllSessions() []*TruenasSession {
+	sessions := make([]*TruenasSession, 0)
+	d.mapMtx.Lock()
+	defer d.mapMtx.Unlock()
+	for _, futures := range d.sessionMap_ {
+		for _, future := range futures {
+			if future == nil {
+				continue
+			}
+			_, s, _ := future.Peek()
+			if s != nil {
+				sessions = append(sessions, s)
+			}
+		}
+	}
+	return sessions
+}
 
-	doneCh <- syscall.SIGTERM
+func reexecDaemon() error {
+	// os.Executable() would resolve to the old, possibly deleted binary, whereas the point of reloading
+	// is usually to pick up a binary that was replaced in-place.
+	thisExec, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(thisExec, os.Args, os.Environ())
 }
 
 func (d *DaemonContext) UpdateCountdown() {
+	d.mapMtx.Lock()
+	d.lastActivity_ = time.Now()
+	d.mapMtx.Unlock()
 	if d.timeoutTimer != nil {
 		d.timeoutTimer.Reset(d.timeoutValue)
 	}
 }
 
-func (d *DaemonContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	out, err := d.serveImpl(r)
+// listenDaemonSocket creates the daemon's socket, which is only accessible to its owner unless an allow-list is in use.
+// Even then, every request is checked against the peer's credentials.
+func listenDaemonSocket(serverSockAddr string, isShared bool) (net.Listener, error) {
+	ls, err := net.Listen("unix", serverSockAddr)
 	if err != nil {
-		//log.Println(err)
+		return nil, err
+	}
+
+	var mode os.FileMode = 0600
+	if isShared {
+		mode = 0666
+	}
+	if err = os.Chmod(serverSockAddr, mode); err != nil {
+		ls.Close()
+		return nil, fmt.Errorf("Failed to set permissions on %s: %v", serverSockAddr, err)
+	}
+	return ls, nil
+}
+
+func (d *DaemonContext) makeHttpServer() *http.Server {
+	return &http.Server{
+		Handler:  d,
+		ErrorLog: slog.NewLogLogger(d.logger().Handler(), slog.LevelError),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			cred, err := getPeerCredentials(c)
+			return context.WithValue(ctx, peerCredentialsKey{}, peerCredentialsResult{cred, err})
+		},
+	}
+}
+
+// checkPeer refuses requests from anyone other than the daemon's owner and the allow-listed users and groups.
+func (d *DaemonContext) checkPeer(r *http.Request) error {
+	if !isPeerCredSupported {
+		return nil
+	}
+
+	result, ok := r.Context().Value(peerCredentialsKey{}).(peerCredentialsResult)
+	if !ok {
+		return fmt.Errorf("could not identify the caller")
+	}
+	if result.err != nil {
+		return fmt.Errorf("could not identify the caller: %v", result.err)
+	}
+
+	cred := result.cred
+	if cred.Uid == d.ownerUid || slices.Contains(d.allowUids, cred.Uid) || slices.Contains(d.allowGids, cred.Gid) {
+		return nil
+	}
+	// SO_PEERCRED only gives the primary group, while users are usually given access through a supplementary one
+	if len(d.allowGids) > 0 && d.lookupGroups != nil {
+		groups, err := d.lookupGroups(cred.Pid)
+		if err != nil {
+			return fmt.Errorf("could not find the groups of uid %d (pid %d): %v", cred.Uid, cred.Pid, err)
+		}
+		for _, gid := range groups {
+			if slices.Contains(d.allowGids, gid) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("uid %d (gid %d, pid %d) is not allowed to use this daemon", cred.Uid, cred.Gid, cred.Pid)
+}
+
+// isOwner reports whether the request came from the user that runs the daemon.
+// Only the owner may use the hosts in the daemon's config or stop it, as allow-listed users would otherwise act with the owner's credentials.
+func (d *DaemonContext) isOwner(r *http.Request) bool {
+	if !isPeerCredSupported {
+		return true
+	}
+	result, ok := r.Context().Value(peerCredentialsKey{}).(peerCredentialsResult)
+	return ok && result.err == nil && result.cred.Uid == d.ownerUid
+}
+
+func (d *DaemonContext) logger() *slog.Logger {
+	if d.log == nil {
+		return slog.Default()
+	}
+	return d.log
+}
+
+// requestLog is shared between ServeHTTP and serveImpl, so that serveImpl can add details (eg. job IDs) to the request's log entries.
+type requestLog struct {
+	logger *slog.Logger
+}
+
+type requestLogKey struct{}
+
+func getRequestLog(r *http.Request) *requestLog {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		return rl
+	}
+	return &requestLog{logger: slog.Default()}
+}
+
+func (d *DaemonContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	method := r.Header.Get("TNC-Call-Method")
+	requestId := r.Header.Get("TNC-Request-Id")
+	if requestId == "" {
+		requestId = NewRequestId()
+	}
+	w.Header().Set("TNC-Request-Id", requestId)
+
+	rl := &requestLog{logger: d.logger().With("request_id", requestId, "method", method)}
+	if configName := r.Header.Get("TNC-Config-Name"); configName != "" {
+		rl.logger = rl.logger.With("config", configName)
+	} else if host := r.Header.Get("TNC-Host-Url"); host != "" {
+		rl.logger = rl.logger.With("host", host)
+	}
+
+	if err := d.checkPeer(r); err != nil {
+		rl.logger.Warn("refused request", "error", err)
+		w.WriteHeader(403)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if retries, err := strconv.ParseUint(r.Header.Get("TNC-Retry-Count"), 10, 64); err == nil {
+		d.metrics.countClientRetries(retries)
+	}
+
+	out, err := d.serveImpl(r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+
+	duration := time.Since(startTime)
+	if method != "" {
+		d.metrics.observeCall(method, err == nil, duration)
+	}
+
+	durationMs := float64(duration.Microseconds()) / 1000
+	if err != nil && r.Context().Err() != nil {
+		rl.logger.Info("request cancelled by the client", "duration_ms", durationMs, "error", err)
+	} else if err != nil {
+		rl.logger.Warn("request failed", "duration_ms", durationMs, "error", err)
 		w.WriteHeader(500)
 		io.WriteString(w, err.Error())
 	} else {
-		//log.Println(string(out))
+		level := slog.LevelInfo
+		if method == TNC_PREFIX_STRING+"ping" || method == TNC_PREFIX_STRING+"status" || method == TNC_PREFIX_STRING+"poll_events" {
+			level = slog.LevelDebug
+		}
+		rl.logger.Log(r.Context(), level, "request completed", "duration_ms", durationMs, "bytes", len(out))
 		w.WriteHeader(200)
 		w.Write(out)
 	}
@@ -151,6 +577,11 @@ func (d *DaemonContext) serveImpl(r *http.Request) (json.RawMessage, error) {
 	key := r.Header.Get("TNC-Api-Key")
 	user := r.Header.Get("TNC-Username")
 	pass := r.Header.Get("TNC-Password")
+	otp := r.Header.Get("TNC-Otp-Token")
+	caFile := r.Header.Get("TNC-Ca-File")
+	certFingerprint := r.Header.Get("TNC-Cert-Fingerprint")
+	clientCert := r.Header.Get("TNC-Client-Cert")
+	clientKey := r.Header.Get("TNC-Client-Key")
 	method := r.Header.Get("TNC-Call-Method")
 	timeoutStr := r.Header.Get("TNC-Timeout")
 	allowInsecure := false
@@ -158,7 +589,8 @@ func (d *DaemonContext) serveImpl(r *http.Request) (json.RawMessage, error) {
 		allowInsecure = strings.ToLower(str) == "true"
 	}
 
-	log.Println("Received request at", r.URL.String(), "for method", method)
+	rl := getRequestLog(r)
+	rl.logger.Debug("received request")
 
 	if method == "" {
 		return nil, fmt.Errorf("TNC-Call-Method was not provided")
@@ -167,28 +599,85 @@ func (d *DaemonContext) serveImpl(r *http.Request) (json.RawMessage, error) {
 	if method == TNC_PREFIX_STRING+"ping" {
 		return []byte("\"pong\""), nil
 	}
+	if method == TNC_PREFIX_STRING+"status" {
+		// the status lists every host that the daemon is connected to, and the jobs and subscriptions of each
+		if !d.isOwner(r) {
+			return nil, fmt.Errorf("only the user that runs tncdaemon may see its status")
+		}
+		return d.getStatus()
+	}
+	if method == TNC_PREFIX_STRING+"stop" || method == TNC_PREFIX_STRING+"reload" {
+		if !d.isOwner(r) {
+			return nil, fmt.Errorf("only the user that runs tncdaemon may stop or reload it")
+		}
+		return d.handleShutdownProcedure(method[len(TNC_PREFIX_STRING):], r)
+	}
+
+	if d.IsDraining() {
+		return nil, fmt.Errorf("tncdaemon is shutting down and is no longer accepting calls")
+	}
+
+	if configName := r.Header.Get("TNC-Config-Name"); configName != "" {
+		if !d.isOwner(r) {
+			return nil, fmt.Errorf("only the user that runs tncdaemon may use the hosts in its config, other users must send their own credentials")
+		}
+		hostConfig, err := d.lookupConfigName(configName, r.Header.Get("TNC-Config-File"))
+		if err != nil {
+			return nil, err
+		}
+		host = hostConfig.Url
+		key = hostConfig.ApiKey
+		user = hostConfig.Username
+		pass = hostConfig.Password
+		// the flags that the client sent take precedence over the config, as they do when the client connects by itself
+		if caFile == "" {
+			caFile = hostConfig.CaFile
+		}
+		if certFingerprint == "" {
+			certFingerprint = hostConfig.CertFingerprint
+		}
+		if clientCert == "" && clientKey == "" {
+			clientCert = hostConfig.ClientCert
+			clientKey = hostConfig.ClientKey
+		}
+		allowInsecure = allowInsecure || hostConfig.AllowInsecure
+	}
 
+	// the daemon reads these files with its own privileges, which must not be lent to other users
+	if (caFile != "" || clientCert != "" || clientKey != "") && !d.isOwner(r) {
+		return nil, fmt.Errorf("only the user that runs tncdaemon may have it read TNC-Ca-File, TNC-Client-Cert or TNC-Client-Key")
+	}
 	if host == "" {
 		return nil, fmt.Errorf("TNC-Host-Url was not provided")
 	}
 
 	var sessionKey string
-	var methodLogin string
-	var paramsLogin []interface{}
+	login := LoginInfo{
+		serverUrl:       host,
+		allowInsecure:   allowInsecure,
+		caFile:          caFile,
+		certFingerprint: certFingerprint,
+		clientCert:      clientCert,
+		clientKey:       clientKey,
+	}
 
 	if key == "" {
 		if user == "" || pass == "" {
 			return nil, fmt.Errorf("TNC-Api-Key was not provided, nor TNC-Username nor TNC-Password")
 		}
-		sessionKey = host + user + pass
-		methodLogin = "auth.login"
-		paramsLogin = []interface{}{user, pass}
+		// the one-time password is left out of the key, as it changes from one call to the next while the session lasts
+		sessionKey = makeSessionKey(host, "user", user, pass, fmt.Sprint(allowInsecure), caFile, certFingerprint, clientCert, clientKey)
+		login.username = user
+		login.password = pass
+		login.otpToken = otp
 	} else {
-		sessionKey = host + key
-		methodLogin = "auth.login_with_api_key"
-		paramsLogin = []interface{}{key}
+		// sessions are only shared by calls that connect to the host in the same way
+		sessionKey = makeSessionKey(host, "key", key, fmt.Sprint(allowInsecure), caFile, certFingerprint, clientCert, clientKey)
+		login.call = CallInfo{
+			method: "auth.login_with_api_key",
+			params: []interface{}{key},
+		}
 	}
-	sessionKey += fmt.Sprint(allowInsecure)
 
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -200,28 +689,90 @@ func (d *DaemonContext) serveImpl(r *http.Request) (json.RawMessage, error) {
 		return nil, err
 	}
 
+	if strings.HasPrefix(method, TNC_PREFIX_STRING) && strings.HasSuffix(method, "_job") && len(params) > 0 {
+		rl.logger = rl.logger.With("job_id", params[0])
+	}
+	rl.logger.Debug("request params", "params", redactParams(method, params))
+
+	if method == TNC_PREFIX_STRING+"poll_events" || method == TNC_PREFIX_STRING+"unsubscribe" {
+		return d.handleWatcherProcedure(r.Context(), method[len(TNC_PREFIX_STRING):], sessionKey, params)
+	}
+
 	call := CallInfo{
 		method: method,
 		params: params,
 	}
-	login := LoginInfo{
-		call: CallInfo{
-			method: methodLogin,
-			params: paramsLogin,
-		},
-		serverUrl:     host,
-		allowInsecure: allowInsecure,
-	}
-
 retry:
-	out, err, shouldRetry := d.maybeCreateSessionAndCall(sessionKey, timeoutStr, call, login)
-	if shouldRetry {
+	out, err, shouldRetry := d.maybeCreateSessionAndCall(r.Context(), sessionKey, timeoutStr, call, login)
+	if shouldRetry && !d.IsDraining() && r.Context().Err() == nil {
+		d.metrics.countSessionRetry()
 		goto retry
 	}
 	return out, err
 }
 
-func (d *DaemonContext) maybeCreateSessionAndCall(sessionKey string, timeoutStr string, call CallInfo, login LoginInfo) (json.RawMessage, error, bool) {
+// makeSessionKey identifies the sessions that share a host and credentials, without keeping the credentials themselves.
+func makeSessionKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lookupConfigName finds the credentials for a host in the daemon's own config file,
+// so that clients can refer to a host by name rather than sending its API key over the socket.
+func (d *DaemonContext) lookupConfigName(configName string, clientConfigFile string) (HostConfig, error) {
+	if d.lookupHost == nil {
+		return HostConfig{}, fmt.Errorf("tncdaemon was started without access to a config file, so TNC-Config-Name cannot be used")
+	}
+	if clientConfigFile != "" && clientConfigFile != d.configFile {
+		return HostConfig{}, fmt.Errorf("tncdaemon is using the config file \"%s\" rather than \"%s\". "+
+			"Run `daemon stop` so that a new daemon can be started with this config file", d.configFile, clientConfigFile)
+	}
+	hostConfig, err := d.lookupHost(configName)
+	if err != nil {
+		return HostConfig{}, fmt.Errorf("tncdaemon could not look up config \"%s\": %v", configName, err)
+	}
+	return hostConfig, nil
+}
+
+func (d *DaemonContext) handleShutdownProcedure(proc string, r *http.Request) (json.RawMessage, error) {
+	drainTimeout := DEFAULT_DRAIN_TIMEOUT
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var params []interface{}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &params); err != nil {
+			return nil, err
+		}
+	}
+	if len(params) > 0 {
+		timeoutStr, ok := params[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("tnc_daemon.%s expects the first parameter to be a duration string", proc)
+		}
+		if drainTimeout, err = time.ParseDuration(timeoutStr); err != nil {
+			return nil, fmt.Errorf("tnc_daemon.%s: could not parse duration \"%s\": %v", proc, timeoutStr, err)
+		}
+	}
+
+	if !d.RequestShutdown(ShutdownRequest{DrainTimeout: drainTimeout, ShouldReload: proc == "reload"}) {
+		return nil, fmt.Errorf("tncdaemon is already shutting down")
+	}
+
+	response := make(map[string]interface{})
+	response["pid"] = os.Getpid()
+	response["drain_timeout"] = drainTimeout.String()
+	response["socket_activated"] = d.isSocketActivated
+	return json.Marshal(response)
+}
+
+func (d *DaemonContext) maybeCreateSessionAndCall(ctx context.Context, sessionKey string, timeoutStr string, call CallInfo, login LoginInfo) (json.RawMessage, error, bool) {
 	shouldCreate := false
 	channel := -1
 	var future *Future[*TruenasSession]
@@ -282,7 +833,12 @@ func (d *DaemonContext) maybeCreateSessionAndCall(sessionKey string, timeoutStr
 			future.Complete(s)
 		}
 	} else {
-		s, err = future.Get()
+		var isDone bool
+		isDone, s, err = AwaitFutureOrContext(ctx, future)
+		if !isDone {
+			// the session is still being created for the other callers waiting on it
+			return nil, err, false
+		}
 	}
 
 	//log.Println("Done waiting for session")
@@ -299,7 +855,7 @@ func (d *DaemonContext) maybeCreateSessionAndCall(sessionKey string, timeoutStr
 
 	//log.Println("Calling method", method)
 
-	out, err, shouldRetry := s.callJson(call.method, timeoutStr, call.params)
+	out, err, shouldRetry := s.callJson(ctx, call.method, timeoutStr, call.params)
 	if shouldRetry {
 		d.deleteSession(sessionKey, channel)
 	}
@@ -308,19 +864,56 @@ func (d *DaemonContext) maybeCreateSessionAndCall(sessionKey string, timeoutStr
 }
 
 func (d *DaemonContext) createSession(sessionKey string, login LoginInfo, channel int) (*TruenasSession, error) {
+	session := &TruenasSession{
+		url:          login.serverUrl,
+		login:        login,
+		ctx:          d,
+		sessionKey:   sessionKey,
+		channel:      channel,
+		createdAt:    time.Now(),
+		connMtx:      &sync.Mutex{},
+		writeMtx:     &sync.Mutex{},
+		lastUsed_:    time.Now(),
+		curCallId_:   0,
+		callMap_:     make(map[int64]*Future[json.RawMessage]),
+		callInfoMap_: make(map[int64]*pendingCall),
+		jobMap_:      make(map[int64]*Future[json.RawMessage]),
+		jobProgress_: make(map[int64]*jobProgressEntry),
+		eventSubs_:   make(map[string]*eventSubscription),
+	}
+
+	conn, err := session.connect()
+	if err != nil {
+		return nil, err
+	}
+	session.conn = conn
+	session.logger().Info("session created")
+
+	go session.listen()
+	go session.sendHeartbeats(conn)
+
+	return session, nil
+}
+
+func dialTruenas(login LoginInfo) (*websocket.Conn, error) {
 	u, err := url.Parse(login.serverUrl)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid URL: %w", err)
 	}
 
-	log.Println("Daemon: creating connection with allowInsecure=" + fmt.Sprint(login.allowInsecure))
-
-	// Configure WebSocket connection with insecure TLS to accept self-signed certs
+	tlsConfig, err := truenas_api.TLSOptions{
+		AllowInsecure:   login.allowInsecure,
+		CaFile:          login.caFile,
+		CertFingerprint: login.certFingerprint,
+		ClientCert:      login.clientCert,
+		ClientKey:       login.clientKey,
+	}.Config()
+	if err != nil {
+		return nil, err
+	}
 	dialer := &websocket.Dialer{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: login.allowInsecure,
-		},
-		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyFromEnvironment,
 	}
 
 	// Establish the WebSocket connection
@@ -328,73 +921,233 @@ func (d *DaemonContext) createSession(sessionKey string, login LoginInfo, channe
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect: %w", err)
 	}
+	return conn, nil
+}
 
-	session := &TruenasSession{
-		url:        login.serverUrl,
-		conn:       conn,
-		ctx:        d,
-		sessionKey: sessionKey,
-		channel:    channel,
-		connMtx:    &sync.Mutex{},
-		curCallId_: 0,
-		callMap_:   make(map[int64]*Future[json.RawMessage]),
-		jobMap_:    make(map[int64]*Future[json.RawMessage]),
-	}
-
-	go session.listen()
-
-	_, err, _ = session.callJson(login.call.method, DEFAULT_CALL_TIMEOUT, login.call.params)
+// connect dials the server, logs in and subscribes to job updates, then picks up any jobs that were being
+// waited on over a previous connection. The listen thread must not be reading from the returned connection yet.
+func (s *TruenasSession) connect() (*websocket.Conn, error) {
+	s.logger().Debug("connecting", "allow_insecure", s.login.allowInsecure)
+	conn, err := dialTruenas(s.login)
 	if err != nil {
 		return nil, err
 	}
+	conn.SetPongHandler(func(string) error {
+		s.extendReadDeadline(conn)
+		return nil
+	})
+
+	if s.login.username != "" {
+		err = truenas_api.LoginWithPassword(func(method string, params []interface{}) (json.RawMessage, error) {
+			return s.callSyncRaw(conn, method, params)
+		}, s.login.username, s.login.password, s.getOtpToken)
+	} else {
+		err = s.loginWithCall(conn)
+	}
+	if err == nil {
+		_, err = s.callSync(conn, "core.subscribe", []interface{}{"core.get_jobs"})
+	}
+	if err == nil {
+		err = s.reattachJobs(conn)
+	}
+	if err == nil {
+		err = s.resubscribeEvents(conn)
+	}
 
-	_, err, _ = session.callJson("core.subscribe", DEFAULT_CALL_TIMEOUT, []interface{}{"core.get_jobs"})
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
-
-	return session, nil
+	return conn, nil
 }
 
-func (d *DaemonContext) deleteSession(sessionKey string, channel int) {
-	d.mapMtx.Lock()
-	if sessionList, exists := d.sessionMap_[sessionKey]; exists {
-		if channel >= 0 && channel < len(sessionList) {
-			sessionList[channel] = nil
-			d.sessionMap_[sessionKey] = sessionList
+// loginWithCall logs in with the call the session was created with, eg. auth.login_with_api_key.
+func (s *TruenasSession) loginWithCall(conn *websocket.Conn) error {
+	out, err := s.callSync(conn, s.login.call.method, s.login.call.params)
+	if err == nil {
+		var result interface{}
+		if json.Unmarshal(out, &result) == nil {
+			if resultMap, ok := result.(map[string]interface{}); ok {
+				if isSuccess, ok := resultMap["result"].(bool); ok && !isSuccess {
+					err = fmt.Errorf("Login to %s was rejected", s.url)
+				}
+			}
 		}
 	}
-	d.mapMtx.Unlock()
+	return err
 }
 
-func (s *TruenasSession) callJson(method string, timeoutStr string, request []interface{}) (json.RawMessage, error, bool) {
-	s.ctx.UpdateCountdown()
+// getOtpToken gives LoginWithPassword the one-time password that the session was created with, if any.
+// A one-time password can only be used once, so it is forgotten and a reconnect that needs one fails instead.
+func (s *TruenasSession) getOtpToken() (string, error) {
+	otp := s.login.otpToken
+	if otp == "" {
+		return "", truenas_api.ErrOtpRequired
+	}
+	s.login.otpToken = ""
+	return otp, nil
+}
 
-	if strings.HasPrefix(method, TNC_PREFIX_STRING) {
-		out, err := s.handleDaemonProcedure(method[len(TNC_PREFIX_STRING):], timeoutStr, request)
-		return out, err, false
+// callSync makes a call on a connection that the listen thread is not reading from, passing along any other
+// messages that arrive in the meantime.
+func (s *TruenasSession) callSync(conn *websocket.Conn, method string, params []interface{}) (json.RawMessage, error) {
+	message, err := s.callSyncRaw(conn, method, params)
+	if err != nil {
+		return nil, err
+	}
+	var response map[string]interface{}
+	if json.Unmarshal(message, &response) == nil {
+		if errMsg := ExtractApiErrorJson(response); errMsg != "" {
+			return nil, fmt.Errorf("%s: %s", method, errMsg)
+		}
 	}
+	return message, nil
+}
 
+// callSyncRaw is callSync without turning an error response into an error.
+func (s *TruenasSession) callSyncRaw(conn *websocket.Conn, method string, params []interface{}) (json.RawMessage, error) {
 	s.connMtx.Lock()
 	s.curCallId_++
 	callId := s.curCallId_
-	fCall := MakeFuture[json.RawMessage]()
-	s.callMap_[callId] = fCall
-	s.callInProgress_ = true
 	s.connMtx.Unlock()
 
-	reqMsg := make(map[string]interface{})
-	reqMsg["jsonrpc"] = "2.0"
-	reqMsg["method"] = method
-	reqMsg["params"] = request
-	reqMsg["id"] = callId
+	if err := s.writeRequest(conn, callId, method, params); err != nil {
+		return nil, err
+	}
+
+	timeout, _ := time.ParseDuration(DEFAULT_CALL_TIMEOUT)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		var response map[string]interface{}
+		if err = json.Unmarshal(message, &response); err == nil {
+			if id, ok := response["id"].(float64); ok && int64(id) == callId {
+				return message, nil
+			}
+		}
+
+		s.handleMessage(message)
+	}
+}
+
+// reattachJobs catches up on any jobs that were being waited on while the connection was down.
+// Jobs that finished in the meantime are completed straight away, and the rest are waited on again.
+func (s *TruenasSession) reattachJobs(conn *websocket.Conn) error {
+	jobIds := make([]interface{}, 0)
+	s.connMtx.Lock()
+	for id, fJob := range s.jobMap_ {
+		if isDone, _, _ := fJob.Peek(); !isDone {
+			jobIds = append(jobIds, id)
+		}
+	}
+	s.connMtx.Unlock()
+
+	if len(jobIds) == 0 {
+		return nil
+	}
+
+	filter := []interface{}{[]interface{}{"id", "in", jobIds}}
+	out, err := s.callSync(conn, "core.get_jobs", []interface{}{filter})
+	if err != nil {
+		return err
+	}
+
+	var response map[string]interface{}
+	if err = json.Unmarshal(out, &response); err != nil {
+		return err
+	}
+	jobsList, _ := response["result"].([]interface{})
+
+	jobsById := make(map[int64]map[string]interface{})
+	for _, jobObj := range jobsList {
+		if job, ok := jobObj.(map[string]interface{}); ok {
+			jobsById[GetIntegerFromJsonObjectOr(job, "id", -1)] = job
+		}
+	}
+
+	for _, idObj := range jobIds {
+		id := idObj.(int64)
+		fJob := s.getJobFuture(id)
+		if fJob == nil {
+			// nothing is waiting on the job any more
+			continue
+		}
+		job, exists := jobsById[id]
+		if !exists {
+			fJob.Fail(fmt.Errorf("Job #%d could not be found after reconnecting to %s", id, s.url))
+			s.forgetJob(id, fJob)
+			continue
+		}
+		state, _ := job["state"].(string)
+		if state == "SUCCESS" || state == "FAILED" || state == "ABORTED" {
+			fJob.Reach(json.Marshal(job))
+			s.forgetJob(id, fJob)
+			continue
+		}
+		if _, err = s.callSync(conn, JOB_WAIT_STRING, []interface{}{id}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DaemonContext) deleteSession(sessionKey string, channel int) {
+	d.mapMtx.Lock()
+	if sessionList, exists := d.sessionMap_[sessionKey]; exists {
+		if channel >= 0 && channel < len(sessionList) {
+			sessionList[channel] = nil
+			d.sessionMap_[sessionKey] = sessionList
+		}
+	}
+	d.mapMtx.Unlock()
+}
+
+// callJson stops waiting for the response once ctx is done or the timeout elapses, whichever comes first.
+func (s *TruenasSession) callJson(ctx context.Context, method string, timeoutStr string, request []interface{}) (json.RawMessage, error, bool) {
+	s.ctx.UpdateCountdown()
+
+	if strings.HasPrefix(method, TNC_PREFIX_STRING) {
+		out, err := s.handleDaemonProcedure(ctx, method[len(TNC_PREFIX_STRING):], timeoutStr, request)
+		return out, err, false
+	}
+
+	s.connMtx.Lock()
+	if s.isClosed_ {
+		s.connMtx.Unlock()
+		return nil, fmt.Errorf("%w: connection was closed", errSessionLost), true
+	}
+	s.curCallId_++
+	callId := s.curCallId_
+	fCall := MakeFuture[json.RawMessage]()
+	s.callMap_[callId] = fCall
+	// while reconnecting, the call is held back until the new connection is ready
+	isReconnecting := s.isReconnecting_
+	s.callInfoMap_[callId] = &pendingCall{call: CallInfo{method: method, params: request}, wasSent: !isReconnecting}
+	conn := s.conn
+	s.callInProgress_ = true
+	s.lastUsed_ = time.Now()
+	s.connMtx.Unlock()
 
 	//log.Println("Writing JSON request with callId:", callId, reqMsg)
 
-	if err := wrapWriteJSON(s.conn, reqMsg); err != nil {
-		errMsg := err.Error()
-		shouldRetry := strings.Contains(errMsg, "use of closed network connection") || strings.Contains(errMsg, "gorilla panic")
-		return nil, err, shouldRetry
+	if !isReconnecting {
+		if err := s.writeRequest(conn, callId, method, request); err != nil {
+			s.logger().Warn("failed to send call", "method", method, "call_id", callId, "error", err)
+			// Closing the connection makes the listen thread reconnect, which then sends this call again.
+			s.connMtx.Lock()
+			if info, exists := s.callInfoMap_[callId]; exists {
+				info.wasSent = false
+			}
+			s.connMtx.Unlock()
+			_ = conn.Close()
+		}
 	}
 
 	timeout, err := time.ParseDuration(timeoutStr)
@@ -402,24 +1155,46 @@ func (s *TruenasSession) callJson(method string, timeoutStr string, request []in
 		timeout = time.Duration(10) * time.Second
 	}
 
-	isDone, dataRes, err := AwaitFutureOrTimeout(fCall, timeout)
-	if !isDone {
-		timeoutParsed := timeout.String()
-		return nil, fmt.Errorf("Request timed out (exceeded %s)", timeoutParsed), false
-	}
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	isDone, dataRes, err := AwaitFutureOrContext(callCtx, fCall)
 
 	s.connMtx.Lock()
 	delete(s.callMap_, callId)
+	delete(s.callInfoMap_, callId)
 	s.callInProgress_ = false
+	s.lastUsed_ = time.Now()
 	s.connMtx.Unlock()
 
+	if !isDone && ctx.Err() != nil {
+		return nil, fmt.Errorf("Request was cancelled: %w", ctx.Err()), false
+	}
+	if !isDone {
+		timeoutParsed := timeout.String()
+		return nil, fmt.Errorf("Request timed out (exceeded %s)", timeoutParsed), false
+	}
+
 	if err != nil {
-		return nil, err, false
+		// Calls that are still pending when a session is lost were never answered, but only those that
+		// cannot have changed anything are safe to try again on a new session.
+		return nil, err, errors.Is(err, errSessionLost) && isReplayableMethod(method)
 	}
 
 	return dataRes, nil, false
 }
 
+func (s *TruenasSession) writeRequest(conn *websocket.Conn, callId int64, method string, params []interface{}) error {
+	reqMsg := make(map[string]interface{})
+	reqMsg["jsonrpc"] = "2.0"
+	reqMsg["method"] = method
+	reqMsg["params"] = params
+	reqMsg["id"] = callId
+
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	return wrapWriteJSON(conn, reqMsg)
+}
+
 func wrapWriteJSON(conn *websocket.Conn, reqMsg interface{}) (err error) {
 	err = nil
 	defer func() {
@@ -440,102 +1215,343 @@ func wrapWriteJSON(conn *websocket.Conn, reqMsg interface{}) (err error) {
 	return err
 }
 
+// isReplayableMethod reports whether a call can be sent again after the connection dropped before it was answered.
+func isReplayableMethod(method string) bool {
+	return strings.HasSuffix(method, ".query") ||
+		strings.HasSuffix(method, ".get_instance") ||
+		method == "core.get_jobs" ||
+		method == "core.ping" ||
+		method == JOB_WAIT_STRING
+}
+
+// close stops the session for good, so that the listen thread exits rather than reconnecting.
+func (s *TruenasSession) close() {
+	s.connMtx.Lock()
+	s.isClosed_ = true
+	conn := s.conn
+	s.connMtx.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+func (s *TruenasSession) logger() *slog.Logger {
+	return s.ctx.logger().With("host", s.url, "channel", s.channel)
+}
+
+func (s *TruenasSession) getConn() *websocket.Conn {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	return s.conn
+}
+
+// reconnect replaces a dropped connection, retrying with an exponential backoff.
+// Calls that may not be safe to repeat are failed straight away, since they may or may not have taken effect.
+// Everything else that was pending is sent again once the new connection is logged in.
+func (s *TruenasSession) reconnect(cause error) error {
+	s.connMtx.Lock()
+	if s.isClosed_ {
+		s.connMtx.Unlock()
+		return cause
+	}
+	s.isReconnecting_ = true
+	for id, info := range s.callInfoMap_ {
+		if info.wasSent && !isReplayableMethod(info.call.method) {
+			if fCall, exists := s.callMap_[id]; exists {
+				fCall.Fail(fmt.Errorf("Connection to %s was lost while waiting for %s, which was not retried: %v", s.url, info.call.method, cause))
+			}
+			info.isAbandoned = true
+		}
+	}
+	oldConn := s.conn
+	s.connMtx.Unlock()
+	_ = oldConn.Close()
+
+	s.logger().Warn("lost connection, reconnecting", "error", cause)
+
+	delay := RECONNECT_INITIAL_DELAY
+	deadline := time.Now().Add(RECONNECT_TIMEOUT)
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		time.Sleep(delay)
+		if s.isClosed() || s.ctx.IsDraining() {
+			return cause
+		}
+
+		var conn *websocket.Conn
+		conn, err = s.connect()
+		if err == nil {
+			s.resume(conn)
+			s.ctx.metrics.countReconnect(s.url, true)
+			s.logger().Info("reconnected", "attempts", attempt)
+			return nil
+		}
+
+		s.logger().Warn("reconnect attempt failed", "attempt", attempt, "error", err)
+		if errors.Is(err, truenas_api.ErrOtpRequired) {
+			s.ctx.metrics.countReconnect(s.url, false)
+			return fmt.Errorf("could not reconnect to %s: %w, which only the client can give (connection was lost: %v)", s.url, err, cause)
+		}
+		if time.Now().Add(delay).After(deadline) {
+			break
+		}
+		delay = min(delay*2, RECONNECT_MAX_DELAY)
+	}
+
+	s.ctx.metrics.countReconnect(s.url, false)
+	return fmt.Errorf("could not reconnect to %s: %v (connection was lost: %v)", s.url, err, cause)
+}
+
+func (s *TruenasSession) resume(conn *websocket.Conn) {
+	type resend struct {
+		id   int64
+		call CallInfo
+	}
+	toSend := make([]resend, 0)
+
+	s.connMtx.Lock()
+	s.conn = conn
+	s.isReconnecting_ = false
+	s.reconnects_++
+	go s.sendHeartbeats(conn)
+	for id, info := range s.callInfoMap_ {
+		if info.isAbandoned {
+			continue
+		}
+		info.wasSent = true
+		toSend = append(toSend, resend{id: id, call: info.call})
+	}
+	s.connMtx.Unlock()
+
+	slices.SortFunc(toSend, func(a, b resend) int {
+		return int(a.id - b.id)
+	})
+	for _, r := range toSend {
+		if err := s.writeRequest(conn, r.id, r.call.method, r.call.params); err != nil {
+			// the listen thread will see that this connection is broken too
+			s.logger().Warn("failed to resend call", "method", r.call.method, "call_id", r.id, "error", err)
+			break
+		}
+	}
+}
+
+func (s *TruenasSession) isClosed() bool {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	return s.isClosed_
+}
+
+// sendHeartbeats pings the server for as long as conn is the session's connection.
+// The pongs push back the listen thread's read deadline (see connect), so a connection that has silently died times out.
+func (s *TruenasSession) sendHeartbeats(conn *websocket.Conn) {
+	if s.ctx.heartbeat <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.ctx.heartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.connMtx.Lock()
+		isCurrent := s.conn == conn && !s.isClosed_
+		s.connMtx.Unlock()
+		if !isCurrent {
+			return
+		}
+		// WriteControl is safe to call alongside the other writers
+		if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.ctx.heartbeat)); err != nil {
+			s.logger().Warn("failed to ping", "error", err)
+			return
+		}
+	}
+}
+
+func (s *TruenasSession) extendReadDeadline(conn *websocket.Conn) {
+	if s.ctx.heartbeat > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(s.ctx.heartbeat * HEARTBEAT_MISSED_LIMIT))
+	}
+}
+
+// evictIfIdle closes a session that lost its connection while nothing was waiting on it, since there is nothing
+// to recover. The next call for this host will simply open a new session.
+func (s *TruenasSession) evictIfIdle() bool {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	if len(s.callMap_) > 0 || len(s.eventSubs_) > 0 {
+		return false
+	}
+	for _, fJob := range s.jobMap_ {
+		if isDone, _, _ := fJob.Peek(); !isDone {
+			return false
+		}
+	}
+	s.isClosed_ = true
+	return true
+}
+
 func (s *TruenasSession) listen() {
 	var err error
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("Recovered from panic:", r)
+			s.logger().Error("recovered from panic in listen", "panic", r)
+		}
+		internalErr := fmt.Errorf("%w: listen() exiting: %v", errSessionLost, err)
+		if errors.Is(err, truenas_api.ErrOtpRequired) {
+			// a new session would log in with the same one-time password again, so the calls are not retried
+			internalErr = fmt.Errorf("listen() exiting: %w", err)
 		}
-		internalErr := fmt.Errorf("listen() exiting: %v", err)
-		_ = s.conn.Close()
 		s.connMtx.Lock()
-		for _, f := range s.callMap_ {
-			f.Fail(internalErr)
+		s.isClosed_ = true
+		conn := s.conn
+		for id, f := range s.callMap_ {
+			if info, exists := s.callInfoMap_[id]; exists && (info.isAbandoned || (info.wasSent && !isReplayableMethod(info.call.method))) {
+				f.Fail(fmt.Errorf("listen() exiting: %v", err))
+			} else {
+				f.Fail(internalErr)
+			}
 		}
 		for _, f := range s.jobMap_ {
 			f.Fail(internalErr)
 		}
 		s.connMtx.Unlock()
+		_ = conn.Close()
 		s.ctx.deleteSession(s.sessionKey, s.channel)
-		log.Println("listen exiting")
+		s.ctx.wakeWatchers(s)
+		s.logger().Info("session closed", "reason", err)
 	}()
 	for true {
+		conn := s.getConn()
+		s.extendReadDeadline(conn)
+
 		var message json.RawMessage
-		_, message, err = s.conn.ReadMessage()
+		_, message, err = conn.ReadMessage()
 		if err != nil {
-			log.Println("listen s.conn.ReadMessage:", err)
-			return
-		}
-
-		var response interface{}
-		if err = json.Unmarshal(message, &response); err != nil {
-			continue
-		}
-		responseMap, ok := response.(map[string]interface{})
-		if !ok {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.logger().Warn("connection is dead", "silent_for", (s.ctx.heartbeat * HEARTBEAT_MISSED_LIMIT).String())
+			} else if s.isClosed() {
+				s.logger().Debug("connection closed", "error", err)
+			} else {
+				s.logger().Warn("failed to read from connection", "error", err)
+			}
+			if s.evictIfIdle() {
+				return
+			}
+			if err = s.reconnect(err); err != nil {
+				return
+			}
 			continue
 		}
 
-		s.ctx.UpdateCountdown()
+		s.handleMessage(message)
+	}
+}
 
-		innerJobId := int64(-1)
+func (s *TruenasSession) handleMessage(message json.RawMessage) {
+	var response interface{}
+	if err := json.Unmarshal(message, &response); err != nil {
+		return
+	}
+	responseMap, ok := response.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	s.ctx.UpdateCountdown()
+
+	innerJobId := int64(-1)
 
-		method, _ := responseMap["method"].(string)
-		var fields map[string]interface{}
+	method, _ := responseMap["method"].(string)
+	var fields map[string]interface{}
+	progressJobId := int64(-1)
+	progressState := ""
+
+	if method == "collection_update" {
+		params, _ := responseMap["params"].(map[string]interface{})
+		collection, _ := params["collection"].(string)
+		if collection == "" {
+			collection, _ = responseMap["collection"].(string)
+		}
+		if collection != "" && collection != "core.get_jobs" {
+			s.dispatchEvent(collection, params)
+			return
+		}
+		jobIdF, _ := params["id"].(float64)
+		fields, _ = params["fields"].(map[string]interface{})
+		state, _ := fields["state"].(string)
 
-		if method == "collection_update" {
-			params, _ := responseMap["params"].(map[string]interface{})
-			jobIdF, _ := params["id"].(float64)
-			fields, _ = params["fields"].(map[string]interface{})
-			state, _ := fields["state"].(string)
+		if innerMethod, _ := fields["method"].(string); innerMethod != JOB_WAIT_STRING {
+			progressJobId = int64(jobIdF)
+			progressState = state
+		}
 
-			if state == "SUCCESS" || state == "FAILED" {
-				innerJobId = int64(jobIdF)
-				if innerMethod, _ := fields["method"].(string); innerMethod == JOB_WAIT_STRING {
-					if args, ok := fields["arguments"].([]interface{}); ok && len(args) > 0 {
-						if value, ok := args[0].(float64); ok {
-							innerJobId = int64(value)
-						}
+		if state == "SUCCESS" || state == "FAILED" {
+			innerJobId = int64(jobIdF)
+			if innerMethod, _ := fields["method"].(string); innerMethod == JOB_WAIT_STRING {
+				if args, ok := fields["arguments"].([]interface{}); ok && len(args) > 0 {
+					if value, ok := args[0].(float64); ok {
+						innerJobId = int64(value)
 					}
 				}
 			}
 		}
+	}
 
-		idValue := int64(-1)
-		if id, exists := responseMap["id"]; exists {
-			idFloat, _ := id.(float64)
-			idValue = int64(idFloat)
-		}
+	idValue := int64(-1)
+	if id, exists := responseMap["id"]; exists {
+		idFloat, _ := id.(float64)
+		idValue = int64(idFloat)
+	}
 
-		var fJob *Future[json.RawMessage]
-		var fCall *Future[json.RawMessage]
-		var exists bool
+	var fJob *Future[json.RawMessage]
+	var fCall *Future[json.RawMessage]
 
-		if innerJobId >= 0 || idValue >= 0 {
-			s.connMtx.Lock()
-			if innerJobId >= 0 {
-				fJob, exists = s.jobMap_[innerJobId]
-				if !exists {
-					fJob = MakeFuture[json.RawMessage]()
-					s.jobMap_[innerJobId] = fJob
-				}
-			}
-			if idValue >= 0 {
-				fCall, exists = s.callMap_[idValue]
-			}
-			s.connMtx.Unlock()
+	if innerJobId >= 0 || idValue >= 0 {
+		s.connMtx.Lock()
+		// only the jobs that a client is waiting on are tracked
+		if innerJobId >= 0 {
+			fJob = s.jobMap_[innerJobId]
 		}
+		if idValue >= 0 {
+			fCall = s.callMap_[idValue]
+		}
+		s.connMtx.Unlock()
+	}
+
+	if fJob != nil && fields != nil {
+		s.logger().Debug("job finished", "job_id", innerJobId, "state", fields["state"])
+		fJob.Reach(json.Marshal(fields))
+		s.forgetJob(innerJobId, fJob)
+	}
+	// after reaching the job's future, so that watchers woken by its completion can see the result
+	if progressJobId >= 0 {
+		s.updateJobProgress(progressJobId, progressState, fields)
+	}
+	if fCall != nil {
+		fCall.Complete(message)
+	}
+}
 
-		if fJob != nil && fields != nil {
-			fJob.Reach(json.Marshal(fields))
+// failPendingFutures fails every call and job that is still being waited on, returning how many were failed.
+func (s *TruenasSession) failPendingFutures(err error) int {
+	nFailed := 0
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	for _, f := range s.callMap_ {
+		if isDone, _, _ := f.Peek(); !isDone {
+			f.Fail(err)
+			nFailed++
 		}
-		if fCall != nil {
-			fCall.Complete(message)
+	}
+	for _, f := range s.jobMap_ {
+		if isDone, _, _ := f.Peek(); !isDone {
+			f.Fail(err)
+			nFailed++
 		}
 	}
+	return nFailed
 }
 
-func (s *TruenasSession) handleDaemonProcedure(proc string, timeoutStr string, params []interface{}) (json.RawMessage, error) {
+func (s *TruenasSession) handleDaemonProcedure(ctx context.Context, proc string, timeoutStr string, params []interface{}) (json.RawMessage, error) {
 	isFirstParamNumber := false
 	firstParamAsNumber := int64(0)
 	nParams := len(params)
@@ -581,17 +1597,154 @@ func (s *TruenasSession) handleDaemonProcedure(proc string, timeoutStr string, p
 			}
 		}
 
-		_, err, _ := s.callJson(JOB_WAIT_STRING, timeoutStr, []interface{}{firstParamAsNumber})
+		waitStart := time.Now()
+		_, err, _ := s.callJson(ctx, JOB_WAIT_STRING, timeoutStr, []interface{}{firstParamAsNumber})
 		if err != nil {
 			return nil, err
 		}
 
-		return fJob.Get()
+		// the job carries on if the client goes away, and can be awaited again
+		isDone, response, err := AwaitFutureOrContext(ctx, fJob)
+		if isDone {
+			s.ctx.metrics.observeJobWait(time.Since(waitStart))
+		}
+		return response, err
+
+	case "watch_job":
+		if !isFirstParamNumber {
+			return nil, fmt.Errorf("tnc_daemon.watch_job expects the first parameter to be a job number")
+		}
+		sinceVersion := int64(0)
+		if nParams > 1 {
+			if n, ok := params[1].(float64); ok {
+				sinceVersion = int64(n)
+			}
+		}
+		return s.watchJob(ctx, firstParamAsNumber, sinceVersion, timeoutStr)
+
+	case "subscribe":
+		var collection string
+		if nParams > 0 {
+			collection, _ = params[0].(string)
+		}
+		if collection == "" {
+			return nil, fmt.Errorf("tnc_daemon.subscribe expects the first parameter to be the name of a collection")
+		}
+		watcherId, err := s.ctx.subscribeEvents(s, collection)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]interface{}{"watcher_id": watcherId})
 	}
 
 	return nil, fmt.Errorf("Unrecognised daemon command \"tnc_daemon.%s\"", proc)
 }
 
+// watchJob waits until the job has made progress since the version the client last saw, or until it completes,
+// or until WATCH_JOB_INTERVAL elapses. The first call (version 0) also makes sure the daemon is waiting on the job.
+func (s *TruenasSession) watchJob(ctx context.Context, jobId int64, sinceVersion int64, timeoutStr string) (json.RawMessage, error) {
+	s.connMtx.Lock()
+	fJob, exists := s.jobMap_[jobId]
+	if !exists {
+		fJob = MakeFuture[json.RawMessage]()
+		s.jobMap_[jobId] = fJob
+	}
+	entry, isWatched := s.jobProgress_[jobId]
+	if !isWatched {
+		entry = &jobProgressEntry{
+			progress:  JobProgress{JobId: jobId, State: "WAITING"},
+			startedAt: time.Now(),
+			changedCh: make(chan struct{}),
+		}
+		s.jobProgress_[jobId] = entry
+	}
+	version := entry.version
+	changedCh := entry.changedCh
+	s.connMtx.Unlock()
+
+	if isDone, _, _ := fJob.Peek(); !isDone {
+		// a job that was forgotten once another watcher saw it finish is waited on again to find its result
+		if sinceVersion == 0 || !exists {
+			if _, err, _ := s.callJson(ctx, JOB_WAIT_STRING, timeoutStr, []interface{}{jobId}); err != nil {
+				return nil, err
+			}
+		}
+		if version <= sinceVersion {
+			select {
+			case <-changedCh:
+			case <-time.After(WATCH_JOB_INTERVAL):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	status := make(map[string]interface{})
+	isDone, response, err := fJob.Peek()
+	if isDone {
+		s.connMtx.Lock()
+		_, isFirstToSee := s.jobProgress_[jobId]
+		delete(s.jobProgress_, jobId)
+		if s.jobMap_[jobId] == fJob {
+			delete(s.jobMap_, jobId)
+		}
+		s.connMtx.Unlock()
+		if isFirstToSee {
+			s.ctx.metrics.observeJobWait(time.Since(entry.startedAt))
+		}
+		if err != nil {
+			return nil, err
+		}
+		status["done"] = true
+		status["job"] = response
+		return json.Marshal(status)
+	}
+
+	s.connMtx.Lock()
+	status["done"] = false
+	status["version"] = entry.version
+	status["state"] = entry.progress.State
+	status["percent"] = entry.progress.Percent
+	status["description"] = entry.progress.Description
+	s.connMtx.Unlock()
+	return json.Marshal(status)
+}
+
+// updateJobProgress records the progress of a watched job and wakes up anyone watching it.
+func (s *TruenasSession) updateJobProgress(jobId int64, state string, fields map[string]interface{}) {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+
+	entry, exists := s.jobProgress_[jobId]
+	if !exists {
+		return
+	}
+
+	progress := JobProgress{JobId: jobId, State: state}
+	if progressMap, ok := fields["progress"].(map[string]interface{}); ok {
+		progress.Percent, _ = progressMap["percent"].(float64)
+		progress.Description, _ = progressMap["description"].(string)
+	}
+	if progress == entry.progress && state != "SUCCESS" && state != "FAILED" {
+		return
+	}
+
+	entry.progress = progress
+	entry.version++
+	close(entry.changedCh)
+	entry.changedCh = make(chan struct{})
+}
+
+// forgetJob stops tracking a job once its future has been resolved, as anyone waiting on it already holds the future.
+// A job whose progress is being watched is kept until watchJob tells a watcher that it is done.
+func (s *TruenasSession) forgetJob(id int64, fJob *Future[json.RawMessage]) {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	if _, isWatched := s.jobProgress_[id]; !isWatched && s.jobMap_[id] == fJob {
+		delete(s.jobMap_, id)
+	}
+}
+
 func (s *TruenasSession) getJobFuture(id int64) *Future[json.RawMessage] {
 	s.connMtx.Lock()
 	defer s.connMtx.Unlock()
@@ -618,3 +1771,119 @@ func MakeIncompleteJobStatus(jobId int64) (json.RawMessage, error) {
 	params["state"] = "WAITING"
 	return json.Marshal(params)
 }
+
+// getStatus reports on every cached connection without revealing the credentials embedded in each session key.
+// Channels of the same host and credentials are grouped into one entry.
+func (d *DaemonContext) getStatus() (json.RawMessage, error) {
+	now := time.Now()
+	sessionsList := make([]map[string]interface{}, 0)
+
+	d.mapMtx.Lock()
+	lastActivity := d.lastActivity_
+	for _, futures := range d.sessionMap_ {
+		host := ""
+		nChannels := 0
+		nCalls := 0
+		nReconnects := 0
+		nReconnecting := 0
+		subscriptions := make([]string, 0)
+		jobsList := make([]map[string]interface{}, 0)
+		var lastUsed time.Time
+		var createdAt time.Time
+
+		for _, future := range futures {
+			if future == nil {
+				continue
+			}
+			isDone, s, err := future.Peek()
+			if !isDone || err != nil || s == nil {
+				continue
+			}
+			nChannels++
+			host = s.url
+			if createdAt.IsZero() || s.createdAt.Before(createdAt) {
+				createdAt = s.createdAt
+			}
+
+			s.connMtx.Lock()
+			nCalls += len(s.callMap_)
+			nReconnects += s.reconnects_
+			if s.isReconnecting_ {
+				nReconnecting++
+			}
+			for collection := range s.eventSubs_ {
+				subscriptions = append(subscriptions, collection)
+			}
+			if s.lastUsed_.After(lastUsed) {
+				lastUsed = s.lastUsed_
+			}
+			for jobId, fJob := range s.jobMap_ {
+				jobsList = append(jobsList, map[string]interface{}{
+					"id":    jobId,
+					"state": getJobFutureState(fJob),
+				})
+			}
+			s.connMtx.Unlock()
+		}
+
+		if nChannels == 0 {
+			continue
+		}
+
+		slices.SortFunc(jobsList, func(a, b map[string]interface{}) int {
+			return int(a["id"].(int64) - b["id"].(int64))
+		})
+		slices.Sort(subscriptions)
+
+		sessionsList = append(sessionsList, map[string]interface{}{
+			"host":          host,
+			"channels":      nChannels,
+			"calls":         nCalls,
+			"reconnects":    nReconnects,
+			"reconnecting":  nReconnecting,
+			"jobs":          jobsList,
+			"subscriptions": subscriptions,
+			"age":           now.Sub(createdAt).Round(time.Second).String(),
+			"idle":          now.Sub(lastUsed).Round(time.Second).String(),
+		})
+	}
+	d.mapMtx.Unlock()
+
+	slices.SortStableFunc(sessionsList, func(a, b map[string]interface{}) int {
+		return strings.Compare(a["host"].(string), b["host"].(string))
+	})
+
+	status := make(map[string]interface{})
+	status["pid"] = os.Getpid()
+	status["uptime"] = now.Sub(d.startTime).Round(time.Second).String()
+	status["idle"] = now.Sub(lastActivity).Round(time.Second).String()
+	if d.timeoutTimer != nil {
+		remaining := d.timeoutValue - now.Sub(lastActivity)
+		if remaining < 0 {
+			remaining = 0
+		}
+		status["timeout"] = d.timeoutValue.String()
+		status["timeout_remaining"] = remaining.Round(time.Second).String()
+	}
+	status["socket_activated"] = d.isSocketActivated
+	status["sessions"] = sessionsList
+
+	return json.Marshal(status)
+}
+
+func getJobFutureState(fJob *Future[json.RawMessage]) string {
+	isDone, response, err := fJob.Peek()
+	if !isDone {
+		return "WAITING"
+	}
+	if err != nil {
+		return "FAILED"
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(response, &fields) == nil {
+		if state, _ := fields["state"].(string); state != "" {
+			return state
+		}
+	}
+	return "UNKNOWN"
+}
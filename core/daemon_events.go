@@ -0,0 +1,313 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Watchers that have not been polled for this long are assumed to belong to clients that went away.
+const WATCHER_EXPIRY = time.Minute
+
+// Events beyond this many are dropped (oldest first) until the watcher is polled again.
+const WATCHER_MAX_EVENTS = 1000
+
+// eventSubscription is a single core.subscribe on one of a session's connections,
+// which is shared by every local watcher of that collection with the same credentials.
+type eventSubscription struct {
+	collection     string
+	key            string
+	session        *TruenasSession
+	subscriptionId interface{}
+	watchers       map[int64]*eventWatcher
+}
+
+// eventWatcher buffers the events of a subscription until its client polls for them.
+// changedCh is closed and replaced whenever an event arrives or the subscription is lost.
+type eventWatcher struct {
+	id         int64
+	sessionKey string
+	sub        *eventSubscription
+	events     []json.RawMessage
+	dropped    int
+	lastPolled time.Time
+	changedCh  chan struct{}
+}
+
+// subscribeEvents adds a watcher for the collection, subscribing to it through s if no other watcher with the same
+// credentials is subscribed to it already. Returns the new watcher's id.
+func (d *DaemonContext) subscribeEvents(s *TruenasSession, collection string) (int64, error) {
+	d.subscribeMtx.Lock()
+	defer d.subscribeMtx.Unlock()
+
+	key := s.sessionKey + "\x00" + collection
+
+	d.watcherMtx.Lock()
+	sub := d.eventSubs_[key]
+	d.watcherMtx.Unlock()
+
+	if sub == nil || sub.session.isClosed() {
+		out, err, _ := s.callJson(context.Background(), "core.subscribe", DEFAULT_CALL_TIMEOUT, []interface{}{collection})
+		if err != nil {
+			return -1, err
+		}
+		var response map[string]interface{}
+		if err = json.Unmarshal(out, &response); err != nil {
+			return -1, err
+		}
+		if errMsg := ExtractApiErrorJson(response); errMsg != "" {
+			return -1, fmt.Errorf("core.subscribe %s: %s", collection, errMsg)
+		}
+
+		sub = &eventSubscription{
+			collection:     collection,
+			key:            key,
+			session:        s,
+			subscriptionId: response["result"],
+			watchers:       make(map[int64]*eventWatcher),
+		}
+		d.watcherMtx.Lock()
+		d.eventSubs_[key] = sub
+		d.watcherMtx.Unlock()
+
+		s.connMtx.Lock()
+		if s.eventSubs_ == nil {
+			s.eventSubs_ = make(map[string]*eventSubscription)
+		}
+		s.eventSubs_[collection] = sub
+		s.connMtx.Unlock()
+
+		s.logger().Info("subscribed to events", "collection", collection)
+	}
+
+	d.watcherMtx.Lock()
+	defer d.watcherMtx.Unlock()
+	d.curWatcherId_++
+	w := &eventWatcher{
+		id:         d.curWatcherId_,
+		sessionKey: s.sessionKey,
+		sub:        sub,
+		lastPolled: time.Now(),
+		changedCh:  make(chan struct{}),
+	}
+	sub.watchers[w.id] = w
+	d.watcherMap_[w.id] = w
+	if !d.isExpiringWatchers_ {
+		d.isExpiringWatchers_ = true
+		go d.expireWatchers()
+	}
+	return w.id, nil
+}
+
+// handleWatcherProcedure serves the procedures that act on an existing watcher, which may belong to any of the
+// connections that share the caller's credentials.
+func (d *DaemonContext) handleWatcherProcedure(ctx context.Context, proc string, sessionKey string, params []interface{}) (json.RawMessage, error) {
+	var watcherId int64
+	if len(params) > 0 {
+		if n, ok := params[0].(float64); ok {
+			watcherId = int64(n)
+		}
+	}
+	if watcherId <= 0 {
+		return nil, fmt.Errorf("tnc_daemon.%s expects the first parameter to be a watcher number", proc)
+	}
+
+	d.watcherMtx.Lock()
+	w, exists := d.watcherMap_[watcherId]
+	if !exists || w.sessionKey != sessionKey {
+		d.watcherMtx.Unlock()
+		return nil, fmt.Errorf("Watcher #%d could not be found", watcherId)
+	}
+
+	switch proc {
+	case "unsubscribe":
+		d.removeWatcherLocked(w)
+		d.watcherMtx.Unlock()
+		return json.Marshal(true)
+
+	case "poll_events":
+		w.lastPolled = time.Now()
+		changedCh := w.changedCh
+		isWaiting := len(w.events) == 0
+		d.watcherMtx.Unlock()
+
+		if isWaiting && !w.sub.session.isClosed() {
+			select {
+			case <-changedCh:
+			case <-time.After(WATCH_JOB_INTERVAL):
+			case <-ctx.Done():
+				// the events stay buffered for the next poll
+				return nil, ctx.Err()
+			}
+		}
+
+		d.watcherMtx.Lock()
+		defer d.watcherMtx.Unlock()
+		events := w.events
+		dropped := w.dropped
+		w.events = nil
+		w.dropped = 0
+		w.lastPolled = time.Now()
+
+		if len(events) == 0 && w.sub.session.isClosed() {
+			d.removeWatcherLocked(w)
+			return nil, fmt.Errorf("The subscription to %s was lost along with the connection to %s", w.sub.collection, w.sub.session.url)
+		}
+
+		if events == nil {
+			events = make([]json.RawMessage, 0)
+		}
+		response := make(map[string]interface{})
+		response["events"] = events
+		response["dropped"] = dropped
+		return json.Marshal(response)
+	}
+
+	d.watcherMtx.Unlock()
+	return nil, fmt.Errorf("Unrecognised daemon command \"tnc_daemon.%s\"", proc)
+}
+
+// removeWatcherLocked must be called with watcherMtx held. The subscription is cancelled once it has no watchers left.
+func (d *DaemonContext) removeWatcherLocked(w *eventWatcher) {
+	delete(d.watcherMap_, w.id)
+	sub := w.sub
+	delete(sub.watchers, w.id)
+	if len(sub.watchers) > 0 {
+		return
+	}
+
+	if d.eventSubs_[sub.key] == sub {
+		delete(d.eventSubs_, sub.key)
+	}
+	s := sub.session
+	s.connMtx.Lock()
+	if s.eventSubs_[sub.collection] == sub {
+		delete(s.eventSubs_, sub.collection)
+	}
+	s.connMtx.Unlock()
+
+	if sub.subscriptionId != nil && !s.isClosed() {
+		go func() {
+			if _, err, _ := s.callJson(context.Background(), "core.unsubscribe", DEFAULT_CALL_TIMEOUT, []interface{}{sub.subscriptionId}); err != nil {
+				s.logger().Debug("failed to unsubscribe from events", "collection", sub.collection, "error", err)
+			} else {
+				s.logger().Info("unsubscribed from events", "collection", sub.collection)
+			}
+		}()
+	}
+}
+
+// expireWatchers runs while there are watchers, removing the ones that are no longer being polled.
+func (d *DaemonContext) expireWatchers() {
+	for {
+		time.Sleep(WATCHER_EXPIRY / 2)
+
+		d.watcherMtx.Lock()
+		for _, w := range d.watcherMap_ {
+			if time.Since(w.lastPolled) > WATCHER_EXPIRY {
+				d.logger().Info("watcher expired", "watcher_id", w.id, "collection", w.sub.collection)
+				d.removeWatcherLocked(w)
+			}
+		}
+		if len(d.watcherMap_) == 0 {
+			d.isExpiringWatchers_ = false
+			d.watcherMtx.Unlock()
+			return
+		}
+		d.watcherMtx.Unlock()
+	}
+}
+
+// dispatchEvent passes a collection_update for anything other than jobs on to the collection's watchers.
+func (s *TruenasSession) dispatchEvent(collection string, params map[string]interface{}) {
+	s.connMtx.Lock()
+	sub := s.eventSubs_[collection]
+	s.connMtx.Unlock()
+	if sub == nil {
+		return
+	}
+
+	eventType, _ := params["msg"].(string)
+	event := make(map[string]interface{})
+	event["collection"] = collection
+	event["event"] = strings.ToUpper(eventType)
+	event["id"] = params["id"]
+	if fields, exists := params["fields"]; exists {
+		event["fields"] = fields
+	}
+	event["time"] = time.Now().Format(time.RFC3339Nano)
+	s.ctx.pushEvent(sub, event)
+}
+
+// pushEvent appends the event to every watcher of the subscription and wakes them up.
+func (d *DaemonContext) pushEvent(sub *eventSubscription, event map[string]interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	d.watcherMtx.Lock()
+	defer d.watcherMtx.Unlock()
+	for _, w := range sub.watchers {
+		if len(w.events) >= WATCHER_MAX_EVENTS {
+			w.events = w.events[1:]
+			w.dropped++
+		}
+		w.events = append(w.events, data)
+		close(w.changedCh)
+		w.changedCh = make(chan struct{})
+	}
+}
+
+// resubscribeEvents renews the session's subscriptions on a new connection. Events that happened while the
+// connection was down are lost, so watchers are sent a RECONNECTED event, after which they may want to re-query.
+func (s *TruenasSession) resubscribeEvents(conn *websocket.Conn) error {
+	s.connMtx.Lock()
+	subs := make([]*eventSubscription, 0, len(s.eventSubs_))
+	for _, sub := range s.eventSubs_ {
+		subs = append(subs, sub)
+	}
+	s.connMtx.Unlock()
+
+	for _, sub := range subs {
+		out, err := s.callSync(conn, "core.subscribe", []interface{}{sub.collection})
+		if err != nil {
+			return err
+		}
+		var response map[string]interface{}
+		if err = json.Unmarshal(out, &response); err != nil {
+			return err
+		}
+
+		s.ctx.watcherMtx.Lock()
+		sub.subscriptionId = response["result"]
+		s.ctx.watcherMtx.Unlock()
+
+		s.ctx.pushEvent(sub, map[string]interface{}{
+			"collection": sub.collection,
+			"event":      "RECONNECTED",
+			"time":       time.Now().Format(time.RFC3339Nano),
+		})
+	}
+	return nil
+}
+
+// wakeWatchers lets the watchers of a closed session find out that their subscriptions are gone.
+func (d *DaemonContext) wakeWatchers(s *TruenasSession) {
+	d.watcherMtx.Lock()
+	defer d.watcherMtx.Unlock()
+	for key, sub := range d.eventSubs_ {
+		if sub.session != s {
+			continue
+		}
+		delete(d.eventSubs_, key)
+		for _, w := range sub.watchers {
+			close(w.changedCh)
+			w.changedCh = make(chan struct{})
+		}
+	}
+}
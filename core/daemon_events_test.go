@@ -0,0 +1,155 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startEventServer counts the subscriptions and unsubscriptions made to collections other than jobs.
+func startEventServer(t *testing.T, nSubscribes *int32, nUnsubscribes *int32) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var request map[string]interface{}
+			if err = conn.ReadJSON(&request); err != nil {
+				return
+			}
+			method, _ := request["method"].(string)
+			params, _ := request["params"].([]interface{})
+			var result interface{} = true
+			if method == "core.subscribe" && len(params) > 0 && params[0] != "core.get_jobs" {
+				atomic.AddInt32(nSubscribes, 1)
+				result = "sub-1"
+			} else if method == "core.unsubscribe" {
+				atomic.AddInt32(nUnsubscribes, 1)
+			}
+			_ = conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": request["id"], "result": result})
+		}
+	}))
+}
+
+func pollTestWatcher(t *testing.T, d *DaemonContext, sessionKey string, watcherId int64) []map[string]interface{} {
+	t.Helper()
+	out, err := d.handleWatcherProcedure(context.Background(), "poll_events", sessionKey, []interface{}{float64(watcherId)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		Events []map[string]interface{} `json:"events"`
+	}
+	if err = json.Unmarshal(out, &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Events
+}
+
+func TestDaemonEventSubscriptionIsShared(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	var nSubscribes, nUnsubscribes int32
+	server := startEventServer(t, &nSubscribes, &nUnsubscribes)
+	defer server.Close()
+
+	s, err := d.createSession("key", makeTestLogin(server), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	watcherIds := make([]int64, 0)
+	for i := 0; i < 2; i++ {
+		out, err, _ := s.callJson(context.Background(), TNC_PREFIX_STRING+"subscribe", "10s", []interface{}{"zfs.snapshot.query"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response map[string]interface{}
+		_ = json.Unmarshal(out, &response)
+		watcherIds = append(watcherIds, int64(response["watcher_id"].(float64)))
+	}
+	AssertEqual(t, atomic.LoadInt32(&nSubscribes), int32(1))
+
+	update, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "collection_update",
+		"params": map[string]interface{}{
+			"msg":        "removed",
+			"collection": "zfs.snapshot.query",
+			"id":         "tank/ds@snap1",
+		},
+	})
+	s.handleMessage(update)
+
+	for _, watcherId := range watcherIds {
+		events := pollTestWatcher(t, d, "key", watcherId)
+		AssertEqual(t, len(events), 1)
+		AssertEqual(t, events[0]["event"].(string), "REMOVED")
+		AssertEqual(t, events[0]["id"].(string), "tank/ds@snap1")
+	}
+
+	if _, err = d.handleWatcherProcedure(context.Background(), "poll_events", "other-key", []interface{}{float64(watcherIds[0])}); err == nil {
+		t.Error("a watcher could be polled with different credentials")
+	}
+
+	for _, watcherId := range watcherIds {
+		if _, err = d.handleWatcherProcedure(context.Background(), "unsubscribe", "key", []interface{}{float64(watcherId)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&nUnsubscribes) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	AssertEqual(t, atomic.LoadInt32(&nUnsubscribes), int32(1))
+	s.connMtx.Lock()
+	AssertEqual(t, len(s.eventSubs_), 0)
+	s.connMtx.Unlock()
+}
+
+func TestDaemonEventsAreNotJobs(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+	s := addTestSession(d, "key", "wss://host", 0)
+	s.eventSubs_ = make(map[string]*eventSubscription)
+	s.jobProgress_ = make(map[int64]*jobProgressEntry)
+
+	sub := &eventSubscription{collection: "pool.dataset.query", key: "key\x00pool.dataset.query", session: s, watchers: make(map[int64]*eventWatcher)}
+	w := &eventWatcher{id: 1, sessionKey: "key", sub: sub, lastPolled: time.Now(), changedCh: make(chan struct{})}
+	sub.watchers[w.id] = w
+	s.eventSubs_[sub.collection] = sub
+	d.watcherMap_[w.id] = w
+
+	// a dataset update with a numeric id and a "state" field must not be mistaken for a finished job
+	update, _ := json.Marshal(map[string]interface{}{
+		"method": "collection_update",
+		"params": map[string]interface{}{
+			"msg":        "changed",
+			"collection": "pool.dataset.query",
+			"id":         5,
+			"fields":     map[string]interface{}{"state": "SUCCESS"},
+		},
+	})
+	s.handleMessage(update)
+
+	s.connMtx.Lock()
+	AssertEqual(t, len(s.jobMap_), 0)
+	s.connMtx.Unlock()
+
+	events := pollTestWatcher(t, d, "key", w.id)
+	AssertEqual(t, len(events), 1)
+	AssertEqual(t, events[0]["event"].(string), "CHANGED")
+}
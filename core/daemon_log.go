@@ -0,0 +1,98 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const REDACTED_STRING = "[REDACTED]"
+
+// Parameters with names like these are never written to the daemon's log.
+var secretKeyRegex = regexp.MustCompile(`(?i)(password|passphrase|secret|token|otp|api_?key|private|^key$|_key$)`)
+
+// makeDaemonLogger creates the daemon's logger, writing to logFile (appending) if given, otherwise to stderr.
+func makeDaemonLogger(levelStr string, format string, logFile string) (*slog.Logger, io.Closer, error) {
+	var level slog.Level
+	if levelStr != "" {
+		if err := level.UnmarshalText([]byte(levelStr)); err != nil {
+			return nil, nil, fmt.Errorf("invalid log level \"%s\" (expected debug, info, warn or error)", levelStr)
+		}
+	}
+
+	var w io.Writer = os.Stderr
+	var closer io.Closer
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open log file: %v", err)
+		}
+		w = f
+		closer = f
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, nil, fmt.Errorf("invalid log format \"%s\" (expected text or json)", format)
+	}
+
+	return slog.New(handler), closer, nil
+}
+
+// NewRequestId returns a short random ID, used to match up a client's request with the daemon's log.
+func NewRequestId() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// redactParams makes a copy of a call's parameters that is safe to log.
+// The parameters of auth.* methods are hidden entirely, as are any values whose keys look like secrets.
+func redactParams(method string, params []interface{}) []interface{} {
+	if strings.HasPrefix(method, "auth.") {
+		redacted := make([]interface{}, len(params))
+		for i := range params {
+			redacted[i] = REDACTED_STRING
+		}
+		return redacted
+	}
+	return redactValue(params).([]interface{})
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			if secretKeyRegex.MatchString(key) {
+				redacted[key] = REDACTED_STRING
+			} else {
+				redacted[key] = redactValue(inner)
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, inner := range v {
+			redacted[i] = redactValue(inner)
+		}
+		return redacted
+	}
+	return value
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRedactParams(t *testing.T) {
+	params := []interface{}{
+		map[string]interface{}{
+			"name": "tank/secure",
+			"encryption_options": map[string]interface{}{
+				"passphrase": "hunter2",
+				"key":        "abcdef",
+				"algorithm":  "AES-256-GCM",
+			},
+		},
+	}
+	data, _ := json.Marshal(redactParams("pool.dataset.create", params))
+	str := string(data)
+	if strings.Contains(str, "hunter2") || strings.Contains(str, "abcdef") {
+		t.Error("secrets were not redacted: " + str)
+	}
+	if !strings.Contains(str, "AES-256-GCM") || !strings.Contains(str, "tank/secure") {
+		t.Error("too much was redacted: " + str)
+	}
+
+	// the original parameters are left alone
+	AssertEqual(t, params[0].(map[string]interface{})["encryption_options"].(map[string]interface{})["passphrase"], "hunter2")
+
+	data, _ = json.Marshal(redactParams("auth.login_with_api_key", []interface{}{"1-abcdef"}))
+	AssertEqual(t, string(data), "[\""+REDACTED_STRING+"\"]")
+}
+
+func TestMakeDaemonLogger(t *testing.T) {
+	if _, _, err := makeDaemonLogger("loud", "text", ""); err == nil {
+		t.Error("an invalid log level was accepted")
+	}
+	if _, _, err := makeDaemonLogger("info", "xml", ""); err == nil {
+		t.Error("an invalid log format was accepted")
+	}
+
+	logFile := path.Join(t.TempDir(), "tncdaemon.log")
+	logger, closer, err := makeDaemonLogger("warn", "json", logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "answer", 42)
+	closer.Close()
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	AssertEqual(t, len(lines), 1)
+
+	var entry map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, entry["msg"].(string), "shown")
+	AssertEqual(t, entry["answer"].(float64), float64(42))
+
+	st, _ := os.Stat(logFile)
+	AssertEqual(t, st.Mode().Perm(), os.FileMode(0600))
+}
+
+func TestDaemonRequestLogging(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	var buf bytes.Buffer
+	d.log = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[{\"password\":\"hunter2\"}]"))
+	request.Header.Set("TNC-Call-Method", "user.update")
+	request.Header.Set("TNC-Request-Id", "abc123")
+	request.Header.Set("TNC-Host-Url", "ws://127.0.0.1:1/api/current")
+	request.Header.Set("TNC-Api-Key", "1-supersecret")
+	ctx := context.WithValue(request.Context(), peerCredentialsKey{}, peerCredentialsResult{cred: PeerCredentials{Uid: d.ownerUid}})
+
+	recorder := httptest.NewRecorder()
+	d.ServeHTTP(recorder, request.WithContext(ctx))
+
+	AssertEqual(t, recorder.Code, 500)
+	AssertEqual(t, recorder.Header().Get("TNC-Request-Id"), "abc123")
+
+	logStr := buf.String()
+	if strings.Contains(logStr, "supersecret") || strings.Contains(logStr, "hunter2") {
+		t.Error("the daemon log contains secrets: " + logStr)
+	}
+
+	var sawFailure bool
+	for _, line := range strings.Split(strings.TrimSpace(logStr), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["msg"] == "request failed" {
+			sawFailure = true
+			AssertEqual(t, entry["request_id"].(string), "abc123")
+			AssertEqual(t, entry["method"].(string), "user.update")
+			if _, exists := entry["duration_ms"]; !exists {
+				t.Error("request failure was logged without a duration")
+			}
+		}
+	}
+	AssertEqual(t, sawFailure, true)
+}
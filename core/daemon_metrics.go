@@ -0,0 +1,335 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds (in seconds) of the histogram buckets for API calls and job waits.
+var callDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+var jobDurationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// The calls to these methods are counted under their own name, and the calls to any other method under "other",
+// since clients can make up as many method names as they like.
+var knownMethodNamespaces = []string{
+	"pool.dataset", "zfs.snapshot", "zfs.dataset", "sharing.nfs",
+	"iscsi.target", "iscsi.extent", "iscsi.targetextent", "iscsi.initiator", "iscsi.portal", "iscsi.auth",
+	"service", "replication", "pool", "user", "api_key",
+}
+var knownMethodVerbs = []string{"query", "get_instance", "create", "update", "delete"}
+var knownMethods = makeKnownMethods()
+
+func makeKnownMethods() map[string]bool {
+	methods := make(map[string]bool)
+	for _, namespace := range knownMethodNamespaces {
+		for _, verb := range knownMethodVerbs {
+			methods[namespace+"."+verb] = true
+		}
+	}
+	for _, method := range []string{
+		"core.bulk", "core.get_jobs", "core.get_methods", "core.job_abort", JOB_WAIT_STRING, "core.ping",
+		"pool.dataset.promote", "zfs.dataset.rename", "zfs.snapshot.clone", "zfs.snapshot.rename", "zfs.snapshot.rollback",
+		"service.start", "service.stop", "service.restart", "service.reload", "service.started",
+		"replication.run_onetime", "system.info",
+	} {
+		methods[method] = true
+	}
+	for _, proc := range []string{
+		"ping", "status", "stop", "reload", "peek_job", "await_job", "watch_job", "subscribe", "unsubscribe", "poll_events",
+	} {
+		methods[TNC_PREFIX_STRING+proc] = true
+	}
+	return methods
+}
+
+// getMethodLabel gives the method label that a call is counted under.
+func getMethodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// daemonMetrics collects the counters and histograms that are exposed in the Prometheus text format.
+// Gauges for the open sessions are computed from the session map at scrape time instead.
+// All methods are safe to call on a nil *daemonMetrics, which collects nothing.
+type daemonMetrics struct {
+	mtx               sync.Mutex
+	calls             map[[2]string]uint64
+	callDurations     map[string]*histogram
+	jobWaitDurations  *histogram
+	reconnects        map[string]uint64
+	reconnectFailures map[string]uint64
+	sessionRetries    uint64
+	clientRetries     uint64
+}
+
+func makeDaemonMetrics() *daemonMetrics {
+	return &daemonMetrics{
+		calls:             make(map[[2]string]uint64),
+		callDurations:     make(map[string]*histogram),
+		jobWaitDurations:  makeHistogram(jobDurationBuckets),
+		reconnects:        make(map[string]uint64),
+		reconnectFailures: make(map[string]uint64),
+	}
+}
+
+func makeHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (m *daemonMetrics) observeCall(method string, isSuccess bool, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	method = getMethodLabel(method)
+	status := "ok"
+	if !isSuccess {
+		status = "error"
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.calls[[2]string{method, status}]++
+	h, exists := m.callDurations[method]
+	if !exists {
+		h = makeHistogram(callDurationBuckets)
+		m.callDurations[method] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func (m *daemonMetrics) observeJobWait(duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	m.jobWaitDurations.observe(duration.Seconds())
+	m.mtx.Unlock()
+}
+
+func (m *daemonMetrics) countReconnect(host string, isSuccess bool) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	if isSuccess {
+		m.reconnects[host]++
+	} else {
+		m.reconnectFailures[host]++
+	}
+	m.mtx.Unlock()
+}
+
+func (m *daemonMetrics) countSessionRetry() {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	m.sessionRetries++
+	m.mtx.Unlock()
+}
+
+func (m *daemonMetrics) countClientRetries(n uint64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.mtx.Lock()
+	m.clientRetries += n
+	m.mtx.Unlock()
+}
+
+// listenMetrics opens the metrics listener, which is either a TCP address or "unix:<path>".
+func listenMetrics(address string) (net.Listener, string, error) {
+	if socketPath, isUnix := strings.CutPrefix(address, "unix:"); isUnix {
+		ls, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, "", err
+		}
+		if err = os.Chmod(socketPath, 0600); err != nil {
+			ls.Close()
+			return nil, "", err
+		}
+		return ls, socketPath, nil
+	}
+	ls, err := net.Listen("tcp", address)
+	return ls, "", err
+}
+
+func (d *DaemonContext) makeMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.writeMetrics(w)
+	})
+	return &http.Server{Handler: mux}
+}
+
+// writeMetrics writes every metric in the Prometheus text exposition format.
+func (d *DaemonContext) writeMetrics(w io.Writer) {
+	type hostCounts struct {
+		sessions     int
+		channels     int
+		pendingCalls int
+		jobs         int
+	}
+	hosts := make(map[string]*hostCounts)
+
+	d.mapMtx.Lock()
+	for _, futures := range d.sessionMap_ {
+		var counts *hostCounts
+		for _, future := range futures {
+			if future == nil {
+				continue
+			}
+			isDone, s, err := future.Peek()
+			if !isDone || err != nil || s == nil {
+				continue
+			}
+			if counts == nil {
+				if counts = hosts[s.url]; counts == nil {
+					counts = &hostCounts{}
+					hosts[s.url] = counts
+				}
+				counts.sessions++
+			}
+			counts.channels++
+			s.connMtx.Lock()
+			counts.pendingCalls += len(s.callMap_)
+			for _, fJob := range s.jobMap_ {
+				if isDone, _, _ := fJob.Peek(); !isDone {
+					counts.jobs++
+				}
+			}
+			s.connMtx.Unlock()
+		}
+	}
+	d.mapMtx.Unlock()
+
+	hostNames := make([]string, 0, len(hosts))
+	for host := range hosts {
+		hostNames = append(hostNames, host)
+	}
+	slices.Sort(hostNames)
+
+	writeMetricHeader(w, "tncdaemon_start_time_seconds", "gauge", "Time at which the daemon started, in seconds since the epoch.")
+	fmt.Fprintf(w, "tncdaemon_start_time_seconds %d\n", d.startTime.Unix())
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(*hostCounts) int
+	}{
+		{"tncdaemon_sessions", "Number of distinct credentials connected to each host.", func(c *hostCounts) int { return c.sessions }},
+		{"tncdaemon_channels", "Number of open websocket connections to each host.", func(c *hostCounts) int { return c.channels }},
+		{"tncdaemon_pending_calls", "Number of API calls waiting for a response from each host.", func(c *hostCounts) int { return c.pendingCalls }},
+		{"tncdaemon_pending_jobs", "Number of jobs being waited on for each host.", func(c *hostCounts) int { return c.jobs }},
+	}
+	for _, g := range gauges {
+		writeMetricHeader(w, g.name, "gauge", g.help)
+		for _, host := range hostNames {
+			fmt.Fprintf(w, "%s{host=\"%s\"} %d\n", g.name, escapeLabel(host), g.value(hosts[host]))
+		}
+	}
+
+	m := d.metrics
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	writeMetricHeader(w, "tncdaemon_calls_total", "counter", "API calls handled by the daemon, by method and outcome.")
+	callKeys := make([][2]string, 0, len(m.calls))
+	for key := range m.calls {
+		callKeys = append(callKeys, key)
+	}
+	slices.SortFunc(callKeys, func(a, b [2]string) int {
+		return strings.Compare(a[0]+"\x00"+a[1], b[0]+"\x00"+b[1])
+	})
+	for _, key := range callKeys {
+		fmt.Fprintf(w, "tncdaemon_calls_total{method=\"%s\",status=\"%s\"} %d\n", escapeLabel(key[0]), key[1], m.calls[key])
+	}
+
+	writeMetricHeader(w, "tncdaemon_call_duration_seconds", "histogram", "Time taken to answer API calls, by method.")
+	methods := make([]string, 0, len(m.callDurations))
+	for method := range m.callDurations {
+		methods = append(methods, method)
+	}
+	slices.Sort(methods)
+	for _, method := range methods {
+		writeHistogram(w, "tncdaemon_call_duration_seconds", "method=\""+escapeLabel(method)+"\"", m.callDurations[method])
+	}
+
+	writeMetricHeader(w, "tncdaemon_job_wait_duration_seconds", "histogram", "Time that clients spent waiting for jobs to complete.")
+	writeHistogram(w, "tncdaemon_job_wait_duration_seconds", "", m.jobWaitDurations)
+
+	writeCounterByHost(w, "tncdaemon_reconnects_total", "Successful reconnections to each host after a connection was lost.", m.reconnects)
+	writeCounterByHost(w, "tncdaemon_reconnect_failures_total", "Sessions that were given up on after failing to reconnect to each host.", m.reconnectFailures)
+
+	writeMetricHeader(w, "tncdaemon_session_retries_total", "counter", "Calls that the daemon retried on a new session after their session was lost.")
+	fmt.Fprintf(w, "tncdaemon_session_retries_total %d\n", m.sessionRetries)
+
+	writeMetricHeader(w, "tncdaemon_client_retries_total", "counter", "Retries that clients needed to reach the daemon, as reported by the clients.")
+	fmt.Fprintf(w, "tncdaemon_client_retries_total %d\n", m.clientRetries)
+}
+
+func writeMetricHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeHistogram(w io.Writer, name string, labels string, h *histogram) {
+	prefix := ""
+	if labels != "" {
+		prefix = labels + ","
+	}
+	for i, upperBound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, prefix, upperBound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func writeCounterByHost(w io.Writer, name string, help string, counts map[string]uint64) {
+	writeMetricHeader(w, name, "counter", help)
+	hosts := make([]string, 0, len(counts))
+	for host := range counts {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s{host=\"%s\"} %d\n", name, escapeLabel(host), counts[host])
+	}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
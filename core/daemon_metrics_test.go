@@ -0,0 +1,105 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemonMetricsOutput(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+	d.metrics = makeDaemonMetrics()
+
+	addTestSession(d, "key1", "wss://host-a/api/current", 0)
+	s := addTestSession(d, "key1", "wss://host-a/api/current", 1)
+	addTestSession(d, "key2", "wss://host-b/api/current", 0)
+	s.callMap_[1] = MakeFuture[json.RawMessage]()
+	s.jobMap_[7] = MakeFuture[json.RawMessage]()
+
+	d.metrics.observeCall("pool.dataset.query", true, 20*time.Millisecond)
+	d.metrics.observeCall("pool.dataset.query", true, 3*time.Second)
+	d.metrics.observeCall("pool.dataset.create", false, time.Millisecond)
+	d.metrics.observeCall("made.up.method1", true, time.Millisecond)
+	d.metrics.observeCall("made.up.method2", true, time.Millisecond)
+	d.metrics.observeJobWait(45 * time.Second)
+	d.metrics.countReconnect("wss://host-a/api/current", true)
+	d.metrics.countReconnect("wss://host-b/api/current", false)
+	d.metrics.countSessionRetry()
+	d.metrics.countClientRetries(3)
+
+	var buf bytes.Buffer
+	d.writeMetrics(&buf)
+	out := buf.String()
+
+	expected := []string{
+		"# TYPE tncdaemon_calls_total counter",
+		"tncdaemon_calls_total{method=\"pool.dataset.query\",status=\"ok\"} 2",
+		"tncdaemon_calls_total{method=\"pool.dataset.create\",status=\"error\"} 1",
+		"tncdaemon_calls_total{method=\"other\",status=\"ok\"} 2",
+		"# TYPE tncdaemon_call_duration_seconds histogram",
+		"tncdaemon_call_duration_seconds_bucket{method=\"pool.dataset.query\",le=\"0.025\"} 1",
+		"tncdaemon_call_duration_seconds_bucket{method=\"pool.dataset.query\",le=\"5\"} 2",
+		"tncdaemon_call_duration_seconds_bucket{method=\"pool.dataset.query\",le=\"+Inf\"} 2",
+		"tncdaemon_call_duration_seconds_count{method=\"pool.dataset.query\"} 2",
+		"tncdaemon_job_wait_duration_seconds_bucket{le=\"30\"} 0",
+		"tncdaemon_job_wait_duration_seconds_bucket{le=\"60\"} 1",
+		"tncdaemon_job_wait_duration_seconds_sum 45",
+		"tncdaemon_sessions{host=\"wss://host-a/api/current\"} 1",
+		"tncdaemon_channels{host=\"wss://host-a/api/current\"} 2",
+		"tncdaemon_channels{host=\"wss://host-b/api/current\"} 1",
+		"tncdaemon_pending_calls{host=\"wss://host-a/api/current\"} 1",
+		"tncdaemon_pending_jobs{host=\"wss://host-a/api/current\"} 1",
+		"tncdaemon_reconnects_total{host=\"wss://host-a/api/current\"} 1",
+		"tncdaemon_reconnect_failures_total{host=\"wss://host-b/api/current\"} 1",
+		"tncdaemon_session_retries_total 1",
+		"tncdaemon_client_retries_total 3",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics output is missing %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestDaemonMetricsCountRequests(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+	d.metrics = makeDaemonMetrics()
+
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", nil)
+		request.Header.Set("TNC-Call-Method", TNC_PREFIX_STRING+"ping")
+		if i == 1 {
+			request.Header.Set("TNC-Retry-Count", "2")
+		}
+		ctx := context.WithValue(request.Context(), peerCredentialsKey{}, peerCredentialsResult{cred: PeerCredentials{Uid: d.ownerUid}})
+		d.ServeHTTP(httptest.NewRecorder(), request.WithContext(ctx))
+	}
+
+	server := httptest.NewServer(d.makeMetricsServer().Handler)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	out := string(data)
+
+	AssertEqual(t, response.StatusCode, 200)
+	AssertEqual(t, strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain"), true)
+	if !strings.Contains(out, "tncdaemon_calls_total{method=\"tnc_daemon.ping\",status=\"ok\"} 2\n") {
+		t.Error("ping calls were not counted:\n" + out)
+	}
+	if !strings.Contains(out, "tncdaemon_client_retries_total 2\n") {
+		t.Error("client retries were not counted:\n" + out)
+	}
+}
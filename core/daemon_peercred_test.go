@@ -0,0 +1,143 @@
+//go:build linux
+
+package core
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+// serveOverUnixSocket serves the daemon on a socket in a temporary directory, returning a client for it.
+func serveOverUnixSocket(t *testing.T, d *DaemonContext, isShared bool) (*http.Client, string) {
+	socketPath := path.Join(t.TempDir(), "tncdaemon.sock")
+	ls, err := listenDaemonSocket(socketPath, isShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := d.makeHttpServer()
+	go server.Serve(ls)
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return makeDaemonHttpClient(socketPath), socketPath
+}
+
+func pingDaemon(t *testing.T, client *http.Client) (int, string) {
+	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", nil)
+	request.Header.Set("TNC-Call-Method", "tnc_daemon.ping")
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	return response.StatusCode, string(data)
+}
+
+func TestDaemonSocketPermissions(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	_, socketPath := serveOverUnixSocket(t, d, false)
+	st, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, st.Mode().Perm(), os.FileMode(0600))
+
+	_, socketPath = serveOverUnixSocket(t, d, true)
+	st, err = os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, st.Mode().Perm(), os.FileMode(0666))
+}
+
+func TestDaemonAllowsOwner(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+	d.ownerUid = os.Getuid()
+
+	client, _ := serveOverUnixSocket(t, d, false)
+	status, body := pingDaemon(t, client)
+	AssertEqual(t, status, 200)
+	AssertEqual(t, body, "\"pong\"")
+}
+
+func TestDaemonRefusesOtherUsers(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+	d.ownerUid = os.Getuid() + 1
+	d.allowUids = []int{os.Getuid() + 2}
+	d.allowGids = []int{os.Getgid() + 1}
+
+	client, _ := serveOverUnixSocket(t, d, true)
+	status, _ := pingDaemon(t, client)
+	AssertEqual(t, status, 403)
+}
+
+func TestDaemonAllowList(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+	d.ownerUid = os.Getuid() + 1
+	d.allowUids = []int{os.Getuid()}
+
+	client, _ := serveOverUnixSocket(t, d, true)
+	status, _ := pingDaemon(t, client)
+	AssertEqual(t, status, 200)
+
+	d2 := makeTestDaemonContext()
+	defer d2.timeoutTimer.Stop()
+	d2.ownerUid = os.Getuid() + 1
+	d2.allowGids = []int{os.Getgid()}
+
+	client, _ = serveOverUnixSocket(t, d2, true)
+	status, _ = pingDaemon(t, client)
+	AssertEqual(t, status, 200)
+}
+
+func TestDaemonAllowsSupplementaryGroup(t *testing.T) {
+	supplementaryGid := os.Getgid() + 1
+	for _, groups := range [][]int{{supplementaryGid}, {supplementaryGid + 1}} {
+		d := makeTestDaemonContext()
+		defer d.timeoutTimer.Stop()
+		d.ownerUid = os.Getuid() + 1
+		d.allowGids = []int{supplementaryGid}
+		var lookedUpPid int
+		d.lookupGroups = func(pid int) ([]int, error) {
+			lookedUpPid = pid
+			return groups, nil
+		}
+
+		client, _ := serveOverUnixSocket(t, d, true)
+		status, _ := pingDaemon(t, client)
+		if groups[0] == supplementaryGid {
+			AssertEqual(t, status, 200)
+		} else {
+			AssertEqual(t, status, 403)
+		}
+		AssertEqual(t, lookedUpPid, os.Getpid())
+	}
+}
+
+func TestGetPeerGroups(t *testing.T) {
+	groups, err := getPeerGroups(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.Getgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(groups)
+	slices.Sort(expected)
+	if !slices.Equal(groups, expected) {
+		t.Errorf("expected the groups of this process to be %v, got %v", expected, groups)
+	}
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// SD_LISTEN_FDS_START is the first file descriptor passed by systemd socket activation.
+const SD_LISTEN_FDS_START = 3
+
+// The sockets passed by systemd stay open for the lifetime of the process, so that they are still
+// inherited if the daemon re-executes itself to reload (the pid, and therefore LISTEN_PID, is unchanged).
+var g_activationFiles []*os.File
+
+// getSocketActivationFdCount returns the number of sockets that systemd passed to this process, if any.
+func getSocketActivationFdCount() (int, error) {
+	pidStr := os.Getenv("LISTEN_PID")
+	if pidStr == "" {
+		return 0, nil
+	}
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse LISTEN_PID \"%s\": %v", pidStr, err)
+	}
+	if pid != os.Getpid() {
+		return 0, nil
+	}
+
+	nFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nFds < 0 {
+		return 0, fmt.Errorf("could not parse LISTEN_FDS \"%s\"", os.Getenv("LISTEN_FDS"))
+	}
+	return nFds, nil
+}
+
+// socketActivationListener returns the daemon's socket if it was passed in by systemd, otherwise nil.
+func socketActivationListener() (net.Listener, error) {
+	nFds, err := getSocketActivationFdCount()
+	if err != nil || nFds == 0 {
+		return nil, err
+	}
+	if nFds > 1 {
+		return nil, fmt.Errorf("expected one socket from systemd, got %d", nFds)
+	}
+
+	if len(g_activationFiles) == 0 {
+		g_activationFiles = append(g_activationFiles, os.NewFile(uintptr(SD_LISTEN_FDS_START), "LISTEN_FD_3"))
+	}
+	ls, err := net.FileListener(g_activationFiles[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on the socket passed by systemd: %v", err)
+	}
+	if _, ok := ls.(*net.UnixListener); !ok {
+		ls.Close()
+		return nil, fmt.Errorf("the socket passed by systemd is not a unix socket")
+	}
+	return ls, nil
+}
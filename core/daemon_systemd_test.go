@@ -0,0 +1,32 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSocketActivationFdCount(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	n, err := getSocketActivationFdCount()
+	AssertEqual(t, n, 0)
+	AssertEqual(t, err, nil)
+
+	// the sockets were meant for a different process
+	t.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	n, err = getSocketActivationFdCount()
+	AssertEqual(t, n, 0)
+	AssertEqual(t, err, nil)
+
+	t.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+	n, err = getSocketActivationFdCount()
+	AssertEqual(t, n, 1)
+	AssertEqual(t, err, nil)
+
+	t.Setenv("LISTEN_FDS", "x")
+	if _, err = getSocketActivationFdCount(); err == nil {
+		t.Error("expected an error for an invalid LISTEN_FDS")
+	}
+}
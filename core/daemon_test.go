@@ -0,0 +1,850 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"truenas/truenas_incus_ctl/truenas_api"
+	"truenas/truenas_incus_ctl/truenastest"
+
+	"github.com/gorilla/websocket"
+)
+
+func makeTestDaemonContext() *DaemonContext {
+	return &DaemonContext{
+		timeoutValue:  time.Minute,
+		timeoutTimer:  time.NewTimer(time.Minute),
+		startTime:     time.Now(),
+		shutdownCh:    make(chan ShutdownRequest, 1),
+		mapMtx:        &sync.Mutex{},
+		watcherMtx:    &sync.Mutex{},
+		subscribeMtx:  &sync.Mutex{},
+		lastActivity_: time.Now(),
+		sessionMap_:   make(map[string][]*Future[*TruenasSession]),
+		watcherMap_:   make(map[int64]*eventWatcher),
+		eventSubs_:    make(map[string]*eventSubscription),
+	}
+}
+
+func addTestSession(d *DaemonContext, sessionKey string, url string, channel int) *TruenasSession {
+	s := &TruenasSession{
+		url:          url,
+		ctx:          d,
+		sessionKey:   sessionKey,
+		channel:      channel,
+		createdAt:    time.Now(),
+		connMtx:      &sync.Mutex{},
+		lastUsed_:    time.Now(),
+		callMap_:     make(map[int64]*Future[json.RawMessage]),
+		callInfoMap_: make(map[int64]*pendingCall),
+		jobMap_:      make(map[int64]*Future[json.RawMessage]),
+	}
+	f := MakeFuture[*TruenasSession]()
+	f.Complete(s)
+	d.sessionMap_[sessionKey] = append(d.sessionMap_[sessionKey], f)
+	return s
+}
+
+// asOwner gives the request the peer credentials of the user that runs the daemon, as ServeHTTP would for the owner.
+func asOwner(d *DaemonContext, request *http.Request) *http.Request {
+	ctx := context.WithValue(request.Context(), peerCredentialsKey{}, peerCredentialsResult{cred: PeerCredentials{Uid: d.ownerUid}})
+	return request.WithContext(ctx)
+}
+
+// asOtherUser gives the request the peer credentials of an allow-listed user other than the daemon's owner.
+func asOtherUser(d *DaemonContext, request *http.Request) *http.Request {
+	ctx := context.WithValue(request.Context(), peerCredentialsKey{}, peerCredentialsResult{cred: PeerCredentials{Uid: d.ownerUid + 1}})
+	return request.WithContext(ctx)
+}
+
+func TestDaemonStatus(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	s0 := addTestSession(d, "wss://b/api/currentsecretfalse", "wss://b/api/current", 0)
+	s1 := addTestSession(d, "wss://b/api/currentsecretfalse", "wss://b/api/current", 1)
+	addTestSession(d, "wss://a/api/currentothersecretfalse", "wss://a/api/current", 0)
+
+	s0.callMap_[1] = MakeFuture[json.RawMessage]()
+	s0.jobMap_[7] = MakeFuture[json.RawMessage]()
+	s1.jobMap_[5] = MakeFuture[json.RawMessage]()
+	s1.jobMap_[5].Complete(json.RawMessage("{\"state\":\"SUCCESS\"}"))
+
+	out, err := d.getStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status map[string]interface{}
+	if err = json.Unmarshal(out, &status); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, errMsg := ExtractJsonArrayOfMaps(status, "sessions")
+	if errMsg != "" {
+		t.Fatal(errMsg)
+	}
+	AssertEqual(t, len(sessions), 2)
+	AssertEqual(t, sessions[0]["host"].(string), "wss://a/api/current")
+	AssertEqual(t, sessions[0]["channels"].(float64), float64(1))
+	AssertEqual(t, sessions[1]["host"].(string), "wss://b/api/current")
+	AssertEqual(t, sessions[1]["channels"].(float64), float64(2))
+	AssertEqual(t, sessions[1]["calls"].(float64), float64(1))
+
+	jobs, _ := ExtractJsonArrayOfMaps(sessions[1], "jobs")
+	AssertEqual(t, len(jobs), 2)
+	AssertEqual(t, jobs[0]["id"].(float64), float64(5))
+	AssertEqual(t, jobs[0]["state"].(string), "SUCCESS")
+	AssertEqual(t, jobs[1]["id"].(float64), float64(7))
+	AssertEqual(t, jobs[1]["state"].(string), "WAITING")
+
+	AssertEqual(t, status["timeout"].(string), "1m0s")
+	if _, exists := status["timeout_remaining"]; !exists {
+		t.Error("timeout_remaining was missing from the daemon status")
+	}
+	if strings.Contains(string(out), "secret") {
+		t.Error("daemon status leaked a session key: " + string(out))
+	}
+}
+
+func TestDaemonShutdownProcedure(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[\"5s\"]"))
+	request.Header.Set("TNC-Call-Method", "tnc_daemon.reload")
+	if isPeerCredSupported {
+		if _, err := d.serveImpl(asOtherUser(d, request)); err == nil {
+			t.Fatal("tnc_daemon.reload was accepted from a user other than the daemon's owner")
+		}
+	}
+	if _, err := d.serveImpl(asOwner(d, request)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case req := <-d.shutdownCh:
+		AssertEqual(t, req.DrainTimeout, time.Duration(5)*time.Second)
+		AssertEqual(t, req.ShouldReload, true)
+	default:
+		t.Fatal("tnc_daemon.reload did not request a shutdown")
+	}
+
+	request, _ = http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[\"soon\"]"))
+	request.Header.Set("TNC-Call-Method", "tnc_daemon.stop")
+	if _, err := d.serveImpl(asOwner(d, request)); err == nil {
+		t.Error("tnc_daemon.stop accepted an invalid duration")
+	}
+}
+
+func TestDaemonRejectsCallsWhileDraining(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+	d.isDraining_ = true
+
+	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[]"))
+	request.Header.Set("TNC-Call-Method", "pool.dataset.query")
+	request.Header.Set("TNC-Host-Url", "wss://a/api/current")
+	request.Header.Set("TNC-Api-Key", "secret")
+	if _, err := d.serveImpl(request); err == nil {
+		t.Error("a call was accepted while the daemon was draining")
+	}
+
+	request, _ = http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[]"))
+	request.Header.Set("TNC-Call-Method", "tnc_daemon.status")
+	if _, err := d.serveImpl(asOwner(d, request)); err != nil {
+		t.Error(err)
+	}
+	if isPeerCredSupported {
+		if _, err := d.serveImpl(asOtherUser(d, request)); err == nil {
+			t.Error("tnc_daemon.status was accepted from a user other than the daemon's owner")
+		}
+	}
+}
+
+func TestFailPendingFutures(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	s := addTestSession(d, "key", "wss://a/api/current", 0)
+	s.callMap_[1] = MakeFuture[json.RawMessage]()
+	s.jobMap_[2] = MakeFuture[json.RawMessage]()
+	s.jobMap_[3] = MakeFuture[json.RawMessage]()
+	s.jobMap_[3].Complete(json.RawMessage("{\"state\":\"SUCCESS\"}"))
+
+	AssertEqual(t, s.failPendingFutures(errors.New("shutting down")), 2)
+
+	_, err := s.callMap_[1].Get()
+	AssertEqual(t, err.Error(), "shutting down")
+	_, err = s.jobMap_[2].Get()
+	AssertEqual(t, err.Error(), "shutting down")
+	_, err = s.jobMap_[3].Get()
+	AssertEqual(t, err, nil)
+}
+
+func TestLostSessionOnlyRetriesReplayableCalls(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	s := addTestSession(d, "key", "wss://a/api/current", 0)
+	// calls are held back while reconnecting, so nothing is written to the missing connection
+	s.isReconnecting_ = true
+
+	for _, method := range []string{"pool.dataset.query", "pool.dataset.create"} {
+		type result struct {
+			err         error
+			shouldRetry bool
+		}
+		resultCh := make(chan result, 1)
+		go func() {
+			_, err, shouldRetry := s.callJson(context.Background(), method, "10s", []interface{}{})
+			resultCh <- result{err, shouldRetry}
+		}()
+		for s.failPendingFutures(fmt.Errorf("%w: reconnecting failed", errSessionLost)) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		r := <-resultCh
+		if r.err == nil {
+			t.Fatal(method + " succeeded on a lost session")
+		}
+		AssertEqual(t, r.shouldRetry, isReplayableMethod(method))
+	}
+}
+
+// startDroppingServer answers just enough of the TrueNAS API for a session to log in, but drops the connection
+// the first time it receives each of the methods in dropOnce.
+func startDroppingServer(t *testing.T, dropOnce []string, jobs []interface{}) (*httptest.Server, *int32) {
+	t.Helper()
+	var nLogins int32
+	dropped := make(map[string]bool)
+	mtx := &sync.Mutex{}
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var request map[string]interface{}
+			if err = conn.ReadJSON(&request); err != nil {
+				return
+			}
+			method, _ := request["method"].(string)
+			var result interface{} = true
+			switch method {
+			case "auth.login_with_api_key":
+				atomic.AddInt32(&nLogins, 1)
+			case "core.get_jobs":
+				result = jobs
+			case "core.job_wait":
+				result = 100
+			default:
+				mtx.Lock()
+				shouldDrop := slices.Contains(dropOnce, method) && !dropped[method]
+				dropped[method] = true
+				mtx.Unlock()
+				if shouldDrop {
+					return
+				}
+				result = []interface{}{method}
+			}
+			_ = conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": request["id"], "result": result})
+		}
+	}))
+	return server, &nLogins
+}
+
+func makeTestLogin(server *httptest.Server) LoginInfo {
+	return LoginInfo{
+		call: CallInfo{
+			method: "auth.login_with_api_key",
+			params: []interface{}{"secret"},
+		},
+		serverUrl: "ws" + strings.TrimPrefix(server.URL, "http"),
+	}
+}
+
+func TestDaemonReconnectReplaysQueries(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	server, nLogins := startDroppingServer(t, []string{"pool.dataset.query", "pool.dataset.create"}, nil)
+	defer server.Close()
+
+	s, err := d.createSession("key", makeTestLogin(server), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	out, err, _ := s.callJson(context.Background(), "pool.dataset.query", "10s", []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "pool.dataset.query") {
+		t.Error("unexpected response to replayed query: " + string(out))
+	}
+	AssertEqual(t, atomic.LoadInt32(nLogins), int32(2))
+
+	_, err, shouldRetry := s.callJson(context.Background(), "pool.dataset.create", "10s", []interface{}{})
+	if err == nil {
+		t.Error("a call that is not safe to repeat was replayed after reconnecting")
+	}
+	AssertEqual(t, shouldRetry, false)
+
+	// calls made while the session is reconnecting are held back until it is ready
+	_, err, _ = s.callJson(context.Background(), "pool.dataset.create", "10s", []interface{}{})
+	AssertEqual(t, err, nil)
+	s.connMtx.Lock()
+	AssertEqual(t, s.reconnects_, 2)
+	s.connMtx.Unlock()
+}
+
+func TestDaemonReconnectReattachesJobs(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	jobs := []interface{}{
+		map[string]interface{}{"id": 5, "state": "SUCCESS", "result": "done"},
+		map[string]interface{}{"id": 6, "state": "RUNNING"},
+	}
+	server, _ := startDroppingServer(t, []string{"pool.dataset.query"}, jobs)
+	defer server.Close()
+
+	s, err := d.createSession("key", makeTestLogin(server), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	fJobs := make(map[int64]*Future[json.RawMessage])
+	s.connMtx.Lock()
+	for _, id := range []int64{5, 6, 7} {
+		fJobs[id] = MakeFuture[json.RawMessage]()
+		s.jobMap_[id] = fJobs[id]
+	}
+	s.connMtx.Unlock()
+
+	if _, err, _ = s.callJson(context.Background(), "pool.dataset.query", "10s", []interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := fJobs[5].Get()
+	AssertEqual(t, err, nil)
+	var job map[string]interface{}
+	_ = json.Unmarshal(out, &job)
+	AssertEqual(t, job["result"], "done")
+
+	AssertEqual(t, getJobFutureState(s.getJobFuture(6)), "WAITING")
+
+	_, err = fJobs[7].Get()
+	if err == nil {
+		t.Error("a job that no longer exists was not failed after reconnecting")
+	}
+
+	// the jobs that were resolved are no longer tracked
+	s.connMtx.Lock()
+	AssertEqual(t, len(s.jobMap_), 1)
+	s.connMtx.Unlock()
+}
+
+// startHangingServer stops reading from its first connection once the session has logged in and subscribed,
+// so that it no longer answers pings. Later connections behave normally.
+func startHangingServer(stopCh chan struct{}) (*httptest.Server, *int32) {
+	var nConns int32
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		isFirst := atomic.AddInt32(&nConns, 1) == 1
+		for {
+			var request map[string]interface{}
+			if err = conn.ReadJSON(&request); err != nil {
+				return
+			}
+			var result interface{} = true
+			if request["method"] == "core.get_jobs" {
+				result = []interface{}{}
+			}
+			_ = conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": request["id"], "result": result})
+			if isFirst && request["method"] == "core.subscribe" {
+				<-stopCh
+				return
+			}
+		}
+	}))
+	return server, &nConns
+}
+
+func TestDaemonHeartbeatEvictsIdleSession(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+	d.heartbeat = time.Duration(100) * time.Millisecond
+
+	stopCh := make(chan struct{})
+	server, nConns := startHangingServer(stopCh)
+	defer server.Close()
+	defer close(stopCh)
+
+	s, err := d.createSession("key", makeTestLogin(server), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := MakeFuture[*TruenasSession]()
+	f.Complete(s)
+	d.mapMtx.Lock()
+	d.sessionMap_["key"] = []*Future[*TruenasSession]{f}
+	d.mapMtx.Unlock()
+
+	time.Sleep(time.Duration(500) * time.Millisecond)
+
+	AssertEqual(t, len(d.getAllSessions()), 0)
+	AssertEqual(t, s.isClosed(), true)
+	AssertEqual(t, atomic.LoadInt32(nConns), int32(1))
+}
+
+func TestDaemonHeartbeatReconnectsBusySession(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+	d.heartbeat = time.Duration(100) * time.Millisecond
+
+	stopCh := make(chan struct{})
+	server, nConns := startHangingServer(stopCh)
+	defer server.Close()
+	defer close(stopCh)
+
+	s, err := d.createSession("key", makeTestLogin(server), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	s.connMtx.Lock()
+	s.jobMap_[9] = MakeFuture[json.RawMessage]()
+	s.connMtx.Unlock()
+
+	isDone, _, err := AwaitFutureOrTimeout(s.getJobFuture(9), time.Duration(5)*time.Second)
+	AssertEqual(t, isDone, true)
+	if err == nil || !strings.Contains(err.Error(), "after reconnecting") {
+		t.Errorf("expected job #9 to be lost after reconnecting, got: %v", err)
+	}
+	AssertEqual(t, atomic.LoadInt32(nConns), int32(2))
+}
+
+func makeJobUpdateMessage(jobId int64, state string, percent float64, description string) json.RawMessage {
+	message, _ := json.Marshal(map[string]interface{}{
+		"msg":        "changed",
+		"method":     "collection_update",
+		"collection": "core.get_jobs",
+		"params": map[string]interface{}{
+			"id": jobId,
+			"fields": map[string]interface{}{
+				"id":       jobId,
+				"method":   "pool.dataset.delete",
+				"state":    state,
+				"progress": map[string]interface{}{"percent": percent, "description": description},
+			},
+		},
+	})
+	return message
+}
+
+func TestDaemonWatchJob(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	server, _ := startDroppingServer(t, nil, nil)
+	defer server.Close()
+
+	s, err := d.createSession("key", makeTestLogin(server), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	type watchResult struct {
+		status map[string]interface{}
+		err    error
+	}
+	watch := func(sinceVersion int64) chan watchResult {
+		ch := make(chan watchResult, 1)
+		go func() {
+			out, err := s.handleDaemonProcedure(context.Background(), "watch_job", "10s", []interface{}{float64(5), float64(sinceVersion)})
+			var status map[string]interface{}
+			if err == nil {
+				err = json.Unmarshal(out, &status)
+			}
+			ch <- watchResult{status, err}
+		}()
+		return ch
+	}
+	awaitWatch := func(ch chan watchResult) map[string]interface{} {
+		select {
+		case res := <-ch:
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			return res.status
+		case <-time.After(WATCH_JOB_INTERVAL / 2):
+			t.Fatal("tnc_daemon.watch_job did not return after the job changed")
+		}
+		return nil
+	}
+
+	ch := watch(0)
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	s.handleMessage(makeJobUpdateMessage(5, "RUNNING", 40, "Deleting"))
+	status := awaitWatch(ch)
+	AssertEqual(t, status["done"], false)
+	AssertEqual(t, status["version"].(float64), float64(1))
+	AssertEqual(t, status["percent"].(float64), float64(40))
+	AssertEqual(t, status["description"], "Deleting")
+
+	ch = watch(1)
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	s.handleMessage(makeJobUpdateMessage(5, "SUCCESS", 100, "Done"))
+	status = awaitWatch(ch)
+	AssertEqual(t, status["done"], true)
+	job, _ := status["job"].(map[string]interface{})
+	AssertEqual(t, job["state"], "SUCCESS")
+
+	s.connMtx.Lock()
+	AssertEqual(t, len(s.jobProgress_), 0)
+	AssertEqual(t, len(s.jobMap_), 0)
+	s.connMtx.Unlock()
+}
+
+func TestDaemonAwaitJobCancelled(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	server, _ := startDroppingServer(t, nil, nil)
+	defer server.Close()
+
+	s, err := d.createSession("key", makeTestLogin(server), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	// another client is waiting on the same job, and should not be disturbed by the first one going away
+	otherCh := make(chan error, 1)
+	go func() {
+		_, err := s.handleDaemonProcedure(context.Background(), "await_job", "10s", []interface{}{float64(8)})
+		otherCh <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(200)*time.Millisecond)
+	defer cancel()
+	_, err = s.handleDaemonProcedure(ctx, "await_job", "10s", []interface{}{float64(8)})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected tnc_daemon.await_job to give up along with its context, got: %v", err)
+	}
+
+	s.handleMessage(makeJobUpdateMessage(8, "SUCCESS", 100, "Done"))
+	select {
+	case err = <-otherCh:
+		AssertEqual(t, err, nil)
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("the other wait on job #8 did not complete")
+	}
+
+	// jobs are forgotten once they have been waited on, and jobs that nobody waited on are not tracked at all
+	s.handleMessage(makeJobUpdateMessage(9, "SUCCESS", 100, "Done"))
+	s.connMtx.Lock()
+	AssertEqual(t, len(s.jobMap_), 0)
+	s.connMtx.Unlock()
+}
+
+func TestDaemonConfigNameLookup(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	server, nLogins := startDroppingServer(t, nil, nil)
+	defer server.Close()
+	serverUrl := makeTestLogin(server).serverUrl
+
+	d.configFile = "/home/user/.truenas_incus_ctl/config.json"
+	d.lookupHost = func(configName string) (HostConfig, error) {
+		if configName != "nas" {
+			return HostConfig{}, errors.New("not found")
+		}
+		return HostConfig{Url: serverUrl, ApiKey: "secret"}, nil
+	}
+
+	makeRequest := func(configName string, configFile string) *http.Request {
+		request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[]"))
+		request.Header.Set("TNC-Call-Method", "pool.dataset.query")
+		request.Header.Set("TNC-Config-Name", configName)
+		request.Header.Set("TNC-Config-File", configFile)
+		return asOwner(d, request)
+	}
+
+	out, err := d.serveImpl(makeRequest("nas", d.configFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "pool.dataset.query") {
+		t.Error("unexpected response: " + string(out))
+	}
+
+	if _, err = d.serveImpl(makeRequest("other", d.configFile)); err == nil {
+		t.Error("an unknown config name was accepted")
+	}
+	if _, err = d.serveImpl(makeRequest("nas", "/tmp/other.json")); err == nil {
+		t.Error("a request for a different config file was accepted")
+	}
+	if isPeerCredSupported {
+		if _, err = d.serveImpl(asOtherUser(d, makeRequest("nas", d.configFile))); err == nil {
+			t.Error("a user other than the daemon's owner was given the owner's credentials")
+		}
+	}
+
+	// a client that sends the same key directly shares the session
+	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[]"))
+	request.Header.Set("TNC-Call-Method", "pool.dataset.query")
+	request.Header.Set("TNC-Host-Url", serverUrl)
+	request.Header.Set("TNC-Api-Key", "secret")
+	if _, err = d.serveImpl(request); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, atomic.LoadInt32(nLogins), int32(1))
+
+	d.mapMtx.Lock()
+	AssertEqual(t, len(d.sessionMap_), 1)
+	for sessionKey := range d.sessionMap_ {
+		if strings.Contains(sessionKey, "secret") || strings.Contains(sessionKey, serverUrl) {
+			t.Error("session key contains credentials: " + sessionKey)
+		}
+	}
+	d.mapMtx.Unlock()
+
+	for _, s := range d.getAllSessions() {
+		s.close()
+	}
+}
+
+func TestDaemonConfigNameKeepsHeaderTlsOptions(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	server, _ := startDroppingServer(t, nil, nil)
+	defer server.Close()
+	serverUrl := makeTestLogin(server).serverUrl
+
+	configFingerprint := strings.Repeat("aa", 32)
+	flagFingerprint := strings.Repeat("bb", 32)
+	d.configFile = "/home/user/.truenas_incus_ctl/config.json"
+	d.lookupHost = func(configName string) (HostConfig, error) {
+		return HostConfig{Url: serverUrl, ApiKey: "secret", CertFingerprint: configFingerprint}, nil
+	}
+
+	for _, fingerprint := range []string{"", flagFingerprint} {
+		request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[]"))
+		request.Header.Set("TNC-Call-Method", "pool.dataset.query")
+		request.Header.Set("TNC-Config-Name", "nas")
+		request.Header.Set("TNC-Config-File", d.configFile)
+		request.Header.Set("TNC-Cert-Fingerprint", fingerprint)
+		if _, err := d.serveImpl(asOwner(d, request)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fingerprints := make(map[string]bool)
+	for _, s := range d.getAllSessions() {
+		fingerprints[s.login.certFingerprint] = true
+		s.close()
+	}
+	AssertEqual(t, len(fingerprints), 2)
+	if !fingerprints[configFingerprint] || !fingerprints[flagFingerprint] {
+		t.Errorf("expected a session with the config's fingerprint and one with the flag's, got %v", fingerprints)
+	}
+}
+
+func TestDaemonRefusesFilesFromOtherUsers(t *testing.T) {
+	if !isPeerCredSupported {
+		t.Skip("peer credentials are not supported on this platform")
+	}
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	for _, header := range []string{"TNC-Ca-File", "TNC-Client-Cert", "TNC-Client-Key"} {
+		request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[]"))
+		request.Header.Set("TNC-Call-Method", "pool.dataset.query")
+		request.Header.Set("TNC-Host-Url", "wss://a/api/current")
+		request.Header.Set("TNC-Api-Key", "secret")
+		request.Header.Set(header, "/home/owner/.ssh/key.pem")
+		_, err := d.serveImpl(asOtherUser(d, request))
+		if err == nil || !strings.Contains(err.Error(), header) {
+			t.Errorf("%s was accepted from a user other than the daemon's owner: %v", header, err)
+		}
+	}
+}
+
+func TestDaemonConfigNameWithoutConfig(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", strings.NewReader("[]"))
+	request.Header.Set("TNC-Call-Method", "pool.dataset.query")
+	request.Header.Set("TNC-Config-Name", "nas")
+	if _, err := d.serveImpl(asOwner(d, request)); err == nil {
+		t.Error("TNC-Config-Name was accepted by a daemon without a config file")
+	}
+}
+
+func makeFakeServerLogin(server *truenastest.Server) LoginInfo {
+	return LoginInfo{
+		call: CallInfo{
+			method: "auth.login_with_api_key",
+			params: []interface{}{truenastest.ApiKey},
+		},
+		serverUrl:     server.URL(),
+		allowInsecure: true,
+	}
+}
+
+func TestDaemonJobAgainstFakeServer(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	server := truenastest.NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+	server.SetJobStepDelay(50 * time.Millisecond)
+
+	s, err := d.createSession("key", makeFakeServerLogin(server), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	out, err, _ := s.callJson(context.Background(), "core.bulk", "10s", []interface{}{"pool.dataset.create", []interface{}{
+		[]interface{}{map[string]interface{}{"name": "dozer/a"}},
+		[]interface{}{map[string]interface{}{"name": "dozer/b"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err = json.Unmarshal(out, &response); err != nil {
+		t.Fatal(err)
+	}
+	jobId := int64(response["result"].(float64))
+
+	s.connMtx.Lock()
+	s.jobMap_[jobId] = MakeFuture[json.RawMessage]()
+	s.connMtx.Unlock()
+
+	// the job carries on while the session reconnects, which then picks it up again
+	server.DropConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	isDone, out, err := AwaitFutureOrContext(ctx, s.getJobFuture(jobId))
+	if !isDone {
+		t.Fatal("timed out waiting for the job")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job map[string]interface{}
+	_ = json.Unmarshal(out, &job)
+	AssertEqual(t, job["state"], "SUCCESS")
+	AssertEqual(t, len(job["result"].([]interface{})), 2)
+	AssertEqual(t, strings.Join(server.Datasets(), ","), "dozer,dozer/a,dozer/b")
+}
+
+func TestDaemonPasswordLoginWithOtp(t *testing.T) {
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	server := truenastest.NewServer()
+	defer server.Close()
+	server.SetOtp("123456")
+
+	login := LoginInfo{
+		username:      truenastest.Username,
+		password:      truenastest.Password,
+		serverUrl:     server.URL(),
+		allowInsecure: true,
+	}
+	if _, err := d.createSession("user", login, 0); err == nil {
+		t.Fatal("expected a login without the one-time password to fail")
+	}
+
+	login.otpToken = "123456"
+	s, err := d.createSession("user", login, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	_, err, _ = s.callJson(context.Background(), "pool.dataset.query", "10s", []interface{}{})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, server.CallCount("auth.login_ex_continue"), 1)
+
+	// the one-time password has been used, so the session ends rather than logging in with it again
+	server.DropConnections()
+	_, err, shouldRetry := s.callJson(context.Background(), "pool.dataset.query", "10s", []interface{}{})
+	if !errors.Is(err, truenas_api.ErrOtpRequired) {
+		t.Errorf("expected the call to fail for want of a one-time password, got %v", err)
+	}
+	AssertEqual(t, shouldRetry, false)
+	AssertEqual(t, server.CallCount("auth.login_ex_continue"), 1)
+}
+
+func TestDaemonDialVerifiesCertificate(t *testing.T) {
+	server := truenastest.NewServer()
+	defer server.Close()
+
+	login := LoginInfo{serverUrl: server.URL()}
+	if _, err := dialTruenas(login); err == nil {
+		t.Error("expected the self-signed certificate to be rejected")
+	}
+
+	login.certFingerprint = truenas_api.CertFingerprint(server.Certificate())
+	conn, err := dialTruenas(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+func TestDaemonDialPresentsClientCertificate(t *testing.T) {
+	certFile, keyFile, pool := writeTestClientCert(t)
+	server := truenastest.NewServerRequiringClientCert(pool)
+	defer server.Close()
+
+	d := makeTestDaemonContext()
+	defer d.timeoutTimer.Stop()
+
+	login := makeFakeServerLogin(server)
+	if _, err := d.createSession("key", login, 0); err == nil {
+		t.Fatal("expected the session without a client certificate to fail")
+	}
+
+	login.clientCert = certFile
+	login.clientKey = keyFile
+	s, err := d.createSession("key", login, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+}
@@ -0,0 +1,206 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Job IDs handed out by DryRunSession start above any real job ID, so that they can't be confused with jobs that exist on the host.
+const DRY_RUN_FIRST_JOB_ID = int64(1) << 40
+
+// PlannedCall is a call that a DryRunSession did not send.
+type PlannedCall struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	// Job is true if the method would have been started as a job
+	Job bool `json:"job"`
+}
+
+// IsReadOnlyMethod reports whether a method only reads from TrueNAS, so that it is safe to call during a dry run.
+// The daemon's own tnc_daemon.* methods, eg. for watching events, don't change anything on TrueNAS either.
+func IsReadOnlyMethod(method string) bool {
+	switch method {
+	case "core.get_jobs", "core.get_methods", "core.ping", "service.started", "system.info":
+		return true
+	}
+	return strings.HasPrefix(method, "tnc_daemon.") || strings.HasSuffix(method, ".query") || strings.HasSuffix(method, ".get_instance") || strings.HasSuffix(method, ".config")
+}
+
+// DryRunSession sends read-only calls to Session, while other calls are planned instead of being sent.
+// Planned calls succeed with a result made up from their params, eg. an object passed to a .create method is returned with a placeholder ID,
+// so that commands which chain several calls carry on as they would against the host.
+type DryRunSession struct {
+	Session
+	mtx          sync.Mutex
+	planned      []PlannedCall
+	jobResults   map[int64]interface{}
+	lastObjectId int64
+	nextJobId    int64
+}
+
+func NewDryRunSession(inner Session) *DryRunSession {
+	return &DryRunSession{
+		Session:    inner,
+		jobResults: make(map[int64]interface{}),
+		nextJobId:  DRY_RUN_FIRST_JOB_ID,
+	}
+}
+
+// Planned returns the calls that were not sent, in the order they were made.
+func (s *DryRunSession) Planned() []PlannedCall {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]PlannedCall{}, s.planned...)
+}
+
+func (s *DryRunSession) plan(method string, params interface{}, isJob bool) (interface{}, int64, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, -1, err
+	}
+	var paramsList []interface{}
+	if err = json.Unmarshal(data, &paramsList); err != nil {
+		return nil, -1, fmt.Errorf("%s: Params must be a list: %v", method, err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.planned = append(s.planned, PlannedCall{Method: method, Params: data, Job: isJob})
+	result := s.makeResultLocked(method, paramsList)
+	if !isJob {
+		return result, -1, nil
+	}
+	jobId := s.nextJobId
+	s.nextJobId++
+	s.jobResults[jobId] = result
+	return nil, jobId, nil
+}
+
+// makeResultLocked makes up what TrueNAS would return for a call that was not sent.
+func (s *DryRunSession) makeResultLocked(method string, params []interface{}) interface{} {
+	if method == "core.bulk" {
+		innerMethod, _ := getParam(params, 0).(string)
+		innerParamsList, _ := getParam(params, 1).([]interface{})
+		statuses := make([]interface{}, 0, len(innerParamsList))
+		for _, innerParams := range innerParamsList {
+			paramsList, _ := innerParams.([]interface{})
+			statuses = append(statuses, map[string]interface{}{
+				"job_id": nil,
+				"result": s.makeResultLocked(innerMethod, paramsList),
+				"error":  nil,
+			})
+		}
+		return statuses
+	}
+
+	switch {
+	case strings.HasSuffix(method, ".create"):
+		obj, _ := DeepCopy(getParam(params, 0)).(map[string]interface{})
+		if obj == nil {
+			obj = make(map[string]interface{})
+		}
+		switch method {
+		case "pool.dataset.create":
+			obj["id"] = obj["name"]
+		case "zfs.snapshot.create":
+			obj["id"] = fmt.Sprint(obj["dataset"], "@", obj["name"])
+		default:
+			// negative, so that queries for the new object don't find an existing one instead
+			s.lastObjectId--
+			obj["id"] = s.lastObjectId
+		}
+		return obj
+	case strings.HasSuffix(method, ".update"):
+		obj, _ := DeepCopy(getParam(params, 1)).(map[string]interface{})
+		if obj == nil {
+			obj = make(map[string]interface{})
+		}
+		obj["id"] = getParam(params, 0)
+		return obj
+	case strings.HasSuffix(method, ".delete"), strings.HasPrefix(method, "service."):
+		return true
+	}
+	return nil
+}
+
+func getParam(params []interface{}, idx int) interface{} {
+	if idx < len(params) {
+		return params[idx]
+	}
+	return nil
+}
+
+func (s *DryRunSession) isPlannedJob(jobId int64) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, exists := s.jobResults[jobId]
+	return exists
+}
+
+func (s *DryRunSession) CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	if IsReadOnlyMethod(method) {
+		return s.Session.CallRaw(method, timeoutSeconds, params)
+	}
+	result, _, err := s.plan(method, params, false)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "result": result, "id": len(s.Planned())})
+}
+
+func (s *DryRunSession) CallRawCtx(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	if IsReadOnlyMethod(method) {
+		return s.Session.CallRawCtx(ctx, method, params)
+	}
+	return s.CallRaw(method, 0, params)
+}
+
+func (s *DryRunSession) CallAsyncRaw(method string, params interface{}) (int64, error) {
+	_, jobId, err := s.plan(method, params, true)
+	return jobId, err
+}
+
+func (s *DryRunSession) CallAsyncRawCtx(ctx context.Context, method string, params interface{}) (int64, error) {
+	return s.CallAsyncRaw(method, params)
+}
+
+func (s *DryRunSession) WaitForJob(jobId int64) (json.RawMessage, error) {
+	if !s.isPlannedJob(jobId) {
+		return s.Session.WaitForJob(jobId)
+	}
+	return s.WaitForJobWithProgress(jobId, nil)
+}
+
+func (s *DryRunSession) WaitForJobCtx(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	if !s.isPlannedJob(jobId) {
+		return s.Session.WaitForJobCtx(ctx, jobId)
+	}
+	return s.WaitForJobWithProgress(jobId, nil)
+}
+
+// WaitForJobWithProgress returns the made up result of a planned job straight away, without reporting any progress.
+func (s *DryRunSession) WaitForJobWithProgress(jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	s.mtx.Lock()
+	result, exists := s.jobResults[jobId]
+	s.mtx.Unlock()
+	if !exists {
+		return s.Session.WaitForJobWithProgress(jobId, onProgress)
+	}
+	return json.Marshal(result)
+}
+
+func (s *DryRunSession) WaitForJobWithProgressCtx(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	if !s.isPlannedJob(jobId) {
+		return s.Session.WaitForJobWithProgressCtx(ctx, jobId, onProgress)
+	}
+	return s.WaitForJobWithProgress(jobId, onProgress)
+}
+
+func (s *DryRunSession) SkipWaitingJobOnClose(jobId int64) {
+	if !s.isPlannedJob(jobId) {
+		s.Session.SkipWaitingJobOnClose(jobId)
+	}
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"truenas/truenas_incus_ctl/truenastest"
+)
+
+func TestDryRunAgainstFakeServer(t *testing.T) {
+	server := truenastest.NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+
+	api := NewDryRunSession(&RealSession{HostName: server.HostName(), ApiKey: truenastest.ApiKey, AllowInsecure: true})
+
+	out, err := ApiCall(api, "sharing.nfs.create", 10, []interface{}{map[string]interface{}{"path": "/mnt/dozer"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ := GetResultsAndErrorsFromApiResponseRaw(out)
+	AssertEqual(t, len(results), 1)
+	AssertEqual(t, GetIdFromObject(results[0]), interface{}(float64(-1)))
+
+	jobId, err := ApiCallAsync(api, "core.bulk", []interface{}{"pool.dataset.create", []interface{}{
+		[]interface{}{map[string]interface{}{"name": "dozer/a"}},
+		[]interface{}{map[string]interface{}{"name": "dozer/b"}},
+	}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = api.WaitForJob(jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []map[string]interface{}
+	if err = json.Unmarshal(out, &statuses); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, len(statuses), 2)
+	AssertEqual(t, statuses[1]["result"].(map[string]interface{})["id"], interface{}("dozer/b"))
+
+	// read-only calls still reach the host
+	out, err = ApiCall(api, "pool.dataset.query", 10, []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ = GetResultsAndErrorsFromApiResponseRaw(out)
+	AssertEqual(t, len(results), 1)
+	AssertEqual(t, api.Close(nil), nil)
+
+	AssertEqual(t, strings.Join(server.Datasets(), ","), "dozer")
+	AssertEqual(t, server.CallCount("sharing.nfs.create"), 0)
+	planned := api.Planned()
+	AssertEqual(t, len(planned), 2)
+	AssertEqual(t, planned[0].Method, "sharing.nfs.create")
+	AssertEqual(t, planned[0].Job, false)
+	AssertEqual(t, planned[1].Method, "core.bulk")
+	AssertEqual(t, planned[1].Job, true)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -12,6 +13,8 @@ type Future[T any] struct {
 	wokenUp_ bool
 	value_   T
 	err_     error
+	// closed once the future is reached, so that it can be awaited in a select
+	doneCh   chan struct{}
 }
 
 func MakeFuture[T any]() *Future[T] {
@@ -21,6 +24,7 @@ func MakeFuture[T any]() *Future[T] {
 		cv: sync.NewCond(m),
 		done_: false,
 		err_: nil,
+		doneCh: make(chan struct{}),
 	}
 }
 
@@ -42,6 +46,7 @@ func (f *Future[T]) Reach(value T, err error) {
 		f.err_ = err
 		f.wokenUp_ = false
 		f.done_ = true
+		close(f.doneCh)
 		f.cv.Broadcast()
 	}
 }
@@ -93,35 +98,26 @@ func (f *Future[T]) Interrupt() {
 	f.mtx.Unlock()
 }
 
-// sync.Cond.WaitTimeout(...) doesn't exist yet, so we burn a goroutine and hope for the best
 func AwaitFutureOrTimeout[T any](f *Future[T], timeout time.Duration) (bool, T, error) {
-	doneCh := make(chan []interface{})
-	go func() {
-		completed, value, err := f.MaybeGet()
-		// Only send on the channel if we didn't time out, since if we did there'd be no one receiving so we'd block forever.
-		if completed {
-			doneCh <- []interface{}{value, err}
-		}
-		close(doneCh)
-	}()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
+	isDone, value, err := AwaitFutureOrContext(ctx, f)
+	if !isDone {
+		return false, value, nil
+	}
+	return true, value, err
+}
+
+// AwaitFutureOrContext waits for the future until ctx is done, in which case it returns false along with ctx.Err().
+// Unlike MaybeGet, this doesn't disturb anyone else waiting on the same future.
+func AwaitFutureOrContext[T any](ctx context.Context, f *Future[T]) (bool, T, error) {
 	select {
-	case result := <-doneCh:
-		var value T
-		var err error
-		if result[0] != nil {
-			value = result[0].(T)
-		}
-		if result[1] != nil {
-			err = result[1].(error)
-		}
+	case <-f.doneCh:
+		_, value, err := f.Peek()
 		return true, value, err
-	case <-time.After(timeout):
-		break
+	case <-ctx.Done():
+		var defaultValue T
+		return false, defaultValue, ctx.Err()
 	}
-
-	f.Interrupt()
-
-	var defaultValue T
-	return false, defaultValue, nil
 }
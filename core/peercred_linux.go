@@ -0,0 +1,72 @@
+//go:build linux
+
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const isPeerCredSupported = true
+
+// getPeerCredentials asks the kernel which process is on the other end of a unix socket (SO_PEERCRED).
+func getPeerCredentials(conn net.Conn) (PeerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCredentials{}, fmt.Errorf("connection was not over a unix socket")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return PeerCredentials{}, fmt.Errorf("syscall.GetsockoptUcred: %v", err)
+	}
+
+	return PeerCredentials{Uid: int(ucred.Uid), Gid: int(ucred.Gid), Pid: int(ucred.Pid)}, nil
+}
+
+// getPeerGroups reads the supplementary groups of a process from /proc, as SO_PEERCRED only gives its primary group.
+func getPeerGroups(pid int) ([]int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields, isGroups := strings.CutPrefix(line, "Groups:")
+		if !isGroups {
+			continue
+		}
+		groups := make([]int, 0)
+		for _, field := range strings.Fields(fields) {
+			gid, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid group \"%s\" in /proc/%d/status", field, pid)
+			}
+			groups = append(groups, gid)
+		}
+		return groups, nil
+	}
+	return nil, fmt.Errorf("/proc/%d/status has no Groups line", pid)
+}
+
+// isOwnedByCurrentUser reports whether a daemon socket was created by this user, ie. whether the daemon
+// will treat this user as its owner.
+func isOwnedByCurrentUser(st fs.FileInfo) bool {
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	return !ok || int(sys.Uid) == os.Getuid()
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+)
+
+// Without SO_PEERCRED, the daemon relies on the permissions of its socket alone.
+const isPeerCredSupported = false
+
+func getPeerCredentials(conn net.Conn) (PeerCredentials, error) {
+	return PeerCredentials{}, fmt.Errorf("peer credentials are not supported on this platform")
+}
+
+func getPeerGroups(pid int) ([]int, error) {
+	return nil, fmt.Errorf("peer groups are not supported on this platform")
+}
+
+func isOwnedByCurrentUser(st fs.FileInfo) bool {
+	return true
+}
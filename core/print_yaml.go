@@ -0,0 +1,110 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// WriteYaml writes a decoded JSON value, eg. an API result, as a YAML document. Object keys are sorted.
+func WriteYaml(builder *strings.Builder, value interface{}) {
+	if isNonEmptyCollection(value) {
+		writeYamlCollection(builder, value, "")
+	} else {
+		builder.WriteString(yamlScalar(value))
+		builder.WriteString("\n")
+	}
+}
+
+func isNonEmptyCollection(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	return false
+}
+
+func writeYamlCollection(builder *strings.Builder, value interface{}, indent string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range GetKeysSorted(v) {
+			builder.WriteString(indent)
+			builder.WriteString(yamlString(key))
+			builder.WriteString(":")
+			writeYamlChild(builder, v[key], indent)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			builder.WriteString(indent)
+			builder.WriteString("-")
+			if isNonEmptyCollection(elem) {
+				// the first line of a nested collection goes on the same line as its "-"
+				var nested strings.Builder
+				writeYamlCollection(&nested, elem, indent+"  ")
+				builder.WriteString(" ")
+				builder.WriteString(nested.String()[len(indent)+2:])
+			} else {
+				builder.WriteString(" ")
+				builder.WriteString(yamlScalar(elem))
+				builder.WriteString("\n")
+			}
+		}
+	}
+}
+
+func writeYamlChild(builder *strings.Builder, value interface{}, indent string) {
+	if isNonEmptyCollection(value) {
+		builder.WriteString("\n")
+		writeYamlCollection(builder, value, indent+"  ")
+	} else {
+		builder.WriteString(" ")
+		builder.WriteString(yamlScalar(value))
+		builder.WriteString("\n")
+	}
+}
+
+func yamlScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	case string:
+		return yamlString(v)
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	}
+	return yamlString(fmt.Sprint(value))
+}
+
+// Plain strings that YAML would read as something other than the same string, eg. booleans, numbers and dates
+var yamlAmbiguousRegex = regexp.MustCompile(`^(?i:true|false|yes|no|on|off|y|n|null|~|` +
+	`[-+]?\.(inf|nan)|[-+]?[0-9][0-9_]*(\.[0-9_]*)?(e[-+]?[0-9]+)?|[-+]?\.[0-9]+(e[-+]?[0-9]+)?|` +
+	`0x[0-9a-f]+|0o[0-7]+|[0-9]+(:[0-5]?[0-9])+(\.[0-9_]*)?|[0-9]{4}-[0-9]{1,2}-[0-9]{1,2}.*)$`)
+
+func yamlString(str string) string {
+	needsQuotes := str == "" ||
+		yamlAmbiguousRegex.MatchString(str) ||
+		strings.ContainsAny(str[:1], "-?:,[]{}#&*!|>'\"%@` \t") ||
+		strings.HasSuffix(str, " ") ||
+		strings.Contains(str, ": ") ||
+		strings.Contains(str, " #") ||
+		strings.HasSuffix(str, ":") ||
+		strings.IndexFunc(str, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0
+	if !needsQuotes {
+		return str
+	}
+	// a JSON string is also a valid double-quoted YAML string
+	data, _ := json.Marshal(str)
+	return string(data)
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteYaml(t *testing.T) {
+	var value interface{}
+	err := json.Unmarshal([]byte(`{"targets":[{"id":1,"groups":[{"portal":1}],"alias":null},[1,"2",true]],`+
+		`"name":"- not a list","empty":{},"when":"2024-05-01","size":"1K","enabled":"on"}`), &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var builder strings.Builder
+	WriteYaml(&builder, value)
+	AssertEqual(t, builder.String(), ""+
+		"empty: {}\n"+
+		"enabled: \"on\"\n"+
+		"name: \"- not a list\"\n"+
+		"size: 1K\n"+
+		"targets:\n"+
+		"  - alias: null\n"+
+		"    groups:\n"+
+		"      - portal: 1\n"+
+		"    id: 1\n"+
+		"  - - 1\n"+
+		"    - \"2\"\n"+
+		"    - true\n"+
+		"when: \"2024-05-01\"\n")
+}
@@ -1,10 +1,12 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	//"strconv"
 	"strings"
+	"sync"
 	"time"
 	"encoding/json"
 	"truenas/truenas_incus_ctl/truenas_api"
@@ -21,13 +23,27 @@ type ApiJobResult struct {
 type RealSession struct {
 	HostName string
 	ApiKey string
+	// Username and Password are used to log in when there is no API key, along with OtpToken if the user has two-factor authentication
+	Username string
+	Password string
+	OtpToken string
 	IsDebug bool
 	AllowInsecure bool
+	// CaFile and CertFingerprint verify a host whose certificate isn't trusted by the system, see truenas_api.TLSOptions
+	CaFile string
+	CertFingerprint string
+	// ClientCert and ClientKey are presented to hosts that require a client certificate
+	ClientCert string
+	ClientKey string
+	// Context bounds the calls that are not given a context of their own, eg. so that SIGINT cancels them
+	Context context.Context
 	client *truenas_api.Client
 	subscribedToJobs bool
 	resultsQueue *SimpleQueue[ApiJobResult]
 	jobsList []int64
 	mapSkipWaitOnClose map[int64]bool
+	progressMtx sync.Mutex
+	progressCallbacks map[int64]func(JobProgress)
 }
 
 func (s *RealSession) IsLoggedIn() bool {
@@ -45,17 +61,26 @@ func (s *RealSession) Login() error {
 		_ = s.Close(nil)
 	}
 
-	if s.HostName == "" || s.ApiKey == "" {
-		return errors.New("Hostname and API key were not provided")
+	if s.HostName == "" {
+		return errors.New("Hostname was not provided")
+	}
+	if s.ApiKey == "" && (s.Username == "" || s.Password == "") {
+		return errors.New("API key was not provided, nor username and password")
 	}
 
 	if s.resultsQueue == nil {
 		s.resultsQueue = MakeSimpleQueue[ApiJobResult]()
 	}
 
-	client, err := truenas_api.NewClientWithCallback(
+	client, err := truenas_api.NewClientWithOptions(
 		GetApiUrlFromHostName(s.HostName),
-		s.AllowInsecure,
+		truenas_api.TLSOptions{
+			AllowInsecure: s.AllowInsecure,
+			CaFile: s.CaFile,
+			CertFingerprint: s.CertFingerprint,
+			ClientCert: s.ClientCert,
+			ClientKey: s.ClientKey,
+		},
 		func(waitingJobId int64, innerJobId int64, params map[string]interface{}) {
 			s.HandleJobUpdate(waitingJobId, innerJobId, params)
 		},
@@ -64,7 +89,11 @@ func (s *RealSession) Login() error {
 		return errors.New("Failed to create client: " + err.Error())
 	}
 
-	err = client.Login("", "", s.ApiKey)
+	if s.ApiKey != "" {
+		err = client.Login("", "", s.ApiKey)
+	} else {
+		err = client.LoginWithPassword(s.Username, s.Password, s.getOtpToken)
+	}
 	if err != nil {
 		client.Close()
 		return errors.New("Client login failed: " + err.Error())
@@ -78,6 +107,13 @@ func (s *RealSession) Login() error {
 	return nil
 }
 
+func (s *RealSession) getOtpToken() (string, error) {
+	if s.OtpToken == "" {
+		return "", truenas_api.ErrOtpRequired
+	}
+	return s.OtpToken, nil
+}
+
 func (s *RealSession) GetHostName() string {
 	return GetHostNameFromApiUrl(s.HostName)
 }
@@ -86,11 +122,22 @@ func (s *RealSession) GetUrl() string {
 }
 
 func (s *RealSession) CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(getContextOrBackground(s.Context), time.Duration(timeoutSeconds) * time.Second)
+	defer cancel()
+
+	out, err := s.CallRawCtx(ctx, method, params)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, errors.New("call timed out")
+	}
+	return out, err
+}
+
+func (s *RealSession) CallRawCtx(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
 	var t1 time.Time
 	if s.IsDebug {
 		t1 = time.Now()
 	}
-	out, err := s.client.Call(method, timeoutSeconds, params)
+	out, err := s.client.CallCtx(ctx, method, params)
 	if s.IsDebug {
 		fmt.Println(method + ":", time.Now().Sub(t1).String())
 	}
@@ -98,6 +145,12 @@ func (s *RealSession) CallRaw(method string, timeoutSeconds int64, params interf
 }
 
 func (s *RealSession) CallAsyncRaw(method string, params interface{}) (int64, error) {
+	ctx, cancel := context.WithTimeout(getContextOrBackground(s.Context), time.Duration(60) * time.Second)
+	defer cancel()
+	return s.CallAsyncRawCtx(ctx, method, params)
+}
+
+func (s *RealSession) CallAsyncRawCtx(ctx context.Context, method string, params interface{}) (int64, error) {
 	if !s.subscribedToJobs {
 		// For every async call that we call "core.job_wait" on, we'll be notified whenever the original call is updated or completes.
 		// In order to get those notifications, we have to subscribe to "core.get_jobs".
@@ -107,14 +160,14 @@ func (s *RealSession) CallAsyncRaw(method string, params interface{}) (int64, er
 		s.subscribedToJobs = true
 	}
 
-	mainJob, err := s.client.CallWithJob(method, params, nil)
+	mainJob, err := s.client.CallWithJobCtx(ctx, method, params, nil)
 	if err != nil {
 		FlushString("Main call error: " + err.Error() + "\n")
-		return mainJob.ID, err
+		return -1, err
 	}
 
 	// This is to ensure we get notified when mainJob completes.
-	_, err = s.client.CallWithJob("core.job_wait", []interface{}{mainJob.ID}, nil)
+	_, err = s.client.CallWithJobCtx(ctx, "core.job_wait", []interface{}{mainJob.ID}, nil)
 	if err != nil {
 		return mainJob.ID, err
 	}
@@ -128,6 +181,10 @@ func (s *RealSession) CallAsyncRaw(method string, params interface{}) (int64, er
 }
 
 func (s *RealSession) WaitForJob(jobId int64) (json.RawMessage, error) {
+	return s.WaitForJobCtx(getContextOrBackground(s.Context), jobId)
+}
+
+func (s *RealSession) WaitForJobCtx(ctx context.Context, jobId int64) (json.RawMessage, error) {
 	//fmt.Println([]interface{}{"Waiting for job", jobId}...)
 	idx := -1
 	for i, job := range s.jobsList {
@@ -145,7 +202,14 @@ func (s *RealSession) WaitForJob(jobId int64) (json.RawMessage, error) {
 
 	irrelevantList := make([]ApiJobResult, 0)
 	for true {
-		jr := s.resultsQueue.Take()
+		jr, errCtx := s.resultsQueue.TakeCtx(ctx)
+		if errCtx != nil {
+			// the job is still running, so it stays in jobsList
+			for _, jr := range irrelevantList {
+				s.resultsQueue.Add(jr)
+			}
+			return nil, errCtx
+		}
 		if jr.JobID == jobId {
 			res = jr.Result
 			err = jr.GetError()
@@ -171,7 +235,32 @@ func (s *RealSession) WaitForJob(jobId int64) (json.RawMessage, error) {
 	return data, err
 }
 
+func (s *RealSession) WaitForJobWithProgress(jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	return s.WaitForJobWithProgressCtx(getContextOrBackground(s.Context), jobId, onProgress)
+}
+
+func (s *RealSession) WaitForJobWithProgressCtx(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	if onProgress != nil {
+		s.progressMtx.Lock()
+		if s.progressCallbacks == nil {
+			s.progressCallbacks = make(map[int64]func(JobProgress))
+		}
+		s.progressCallbacks[jobId] = onProgress
+		s.progressMtx.Unlock()
+
+		defer func() {
+			s.progressMtx.Lock()
+			delete(s.progressCallbacks, jobId)
+			s.progressMtx.Unlock()
+		}()
+	}
+	return s.WaitForJobCtx(ctx, jobId)
+}
+
 func (s *RealSession) SkipWaitingJobOnClose(jobId int64) {
+	if s.mapSkipWaitOnClose == nil {
+		s.mapSkipWaitOnClose = make(map[int64]bool)
+	}
 	s.mapSkipWaitOnClose[jobId] = true
 }
 
@@ -194,7 +283,11 @@ func (s *RealSession) Close(internalError error) error {
 	}
 
 	for len(s.jobsList) > 0 {
-		jr := s.resultsQueue.Take()
+		jr, err := s.resultsQueue.TakeCtx(getContextOrBackground(s.Context))
+		if err != nil {
+			errorList = append(errorList, makeInterruptedJobsError(s.jobsList, err))
+			break
+		}
 		//jr.Print()
 		for i := 0; i < len(s.jobsList); i++ {
 			if s.jobsList[i] == jr.JobID {
@@ -236,6 +329,19 @@ func (s *RealSession) HandleJobUpdate(waitingJobId int64, innerJobId int64, para
 			Error:  err,
 		}
 		s.resultsQueue.Add(jr)
+	} else if waitingJobId == innerJobId {
+		s.progressMtx.Lock()
+		onProgress := s.progressCallbacks[innerJobId]
+		s.progressMtx.Unlock()
+
+		if onProgress != nil {
+			progress := JobProgress{JobId: innerJobId, State: state}
+			if progressMap, ok := params["progress"].(map[string]interface{}); ok {
+				progress.Percent, _ = progressMap["percent"].(float64)
+				progress.Description, _ = progressMap["description"].(string)
+			}
+			onProgress(progress)
+		}
 	}
 }
 
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"truenas/truenas_incus_ctl/truenas_api"
+	"truenas/truenas_incus_ctl/truenastest"
+)
+
+func TestRealSessionAgainstFakeServer(t *testing.T) {
+	server := truenastest.NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+	// slow enough for progress to be reported while the job is waited for
+	server.SetJobStepDelay(50 * time.Millisecond)
+
+	api := &RealSession{HostName: server.HostName(), ApiKey: truenastest.ApiKey, AllowInsecure: true}
+
+	_, err := ApiCall(api, "pool.dataset.create", 10, []interface{}{map[string]interface{}{"name": "dozer/missing/child"}})
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected the missing parent to be reported, got %v", err)
+	}
+
+	jobId, err := ApiCallAsync(api, "core.bulk", []interface{}{"pool.dataset.create", []interface{}{
+		[]interface{}{map[string]interface{}{"name": "dozer/a"}},
+		[]interface{}{map[string]interface{}{"name": "dozer/b", "type": "VOLUME", "volsize": 1 << 20}},
+	}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastProgress JobProgress
+	out, err := api.WaitForJobWithProgress(jobId, func(progress JobProgress) {
+		lastProgress = progress
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []map[string]interface{}
+	if err = json.Unmarshal(out, &statuses); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, len(statuses), 2)
+	AssertEqual(t, statuses[1]["error"], nil)
+	AssertEqual(t, lastProgress.JobId, jobId)
+	AssertEqual(t, lastProgress.Percent, float64(50))
+
+	out, err = ApiCall(api, "pool.dataset.query", 10, []interface{}{[]interface{}{[]interface{}{"type", "=", "VOLUME"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ := GetResultsAndErrorsFromApiResponseRaw(out)
+	AssertEqual(t, len(results), 1)
+
+	AssertEqual(t, api.Close(nil), nil)
+}
+
+func TestApiCallAsyncSkipsWaitingForJobsNotAwaited(t *testing.T) {
+	server := truenastest.NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+
+	api := &RealSession{HostName: server.HostName(), ApiKey: truenastest.ApiKey, AllowInsecure: true}
+	callAsyncs := []func(string, bool) (int64, error){
+		func(name string, awaitThisJob bool) (int64, error) {
+			return ApiCallAsync(api, "core.bulk", []interface{}{"pool.dataset.create", []interface{}{
+				[]interface{}{map[string]interface{}{"name": name}},
+			}}, awaitThisJob)
+		},
+		func(name string, awaitThisJob bool) (int64, error) {
+			return ApiCallAsyncCtx(context.Background(), api, "core.bulk", []interface{}{"pool.dataset.create", []interface{}{
+				[]interface{}{map[string]interface{}{"name": name}},
+			}}, awaitThisJob)
+		},
+	}
+	for i, callAsync := range callAsyncs {
+		awaitedId, err := callAsync(fmt.Sprintf("dozer/awaited%d", i), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		detachedId, err := callAsync(fmt.Sprintf("dozer/detached%d", i), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertEqual(t, api.mapSkipWaitOnClose[awaitedId], false)
+		AssertEqual(t, api.mapSkipWaitOnClose[detachedId], true)
+	}
+
+	AssertEqual(t, api.Close(nil), nil)
+}
+
+func TestRealSessionPasswordAndOtpLogin(t *testing.T) {
+	server := truenastest.NewServer()
+	defer server.Close()
+	server.SetOtp("123456")
+
+	api := &RealSession{HostName: server.HostName(), Username: truenastest.Username, Password: truenastest.Password, AllowInsecure: true}
+	err := api.Login()
+	if err == nil || !strings.Contains(err.Error(), "one-time password is required") {
+		t.Fatalf("expected the missing one-time password to be reported, got %v", err)
+	}
+
+	api.OtpToken = "654321"
+	if err = api.Login(); err == nil {
+		t.Fatal("expected the wrong one-time password to be rejected")
+	}
+
+	api.OtpToken = "123456"
+	if err = api.Login(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ApiCall(api, "api_key.create", 10, []interface{}{map[string]interface{}{"name": "tnc", "username": truenastest.Username}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, api.Close(nil), nil)
+
+	// the new key logs in without a password
+	var response map[string]interface{}
+	_ = json.Unmarshal(out, &response)
+	key, _ := response["result"].(map[string]interface{})["key"].(string)
+	api = &RealSession{HostName: server.HostName(), ApiKey: key, AllowInsecure: true}
+	if _, err = ApiCall(api, "pool.dataset.query", 10, []interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, api.Close(nil), nil)
+}
+
+func TestRealSessionVerifiesCertificate(t *testing.T) {
+	server := truenastest.NewServer()
+	defer server.Close()
+
+	login := func(api *RealSession) error {
+		api.HostName = server.HostName()
+		api.ApiKey = truenastest.ApiKey
+		err := api.Login()
+		if err == nil {
+			AssertEqual(t, api.Close(nil), nil)
+		}
+		return err
+	}
+
+	// the fake server's certificate is self-signed, so it is only trusted when it is pinned or given as a CA
+	if err := login(&RealSession{}); err == nil {
+		t.Error("expected the self-signed certificate to be rejected")
+	}
+	if err := login(&RealSession{CertFingerprint: strings.Repeat("00", 32)}); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected the wrong fingerprint to be rejected, got %v", err)
+	}
+	fingerprint := truenas_api.CertFingerprint(server.Certificate())
+	AssertEqual(t, login(&RealSession{CertFingerprint: fingerprint}), nil)
+	AssertEqual(t, login(&RealSession{CertFingerprint: strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))}), nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, login(&RealSession{CaFile: caFile}), nil)
+	AssertEqual(t, login(&RealSession{CaFile: caFile, CertFingerprint: fingerprint}), nil)
+
+	cert, isTrusted, err := truenas_api.FetchServerCertificate(server.URL(), truenas_api.TLSOptions{})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, isTrusted, false)
+	AssertEqual(t, truenas_api.CertFingerprint(cert), fingerprint)
+}
+
+// writeTestClientCert makes a self-signed client certificate, returning the files holding it and its key,
+// along with a pool that trusts it.
+func writeTestClientCert(t *testing.T) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "truenas_incus_ctl"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestRealSessionClientCertificate(t *testing.T) {
+	certFile, keyFile, pool := writeTestClientCert(t)
+	server := truenastest.NewServerRequiringClientCert(pool)
+	defer server.Close()
+
+	api := &RealSession{HostName: server.HostName(), ApiKey: truenastest.ApiKey, AllowInsecure: true}
+	if err := api.Login(); err == nil {
+		t.Fatal("expected the login without a client certificate to fail")
+	}
+
+	api.ClientCert = certFile
+	api.ClientKey = keyFile
+	if _, err := ApiCall(api, "core.ping", 10, []interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, api.Close(nil), nil)
+
+	// the certificate can be fetched for pinning from a host that requires a client certificate
+	_, _, err := truenas_api.FetchServerCertificate(server.URL(), truenas_api.TLSOptions{ClientCert: certFile, ClientKey: keyFile})
+	AssertEqual(t, err, nil)
+}
@@ -0,0 +1,360 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// CassetteEntry is one line of a cassette, the JSONL file written by RecordingSession and served by ReplaySession.
+// Type is one of "session", "call", "async_call", "job_progress", "job" or "close".
+type CassetteEntry struct {
+	Type        string          `json:"type"`
+	Host        string          `json:"host,omitempty"`
+	Url         string          `json:"url,omitempty"`
+	Method      string          `json:"method,omitempty"`
+	Params      json.RawMessage `json:"params,omitempty"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	JobId       int64           `json:"job_id,omitempty"`
+	State       string          `json:"state,omitempty"`
+	Percent     float64         `json:"percent,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// RecordingSession passes every call through to Session, and writes each method, params, response and job event to a cassette.
+type RecordingSession struct {
+	Session
+	mtx      sync.Mutex
+	file     io.WriteCloser
+	writeErr error
+}
+
+// NewRecordingSession records the traffic of inner into the file at path, replacing any existing file.
+func NewRecordingSession(inner Session, path string) (*RecordingSession, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &RecordingSession{Session: inner, file: file}
+	s.record(CassetteEntry{Type: "session", Host: inner.GetHostName(), Url: inner.GetUrl()})
+	return s, nil
+}
+
+func (s *RecordingSession) record(entry CassetteEntry) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.writeErr != nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		_, err = s.file.Write(append(data, '\n'))
+	}
+	s.writeErr = err
+}
+
+func (s *RecordingSession) recordCall(entryType string, method string, params interface{}) CassetteEntry {
+	entry := CassetteEntry{Type: entryType, Method: method}
+	if data, err := json.Marshal(params); err == nil {
+		entry.Params = data
+	}
+	return entry
+}
+
+func (s *RecordingSession) recordResponse(entry CassetteEntry, out json.RawMessage, err error) {
+	if json.Valid(out) {
+		entry.Response = out
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.record(entry)
+}
+
+func (s *RecordingSession) wrapProgress(onProgress func(JobProgress)) func(JobProgress) {
+	if onProgress == nil {
+		return nil
+	}
+	return func(progress JobProgress) {
+		s.record(CassetteEntry{
+			Type:        "job_progress",
+			JobId:       progress.JobId,
+			State:       progress.State,
+			Percent:     progress.Percent,
+			Description: progress.Description,
+		})
+		onProgress(progress)
+	}
+}
+
+func (s *RecordingSession) CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	out, err := s.Session.CallRaw(method, timeoutSeconds, params)
+	s.recordResponse(s.recordCall("call", method, params), out, err)
+	return out, err
+}
+
+func (s *RecordingSession) CallRawCtx(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	out, err := s.Session.CallRawCtx(ctx, method, params)
+	s.recordResponse(s.recordCall("call", method, params), out, err)
+	return out, err
+}
+
+func (s *RecordingSession) CallAsyncRaw(method string, params interface{}) (int64, error) {
+	jobId, err := s.Session.CallAsyncRaw(method, params)
+	entry := s.recordCall("async_call", method, params)
+	entry.JobId = jobId
+	s.recordResponse(entry, nil, err)
+	return jobId, err
+}
+
+func (s *RecordingSession) CallAsyncRawCtx(ctx context.Context, method string, params interface{}) (int64, error) {
+	jobId, err := s.Session.CallAsyncRawCtx(ctx, method, params)
+	entry := s.recordCall("async_call", method, params)
+	entry.JobId = jobId
+	s.recordResponse(entry, nil, err)
+	return jobId, err
+}
+
+func (s *RecordingSession) WaitForJob(jobId int64) (json.RawMessage, error) {
+	out, err := s.Session.WaitForJob(jobId)
+	s.recordResponse(CassetteEntry{Type: "job", JobId: jobId}, out, err)
+	return out, err
+}
+
+func (s *RecordingSession) WaitForJobCtx(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	out, err := s.Session.WaitForJobCtx(ctx, jobId)
+	s.recordResponse(CassetteEntry{Type: "job", JobId: jobId}, out, err)
+	return out, err
+}
+
+func (s *RecordingSession) WaitForJobWithProgress(jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	out, err := s.Session.WaitForJobWithProgress(jobId, s.wrapProgress(onProgress))
+	s.recordResponse(CassetteEntry{Type: "job", JobId: jobId}, out, err)
+	return out, err
+}
+
+func (s *RecordingSession) WaitForJobWithProgressCtx(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	out, err := s.Session.WaitForJobWithProgressCtx(ctx, jobId, s.wrapProgress(onProgress))
+	s.recordResponse(CassetteEntry{Type: "job", JobId: jobId}, out, err)
+	return out, err
+}
+
+// Close closes the inner session, then the cassette. A cassette that could not be written fails an otherwise successful command.
+func (s *RecordingSession) Close(internalError error) error {
+	err := s.Session.Close(internalError)
+	s.recordResponse(CassetteEntry{Type: "close"}, nil, err)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if closeErr := s.file.Close(); s.writeErr == nil {
+		s.writeErr = closeErr
+	}
+	if err == nil && s.writeErr != nil {
+		return fmt.Errorf("Failed to write cassette: %v", s.writeErr)
+	}
+	return err
+}
+
+// ReplaySession serves the responses of a cassette instead of talking to TrueNAS.
+// Calls must be made in the order they were recorded, with the same method and params; jobs are looked up by their ID.
+type ReplaySession struct {
+	mtx     sync.Mutex
+	header  CassetteEntry
+	calls   []CassetteEntry
+	callIdx int
+	jobs    map[int64][]CassetteEntry
+	closing *CassetteEntry
+}
+
+// LoadCassette reads the cassette at path into a ReplaySession.
+func LoadCassette(path string) (*ReplaySession, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadCassette(file)
+}
+
+// ReadCassette reads a cassette into a ReplaySession. Blank lines are skipped.
+func ReadCassette(r io.Reader) (*ReplaySession, error) {
+	s := &ReplaySession{jobs: make(map[int64][]CassetteEntry)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry CassetteEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("cassette line %d: %v", lineNo, err)
+		}
+		switch entry.Type {
+		case "session":
+			s.header = entry
+		case "call", "async_call":
+			s.calls = append(s.calls, entry)
+		case "job_progress", "job":
+			s.jobs[entry.JobId] = append(s.jobs[entry.JobId], entry)
+		case "close":
+			s.closing = &entry
+		default:
+			return nil, fmt.Errorf("cassette line %d: unknown entry type \"%s\"", lineNo, entry.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Remaining returns the number of recorded calls that have not been replayed yet.
+func (s *ReplaySession) Remaining() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.calls) - s.callIdx
+}
+
+func (s *ReplaySession) Login() error        { return nil }
+func (s *ReplaySession) IsLoggedIn() bool    { return true }
+func (s *ReplaySession) GetHostName() string { return s.header.Host }
+func (s *ReplaySession) GetUrl() string      { return s.header.Url }
+
+func (s *ReplaySession) SkipWaitingJobOnClose(jobId int64) {}
+
+// normalizeJson re-encodes data so that whitespace and key order don't matter when comparing params.
+func normalizeJson(data []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return string(data)
+	}
+	normalized, err := json.Marshal(value)
+	if err != nil {
+		return string(data)
+	}
+	return string(normalized)
+}
+
+func (s *ReplaySession) nextCall(entryType string, method string, params interface{}) (CassetteEntry, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return CassetteEntry{}, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.callIdx >= len(s.calls) {
+		return CassetteEntry{}, fmt.Errorf("Unexpected call to %s %s: the cassette has no more calls", method, string(data))
+	}
+	entry := s.calls[s.callIdx]
+	if entry.Type != entryType || entry.Method != method {
+		return CassetteEntry{}, fmt.Errorf("Expected %s to %s, got %s to %s", entry.Type, entry.Method, entryType, method)
+	}
+	if actual, expected := normalizeJson(data), normalizeJson(entry.Params); actual != expected {
+		return CassetteEntry{}, fmt.Errorf("\"%s\" != \"%s\"", actual, expected)
+	}
+	s.callIdx++
+	return entry, nil
+}
+
+func getEntryError(entry CassetteEntry) error {
+	if entry.Error != "" {
+		return errors.New(entry.Error)
+	}
+	return nil
+}
+
+func (s *ReplaySession) CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	entry, err := s.nextCall("call", method, params)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Response, getEntryError(entry)
+}
+
+func (s *ReplaySession) CallRawCtx(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.CallRaw(method, 0, params)
+}
+
+func (s *ReplaySession) CallAsyncRaw(method string, params interface{}) (int64, error) {
+	entry, err := s.nextCall("async_call", method, params)
+	if err != nil {
+		return -1, err
+	}
+	return entry.JobId, getEntryError(entry)
+}
+
+func (s *ReplaySession) CallAsyncRawCtx(ctx context.Context, method string, params interface{}) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return s.CallAsyncRaw(method, params)
+}
+
+func (s *ReplaySession) WaitForJob(jobId int64) (json.RawMessage, error) {
+	return s.WaitForJobWithProgress(jobId, nil)
+}
+
+func (s *ReplaySession) WaitForJobCtx(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	return s.WaitForJobWithProgressCtx(ctx, jobId, nil)
+}
+
+// WaitForJobWithProgress reports the job's recorded progress, then returns its recorded result.
+func (s *ReplaySession) WaitForJobWithProgress(jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	s.mtx.Lock()
+	var progressList []JobProgress
+	var result *CassetteEntry
+	entries := s.jobs[jobId]
+	for i, entry := range entries {
+		if entry.Type == "job" {
+			result = &entries[i]
+			s.jobs[jobId] = entries[i+1:]
+			break
+		}
+		progressList = append(progressList, JobProgress{
+			JobId:       jobId,
+			State:       entry.State,
+			Percent:     entry.Percent,
+			Description: entry.Description,
+		})
+	}
+	s.mtx.Unlock()
+
+	if result == nil {
+		return nil, fmt.Errorf("Job ID %d was not waited for in the cassette", jobId)
+	}
+	if onProgress != nil {
+		for _, progress := range progressList {
+			onProgress(progress)
+		}
+	}
+	return result.Response, getEntryError(*result)
+}
+
+func (s *ReplaySession) WaitForJobWithProgressCtx(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.WaitForJobWithProgress(jobId, onProgress)
+}
+
+// Close returns the error that the recorded session was closed with, or internalError if the cassette doesn't say.
+func (s *ReplaySession) Close(internalError error) error {
+	if s.closing != nil {
+		return getEntryError(*s.closing)
+	}
+	return internalError
+}
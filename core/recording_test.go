@@ -0,0 +1,94 @@
+package core
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"truenas/truenas_incus_ctl/truenastest"
+)
+
+func TestRecordAndReplayAgainstFakeServer(t *testing.T) {
+	server := truenastest.NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+	server.SetJobStepDelay(50 * time.Millisecond)
+
+	cassettePath := filepath.Join(t.TempDir(), "session.jsonl")
+	inner := &RealSession{HostName: server.HostName(), ApiKey: truenastest.ApiKey, AllowInsecure: true}
+	recorder, err := NewRecordingSession(inner, cassettePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(api Session) (string, []JobProgress) {
+		var progressList []JobProgress
+		out, err := ApiCall(api, "pool.dataset.query", 10, []interface{}{[]interface{}{}, map[string]interface{}{"select": []interface{}{"id"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobId, err := ApiCallAsync(api, "core.bulk", []interface{}{"pool.dataset.create", []interface{}{
+			[]interface{}{map[string]interface{}{"name": "dozer/a"}},
+			[]interface{}{map[string]interface{}{"name": "dozer/b"}},
+		}}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := api.WaitForJobWithProgress(jobId, func(progress JobProgress) {
+			progressList = append(progressList, progress)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertEqual(t, api.Close(nil), nil)
+		// the cassette stores responses compacted, without the trailing newline of a websocket message
+		return strings.TrimSpace(string(out)) + string(result), progressList
+	}
+
+	recorded, recordedProgress := run(recorder)
+	if len(recordedProgress) == 0 {
+		t.Fatal("expected the job to report progress")
+	}
+
+	replay, err := LoadCassette(cassettePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, replay.GetHostName(), server.HostName())
+	replayed, replayedProgress := run(replay)
+	AssertEqual(t, replayed, recorded)
+	AssertEqual(t, len(replayedProgress), len(recordedProgress))
+	AssertEqual(t, replay.Remaining(), 0)
+	AssertEqual(t, server.CallCount("core.bulk"), 1)
+}
+
+func TestReplayRejectsUnexpectedCalls(t *testing.T) {
+	replay, err := ReadCassette(strings.NewReader(
+		`{"type":"call","method":"pool.dataset.query","params":[[["id", "=", "dozer/a"]], {}],"response":{"jsonrpc":"2.0","result":[],"id":2}}` + "\n" +
+			`{"type":"async_call","method":"pool.dataset.delete","params":["dozer/a"],"job_id":7}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// whitespace and key order in the cassette don't matter
+	out, err := replay.CallRaw("pool.dataset.query", 10, []interface{}{[]interface{}{[]interface{}{"id", "=", "dozer/a"}}, map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, string(out), `{"jsonrpc":"2.0","result":[],"id":2}`)
+
+	_, err = replay.CallAsyncRaw("pool.dataset.delete", []interface{}{"dozer/b"})
+	if err == nil || !strings.Contains(err.Error(), "dozer/b") {
+		t.Fatalf("expected the params mismatch to be reported, got %v", err)
+	}
+	jobId, err := replay.CallAsyncRaw("pool.dataset.delete", []interface{}{"dozer/a"})
+	AssertEqual(t, jobId, int64(7))
+	AssertEqual(t, err, nil)
+
+	if _, err = replay.WaitForJob(7); err == nil {
+		t.Fatal("expected a job that was never waited for to be reported")
+	}
+	if _, err = replay.CallRaw("pool.dataset.query", 10, []interface{}{}); err == nil {
+		t.Fatal("expected a call past the end of the cassette to be reported")
+	}
+}
@@ -1,9 +1,11 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	//"fmt"
+	"fmt"
+	"strings"
 )
 
 type Session interface {
@@ -14,10 +16,25 @@ type Session interface {
 	CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error)
 	CallAsyncRaw(method string, params interface{}) (int64, error)
 	WaitForJob(jobId int64) (json.RawMessage, error)
+	WaitForJobWithProgress(jobId int64, onProgress func(JobProgress)) (json.RawMessage, error)
+	// The Ctx variants stop waiting once ctx is done, returning ctx.Err().
+	// A deadline on ctx replaces the call's timeout. Calls and jobs that reached TrueNAS carry on there regardless.
+	CallRawCtx(ctx context.Context, method string, params interface{}) (json.RawMessage, error)
+	CallAsyncRawCtx(ctx context.Context, method string, params interface{}) (int64, error)
+	WaitForJobCtx(ctx context.Context, jobId int64) (json.RawMessage, error)
+	WaitForJobWithProgressCtx(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error)
 	SkipWaitingJobOnClose(jobId int64)
 	Close(error) error
 }
 
+// JobProgress is a snapshot of a running job, as reported by core.get_jobs.
+type JobProgress struct {
+	JobId       int64
+	State       string
+	Percent     float64
+	Description string
+}
+
 func MaybeLogin(s Session) error {
 	if s.IsLoggedIn() {
 		return nil
@@ -44,8 +61,50 @@ func ApiCallAsync(s Session, method string, params interface{}, awaitThisJob boo
 		return -1, err
 	}
 	jobId, err := s.CallAsyncRaw(method, params)
-	if err != nil && jobId > 0 && !awaitThisJob {
+	if err == nil && jobId > 0 && !awaitThisJob {
+		s.SkipWaitingJobOnClose(jobId)
+	}
+	return jobId, err
+}
+
+func ApiCallCtx(ctx context.Context, s Session, method string, params interface{}) (json.RawMessage, error) {
+	if err := MaybeLogin(s); err != nil {
+		return nil, err
+	}
+	out, err := s.CallRawCtx(ctx, method, params)
+	if err != nil {
+		return out, err
+	}
+	if errMsg := ExtractApiError(out); errMsg != "" {
+		return out, errors.New(errMsg)
+	}
+	return out, nil
+}
+
+func ApiCallAsyncCtx(ctx context.Context, s Session, method string, params interface{}, awaitThisJob bool) (int64, error) {
+	if err := MaybeLogin(s); err != nil {
+		return -1, err
+	}
+	jobId, err := s.CallAsyncRawCtx(ctx, method, params)
+	if err == nil && jobId > 0 && !awaitThisJob {
 		s.SkipWaitingJobOnClose(jobId)
 	}
 	return jobId, err
 }
+
+// getContextOrBackground returns the context that bounds a session's calls when they are not given one explicitly.
+func getContextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// makeInterruptedJobsError reports the jobs that a session stopped waiting for when it was cancelled.
+func makeInterruptedJobsError(jobIds []int64, cause error) error {
+	idStrings := make([]string, len(jobIds))
+	for i, jobId := range jobIds {
+		idStrings[i] = fmt.Sprint(jobId)
+	}
+	return fmt.Errorf("Stopped waiting for job(s) %s, which may still be running: %w", strings.Join(idStrings, ", "), cause)
+}
@@ -1,10 +1,12 @@
 package core
 
 import (
+	"context"
 	//"fmt"
 	"runtime/debug"
 	"sync"
 	"testing"
+	"time"
 )
 
 func AssertEqual[T comparable](test *testing.T, a T, b T) {
@@ -130,3 +132,23 @@ func TestSimpleQueueAddTake(t *testing.T) {
 	AssertPanics(t, func(){sq.Take()})
 	AssertEqual(t, c.WaitCalls, 1)
 }
+
+func TestSimpleQueueTakeCtx(t *testing.T) {
+	sq := MakeSimpleQueue[int]()
+	sq.Add(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	value, err := sq.TakeCtx(ctx)
+	AssertEqual(t, value, 3)
+	AssertEqual(t, err, nil)
+
+	go func() {
+		time.Sleep(time.Duration(50) * time.Millisecond)
+		cancel()
+	}()
+	_, err = sq.TakeCtx(ctx)
+	AssertEqual(t, err, context.Canceled)
+
+	sq.Add(4)
+	AssertEqual(t, sq.Take(), 4)
+}
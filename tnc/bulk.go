@@ -0,0 +1,88 @@
+package tnc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"truenas/truenas_incus_ctl/core"
+)
+
+// BulkOptions controls how a function that may run several calls at once through core.bulk treats the resulting job.
+// A job that is neither waited for nor detached is waited for when the session is closed.
+type BulkOptions struct {
+	// Wait waits for the job to finish and returns its result.
+	Wait bool
+	// Detach leaves the job running when the session is closed, and always starts one, even for a single call, so that there is a job ID to return.
+	Detach bool
+	// OnProgress is called with the job's progress while waiting for it.
+	OnProgress func(core.JobProgress)
+}
+
+// BulkCall calls endpoint once for each entry in paramsArray.
+// A single call is made directly and its result returned with a job ID of -1.
+// Otherwise the calls are made in one core.bulk job, whose ID is returned.
+func BulkCall(ctx context.Context, api core.Session, endpoint string, timeoutSeconds int64, paramsArray []interface{}, opts BulkOptions) (json.RawMessage, int64, error) {
+	nCalls := len(paramsArray)
+	if nCalls == 0 {
+		return nil, -1, errors.New("BulkCall: Nothing to do")
+	}
+	if nCalls == 1 && !opts.Detach {
+		debugJson(paramsArray[0])
+		out, err := callApi(ctx, api, endpoint, timeoutSeconds, paramsArray[0])
+		return out, -1, err
+	}
+
+	methodAndParams := []interface{}{endpoint, paramsArray}
+	debugJson(methodAndParams)
+
+	// a job that is not detached is waited for, either here or when the session is closed
+	jobId, err := core.ApiCallAsyncCtx(ctx, api, "core.bulk", methodAndParams, !opts.Detach)
+	if err != nil || jobId < 0 {
+		return nil, jobId, err
+	}
+	if opts.Detach || !opts.Wait {
+		return nil, jobId, nil
+	}
+
+	var out json.RawMessage
+	if opts.OnProgress != nil {
+		out, err = api.WaitForJobWithProgressCtx(ctx, jobId, opts.OnProgress)
+	} else {
+		out, err = api.WaitForJobCtx(ctx, jobId)
+	}
+	return out, jobId, err
+}
+
+// ExpandBulkParams makes a copy of params for each value in remapList, with the value put in place.
+// The "" key replaces the first parameter, eg. the name of the dataset to update,
+// while any other key sets that field of the parameters' object, eg. the "name" of a dataset to create.
+func ExpandBulkParams(params []interface{}, remapList map[string][]interface{}) []interface{} {
+	allParams := make([][]interface{}, 0)
+	for key, valueList := range remapList {
+		for i, value := range valueList {
+			if len(allParams) <= i {
+				allParams = append(allParams, core.DeepCopy(params).([]interface{}))
+			}
+			_, isObjFirst := allParams[i][0].(map[string]interface{})
+			if key == "" {
+				if isObjFirst {
+					allParams[i] = append([]interface{}{value}, allParams[i]...)
+				} else {
+					allParams[i][0] = value
+				}
+			} else {
+				objIdx := 1
+				if isObjFirst {
+					objIdx = 0
+				}
+				allParams[i][objIdx].(map[string]interface{})[key] = value
+			}
+		}
+	}
+
+	paramsArray := make([]interface{}, len(allParams))
+	for i, p := range allParams {
+		paramsArray[i] = p
+	}
+	return paramsArray
+}
@@ -0,0 +1,250 @@
+package tnc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"truenas/truenas_incus_ctl/core"
+)
+
+// DatasetOptions holds the properties given to pool.dataset.create or pool.dataset.update.
+type DatasetOptions struct {
+	BulkOptions
+	// Params are passed on as they are, eg. {"compression": "LZ4", "comments": "Managed by Incus", "volsize": 1073741824}.
+	// Datasets are created as volumes if a volsize is given, and as filesystems otherwise.
+	Params map[string]interface{}
+	// UserProperties are set in the order given, eg. {Key: "incus:content_type", Value: "block"}.
+	UserProperties []UserProperty
+	// CreateParents creates any missing parents of the datasets being created.
+	CreateParents bool
+}
+
+// UserProperty is a ZFS user property, whose key must contain a colon.
+type UserProperty struct {
+	Key   string
+	Value interface{}
+}
+
+// DeleteDatasetOptions controls how pool.dataset.delete destroys datasets.
+type DeleteDatasetOptions struct {
+	BulkOptions
+	// Recursive also destroys the datasets' children.
+	Recursive bool
+	// Force destroys datasets that are busy.
+	Force bool
+	// NoSmartTimeout skips counting the children of recursively deleted datasets to choose a timeout, and uses 20 seconds instead.
+	NoSmartTimeout bool
+}
+
+// DatasetFilter selects the datasets and properties returned by ListDatasets.
+type DatasetFilter struct {
+	// Names are datasets or pools. Every dataset is listed if there are none.
+	Names []string
+	// Recursive includes the children of each of Names.
+	Recursive bool
+	// Properties to retrieve, besides the name. Ones that contain a colon are user properties.
+	Properties []string
+	// AllProperties retrieves every property, ignoring Properties.
+	AllProperties bool
+	// UserProperties retrieves every user property.
+	UserProperties bool
+}
+
+// CreateDatasets creates each of names with the same options.
+func CreateDatasets(ctx context.Context, api core.Session, names []string, opts DatasetOptions) (json.RawMessage, int64, error) {
+	outMap := buildDatasetParams(opts)
+	if opts.CreateParents {
+		outMap["create_ancestors"] = true
+	}
+	if _, exists := outMap["volsize"]; exists {
+		outMap["type"] = "VOLUME"
+	} else {
+		outMap["type"] = "FILESYSTEM"
+	}
+
+	objRemap := map[string][]interface{}{"name": core.ToAnyArray(names)}
+	return BulkCall(ctx, api, "pool.dataset.create", 10, ExpandBulkParams([]interface{}{outMap}, objRemap), opts.BulkOptions)
+}
+
+// UpdateDatasets updates each of names with the same options.
+func UpdateDatasets(ctx context.Context, api core.Session, names []string, opts DatasetOptions) (json.RawMessage, int64, error) {
+	outMap := buildDatasetParams(opts)
+	objRemap := map[string][]interface{}{"": core.ToAnyArray(names)}
+	return BulkCall(ctx, api, "pool.dataset.update", 10, ExpandBulkParams([]interface{}{outMap}, objRemap), opts.BulkOptions)
+}
+
+// FindDatasets splits names into the datasets that exist and those that are missing, keeping their order.
+func FindDatasets(ctx context.Context, api core.Session, names []string) ([]string, []string, error) {
+	extras := QueryParams{
+		ValueOrder:         BuildValueOrder(true),
+		ShouldGetAllProps:  false,
+		ShouldGetUserProps: false,
+		ShouldRecurse:      false,
+	}
+	response, err := Query(ctx, api, "pool.dataset", names, core.StringRepeated("name", len(names)), nil, extras)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing := make([]string, 0)
+	missing := make([]string, 0)
+	for _, name := range names {
+		if _, exists := response.ResultsMap[name]; exists {
+			existing = append(existing, name)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	return existing, missing, nil
+}
+
+// DeleteDatasets destroys each of names.
+func DeleteDatasets(ctx context.Context, api core.Session, names []string, opts DeleteDatasetOptions) (json.RawMessage, int64, error) {
+	if len(names) == 0 {
+		return nil, -1, errors.New("No datasets were given to delete")
+	}
+
+	timeout := int64(20)
+	if opts.Recursive && !opts.NoSmartTimeout {
+		extras := QueryParams{
+			ValueOrder:         BuildValueOrder(true),
+			ShouldGetAllProps:  false,
+			ShouldGetUserProps: false,
+			ShouldRecurse:      true,
+		}
+		response, err := Query(ctx, api, "pool.dataset", names, core.StringRepeated("name", len(names)), []string{}, extras)
+		if err != nil {
+			return nil, -1, err
+		}
+		timeout = int64(10 + 10*len(response.ResultsMap))
+	}
+
+	outMap := make(map[string]interface{})
+	if opts.Recursive {
+		outMap["recursive"] = true
+	}
+	if opts.Force {
+		outMap["force"] = true
+	}
+
+	objRemap := map[string][]interface{}{"": core.ToAnyArray(names)}
+	return BulkCall(ctx, api, "pool.dataset.delete", timeout, ExpandBulkParams([]interface{}{names[0], outMap}, objRemap), opts.BulkOptions)
+}
+
+// PromoteDatasets makes each of names, which must be clones, no longer depend on their origin snapshots.
+func PromoteDatasets(ctx context.Context, api core.Session, names []string, opts BulkOptions) (json.RawMessage, int64, error) {
+	if len(names) == 0 {
+		return nil, -1, errors.New("No datasets were given to promote")
+	}
+	objRemap := map[string][]interface{}{"": core.ToAnyArray(names)}
+	return BulkCall(ctx, api, "pool.dataset.promote", 10, ExpandBulkParams([]interface{}{names[0]}, objRemap), opts)
+}
+
+// RenameDataset renames a dataset or snapshot. If updateShares is set and a dataset had an NFS share, the share is moved along with it.
+// It returns whether a share was updated.
+func RenameDataset(ctx context.Context, api core.Session, source, dest string, updateShares bool) (bool, error) {
+	params := []interface{}{source, map[string]interface{}{"new_name": dest}}
+	debugJson(params)
+
+	out, err := callApi(ctx, api, "zfs.dataset.rename", DefaultCallTimeout, params)
+	if err != nil {
+		return false, err
+	}
+	debugString(string(out))
+
+	// no point updating the share if we're renaming a snapshot.
+	if !updateShares || strings.Contains(source, "@") {
+		return false, nil
+	}
+
+	idStr, found, err := LookupNfsIdByPath(ctx, api, "/mnt/"+source, nil)
+	if err != nil || !found {
+		return false, err
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return false, fmt.Errorf("Error updating share for dataset \"%s\", nfs id \"%s\": %v", dest, idStr, err)
+	}
+
+	nfsParams := []interface{}{id, map[string]interface{}{"path": "/mnt/" + dest}}
+	debugJson(nfsParams)
+
+	out, err = callApi(ctx, api, "sharing.nfs.update", DefaultCallTimeout, nfsParams)
+	if err != nil {
+		return false, err
+	}
+	debugString(string(out))
+	return true, nil
+}
+
+// ListDatasets returns the datasets matching filter.
+// Like `zfs list`, every dataset is listed recursively if no names are given.
+func ListDatasets(ctx context.Context, api core.Session, filter DatasetFilter) ([]Dataset, error) {
+	names := make([]string, len(filter.Names))
+	copy(names, filter.Names)
+	idTypes, err := getDatasetListTypes(names)
+	if err != nil {
+		return nil, err
+	}
+
+	extras := QueryParams{
+		ValueOrder:         BuildValueOrder(true),
+		ShouldGetAllProps:  filter.AllProperties,
+		ShouldGetUserProps: filter.UserProperties,
+		ShouldRecurse:      len(names) == 0 || filter.Recursive,
+	}
+
+	for _, prop := range filter.Properties {
+		if strings.Index(prop, ":") >= 0 {
+			extras.ShouldGetUserProps = true
+			break
+		}
+	}
+
+	response, err := Query(ctx, api, "pool.dataset", names, idTypes, filter.Properties, extras)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeQueryResponse(&response, DecodeDataset)
+}
+
+func buildDatasetParams(opts DatasetOptions) map[string]interface{} {
+	outMap := copyParams(opts.Params)
+	if len(opts.UserProperties) > 0 {
+		userPropsArr := make([]map[string]interface{}, 0, len(opts.UserProperties))
+		for _, prop := range opts.UserProperties {
+			userPropsArr = append(userPropsArr, map[string]interface{}{"key": prop.Key, "value": prop.Value})
+		}
+		outMap["user_properties"] = userPropsArr
+	}
+	return outMap
+}
+
+// getDatasetListTypes identifies the field to query for each of args, and strips any prefix from them.
+func getDatasetListTypes(args []string) ([]string, error) {
+	var typeList []string
+	if len(args) == 0 {
+		return typeList, nil
+	}
+
+	typeList = make([]string, len(args), len(args))
+	for i := 0; i < len(args); i++ {
+		t, value := core.IdentifyObject(args[i])
+		if t == "id" || t == "share" {
+			return nil, errors.New("querying datasets based on mount point is not yet supported")
+		} else if t == "snapshot" || t == "snapshot_only" {
+			return nil, errors.New("querying datasets based on shapshot is not yet supported")
+		} else if t == "dataset" {
+			t = "name"
+		} else if t != "pool" {
+			return nil, errors.New("Unrecognised namespec \"" + args[i] + "\"")
+		}
+		typeList[i] = t
+		args[i] = value
+	}
+
+	return typeList, nil
+}
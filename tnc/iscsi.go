@@ -0,0 +1,545 @@
+package tnc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+)
+
+// ErrNoMatchingIscsiTargets is returned by ActivateIscsiTargets when none of the targets could be logged in to.
+var ErrNoMatchingIscsiTargets = errors.New("No matching iscsi shares were found")
+
+// IscsiLoginSpec identifies a target, as found by discovery or in an active session.
+type IscsiLoginSpec struct {
+	RemoteIp string
+	Iqn      string
+	Target   string
+}
+
+// IscsiActivateResult reports the outcome of ActivateIscsiTargets.
+type IscsiActivateResult struct {
+	// Devices maps each activated "iqn:target" name to its disk under /dev/disk/by-path.
+	Devices map[string]string
+	// TimedOut lists the targets that were logged in to, but whose disks did not appear within 30 seconds.
+	TimedOut []string
+	// Skipped lists the targets that were found on a different address than the portal.
+	Skipped []IscsiLoginSpec
+}
+
+type iscsiPathAndIqnTarget struct {
+	fullPath      string
+	iqnTargetName string
+}
+
+// IqnTarget returns the full "iqn:target" name that iscsiadm expects.
+func (t IscsiLoginSpec) IqnTarget() string {
+	return t.Iqn + ":" + t.Target
+}
+
+// ActivateIscsiTargets logs in to each of targets through portalAddr (see MaybeLookupIpPortFromPortal), then waits for their disks to appear.
+// onActivated, if not nil, is called as soon as each disk appears. The iscsid daemon must already be running.
+func ActivateIscsiTargets(ctx context.Context, api core.Session, portalAddr string, targets []IscsiLoginSpec, onActivated func(iqnTarget, devicePath string)) (IscsiActivateResult, error) {
+	result := IscsiActivateResult{Devices: make(map[string]string)}
+	outerMap := make(map[string]bool)
+
+	for _, t := range targets {
+		iqnTarget := t.IqnTarget()
+		if t.RemoteIp != portalAddr {
+			result.Skipped = append(result.Skipped, t)
+			continue
+		}
+		loginParams := []string{
+			"--mode",
+			"node",
+			"--targetname",
+			iqnTarget,
+			"--portal",
+			portalAddr,
+			"--login",
+		}
+		debugString(strings.Join(loginParams, " "))
+		_, err := RunIscsiAdminTool(ctx, api, loginParams)
+		if err == nil {
+			outerMap[iqnTarget] = true
+		} else {
+			return result, fmt.Errorf("failed\t%s\t%v", iqnTarget, err)
+		}
+	}
+
+	if len(outerMap) == 0 {
+		return result, ErrNoMatchingIscsiTargets
+	}
+
+	innerMap := make(map[string]bool)
+	for key, value := range outerMap {
+		innerMap[key] = value
+	}
+
+	onFound := func(fullPath, iqnTargetName string) {
+		if _, exists := outerMap[iqnTargetName]; exists {
+			result.Devices[iqnTargetName] = fullPath
+			if onActivated != nil {
+				onActivated(iqnTargetName, fullPath)
+			}
+			delete(outerMap, iqnTargetName)
+		}
+	}
+
+	// the watcher can't be interrupted while it waits for the next file event, so it stops at the first one after we return.
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	shareCh := make(chan iscsiPathAndIqnTarget)
+	go func() {
+		err := core.WaitForCreatedDeletedFiles("/dev/disk/by-path", func(fname string, wasCreate, wasDelete bool) bool {
+			IterateActivatedIscsiShares(portalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
+				select {
+				case shareCh <- iscsiPathAndIqnTarget{fullPath: path.Join(root, fullName), iqnTargetName: iqnTargetName}:
+				case <-doneCh:
+				}
+				delete(innerMap, iqnTargetName)
+			})
+			select {
+			case <-doneCh:
+				return true
+			default:
+				return len(innerMap) == 0
+			}
+		})
+		if err != nil {
+			debugString("error waiting for iSCSI disks: " + err.Error())
+		}
+	}()
+
+	const maxTries = 30
+	for i := 0; i < maxTries && len(outerMap) > 0; i++ {
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case names := <-shareCh:
+			onFound(names.fullPath, names.iqnTargetName)
+		case <-time.After(time.Duration(1000) * time.Millisecond):
+			IterateActivatedIscsiShares(portalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
+				onFound(path.Join(root, fullName), iqnTargetName)
+			})
+		}
+	}
+
+	for iqnTargetName := range outerMap {
+		result.TimedOut = append(result.TimedOut, iqnTargetName)
+	}
+	return result, nil
+}
+
+// MaybeLookupIpPortFromPortal resolves a portal ID, or an address with an optional port, to the ip:port that iscsiadm should connect to.
+func MaybeLookupIpPortFromPortal(ctx context.Context, api core.Session, defaultPort int, spec string) (string, error) {
+	if spec == "" {
+		return "", fmt.Errorf("Portal was not specified (use ':' for the default portal)")
+	}
+
+	var ipPortObjMap map[string]interface{}
+	if asInt, errNotNumber := strconv.Atoi(spec); errNotNumber == nil {
+		queryFilter := []interface{}{[]interface{}{"id", "=", asInt}}
+		queryParams := []interface{}{
+			queryFilter,
+			make(map[string]interface{}),
+		}
+		out, err := callApi(ctx, api, "iscsi.portal.query", DefaultCallTimeout, queryParams)
+		if err != nil {
+			return "", err
+		}
+		var response map[string]interface{}
+		if err = json.Unmarshal(out, &response); err != nil {
+			return "", err
+		}
+		results, _ := response["result"].([]interface{})
+		for i := 0; i < len(results); i++ {
+			if obj, ok := results[i].(map[string]interface{}); ok {
+				if listenArray, ok := obj["listen"].([]interface{}); ok && len(listenArray) > 0 {
+					ipPortObjMap, _ = listenArray[0].(map[string]interface{})
+					break
+				} else if listenMap, ok := obj["listen"].(map[string]interface{}); ok {
+					ipPortObjMap = listenMap
+					break
+				}
+			}
+		}
+	}
+
+	if ipPortObjMap == nil {
+		ipPortStr := core.IpPortToJsonString(spec, api.GetHostName(), defaultPort)
+		var obj interface{}
+		if err := json.Unmarshal([]byte(ipPortStr), &obj); err != nil {
+			return "", err
+		}
+		if objArray, isArray := obj.([]interface{}); isArray {
+			if len(objArray) > 0 {
+				obj = objArray[0]
+			} else {
+				return "", fmt.Errorf("listen object was empty")
+			}
+		}
+		if objMap, isMap := obj.(map[string]interface{}); isMap {
+			ipPortObjMap = objMap
+		} else {
+			return "", fmt.Errorf("listen object was not a map or array of map")
+		}
+	}
+
+	ip, exists := ipPortObjMap["ip"]
+	if !exists {
+		ip = core.ResolvedIpv4OrVerbatim(api.GetHostName())
+	}
+	port, exists := ipPortObjMap["port"]
+	if !exists {
+		port = defaultPort
+	}
+
+	// Prepare to output ip:port, but we need to wrap IPv6 in []
+	ipStr := fmt.Sprintf("%v", ip)
+	if strings.Contains(ipStr, ":") {
+		// we're about to add a port, we need to wrap the IP.
+		ipStr = fmt.Sprintf("[%s]", StripIpV6Brackets(ipStr))
+	}
+
+	return fmt.Sprintf("%s:%v", ipStr, port), nil
+}
+
+// MakeIscsiTargetNameFromVolumePath turns a volume path into a valid iSCSI target name.
+func MakeIscsiTargetNameFromVolumePath(prefix, vol string) string {
+	var substituted strings.Builder
+	for _, r := range vol {
+		if r == ':' || r == '.' || r == '_' {
+			r = '-'
+		}
+		if r == '/' || r == '@' {
+			r = ':'
+		}
+		substituted.WriteRune(r)
+	}
+	if prefix == "" {
+		return strings.ToLower(substituted.String())
+	}
+	return strings.ToLower(prefix + ":" + substituted.String())
+}
+
+// MaybeHashIscsiNameFromVolumePath is MakeIscsiTargetNameFromVolumePath, but hashes the volume path if the name would be longer than 64 characters.
+func MaybeHashIscsiNameFromVolumePath(prefix, vol string) string {
+	iscsiName := MakeIscsiTargetNameFromVolumePath(prefix, vol)
+	if len(iscsiName) > 64 {
+		var begin string
+		if prefix == "" {
+			begin = "-:"
+		} else {
+			begin = prefix + ":-:"
+		}
+		return begin + core.MakeHashedString(vol, 64-len(begin))
+	}
+	return iscsiName
+}
+
+// Normalize IPv6 portal: remove brackets if present
+func StripIpV6Brackets(ipv6Addr string) string {
+	s := strings.ReplaceAll(ipv6Addr, "[", "")
+	s = strings.ReplaceAll(s, "]", "")
+
+	return s
+}
+
+// IterateActivatedIscsiShares calls callback for each iSCSI disk under /dev/disk/by-path that was activated from the given portal, or from any portal if optIpPortalAddr is empty.
+func IterateActivatedIscsiShares(optIpPortalAddr string, callback func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string)) {
+	diskEntries, err := os.ReadDir("/dev/disk/by-path")
+	if err != nil {
+		return
+	}
+
+	// Normalize IPv6 portal. The brackets are not used in the /dev/disk/by-path node
+	optIpPortalAddr = StripIpV6Brackets(optIpPortalAddr)
+
+	for _, e := range diskEntries {
+		name := e.Name()
+		suffix := "-lun-0"
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		pathPrefix := "ip-" + optIpPortalAddr
+		if !strings.HasPrefix(name, pathPrefix) {
+			continue
+		}
+
+		iqnPathStart := "-iscsi-iqn."
+		var pathStartPos int
+		var ipPortalAddr string
+
+		if len(optIpPortalAddr) == 0 {
+			pathStartPos = strings.Index(name, iqnPathStart)
+			if pathStartPos == -1 {
+				continue
+			}
+			ipPortalAddr = name[3:pathStartPos]
+		} else {
+			pathStartPos = len(pathPrefix)
+			if !strings.HasPrefix(name[pathStartPos:], iqnPathStart) {
+				continue
+			}
+			ipPortalAddr = optIpPortalAddr
+		}
+
+		iqnStart := pathStartPos + len(iqnPathStart) - 4
+		iqnTargetName := name[iqnStart : len(name)-len(suffix)]
+		targetOnlyName := iqnTargetName[strings.Index(iqnTargetName, ":")+1:]
+
+		callback("/dev/disk/by-path", name, ipPortalAddr, iqnTargetName, targetOnlyName)
+	}
+}
+
+// DeactivateIscsiTargetList logs out of each of the "iqn:target" names in toDeactivate, after syncing their disks.
+// If shouldWait is set, it waits up to 30 seconds for their disks to disappear. It returns the targets that were logged out of, and the errors for the rest.
+func DeactivateIscsiTargetList(ctx context.Context, api core.Session, ipPortalAddr string, toDeactivate []string, shouldWait bool) ([]string, []error) {
+	results := make([]string, 0)
+	errs := make([]error, 0)
+
+	toDeactivateMap := make(map[string]bool)
+	for _, t := range toDeactivate {
+		toDeactivateMap[t] = true
+	}
+
+	toSyncList := make([]string, 0)
+	IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
+		if _, exists := toDeactivateMap[iqnTargetName]; exists {
+			fullPath := path.Join(root, fullName)
+			toSyncList = append(toSyncList, fullPath)
+		}
+	})
+
+	if len(toSyncList) > 0 {
+		_, _ = core.RunCommand("sync", append([]string{"-f"}, toSyncList...)...)
+	}
+
+	for _, t := range toDeactivate {
+		if err := RunIscsiDeactivate(ctx, api, t, ipPortalAddr); err != nil {
+			errs = append(errs, fmt.Errorf("%s\t%v", t, err.Error()))
+		} else {
+			results = append(results, t)
+		}
+	}
+	if len(results) == 0 {
+		results = nil
+	}
+	if len(errs) == 0 {
+		errs = nil
+	}
+
+	if !shouldWait || results == nil {
+		return results, errs
+	}
+
+	statusCh := make(chan bool)
+	innerMap := make(map[string]bool)
+	outerMap := make(map[string]bool)
+	for _, t := range results {
+		innerMap[t] = true
+		outerMap[t] = true
+	}
+
+	go func() {
+		core.WaitForCreatedDeletedFiles("/dev/disk/by-path", func(fname string, wasCreate, wasDelete bool) bool {
+			isDone := true
+			IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
+				if _, exists := innerMap[iqnTargetName]; exists {
+					isDone = false
+				}
+			})
+			statusCh <- isDone
+			return isDone
+		})
+	}()
+
+	const maxTries = 30
+	for i := 0; i < maxTries; i++ {
+		select {
+		case isDone := <-statusCh:
+			if isDone {
+				return results, errs
+			}
+		case <-time.After(time.Duration(1000) * time.Millisecond):
+			isDone := true
+			IterateActivatedIscsiShares(ipPortalAddr, func(root string, fullName string, ipPortalAddr string, iqnTargetName string, targetOnlyName string) {
+				if _, exists := outerMap[iqnTargetName]; exists {
+					isDone = false
+				}
+			})
+			if isDone {
+				return results, errs
+			}
+		}
+	}
+
+	return results, errs
+}
+
+// GetIscsiTargetsFromDiscovery runs a sendtargets discovery against portalAddr, and returns the targets whose names are keys of maybeHashedToVolumeMap.
+func GetIscsiTargetsFromDiscovery(ctx context.Context, api core.Session, maybeHashedToVolumeMap map[string]string, portalAddr string) ([]IscsiLoginSpec, error) {
+	out, err := RunIscsiDiscover(ctx, api, portalAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]IscsiLoginSpec, 0)
+	lines := strings.Split(out, "\n")
+	for _, l := range lines {
+		spacePos := strings.Index(l, " ")
+		if spacePos == -1 {
+			continue
+		}
+		commaPos := strings.Index(l, ",")
+		if commaPos == -1 || commaPos > spacePos {
+			commaPos = spacePos
+		}
+		iqnSepPos := strings.Index(l[commaPos:], ":")
+		if iqnSepPos == -1 {
+			continue
+		}
+
+		targetName := l[commaPos+iqnSepPos+1:]
+		if _, exists := maybeHashedToVolumeMap[targetName]; exists {
+			t := IscsiLoginSpec{}
+			t.RemoteIp = l[0:commaPos]
+			t.Iqn = l[spacePos+1 : commaPos+iqnSepPos]
+			t.Target = targetName
+			targets = append(targets, t)
+		}
+	}
+
+	return targets, nil
+}
+
+// GetIscsiTargetsFromSession returns the targets with an active session whose names are keys of maybeHashedToVolumeMap.
+func GetIscsiTargetsFromSession(ctx context.Context, api core.Session, maybeHashedToVolumeMap map[string]string) ([]IscsiLoginSpec, error) {
+	out, err := RunIscsiAdminTool(ctx, api, []string{"--mode", "session"})
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]IscsiLoginSpec, 0)
+	lines := strings.Split(out, "\n")
+	for _, l := range lines {
+		firstEndBracket := strings.Index(l, "]")
+		if firstEndBracket == -1 {
+			continue
+		}
+		addrStart := firstEndBracket + 2
+		firstSpacePos := strings.Index(l[addrStart:], " ")
+		if firstSpacePos == -1 {
+			continue
+		}
+		firstCommaPos := strings.Index(l[addrStart:], ",")
+		if firstCommaPos == -1 || firstCommaPos > firstSpacePos {
+			firstCommaPos = firstSpacePos
+		}
+		lastSpacePos := strings.LastIndex(l, " ")
+		if lastSpacePos == firstSpacePos {
+			lastSpacePos = len(l)
+		}
+		ipPortalAddr := l[addrStart : addrStart+firstCommaPos]
+		fullName := l[addrStart+firstSpacePos+1 : lastSpacePos]
+		firstColon := strings.Index(fullName, ":")
+		if firstColon == -1 {
+			continue
+		}
+		targetName := fullName[firstColon+1:]
+
+		if _, exists := maybeHashedToVolumeMap[targetName]; exists {
+			iqnName := fullName[0:firstColon]
+			targets = append(targets, IscsiLoginSpec{
+				RemoteIp: ipPortalAddr,
+				Iqn:      iqnName,
+				Target:   targetName,
+			})
+		}
+	}
+
+	return targets, nil
+}
+
+// CheckRemoteIscsiServiceIsRunning returns a message explaining how to start the iscsitarget service if it is not running.
+func CheckRemoteIscsiServiceIsRunning(ctx context.Context, api core.Session) (string, error) {
+	out, err := callApi(ctx, api, "service.started", DefaultCallTimeout, []interface{}{"iscsitarget"})
+	if err != nil {
+		return "", err
+	}
+	var response map[string]interface{}
+	if err = json.Unmarshal(out, &response); err != nil {
+		return "", err
+	}
+	if !core.IsValueTrue(response, "result") {
+		return "The iSCSI service has not been started\nRun this tool with:\nservice start --enable iscsitarget\nTo start the service", nil
+	}
+	return "", nil
+}
+
+// RunIscsiDeactivate logs out of a single target.
+func RunIscsiDeactivate(ctx context.Context, api core.Session, iqnTargetName string, ipPortalAddr string) error {
+	logoutParams := []string{
+		"--mode",
+		"node",
+		"--targetname",
+		iqnTargetName,
+		"--portal",
+		ipPortalAddr,
+		"--logout",
+	}
+	debugString(strings.Join(logoutParams, " "))
+	_, err := RunIscsiAdminTool(ctx, api, logoutParams)
+	return err
+}
+
+// RunIscsiDiscover runs a sendtargets discovery against portalAddr.
+func RunIscsiDiscover(ctx context.Context, api core.Session, portalAddr string) (string, error) {
+	return RunIscsiAdminTool(ctx, api, []string{"--mode", "discoverydb", "--type", "sendtargets", "--discover", "--portal", portalAddr})
+}
+
+// TestIscsiDiscovery runs a discovery against portalAddr and returns the targets that it found, as printed by iscsiadm.
+func TestIscsiDiscovery(ctx context.Context, api core.Session, portalAddr string) (string, error) {
+	RunIscsiDiscover(ctx, api, portalAddr)
+	return RunIscsiAdminTool(ctx, api, []string{"--mode", "discovery", "--portal", portalAddr})
+}
+
+// RunIscsiAdminTool runs iscsiadm, retrying the errors caused by another instance running at the same time.
+// If it still fails, the error says whether the remote iscsitarget service needs to be started or restarted.
+func RunIscsiAdminTool(ctx context.Context, api core.Session, args []string) (string, error) {
+	retriesLeft := 10
+begin:
+	out, err := core.RunCommand("iscsiadm", args...)
+	// "Could not stat" seems to happen when iscsiadm decides to delete a node... and another instance deletes the node, a retry should resolve.
+	if err != nil && (strings.HasPrefix(err.Error(), "iscsiadm: Could not scan /sys/class/iscsi_transport") || strings.HasPrefix(err.Error(), "iscsiadm: Could not stat")) {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Duration(500) * time.Millisecond):
+		}
+		retriesLeft--
+		if retriesLeft > 0 {
+			goto begin
+		}
+	}
+	if err != nil {
+		msg, apiErr := CheckRemoteIscsiServiceIsRunning(ctx, api)
+		if apiErr == nil {
+			if msg != "" {
+				err = errors.New(err.Error() + "\n" + msg)
+			} else {
+				err = errors.New(err.Error() + "\nThe remote iscsitarget service is running. It may need to be restarted with:\nservice restart iscsitarget")
+			}
+		}
+	}
+	return out, err
+}
@@ -0,0 +1,555 @@
+package tnc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Property is a ZFS property as reported by TrueNAS, eg. {"value": "LZ4", "rawvalue": "lz4", "parsed": "lz4", "source": "LOCAL"}.
+type Property struct {
+	// Value is the human readable value, eg. "LZ4" or "1.5G".
+	Value string
+	// RawValue is the value as given by `zfs get -p`, eg. "lz4" or "1610612736".
+	RawValue string
+	// Parsed is the value decoded by TrueNAS, eg. "lz4", int64(1610612736) or false.
+	Parsed interface{}
+	// Source is where the value comes from, eg. "LOCAL", "DEFAULT", "INHERITED" or "NONE".
+	Source string
+}
+
+// Dataset is a filesystem or volume returned by pool.dataset.query.
+type Dataset struct {
+	ID         string
+	Name       string
+	Pool       string
+	Type       string // "FILESYSTEM" or "VOLUME"
+	Mountpoint string
+	Encrypted  bool
+	// Properties holds the ZFS properties that were retrieved, eg. "compression", "used" or "volsize".
+	Properties map[string]Property
+	// UserProperties holds the user properties that were retrieved, eg. "incus:content_type".
+	UserProperties map[string]Property
+	raw            map[string]interface{}
+}
+
+// Snapshot is a snapshot returned by zfs.snapshot.query.
+type Snapshot struct {
+	ID           string
+	Name         string // dataset@snapshot
+	Dataset      string
+	SnapshotName string
+	Pool         string
+	Type         string
+	CreateTxg    int64
+	// Properties holds the ZFS properties that were retrieved, eg. "clones" or "referenced".
+	Properties map[string]Property
+	raw        map[string]interface{}
+}
+
+// NfsShare is a share returned by sharing.nfs.query.
+type NfsShare struct {
+	ID           int
+	Path         string
+	Comment      string
+	Hosts        []string
+	Networks     []string
+	Ro           bool
+	MaprootUser  string
+	MaprootGroup string
+	MapallUser   string
+	MapallGroup  string
+	Security     []string
+	Enabled      bool
+	Locked       bool
+	raw          map[string]interface{}
+}
+
+// IscsiTarget is a target returned by iscsi.target.query.
+type IscsiTarget struct {
+	ID     int
+	Name   string
+	Alias  string
+	Mode   string
+	Groups []IscsiTargetGroup
+	raw    map[string]interface{}
+}
+
+// IscsiTargetGroup ties a target to the portal and initiator group it is reachable through.
+type IscsiTargetGroup struct {
+	Portal     int
+	Initiator  int
+	AuthMethod string
+	Auth       int
+}
+
+// IscsiExtent is an extent returned by iscsi.extent.query.
+type IscsiExtent struct {
+	ID        int
+	Name      string
+	Type      string // "DISK" or "FILE"
+	Disk      string // eg. "zvol/dozer/vol"
+	Path      string
+	Serial    string
+	Naa       string
+	Comment   string
+	Blocksize int
+	Enabled   bool
+	Ro        bool
+	raw       map[string]interface{}
+}
+
+// Portal is an iSCSI portal returned by iscsi.portal.query.
+type Portal struct {
+	ID      int
+	Tag     int
+	Comment string
+	Listen  []PortalListen
+	raw     map[string]interface{}
+}
+
+// PortalListen is an address that a portal listens on. Port is 0 if the server did not give one.
+type PortalListen struct {
+	IP   string
+	Port int
+}
+
+// Initiator is an iSCSI initiator group returned by iscsi.initiator.query.
+type Initiator struct {
+	ID         int
+	Comment    string
+	Initiators []string
+	raw        map[string]interface{}
+}
+
+// Service is a service returned by service.query.
+type Service struct {
+	ID      int
+	Service string
+	Enable  bool
+	State   string // eg. "RUNNING" or "STOPPED"
+	Pids    []int
+	raw     map[string]interface{}
+}
+
+// DatasetEnumProperties are the dataset properties whose values are shown in lower case, the same way that they are given to `dataset create`.
+var DatasetEnumProperties = []string{
+	"sync", "snapdir", "compression", "atime", "exec", "acltype", "aclmode", "deduplication", "checksum",
+	"readonly", "casesensitivity", "share_type", "volblocksize", "snapdev", "type",
+}
+
+// NfsShareEnumProperties are the NFS share fields whose values are shown in lower case.
+var NfsShareEnumProperties = []string{"security"}
+
+// DecodeDataset reads a dataset from a pool.dataset.query result.
+func DecodeDataset(result map[string]interface{}) (Dataset, error) {
+	d := Dataset{
+		ID:             stringField(result, "id"),
+		Name:           stringField(result, "name"),
+		Pool:           stringField(result, "pool"),
+		Type:           stringField(result, "type"),
+		Mountpoint:     stringField(result, "mountpoint"),
+		Encrypted:      boolField(result, "encrypted"),
+		Properties:     decodeProperties(result),
+		UserProperties: decodePropertyMap(result["user_properties"]),
+		raw:            result,
+	}
+	if d.ID == "" {
+		return d, fmt.Errorf("dataset \"%s\" has no id", d.Name)
+	}
+	return d, nil
+}
+
+// DecodeSnapshot reads a snapshot from a zfs.snapshot.query result.
+func DecodeSnapshot(result map[string]interface{}) (Snapshot, error) {
+	s := Snapshot{
+		ID:           stringField(result, "id"),
+		Name:         stringField(result, "name"),
+		Dataset:      stringField(result, "dataset"),
+		SnapshotName: stringField(result, "snapshot_name"),
+		Pool:         stringField(result, "pool"),
+		Type:         stringField(result, "type"),
+		CreateTxg:    int64Field(result, "createtxg"),
+		Properties:   decodeProperties(result),
+		raw:          result,
+	}
+	if s.ID == "" {
+		return s, fmt.Errorf("snapshot \"%s\" has no id", s.Name)
+	}
+	if atPos := strings.Index(s.Name, "@"); atPos > 0 {
+		if s.Dataset == "" {
+			s.Dataset = s.Name[0:atPos]
+		}
+		if s.SnapshotName == "" {
+			s.SnapshotName = s.Name[atPos+1:]
+		}
+	}
+	if s.CreateTxg == 0 {
+		if txg, exists := s.Properties["createtxg"]; exists {
+			s.CreateTxg, _ = strconv.ParseInt(txg.RawValue, 10, 64)
+		}
+	}
+	return s, nil
+}
+
+// DecodeNfsShare reads an NFS share from a sharing.nfs.query result.
+func DecodeNfsShare(result map[string]interface{}) (NfsShare, error) {
+	id, err := idField(result)
+	if err != nil {
+		return NfsShare{}, err
+	}
+	return NfsShare{
+		ID:           id,
+		Path:         stringField(result, "path"),
+		Comment:      stringField(result, "comment"),
+		Hosts:        stringListField(result, "hosts"),
+		Networks:     stringListField(result, "networks"),
+		Ro:           boolField(result, "ro"),
+		MaprootUser:  stringField(result, "maproot_user"),
+		MaprootGroup: stringField(result, "maproot_group"),
+		MapallUser:   stringField(result, "mapall_user"),
+		MapallGroup:  stringField(result, "mapall_group"),
+		Security:     stringListField(result, "security"),
+		Enabled:      boolField(result, "enabled"),
+		Locked:       boolField(result, "locked"),
+		raw:          result,
+	}, nil
+}
+
+// DecodeIscsiTarget reads a target from an iscsi.target.query result.
+func DecodeIscsiTarget(result map[string]interface{}) (IscsiTarget, error) {
+	id, err := idField(result)
+	if err != nil {
+		return IscsiTarget{}, err
+	}
+	t := IscsiTarget{
+		ID:    id,
+		Name:  stringField(result, "name"),
+		Alias: stringField(result, "alias"),
+		Mode:  stringField(result, "mode"),
+		raw:   result,
+	}
+	if groups, ok := result["groups"].([]interface{}); ok {
+		for _, g := range groups {
+			if groupMap, ok := g.(map[string]interface{}); ok {
+				t.Groups = append(t.Groups, IscsiTargetGroup{
+					Portal:     int(int64Field(groupMap, "portal")),
+					Initiator:  int(int64Field(groupMap, "initiator")),
+					AuthMethod: stringField(groupMap, "authmethod"),
+					Auth:       int(int64Field(groupMap, "auth")),
+				})
+			}
+		}
+	}
+	return t, nil
+}
+
+// DecodeIscsiExtent reads an extent from an iscsi.extent.query result.
+func DecodeIscsiExtent(result map[string]interface{}) (IscsiExtent, error) {
+	id, err := idField(result)
+	if err != nil {
+		return IscsiExtent{}, err
+	}
+	return IscsiExtent{
+		ID:        id,
+		Name:      stringField(result, "name"),
+		Type:      stringField(result, "type"),
+		Disk:      stringField(result, "disk"),
+		Path:      stringField(result, "path"),
+		Serial:    stringField(result, "serial"),
+		Naa:       stringField(result, "naa"),
+		Comment:   stringField(result, "comment"),
+		Blocksize: int(int64Field(result, "blocksize")),
+		Enabled:   boolField(result, "enabled"),
+		Ro:        boolField(result, "ro"),
+		raw:       result,
+	}, nil
+}
+
+// DecodePortal reads a portal from an iscsi.portal.query result.
+func DecodePortal(result map[string]interface{}) (Portal, error) {
+	id, err := idField(result)
+	if err != nil {
+		return Portal{}, err
+	}
+	p := Portal{
+		ID:      id,
+		Tag:     int(int64Field(result, "tag")),
+		Comment: stringField(result, "comment"),
+		raw:     result,
+	}
+	if listen, ok := result["listen"].([]interface{}); ok {
+		for _, l := range listen {
+			if listenMap, ok := l.(map[string]interface{}); ok {
+				p.Listen = append(p.Listen, PortalListen{
+					IP:   stringField(listenMap, "ip"),
+					Port: int(int64Field(listenMap, "port")),
+				})
+			}
+		}
+	}
+	return p, nil
+}
+
+// DecodeInitiator reads an initiator group from an iscsi.initiator.query result.
+func DecodeInitiator(result map[string]interface{}) (Initiator, error) {
+	id, err := idField(result)
+	if err != nil {
+		return Initiator{}, err
+	}
+	return Initiator{
+		ID:         id,
+		Comment:    stringField(result, "comment"),
+		Initiators: stringListField(result, "initiators"),
+		raw:        result,
+	}, nil
+}
+
+// DecodeService reads a service from a service.query result.
+func DecodeService(result map[string]interface{}) (Service, error) {
+	id, err := idField(result)
+	if err != nil {
+		return Service{}, err
+	}
+	s := Service{
+		ID:      id,
+		Service: stringField(result, "service"),
+		Enable:  boolField(result, "enable"),
+		State:   stringField(result, "state"),
+		raw:     result,
+	}
+	if pids, ok := result["pids"].([]interface{}); ok {
+		for _, pid := range pids {
+			if pidFloat, ok := pid.(float64); ok {
+				s.Pids = append(s.Pids, int(pidFloat))
+			}
+		}
+	}
+	return s, nil
+}
+
+// DecodeQueryResponse decodes each of the results of response, in the order given by GetListFromQueryResponse.
+func DecodeQueryResponse[T any](response *QueryResponse, decode func(map[string]interface{}) (T, error)) ([]T, error) {
+	keys := GetKeysFromQueryResponse(response)
+	out := make([]T, 0, len(keys))
+	for _, key := range keys {
+		result, exists := response.RawResultsMap[key]
+		if !exists {
+			result = response.ResultsMap[key]
+		}
+		item, err := decode(result)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+// Values returns the dataset's fields and properties as plain values, as shown by `dataset list`.
+// If parsed is true, each property is given as its parsed value, otherwise as its human readable value.
+func (d Dataset) Values(parsed bool) map[string]interface{} {
+	values := flattenResult(d.raw, false, BuildValueOrder(parsed))
+	LowerCaseEnumValues(values, DatasetEnumProperties)
+	return values
+}
+
+// IsVolume reports whether the dataset is a volume (zvol) rather than a filesystem.
+func (d Dataset) IsVolume() bool {
+	return strings.EqualFold(d.Type, "VOLUME")
+}
+
+// Values returns the snapshot's fields and properties as plain values, as shown by `snapshot list`.
+func (s Snapshot) Values(parsed bool) map[string]interface{} {
+	return flattenResult(s.raw, false, BuildValueOrder(parsed))
+}
+
+// Values returns the share's fields as plain values, as shown by `share nfs list`.
+func (s NfsShare) Values(parsed bool) map[string]interface{} {
+	values := flattenResult(s.raw, true, BuildValueOrder(parsed))
+	LowerCaseEnumValues(values, NfsShareEnumProperties)
+	return values
+}
+
+// Values returns the target's fields as plain values, as shown by `share iscsi target list`.
+func (t IscsiTarget) Values(parsed bool) map[string]interface{} {
+	return flattenResult(t.raw, false, BuildValueOrder(parsed))
+}
+
+// Values returns the extent's fields as plain values, as shown by `share iscsi extent list`.
+func (e IscsiExtent) Values(parsed bool) map[string]interface{} {
+	return flattenResult(e.raw, false, BuildValueOrder(parsed))
+}
+
+// Values returns the portal's fields as plain values, as shown by `share iscsi portal list`.
+func (p Portal) Values(parsed bool) map[string]interface{} {
+	return flattenResult(p.raw, false, BuildValueOrder(parsed))
+}
+
+// Values returns the initiator group's fields as plain values, as shown by `share iscsi initiator list`.
+func (i Initiator) Values(parsed bool) map[string]interface{} {
+	return flattenResult(i.raw, false, BuildValueOrder(parsed))
+}
+
+// Values returns the service's fields as plain values, as shown by `service list`.
+func (s Service) Values(parsed bool) map[string]interface{} {
+	return flattenResult(s.raw, false, BuildValueOrder(parsed))
+}
+
+// LowerCaseEnumValues lower-cases the string values of each of keys.
+func LowerCaseEnumValues(values map[string]interface{}, keys []string) {
+	for _, key := range keys {
+		if value, exists := values[key]; exists {
+			if valueStr, ok := value.(string); ok {
+				values[key] = strings.ToLower(valueStr)
+			}
+		}
+	}
+}
+
+// decodeProperties collects the property objects of a result, whether they are top-level fields (pool.dataset.query)
+// or listed under "properties" (zfs.snapshot.query).
+func decodeProperties(result map[string]interface{}) map[string]Property {
+	props := make(map[string]Property)
+	for key, value := range result {
+		if key == "user_properties" || key == "properties" || key == "children" {
+			continue
+		}
+		if prop, ok := decodeProperty(value); ok {
+			props[key] = prop
+		}
+	}
+	for key, prop := range decodePropertyMap(result["properties"]) {
+		props[key] = prop
+	}
+	return props
+}
+
+func decodePropertyMap(value interface{}) map[string]Property {
+	props := make(map[string]Property)
+	valueMap, ok := value.(map[string]interface{})
+	if !ok {
+		return props
+	}
+	for key, v := range valueMap {
+		if prop, ok := decodeProperty(v); ok {
+			props[key] = prop
+		} else if vStr, ok := v.(string); ok {
+			props[key] = Property{Value: vStr, RawValue: vStr, Parsed: vStr}
+		}
+	}
+	return props
+}
+
+func decodeProperty(value interface{}) (Property, bool) {
+	valueMap, ok := value.(map[string]interface{})
+	if !ok {
+		return Property{}, false
+	}
+	_, hasValue := valueMap["value"]
+	_, hasRawValue := valueMap["rawvalue"]
+	_, hasParsed := valueMap["parsed"]
+	if !hasValue && !hasRawValue && !hasParsed {
+		return Property{}, false
+	}
+
+	parsed := valueMap["parsed"]
+	if parsedFloat, ok := parsed.(float64); ok && parsedFloat == math.Floor(parsedFloat) {
+		parsed = int64(parsedFloat)
+	}
+	return Property{
+		Value:    stringField(valueMap, "value"),
+		RawValue: stringField(valueMap, "rawvalue"),
+		Parsed:   parsed,
+		Source:   stringField(valueMap, "source"),
+	}, true
+}
+
+func idField(result map[string]interface{}) (int, error) {
+	value, exists := result["id"]
+	if !exists {
+		return 0, fmt.Errorf("result has no id")
+	}
+	if valueFloat, ok := value.(float64); ok {
+		return int(valueFloat), nil
+	}
+	id, err := strconv.Atoi(fmt.Sprint(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid id \"%v\"", value)
+	}
+	return id, nil
+}
+
+// stringField returns a field as a string. A property is given as its raw value.
+func stringField(result map[string]interface{}, key string) string {
+	value := result[key]
+	if prop, ok := decodeProperty(value); ok {
+		return prop.RawValue
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		if v == math.Floor(v) {
+			return strconv.FormatInt(int64(v), 10)
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+func int64Field(result map[string]interface{}, key string) int64 {
+	value := result[key]
+	if prop, ok := decodeProperty(value); ok {
+		if n, ok := prop.Parsed.(int64); ok {
+			return n
+		}
+		value = prop.RawValue
+	}
+	switch v := value.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+func boolField(result map[string]interface{}, key string) bool {
+	value := result[key]
+	if prop, ok := decodeProperty(value); ok {
+		if b, ok := prop.Parsed.(bool); ok {
+			return b
+		}
+		value = prop.RawValue
+	}
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		switch strings.ToLower(v) {
+		case "on", "yes", "true":
+			return true
+		}
+	}
+	return false
+}
+
+func stringListField(result map[string]interface{}, key string) []string {
+	list, ok := result[key].([]interface{})
+	if !ok {
+		return nil
+	}
+	out := make([]string, 0, len(list))
+	for _, elem := range list {
+		if elemStr, ok := elem.(string); ok {
+			out = append(out, elemStr)
+		} else {
+			out = append(out, fmt.Sprint(elem))
+		}
+	}
+	return out
+}
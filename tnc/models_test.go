@@ -0,0 +1,96 @@
+package tnc
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func decodeJsonObject(t *testing.T, str string) map[string]interface{} {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(str), &obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestDecodeDatasetProperties(t *testing.T) {
+	d, err := DecodeDataset(decodeJsonObject(t, "{\"id\":\"dozer/vol\",\"name\":\"dozer/vol\",\"pool\":\"dozer\",\"type\":\"VOLUME\",\"encrypted\":false,"+
+		"\"compression\":{\"value\":\"LZ4\",\"rawvalue\":\"lz4\",\"parsed\":\"lz4\",\"source\":\"INHERITED\"},"+
+		"\"volsize\":{\"value\":\"1G\",\"rawvalue\":\"1073741824\",\"parsed\":1073741824,\"source\":\"LOCAL\"},"+
+		"\"user_properties\":{\"incus:content_type\":{\"value\":\"block\",\"rawvalue\":\"block\",\"source\":\"LOCAL\"}}}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AssertEqual(t, d.Name, "dozer/vol")
+	AssertEqual(t, d.Pool, "dozer")
+	AssertEqual(t, d.IsVolume(), true)
+	AssertEqual(t, len(d.Properties), 2)
+	AssertEqual(t, d.Properties["compression"], Property{Value: "LZ4", RawValue: "lz4", Parsed: "lz4", Source: "INHERITED"})
+	AssertEqual(t, d.Properties["volsize"].Parsed, interface{}(int64(1073741824)))
+	AssertEqual(t, d.Properties["volsize"].Source, "LOCAL")
+	AssertEqual(t, d.UserProperties["incus:content_type"].Value, "block")
+
+	values := d.Values(false)
+	AssertEqual(t, values["compression"], interface{}("lz4"))
+	AssertEqual(t, values["type"], interface{}("volume"))
+	AssertEqual(t, values["volsize"], interface{}("1G"))
+	AssertEqual(t, values["incus:content_type"], interface{}("block"))
+
+	values = d.Values(true)
+	AssertEqual(t, values["volsize"], interface{}(int64(1073741824)))
+}
+
+func TestDecodeSnapshotFromProperties(t *testing.T) {
+	s, err := DecodeSnapshot(decodeJsonObject(t, "{\"id\":\"dozer/a@snap1\",\"name\":\"dozer/a@snap1\","+
+		"\"properties\":{\"createtxg\":{\"value\":\"1003\",\"rawvalue\":\"1003\",\"parsed\":\"1003\",\"source\":\"NONE\"}}}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AssertEqual(t, s.Dataset, "dozer/a")
+	AssertEqual(t, s.SnapshotName, "snap1")
+	AssertEqual(t, s.CreateTxg, int64(1003))
+	AssertEqual(t, s.Properties["createtxg"].Source, "NONE")
+}
+
+func TestDecodeNfsShareAndPortal(t *testing.T) {
+	share, err := DecodeNfsShare(decodeJsonObject(t, "{\"id\":3,\"path\":\"/mnt/dozer/a\",\"ro\":true,\"hosts\":[\"10.0.0.1\"],\"security\":[\"SYS\"],\"enabled\":true}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, share.ID, 3)
+	AssertEqual(t, share.Ro, true)
+	AssertEqual(t, len(share.Hosts), 1)
+	AssertEqual(t, share.Security[0], "SYS")
+	AssertEqual(t, share.Values(false)["type"], interface{}("NFS"))
+
+	portal, err := DecodePortal(decodeJsonObject(t, "{\"id\":1,\"tag\":1,\"listen\":[{\"ip\":\"0.0.0.0\",\"port\":3260},{\"ip\":\"::\"}]}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, len(portal.Listen), 2)
+	AssertEqual(t, portal.Listen[0], PortalListen{IP: "0.0.0.0", Port: 3260})
+	AssertEqual(t, portal.Listen[1].Port, 0)
+
+	_, err = DecodeService(decodeJsonObject(t, "{\"service\":\"nfs\"}"))
+	if err == nil {
+		t.Fatal("expected an error for a result without an id")
+	}
+}
+
+func TestListSnapshotsDecodesInOrder(t *testing.T) {
+	api := &testSession{responses: []string{
+		"{\"result\":[{\"id\":\"dozer/a@snap2\",\"name\":\"dozer/a@snap2\",\"createtxg\":1002}," +
+			"{\"id\":\"dozer/a@snap1\",\"name\":\"dozer/a@snap1\",\"createtxg\":1001}]}",
+	}}
+
+	snapshots, err := ListSnapshots(context.Background(), api, SnapshotFilter{Names: []string{"dozer/a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, len(snapshots), 2)
+	AssertEqual(t, snapshots[0].SnapshotName, "snap1")
+	AssertEqual(t, snapshots[1].CreateTxg, int64(1002))
+}
@@ -0,0 +1,157 @@
+package tnc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"truenas/truenas_incus_ctl/core"
+)
+
+// NfsShareOptions holds the fields given to sharing.nfs.create or sharing.nfs.update.
+type NfsShareOptions struct {
+	BulkOptions
+	// Params are passed on as they are, eg. {"ro": true, "comment": "Managed by Incus", "security": ["SYS"]}.
+	Params map[string]interface{}
+}
+
+// LookupNfsIdByPath finds the ID of the NFS share exporting sharePath, and whether there was one.
+// If optShareProperties is not nil, it is filled with all of the share's properties.
+func LookupNfsIdByPath(ctx context.Context, api core.Session, sharePath string, optShareProperties map[string]string) (string, bool, error) {
+	if sharePath == "" {
+		return "", false, errors.New("Error looking up NFS share: no path was specified")
+	}
+
+	extras := QueryParams{
+		ValueOrder:         BuildValueOrder(false),
+		ShouldGetAllProps:  optShareProperties != nil,
+		ShouldGetUserProps: optShareProperties != nil,
+		ShouldRecurse:      false,
+	}
+
+	response, err := Query(ctx, api, "sharing.nfs", []string{sharePath}, []string{"path"}, []string{"id", "path"}, extras)
+	if err != nil {
+		return "", false, errors.New("API error: " + fmt.Sprint(err))
+	}
+
+	shares := GetListFromQueryResponse(&response)
+	if len(shares) == 0 {
+		return "", false, nil
+	}
+
+	var idStr string
+	if value, exists := shares[0]["id"]; exists {
+		if valueStr, ok := value.(string); ok {
+			if _, errNotNumber := strconv.Atoi(valueStr); errNotNumber == nil {
+				idStr = valueStr
+			}
+		} else {
+			idStr = fmt.Sprint(value)
+		}
+	}
+	if idStr == "" {
+		return "", false, nil
+	}
+
+	if optShareProperties != nil {
+		for key, value := range shares[0] {
+			if valueStr, ok := value.(string); ok {
+				optShareProperties[key] = valueStr
+			} else {
+				optShareProperties[key] = fmt.Sprint(value)
+			}
+		}
+	}
+
+	return idStr, true, nil
+}
+
+// CreateNfsShares creates an NFS share for each of paths.
+func CreateNfsShares(ctx context.Context, api core.Session, paths []string, opts NfsShareOptions) (json.RawMessage, int64, error) {
+	params := []interface{}{copyParams(opts.Params)}
+	objRemap := map[string][]interface{}{"path": core.ToAnyArray(paths)}
+	return BulkCall(ctx, api, "sharing.nfs.create", 10, ExpandBulkParams(params, objRemap), opts.BulkOptions)
+}
+
+// UpdateNfsShares updates the NFS shares with the given IDs.
+func UpdateNfsShares(ctx context.Context, api core.Session, ids []int, opts NfsShareOptions) (json.RawMessage, int64, error) {
+	params := []interface{}{copyParams(opts.Params)}
+	objRemap := map[string][]interface{}{"": core.ToAnyArray(ids)}
+	return BulkCall(ctx, api, "sharing.nfs.update", 10, ExpandBulkParams(params, objRemap), opts.BulkOptions)
+}
+
+// DeleteNfsShares deletes the NFS shares with the given IDs.
+func DeleteNfsShares(ctx context.Context, api core.Session, ids []int, opts BulkOptions) (json.RawMessage, int64, error) {
+	if len(ids) == 0 {
+		return nil, -1, errors.New("No NFS shares were given to delete")
+	}
+	params := []interface{}{ids[0]}
+	objRemap := map[string][]interface{}{"": core.ToAnyArray(ids)}
+	return BulkCall(ctx, api, "sharing.nfs.delete", 10, ExpandBulkParams(params, objRemap), opts)
+}
+
+// EnsureNfsShare makes sure that sharePath is exported with the given parameters.
+// The share is created if there is none, or updated if any of params differ from its current settings.
+// It returns the share's ID and whether it was created.
+func EnsureNfsShare(ctx context.Context, api core.Session, sharePath string, params map[string]interface{}) (int, bool, error) {
+	properties := make(map[string]string)
+	idStr, found, err := LookupNfsIdByPath(ctx, api, sharePath, properties)
+	if err != nil {
+		return -1, false, err
+	}
+
+	if !found {
+		createParams := copyParams(params)
+		createParams["path"] = sharePath
+		debugJson(createParams)
+		out, err := callApi(ctx, api, "sharing.nfs.create", 10, []interface{}{createParams})
+		if err != nil {
+			return -1, false, err
+		}
+		results, _ := core.GetResultsAndErrorsFromApiResponseRaw(out)
+		if len(results) > 0 {
+			if id, errNotNumber := strconv.Atoi(fmt.Sprint(core.GetIdFromObject(results[0]))); errNotNumber == nil {
+				return id, true, nil
+			}
+		}
+		idStr, found, err = LookupNfsIdByPath(ctx, api, sharePath, nil)
+		if err != nil {
+			return -1, true, err
+		}
+		if !found {
+			return -1, true, fmt.Errorf("Could not find the NFS share for %s after creating it", sharePath)
+		}
+		id, err := strconv.Atoi(idStr)
+		return id, true, err
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return -1, false, fmt.Errorf("Invalid ID \"%s\" for the NFS share of %s", idStr, sharePath)
+	}
+
+	anyDiffs := false
+	for key, value := range params {
+		if current, exists := properties[key]; !exists || current != fmt.Sprint(value) {
+			anyDiffs = true
+			break
+		}
+	}
+	if !anyDiffs {
+		return id, false, nil
+	}
+
+	updateParams := []interface{}{id, params}
+	debugJson(updateParams)
+	_, err = callApi(ctx, api, "sharing.nfs.update", 10, updateParams)
+	return id, false, err
+}
+
+func copyParams(params map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		out[key] = value
+	}
+	return out
+}
@@ -0,0 +1,429 @@
+package tnc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"truenas/truenas_incus_ctl/core"
+)
+
+// QueryParams controls how Query builds its query and reads back the results.
+type QueryParams struct {
+	// ValueOrder picks which of a property's "parsed", "value" and "rawvalue" to keep, see BuildValueOrder.
+	ValueOrder         []string
+	ShouldSkipKeyBuild bool
+	ShouldGetAllProps  bool
+	ShouldGetUserProps bool
+	ShouldRecurse      bool
+}
+
+// QueryResponse holds the results of a query keyed on their "id", in the order given by GetListFromQueryResponse.
+type QueryResponse struct {
+	ResultsMap map[string]map[string]interface{}
+	IntKeys    []int
+	StrKeys    []string
+	// RawResultsMap holds each result as it was returned by TrueNAS, for DecodeQueryResponse.
+	RawResultsMap map[string]map[string]interface{}
+}
+
+// Query calls <category>.query with a filter that matches any of entries, where each entry is compared against the field named by entryTypes.
+// Children are flattened into the results, and each result's properties are merged into it as plain values.
+func Query(ctx context.Context, api core.Session, category string, entries, entryTypes, propsList []string, params QueryParams) (QueryResponse, error) {
+	response := QueryResponse{}
+	endpoint := category + ".query"
+	isNfs := endpoint == "sharing.nfs.query"
+
+	if len(entryTypes) != len(entries) {
+		return response, fmt.Errorf("length mismatch between entries and entry types: %d != %d", len(entries), len(entryTypes))
+	}
+
+	filter, err := makeQueryFilter(entries, entryTypes, params)
+	if err != nil {
+		return response, err
+	}
+
+	query := []interface{}{filter}
+	if !isNfs {
+		query = append(query, makeQueryOptions(propsList, params, strings.Contains(endpoint, "snapshot")))
+	}
+
+	debugJson(query)
+
+	data, err := callApi(ctx, api, endpoint, DefaultCallTimeout, query)
+	if err != nil {
+		return response, err
+	}
+
+	var jsonResponse interface{}
+	if err = json.Unmarshal(data, &jsonResponse); err != nil {
+		return response, fmt.Errorf("response error: %v", err)
+	}
+
+	responseMap, ok := jsonResponse.(map[string]interface{})
+	if !ok {
+		return response, errors.New("API response was not a JSON object")
+	}
+
+	resultsList, errMsg := core.ExtractJsonArrayOfMaps(responseMap, "result")
+	if errMsg != "" {
+		return response, errors.New("API response results: " + errMsg)
+	}
+	if len(resultsList) == 0 {
+		debugString("resultsList was empty")
+		return response, nil
+	}
+
+	outputMap := make(map[string]map[string]interface{})
+	rawOutputMap := make(map[string]map[string]interface{})
+	outputMapIntKeys := make([]int, 0, 0)
+	outputMapStrKeys := make([]string, 0, 0)
+
+	// Do not refactor this loop condition into a range!
+	// This loop modifies the size of resultsList as it iterates.
+	for i := 0; i < len(resultsList); i++ {
+		children, _ := core.ExtractJsonArrayOfMaps(resultsList[i], "children")
+		if len(children) > 0 {
+			resultsList = append(resultsList, children...)
+		}
+
+		var primary string
+		var primaryValue interface{}
+		if primaryValue, ok = resultsList[i]["id"]; ok {
+			if primaryStr, ok := primaryValue.(string); ok {
+				primary = primaryStr
+			} else {
+				primary = fmt.Sprint(primaryValue)
+			}
+		}
+		if len(primary) == 0 {
+			continue
+		}
+		if _, exists := outputMap[primary]; exists {
+			continue
+		}
+
+		outputMap[primary] = flattenResult(resultsList[i], isNfs, params.ValueOrder)
+		rawOutputMap[primary] = resultsList[i]
+		if !params.ShouldSkipKeyBuild {
+			if primaryInt, errNotNumber := strconv.Atoi(primary); errNotNumber == nil {
+				outputMapIntKeys = append(outputMapIntKeys, primaryInt)
+			} else {
+				outputMapStrKeys = append(outputMapStrKeys, primary)
+			}
+		}
+	}
+
+	response = QueryResponse{
+		ResultsMap:    outputMap,
+		IntKeys:       outputMapIntKeys,
+		StrKeys:       outputMapStrKeys,
+		RawResultsMap: rawOutputMap,
+	}
+	return response, nil
+}
+
+// MergeResponseInto adds the results of src to dst, replacing any with the same key.
+func MergeResponseInto(dst *QueryResponse, src *QueryResponse) {
+	if dst == nil || src == nil {
+		return
+	}
+
+	for k, v := range src.ResultsMap {
+		if _, exists := dst.ResultsMap[k]; !exists {
+			if n, errNotNumber := strconv.Atoi(k); errNotNumber == nil {
+				dst.IntKeys = append(dst.IntKeys, n)
+			} else {
+				dst.StrKeys = append(dst.StrKeys, k)
+			}
+		}
+		dst.ResultsMap[k] = v
+	}
+
+	for k, v := range src.RawResultsMap {
+		if dst.RawResultsMap == nil {
+			dst.RawResultsMap = make(map[string]map[string]interface{})
+		}
+		dst.RawResultsMap[k] = v
+	}
+}
+
+// DeleteResponseEntries removes the results with the given keys.
+func DeleteResponseEntries(response *QueryResponse, keys []string) {
+	if response == nil || len(keys) == 0 {
+		return
+	}
+
+	anyDeletions := false
+	for _, k := range keys {
+		if _, exists := response.ResultsMap[k]; exists {
+			delete(response.ResultsMap, k)
+			anyDeletions = true
+		}
+		delete(response.RawResultsMap, k)
+	}
+
+	if anyDeletions && (len(response.IntKeys) > 0 || len(response.StrKeys) > 0) {
+		intKeys := make([]int, 0)
+		strKeys := make([]string, 0)
+		for k, _ := range response.ResultsMap {
+			if n, errNotNumber := strconv.Atoi(k); errNotNumber == nil {
+				intKeys = append(intKeys, n)
+			} else {
+				strKeys = append(strKeys, k)
+			}
+		}
+		response.IntKeys = intKeys
+		response.StrKeys = strKeys
+	}
+}
+
+// GetListFromQueryResponse returns the results ordered by numeric ID, then by name, with the snapshots of each dataset in the order they were taken.
+func GetListFromQueryResponse(response *QueryResponse) []map[string]interface{} {
+	keys := GetKeysFromQueryResponse(response)
+	resultsList := make([]map[string]interface{}, len(keys), len(keys))
+	for i, key := range keys {
+		resultsList[i] = response.ResultsMap[key]
+	}
+	return resultsList
+}
+
+// GetKeysFromQueryResponse returns the keys of the results in the order used by GetListFromQueryResponse.
+func GetKeysFromQueryResponse(response *QueryResponse) []string {
+	if response == nil {
+		return nil
+	}
+
+	slices.Sort(response.IntKeys)
+
+	slices.SortStableFunc(response.StrKeys, func(a, b string) int {
+		atPosA := strings.Index(a, "@")
+		if atPosA < 0 {
+			return strings.Compare(a, b)
+		}
+		atPosB := strings.Index(b, "@")
+		if atPosB < 0 {
+			return strings.Compare(a, b)
+		}
+		if atPosA != atPosB {
+			return strings.Compare(a, b)
+		}
+		nameCompare := strings.Compare(a[0:atPosA], b[0:atPosB])
+		if nameCompare != 0 {
+			return nameCompare
+		}
+		var txgA int64
+		if res, exists := response.ResultsMap[a]; exists {
+			txgA = core.GetIntegerFromJsonObjectOr(res, "createtxg", 0)
+		}
+		if txgA == 0 {
+			return 0
+		}
+		var txgB int64
+		if res, exists := response.ResultsMap[b]; exists {
+			txgB = core.GetIntegerFromJsonObjectOr(res, "createtxg", 0)
+		}
+		if txgB == 0 || txgA == txgB {
+			return 0
+		}
+		if txgA < txgB {
+			return -1
+		}
+		return 1
+	})
+
+	keys := make([]string, 0, len(response.IntKeys)+len(response.StrKeys))
+	for _, key := range response.IntKeys {
+		keys = append(keys, strconv.Itoa(key))
+	}
+	keys = append(keys, response.StrKeys...)
+
+	return keys
+}
+
+// GetMapFromQueryResponseKeyedOn returns the results keyed on the value of the given field instead of their ID.
+func GetMapFromQueryResponseKeyedOn(response *QueryResponse, key string) map[string]map[string]interface{} {
+	outMap := make(map[string]map[string]interface{})
+	for _, data := range response.ResultsMap {
+		if value, exists := data[key]; exists {
+			if valueStr, ok := value.(string); ok {
+				outMap[valueStr] = data
+			} else {
+				outMap[fmt.Sprint(value)] = data
+			}
+		}
+	}
+	return outMap
+}
+
+func makeQueryFilter(entries, entryTypes []string, params QueryParams) ([]interface{}, error) {
+	for i, e := range entries {
+		if e == "" {
+			return nil, fmt.Errorf("Cannot query based on empty %s", entryTypes[i])
+		}
+	}
+
+	filter := make([]interface{}, 0)
+
+	// first arg = query-filter
+	if len(entries) == 1 {
+		filter = append(filter, makeIndividualFilter(entryTypes[0], []string{entries[0]}, params.ShouldRecurse))
+	} else if len(entries) > 1 {
+		typeEntriesMap := make(map[string][]string)
+		uniqTypes := make([]string, 0, 0)
+		for i := 0; i < len(entries); i++ {
+			if _, exists := typeEntriesMap[entryTypes[i]]; !exists {
+				typeEntriesMap[entryTypes[i]] = make([]string, 0, 0)
+				uniqTypes = append(uniqTypes, entryTypes[i])
+			}
+			typeEntriesMap[entryTypes[i]] = append(typeEntriesMap[entryTypes[i]], entries[i])
+		}
+
+		filterList := make([][]interface{}, len(uniqTypes))
+		for i := 0; i < len(uniqTypes); i++ {
+			filterList[i] = makeIndividualFilter(uniqTypes[i], typeEntriesMap[uniqTypes[i]], params.ShouldRecurse)
+		}
+
+		filter = append(filter, constructORChain(filterList))
+	}
+
+	return filter, nil
+}
+
+func makeIndividualFilter(key string, array []string, isRecursive bool) []interface{} {
+	if isRecursive && (key == "dataset" /* || key == "pool"*/) {
+		return constructORChain(makeRecursivePathsFilterList(key, array))
+	}
+	arr := make([]interface{}, len(array), len(array))
+	for i := 0; i < len(array); i++ {
+		if n, errNotNumber := strconv.Atoi(array[i]); errNotNumber == nil {
+			arr[i] = n
+		} else if strings.HasPrefix(array[i], "[") {
+			_ = json.Unmarshal([]byte(array[i]), &arr[i])
+		} else {
+			arr[i] = array[i]
+		}
+	}
+	return []interface{}{key, "in", arr}
+}
+
+func makeRecursivePathsFilterList(key string, paths []string) [][]interface{} {
+	filterList := make([][]interface{}, 0)
+	for i := 0; i < len(paths); i++ {
+		filterList = append(filterList, []interface{}{key, "=", paths[i]})
+		filterList = append(filterList, []interface{}{key, "^", paths[i] + "/"})
+	}
+	return filterList
+}
+
+func constructORChain(filterList [][]interface{}) []interface{} {
+	nFilters := len(filterList)
+	if nFilters == 0 {
+		return nil
+	}
+	top := [][]interface{}{filterList[0]}
+	for i := 1; i < nFilters; i++ {
+		top = append(top, filterList[i])
+		inner := []interface{}{"OR", top}
+		top = [][]interface{}{inner}
+	}
+	return top[0]
+}
+
+func makeQueryOptions(propsList []string, params QueryParams, isSnapshot bool) map[string]interface{} {
+	// second arg = query-options
+	options := make(map[string]interface{})
+	options["flat"] = false
+	options["retrieve_children"] = params.ShouldRecurse
+	if params.ShouldGetAllProps {
+		var nothing interface{}
+		options["properties"] = nothing
+	} else {
+		if propsList == nil {
+			propsList = make([]string, 0)
+		}
+		if isSnapshot {
+			propsList = core.AppendIfMissing(propsList, "createtxg")
+		}
+		options["properties"] = propsList
+	}
+	options["user_properties"] = params.ShouldGetUserProps
+	return map[string]interface{}{"extra": options}
+}
+
+// flattenResult returns a copy of a query result with its properties merged into it as plain values.
+func flattenResult(result map[string]interface{}, isNfs bool, valueOrder []string) map[string]interface{} {
+	dict := make(map[string]interface{})
+	dict["id"] = result["id"]
+
+	if isNfs {
+		dict["type"] = "NFS"
+	}
+
+	InsertProperties(dict, result, []string{"id", "children", "properties"}, valueOrder)
+	if innerProps, exists := result["properties"]; exists {
+		if innerPropsMap, ok := innerProps.(map[string]interface{}); ok {
+			InsertProperties(dict, innerPropsMap, nil, valueOrder)
+		}
+	}
+	if innerProps, exists := result["user_properties"]; exists {
+		if innerPropsMap, ok := innerProps.(map[string]interface{}); ok {
+			InsertProperties(dict, innerPropsMap, nil, valueOrder)
+		}
+	}
+	return dict
+}
+
+// InsertProperties copies the entries of srcMap that are missing from dstMap, except for excludeKeys.
+// Properties given as an object are reduced to the first of their fields listed in valueOrder.
+func InsertProperties(dstMap, srcMap map[string]interface{}, excludeKeys []string, valueOrder []string) {
+	for key, value := range srcMap {
+		if _, exists := dstMap[key]; exists {
+			continue
+		}
+		shouldSkip := false
+		for _, ex := range excludeKeys {
+			if key == ex {
+				shouldSkip = true
+				break
+			}
+		}
+		if shouldSkip {
+			continue
+		}
+
+		var elem interface{}
+		if valueMap, ok := value.(map[string]interface{}); ok {
+			for _, t := range valueOrder {
+				if actualValue, ok := valueMap[t]; ok {
+					elem = actualValue
+					break
+				}
+			}
+
+		} else {
+			elem = value
+		}
+
+		if elem != nil {
+			if elemFloat, ok := elem.(float64); ok {
+				if elemFloat == math.Floor(elemFloat) {
+					elem = int64(elemFloat)
+				}
+			}
+			dstMap[key] = elem
+		}
+	}
+}
+
+// BuildValueOrder prefers the "parsed" value of each property if parsed is true, or else the human readable "value".
+func BuildValueOrder(parsed bool) []string {
+	if parsed {
+		return []string{"parsed", "value", "rawvalue"}
+	}
+	return []string{"value", "rawvalue", "parsed"}
+}
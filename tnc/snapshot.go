@@ -0,0 +1,193 @@
+package tnc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"truenas/truenas_incus_ctl/core"
+)
+
+// SnapshotOptions holds the parameters given to zfs.snapshot.create.
+type SnapshotOptions struct {
+	BulkOptions
+	// Recursive also snapshots the datasets' children.
+	Recursive bool
+	// Exclude lists children to leave out of a recursive snapshot.
+	Exclude []string
+	// Properties are ZFS properties to set on the snapshots, eg. {"readonly": "ON"}.
+	Properties map[string]interface{}
+	// Params are passed on as they are, eg. {"suspend_vms": true}.
+	Params map[string]interface{}
+}
+
+// DeleteSnapshotOptions controls how zfs.snapshot.delete destroys snapshots.
+type DeleteSnapshotOptions struct {
+	BulkOptions
+	// Recursive also destroys the snapshots of the same name in the datasets' children.
+	Recursive bool
+	// Defer marks snapshots that are still in use for deletion once they are released, instead of failing.
+	Defer bool
+}
+
+// RollbackSnapshotOptions controls how zfs.snapshot.rollback rolls datasets back.
+type RollbackSnapshotOptions struct {
+	BulkOptions
+	// Force unmounts any clones.
+	Force bool
+	// Recursive destroys any snapshots and bookmarks more recent than the one given.
+	Recursive bool
+	// RecursiveClones is like Recursive, but also destroys any clones.
+	RecursiveClones bool
+	// RecursiveRollback rolls back each child to its snapshot of the same name, which must exist.
+	RecursiveRollback bool
+}
+
+// SnapshotFilter selects the snapshots and properties returned by ListSnapshots.
+type SnapshotFilter struct {
+	// Names are snapshots (dataset@snapshot), snapshot names (@snapshot), datasets or pools. Every snapshot is listed if there are none.
+	Names []string
+	// Recursive includes the snapshots of the children of each dataset.
+	Recursive bool
+	// Properties to retrieve, besides the name.
+	Properties []string
+	// AllProperties retrieves every property, ignoring Properties.
+	AllProperties bool
+}
+
+// CreateSnapshots takes each of snapshots, which must be given as dataset@snapshot.
+func CreateSnapshots(ctx context.Context, api core.Session, snapshots []string, opts SnapshotOptions) (json.RawMessage, int64, error) {
+	datasetList := make([]string, len(snapshots), len(snapshots))
+	nameList := make([]string, len(snapshots), len(snapshots))
+
+	for i, snapshot := range snapshots {
+		datasetLen := strings.Index(snapshot, "@")
+		if datasetLen <= 0 || datasetLen == len(snapshot)-1 {
+			return nil, -1, errors.New("No dataset name was found in snapshot specifier.\nExpected <datasetname>@<snapshotname>.")
+		}
+		if snapshot[0] == '/' {
+			return nil, -1, errors.New("Dataset names must not start with '/'.")
+		}
+		datasetList[i] = snapshot[0:datasetLen]
+		nameList[i] = snapshot[datasetLen+1:]
+	}
+
+	outMap := copyParams(opts.Params)
+	outMap["dataset"] = datasetList[0]
+	outMap["name"] = nameList[0]
+	outMap["recursive"] = opts.Recursive
+	if len(opts.Exclude) > 0 {
+		outMap["exclude"] = opts.Exclude
+	}
+	outMap["properties"] = copyParams(opts.Properties)
+
+	objRemap := map[string][]interface{}{"dataset": core.ToAnyArray(datasetList), "name": core.ToAnyArray(nameList)}
+	return BulkCall(ctx, api, "zfs.snapshot.create", 10, ExpandBulkParams([]interface{}{outMap}, objRemap), opts.BulkOptions)
+}
+
+// DeleteSnapshots destroys each of snapshots.
+func DeleteSnapshots(ctx context.Context, api core.Session, snapshots []string, opts DeleteSnapshotOptions) (json.RawMessage, int64, error) {
+	outMap := make(map[string]interface{})
+	if opts.Recursive {
+		outMap["recursive"] = true
+	}
+	if opts.Defer {
+		outMap["defer"] = true
+	}
+	return snapshotBulkCall(ctx, api, "zfs.snapshot.delete", snapshots, outMap, opts.BulkOptions)
+}
+
+// RollbackSnapshots rolls back the dataset of each of snapshots to that snapshot.
+func RollbackSnapshots(ctx context.Context, api core.Session, snapshots []string, opts RollbackSnapshotOptions) (json.RawMessage, int64, error) {
+	outMap := make(map[string]interface{})
+	if opts.Force {
+		outMap["force"] = true
+	}
+	if opts.Recursive {
+		outMap["recursive"] = true
+	}
+	if opts.RecursiveClones {
+		outMap["recursive_clones"] = true
+	}
+	if opts.RecursiveRollback {
+		outMap["recursive_rollback"] = true
+	}
+	return snapshotBulkCall(ctx, api, "zfs.snapshot.rollback", snapshots, outMap, opts.BulkOptions)
+}
+
+// CloneSnapshot creates the dataset dest as a clone of snapshot.
+func CloneSnapshot(ctx context.Context, api core.Session, snapshot, dest string) error {
+	params := []interface{}{map[string]interface{}{"snapshot": snapshot, "dataset_dst": dest}}
+	debugJson(params)
+
+	out, err := callApi(ctx, api, "zfs.snapshot.clone", DefaultCallTimeout, params)
+	if err != nil {
+		return err
+	}
+	debugString(string(out))
+	return nil
+}
+
+// ListSnapshots returns the snapshots matching filter.
+// Each dataset's snapshots are in the order they were taken. Like `zfs list`, every snapshot is listed if no names are given.
+func ListSnapshots(ctx context.Context, api core.Session, filter SnapshotFilter) ([]Snapshot, error) {
+	names := make([]string, len(filter.Names))
+	copy(names, filter.Names)
+	idTypes, err := getSnapshotListTypes(names)
+	if err != nil {
+		return nil, err
+	}
+
+	extras := QueryParams{
+		ValueOrder:         BuildValueOrder(true),
+		ShouldGetAllProps:  filter.AllProperties,
+		ShouldGetUserProps: false,
+		ShouldRecurse:      len(names) == 0 || filter.Recursive,
+	}
+
+	response, err := Query(ctx, api, "zfs.snapshot", names, idTypes, filter.Properties, extras)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeQueryResponse(&response, DecodeSnapshot)
+}
+
+func snapshotBulkCall(ctx context.Context, api core.Session, endpoint string, snapshots []string, outMap map[string]interface{}, opts BulkOptions) (json.RawMessage, int64, error) {
+	if len(snapshots) == 0 {
+		return nil, -1, errors.New("No snapshots were given")
+	}
+	for _, snapshot := range snapshots {
+		if strings.Index(snapshot, "@") <= 0 {
+			return nil, -1, errors.New("No dataset name was found in snapshot specifier.\nExpected <datasetname>@<snapshotname>.")
+		}
+	}
+
+	objRemap := map[string][]interface{}{"": core.ToAnyArray(snapshots)}
+	return BulkCall(ctx, api, endpoint, 10, ExpandBulkParams([]interface{}{snapshots[0], outMap}, objRemap), opts)
+}
+
+// getSnapshotListTypes identifies the field to query for each of args, and strips any prefix from them.
+func getSnapshotListTypes(args []string) ([]string, error) {
+	var typeList []string
+	if len(args) == 0 {
+		return typeList, nil
+	}
+
+	typeList = make([]string, len(args), len(args))
+	for i := 0; i < len(args); i++ {
+		t, value := core.IdentifyObject(args[i])
+		if t == "id" || t == "share" {
+			return nil, errors.New("querying snapshots based on mount point is not yet supported")
+		} else if t == "snapshot" {
+			t = "name"
+		} else if t == "snapshot_only" {
+			t = "snapshot_name"
+		} else if t != "dataset" && t != "pool" {
+			return nil, errors.New("Unrecognised namespec \"" + args[i] + "\"")
+		}
+		typeList[i] = t
+		args[i] = value
+	}
+
+	return typeList, nil
+}
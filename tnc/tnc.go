@@ -0,0 +1,52 @@
+// Package tnc exposes the operations behind truenas_incus_ctl as plain Go functions, so that programs
+// which manage TrueNAS storage for Incus can create datasets, snapshots, NFS shares and iSCSI targets without shelling out.
+//
+// Every function takes a core.Session: a *core.RealSession talks to TrueNAS directly over a websocket,
+// while a *core.ClientSession shares the connections of a running truenas_incus_ctl daemon.
+// The context bounds each call; calls and jobs that already reached TrueNAS carry on there regardless.
+package tnc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+)
+
+// DefaultCallTimeout is the number of seconds that a call may take when a function has no more specific limit.
+const DefaultCallTimeout = 30
+
+// DebugLog, if set, is given the parameters of each call before it is sent, along with other diagnostics.
+var DebugLog func(msg string)
+
+func debugString(msg string) {
+	if DebugLog != nil {
+		DebugLog(msg)
+	}
+}
+
+func debugJson(obj interface{}) {
+	if DebugLog == nil {
+		return
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		DebugLog(fmt.Sprintf("%v (%v)", obj, err))
+		return
+	}
+	DebugLog(string(data))
+}
+
+// callApi makes a single call that gives up after timeoutSeconds, or sooner if ctx has an earlier deadline.
+func callApi(ctx context.Context, api core.Session, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	callCtx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	out, err := core.ApiCallCtx(callCtx, api, method, params)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, errors.New("call timed out")
+	}
+	return out, err
+}
@@ -0,0 +1,276 @@
+package tnc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"testing"
+	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/truenastest"
+)
+
+type testCall struct {
+	method string
+	params string
+}
+
+// testSession records each call and answers it with the next of its responses.
+type testSession struct {
+	calls      []testCall
+	responses  []string
+	nextJobId  int64
+	skippedIds []int64
+}
+
+func (s *testSession) Login() error        { return nil }
+func (s *testSession) IsLoggedIn() bool    { return true }
+func (s *testSession) GetHostName() string { return "truenas.local" }
+func (s *testSession) GetUrl() string      { return "wss://truenas.local/api/current" }
+
+func (s *testSession) CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	return s.CallRawCtx(context.Background(), method, params)
+}
+
+func (s *testSession) CallRawCtx(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	s.calls = append(s.calls, testCall{method: method, params: string(data)})
+	if len(s.responses) == 0 {
+		return nil, errors.New("no response for " + method)
+	}
+	response := s.responses[0]
+	s.responses = s.responses[1:]
+	return json.RawMessage(response), nil
+}
+
+func (s *testSession) CallAsyncRaw(method string, params interface{}) (int64, error) {
+	return s.CallAsyncRawCtx(context.Background(), method, params)
+}
+
+func (s *testSession) CallAsyncRawCtx(ctx context.Context, method string, params interface{}) (int64, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return -1, err
+	}
+	s.calls = append(s.calls, testCall{method: method, params: string(data)})
+	s.nextJobId++
+	return s.nextJobId, nil
+}
+
+func (s *testSession) WaitForJob(jobId int64) (json.RawMessage, error) {
+	return json.RawMessage(fmt.Sprintf("{\"id\":%d}", jobId)), nil
+}
+func (s *testSession) WaitForJobWithProgress(jobId int64, onProgress func(core.JobProgress)) (json.RawMessage, error) {
+	return s.WaitForJob(jobId)
+}
+func (s *testSession) WaitForJobCtx(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	return s.WaitForJob(jobId)
+}
+func (s *testSession) WaitForJobWithProgressCtx(ctx context.Context, jobId int64, onProgress func(core.JobProgress)) (json.RawMessage, error) {
+	onProgress(core.JobProgress{JobId: jobId, State: "SUCCESS", Percent: 100})
+	return s.WaitForJob(jobId)
+}
+func (s *testSession) SkipWaitingJobOnClose(jobId int64) {
+	s.skippedIds = append(s.skippedIds, jobId)
+}
+func (s *testSession) Close(internalError error) error { return internalError }
+
+func AssertEqual[T comparable](test *testing.T, a T, b T) {
+	if a != b {
+		test.Errorf("\nFailure: %v != %v\n%s", a, b, string(debug.Stack()))
+	}
+}
+
+func assertCalls(t *testing.T, s *testSession, expected ...testCall) {
+	AssertEqual(t, len(s.calls), len(expected))
+	for i := 0; i < len(s.calls) && i < len(expected); i++ {
+		AssertEqual(t, s.calls[i], expected[i])
+	}
+}
+
+func TestQueryMergesPropertiesAndChildren(t *testing.T) {
+	api := &testSession{responses: []string{
+		"{\"result\":[{\"id\":\"dozer/a\",\"properties\":{\"atime\":{\"value\":\"OFF\",\"rawvalue\":\"off\",\"parsed\":false}}," +
+			"\"children\":[{\"id\":\"dozer/a/b\",\"properties\":{\"atime\":{\"value\":\"ON\",\"rawvalue\":\"on\",\"parsed\":true}}}]}]}",
+	}}
+
+	params := QueryParams{ValueOrder: BuildValueOrder(true), ShouldRecurse: true}
+	response, err := Query(context.Background(), api, "pool.dataset", []string{"dozer/a", "tank"}, []string{"name", "pool"}, []string{"atime"}, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertCalls(t, api, testCall{
+		method: "pool.dataset.query",
+		params: "[[[\"OR\",[[\"name\",\"in\",[\"dozer/a\"]],[\"pool\",\"in\",[\"tank\"]]]]]," +
+			"{\"extra\":{\"flat\":false,\"properties\":[\"atime\"],\"retrieve_children\":true,\"user_properties\":false}}]",
+	})
+
+	results := GetListFromQueryResponse(&response)
+	AssertEqual(t, len(results), 2)
+	AssertEqual(t, results[0]["id"], interface{}("dozer/a"))
+	AssertEqual(t, results[0]["atime"], interface{}(false))
+	AssertEqual(t, results[1]["id"], interface{}("dozer/a/b"))
+	AssertEqual(t, results[1]["atime"], interface{}(true))
+}
+
+func TestCreateDatasetsSingleCall(t *testing.T) {
+	api := &testSession{responses: []string{"{\"result\":{}}"}}
+	opts := DatasetOptions{
+		Params:         map[string]interface{}{"volsize": 1024},
+		UserProperties: []UserProperty{{Key: "incus:content_type", Value: "block"}},
+		CreateParents:  true,
+	}
+
+	_, jobId, err := CreateDatasets(context.Background(), api, []string{"dozer/vol"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, jobId, int64(-1))
+	assertCalls(t, api, testCall{
+		method: "pool.dataset.create",
+		params: "[{\"create_ancestors\":true,\"name\":\"dozer/vol\",\"type\":\"VOLUME\"," +
+			"\"user_properties\":[{\"key\":\"incus:content_type\",\"value\":\"block\"}],\"volsize\":1024}]",
+	})
+	// the caller's params must not be modified
+	AssertEqual(t, len(opts.Params), 1)
+}
+
+func TestDeleteDatasetsBulkDetached(t *testing.T) {
+	api := &testSession{}
+	opts := DeleteDatasetOptions{BulkOptions: BulkOptions{Detach: true}, Force: true}
+
+	_, jobId, err := DeleteDatasets(context.Background(), api, []string{"dozer/a", "dozer/b"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, jobId, int64(1))
+	AssertEqual(t, len(api.skippedIds), 1)
+	assertCalls(t, api, testCall{
+		method: "core.bulk",
+		params: "[\"pool.dataset.delete\",[[\"dozer/a\",{\"force\":true}],[\"dozer/b\",{\"force\":true}]]]",
+	})
+}
+
+func TestBulkCallWaitsWithProgress(t *testing.T) {
+	api := &testSession{}
+	var lastPercent float64
+	opts := BulkOptions{Wait: true, OnProgress: func(progress core.JobProgress) {
+		lastPercent = progress.Percent
+	}}
+
+	out, jobId, err := BulkCall(context.Background(), api, "service.start", 10, []interface{}{[]interface{}{"nfs"}, []interface{}{"iscsitarget"}}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, jobId, int64(1))
+	AssertEqual(t, string(out), "{\"id\":1}")
+	AssertEqual(t, lastPercent, float64(100))
+	AssertEqual(t, len(api.skippedIds), 0)
+}
+
+func TestEnsureNfsShareCreatesMissingShare(t *testing.T) {
+	api := &testSession{responses: []string{
+		"{\"result\":[]}",
+		"{\"result\":{\"id\":7,\"path\":\"/mnt/dozer/a\"}}",
+	}}
+
+	id, created, err := EnsureNfsShare(context.Background(), api, "/mnt/dozer/a", map[string]interface{}{"ro": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, id, 7)
+	AssertEqual(t, created, true)
+	AssertEqual(t, len(api.calls), 2)
+	AssertEqual(t, api.calls[1], testCall{method: "sharing.nfs.create", params: "[{\"path\":\"/mnt/dozer/a\",\"ro\":true}]"})
+}
+
+func TestEnsureNfsShareUpdatesOnlyWhenChanged(t *testing.T) {
+	existing := "{\"result\":[{\"id\":3,\"path\":\"/mnt/dozer/a\",\"ro\":false,\"comment\":\"\"}]}"
+
+	api := &testSession{responses: []string{existing}}
+	id, created, err := EnsureNfsShare(context.Background(), api, "/mnt/dozer/a", map[string]interface{}{"ro": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, id, 3)
+	AssertEqual(t, created, false)
+	AssertEqual(t, len(api.calls), 1)
+
+	api = &testSession{responses: []string{existing, "{\"result\":{}}"}}
+	_, _, err = EnsureNfsShare(context.Background(), api, "/mnt/dozer/a", map[string]interface{}{"ro": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, len(api.calls), 2)
+	AssertEqual(t, api.calls[1], testCall{method: "sharing.nfs.update", params: "[3,{\"ro\":true}]"})
+}
+
+func TestCreateSnapshotsRejectsMissingDataset(t *testing.T) {
+	api := &testSession{}
+	_, _, err := CreateSnapshots(context.Background(), api, []string{"@snap"}, SnapshotOptions{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	AssertEqual(t, len(api.calls), 0)
+}
+
+func TestMaybeHashIscsiNameFromVolumePath(t *testing.T) {
+	AssertEqual(t, MaybeHashIscsiNameFromVolumePath("incus", "dozer/vm_1@snap.0"), "incus:dozer:vm-1:snap-0")
+
+	long := "dozer/a-very-long-volume-name-that-does-not-fit-within-the-iscsi-limit"
+	hashed := MaybeHashIscsiNameFromVolumePath("incus", long)
+	AssertEqual(t, len(hashed), 64)
+	AssertEqual(t, hashed[0:8], "incus:-:")
+}
+
+func TestDatasetsAndSharesAgainstFakeServer(t *testing.T) {
+	server := truenastest.NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+
+	api := &core.RealSession{HostName: server.HostName(), ApiKey: truenastest.ApiKey, AllowInsecure: true}
+	defer api.Close(nil)
+	ctx := context.Background()
+
+	opts := DatasetOptions{
+		BulkOptions:    BulkOptions{Wait: true},
+		Params:         map[string]interface{}{"compression": "ZSTD"},
+		UserProperties: []UserProperty{{Key: "incus:content_type", Value: "filesystem"}},
+		CreateParents:  true,
+	}
+	if _, _, err := CreateDatasets(ctx, api, []string{"dozer/incus/a", "dozer/incus/b"}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	datasets, err := ListDatasets(ctx, api, DatasetFilter{Names: []string{"dozer/incus"}, Recursive: true, Properties: []string{"compression"}, UserProperties: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, len(datasets), 3)
+	AssertEqual(t, datasets[1].Name, "dozer/incus/a")
+	AssertEqual(t, datasets[1].Properties["compression"].RawValue, "zstd")
+	AssertEqual(t, datasets[1].UserProperties["incus:content_type"].Value, "filesystem")
+
+	id, created, err := EnsureNfsShare(ctx, api, "/mnt/dozer/incus/a", map[string]interface{}{"ro": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, created, true)
+	sameId, created, err := EnsureNfsShare(ctx, api, "/mnt/dozer/incus/a", map[string]interface{}{"ro": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, sameId, id)
+	AssertEqual(t, created, false)
+	AssertEqual(t, server.CallCount("sharing.nfs.update"), 0)
+
+	if _, _, err = DeleteDatasets(ctx, api, []string{"dozer/incus"}, DeleteDatasetOptions{BulkOptions: BulkOptions{Wait: true}, Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, len(server.Datasets()), 1)
+}
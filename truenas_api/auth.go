@@ -0,0 +1,129 @@
+package truenas_api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrOtpRequired is returned by LoginWithPassword when the user needs a one-time password but none was given.
+var ErrOtpRequired = errors.New("a one-time password is required for this user")
+
+// LoginCaller makes a call for LoginWithPassword. It returns the whole response, including any JSON-RPC error.
+type LoginCaller func(method string, params []interface{}) (json.RawMessage, error)
+
+// LoginWithPassword logs in with auth.login_ex, calling getOtp if TrueNAS asks for a one-time password.
+// getOtp may be nil, in which case ErrOtpRequired is returned instead. Hosts that are too old to have
+// auth.login_ex are logged in with auth.login, which does not support one-time passwords.
+func LoginWithPassword(call LoginCaller, username, password string, getOtp func() (string, error)) error {
+	result, err := callLogin(call, "auth.login_ex", map[string]interface{}{
+		"mechanism": "PASSWORD_PLAIN",
+		"username":  username,
+		"password":  password,
+	})
+	if errors.Is(err, errMethodNotFound) {
+		return loginLegacy(call, username, password)
+	}
+	if err != nil {
+		return err
+	}
+
+	if result["response_type"] == "OTP_REQUIRED" {
+		if getOtp == nil {
+			return ErrOtpRequired
+		}
+		otp, err := getOtp()
+		if err != nil {
+			return err
+		}
+		result, err = callLogin(call, "auth.login_ex_continue", map[string]interface{}{
+			"mechanism": "OTP_TOKEN",
+			"otp_token": otp,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	switch result["response_type"] {
+	case "SUCCESS":
+		return nil
+	case "AUTH_ERR":
+		return errors.New("login failed: the username, password or one-time password is incorrect")
+	case "EXPIRED":
+		return errors.New("login failed: the password has expired")
+	case "OTP_REQUIRED":
+		return errors.New("login failed: the one-time password was not accepted")
+	}
+	return fmt.Errorf("login failed, unexpected response type %v", result["response_type"])
+}
+
+var errMethodNotFound = errors.New("method not found")
+
+func callLogin(call LoginCaller, method string, data map[string]interface{}) (map[string]interface{}, error) {
+	res, err := call(method, []interface{}{data})
+	if err != nil {
+		return nil, fmt.Errorf("login failed: %w", err)
+	}
+
+	var response struct {
+		Result map[string]interface{} `json:"result"`
+		Error  *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(res, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse login response: %w", err)
+	}
+	if response.Error != nil {
+		// -32601 is the JSON-RPC code for an unknown method
+		if response.Error.Code == -32601 {
+			return nil, errMethodNotFound
+		}
+		return nil, fmt.Errorf("login error: %s", extractErrorMessage(res))
+	}
+	return response.Result, nil
+}
+
+func loginLegacy(call LoginCaller, username, password string) error {
+	res, err := call("auth.login", []interface{}{username, password})
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(res, &response); err != nil {
+		return fmt.Errorf("failed to parse login response: %w", err)
+	}
+	if errorData, exists := response["error"]; exists && errorData != nil {
+		return fmt.Errorf("login error: %v", errorData)
+	}
+	if result, exists := response["result"]; exists && result == true {
+		return nil
+	}
+	return errors.New("login failed: the username or password is incorrect")
+}
+
+// extractErrorMessage prefers the reason that the middleware gives for an error over its generic message.
+func extractErrorMessage(res json.RawMessage) string {
+	var response struct {
+		Error struct {
+			Message string `json:"message"`
+			Data    struct {
+				Reason string `json:"reason"`
+			} `json:"data"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(res, &response)
+	if response.Error.Data.Reason != "" {
+		return response.Error.Data.Reason
+	}
+	return response.Error.Message
+}
+
+// LoginWithPassword logs the client in with a username and password. See LoginWithPassword.
+func (c *Client) LoginWithPassword(username, password string, getOtp func() (string, error)) error {
+	return LoginWithPassword(func(method string, params []interface{}) (json.RawMessage, error) {
+		return c.Call(method, 10, params)
+	}, username, password, getOtp)
+}
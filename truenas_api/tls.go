@@ -0,0 +1,163 @@
+package truenas_api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSOptions controls how the server's certificate is verified.
+type TLSOptions struct {
+	// AllowInsecure skips verification entirely.
+	AllowInsecure bool
+	// CaFile is a PEM bundle of the CAs to trust instead of the system's.
+	CaFile string
+	// CertFingerprint is the SHA-256 fingerprint of the server's certificate in hex, with or without colons.
+	// When it is set, a certificate with this fingerprint is trusted even if it is self-signed, and no other is.
+	CertFingerprint string
+	// ClientCert and ClientKey are PEM files with a certificate and key to present to the server,
+	// eg. to a reverse proxy that requires clients to authenticate with mutual TLS.
+	ClientCert string
+	ClientKey  string
+}
+
+// Config makes the TLS config for dialing a server with these options.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: o.AllowInsecure,
+	}
+	if err := o.addClientCert(tlsConfig); err != nil {
+		return nil, err
+	}
+	if o.AllowInsecure {
+		return tlsConfig, nil
+	}
+
+	if o.CaFile != "" {
+		data, err := os.ReadFile(o.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("CA file %s does not hold any PEM certificates", o.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if o.CertFingerprint != "" {
+		pin, err := parseFingerprint(o.CertFingerprint)
+		if err != nil {
+			return nil, err
+		}
+		// the pin replaces the usual verification, which would reject a self-signed certificate, unless there is also a CA file
+		tlsConfig.InsecureSkipVerify = true
+		roots := tlsConfig.RootCAs
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("the server did not present a certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			if fingerprint := sha256.Sum256(leaf.Raw); string(fingerprint[:]) != string(pin) {
+				return fmt.Errorf("the server's certificate has the fingerprint %s, which does not match the pinned %s",
+					CertFingerprint(leaf), FormatFingerprint(pin))
+			}
+			if roots == nil {
+				return nil
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := leaf.Verify(x509.VerifyOptions{DNSName: cs.ServerName, Roots: roots, Intermediates: intermediates})
+			return err
+		}
+	}
+	return tlsConfig, nil
+}
+
+func (o TLSOptions) addClientCert(tlsConfig *tls.Config) error {
+	if o.ClientCert == "" && o.ClientKey == "" {
+		return nil
+	}
+	if o.ClientCert == "" || o.ClientKey == "" {
+		return errors.New("a client certificate needs both a certificate file and a key file")
+	}
+	cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of a certificate, formatted like "AB:CD:...".
+func CertFingerprint(cert *x509.Certificate) string {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return FormatFingerprint(fingerprint[:])
+}
+
+// FormatFingerprint formats a fingerprint as upper-case hex bytes separated by colons, as openssl does.
+func FormatFingerprint(fingerprint []byte) string {
+	parts := make([]string, len(fingerprint))
+	for i, b := range fingerprint {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func parseFingerprint(str string) ([]byte, error) {
+	cleaned := strings.NewReplacer(":", "", " ", "").Replace(strings.TrimPrefix(strings.ToLower(str), "sha256:"))
+	pin, err := hex.DecodeString(cleaned)
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid certificate fingerprint \"%s\", expected a SHA-256 fingerprint in hex", str)
+	}
+	return pin, nil
+}
+
+// FetchServerCertificate connects to a server without verifying it, to find out which certificate it presents,
+// eg. so that the user can decide whether to pin it. It also reports whether the certificate is trusted by the system.
+// Only the client certificate in tlsOptions is used, for servers that require one.
+func FetchServerCertificate(serverURL string, tlsOptions TLSOptions) (*x509.Certificate, bool, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "wss" && u.Scheme != "https" {
+		return nil, false, fmt.Errorf("%s does not use TLS", serverURL)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, ServerName: u.Hostname()}
+	if err = tlsOptions.addClientCert(tlsConfig); err != nil {
+		return nil, false, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, false, errors.New("the server did not present a certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, verifyErr := certs[0].Verify(x509.VerifyOptions{DNSName: u.Hostname(), Intermediates: intermediates})
+	return certs[0], verifyErr == nil, nil
+}
@@ -1,7 +1,7 @@
 package truenas_api
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -146,13 +146,19 @@ func NewClient(serverURL string, verifySSL bool) (*Client, error) {
 }
 
 func NewClientWithCallback(serverURL string, verifySSL bool, jobsCallback func(int64, int64, map[string]interface{})) (*Client, error) {
+	return NewClientWithOptions(serverURL, TLSOptions{AllowInsecure: verifySSL}, jobsCallback)
+}
+
+// NewClientWithOptions creates a new WebSocket client connection, verifying the server's certificate as tlsOptions says.
+func NewClientWithOptions(serverURL string, tlsOptions TLSOptions, jobsCallback func(int64, int64, map[string]interface{})) (*Client, error) {
 	u, err := url.Parse(serverURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid URL: %w", err)
 	}
 
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: verifySSL,
+	tlsConfig, err := tlsOptions.Config()
+	if err != nil {
+		return nil, err
 	}
 
 	dialer := &websocket.Dialer{
@@ -201,8 +207,19 @@ func (c *Client) Close() error {
 
 // Call sends an RPC call to the server and waits for a response.
 func (c *Client) Call(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
-	timeout := time.Duration(timeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	res, err := c.CallCtx(ctx, method, params)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, errors.New("call timed out")
+	}
+	return res, err
+}
 
+// CallCtx sends an RPC call to the server and waits for a response until ctx is done.
+// The server carries on with the call regardless, since JSON-RPC has no way of cancelling it.
+func (c *Client) CallCtx(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
 	c.mu.Lock()
 	c.callID++ // Increment callID for each call
 	callID := c.callID
@@ -229,12 +246,12 @@ func (c *Client) Call(method string, timeoutSeconds int64, params interface{}) (
 		return nil, fmt.Errorf("failed to send call: %w", err)
 	}
 
-	// Wait for the response or timeout
+	// Wait for the response or cancellation
 	select {
 	case res := <-responseChan:
 		return res, nil
-	case <-time.After(timeout):
-		return nil, errors.New("call timed out")
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
@@ -310,8 +327,20 @@ func (c *Client) listen() {
 
 // CallWithJob sends an RPC call that returns a job ID and tracks the long-running job.
 func (c *Client) CallWithJob(method string, params interface{}, callback func(progress float64, state string, desc string)) (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	job, err := c.CallWithJobCtx(ctx, method, params, callback)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, errors.New("call timed out")
+	}
+	return job, err
+}
+
+// CallWithJobCtx is CallWithJob, but gives up waiting for the job ID once ctx is done.
+func (c *Client) CallWithJobCtx(ctx context.Context, method string, params interface{}, callback func(progress float64, state string, desc string)) (*Job, error) {
 	// Call the API method
-	res, err := c.Call(method, 60, params)
+	res, err := c.CallCtx(ctx, method, params)
 	if err != nil {
 		return nil, err
 	}
@@ -386,9 +415,8 @@ func (c *Client) Login(username, password, apiKey string) error {
 		method = "auth.login_with_api_key"
 		params = []interface{}{apiKey}
 	} else if username != "" && password != "" {
-		// Use username and password login
-		method = "auth.login"
-		params = []interface{}{username, password}
+		// Use username and password login, which fails if the user needs a one-time password
+		return c.LoginWithPassword(username, password, nil)
 	} else {
 		return errors.New("either username/password or API key must be provided")
 	}
@@ -0,0 +1,1029 @@
+package truenastest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type dataset struct {
+	name string
+	// typ is "FILESYSTEM" or "VOLUME"
+	typ string
+	// props holds the properties set locally, as they were given to pool.dataset.create or pool.dataset.update
+	props     map[string]interface{}
+	userProps map[string]string
+	createtxg int64
+	// origin is the snapshot that a clone was made from
+	origin string
+}
+
+type snapshot struct {
+	name      string
+	createtxg int64
+	userProps map[string]string
+}
+
+type propKind int
+
+const (
+	kindEnum propKind = iota
+	kindOnOff
+	kindSize
+	kindNumber
+	kindString
+)
+
+type propSpec struct {
+	kind       propKind
+	defaultVal interface{}
+	inherit    bool
+	filesystem bool
+	volume     bool
+}
+
+// datasetProps are the properties reported by pool.dataset.query, besides the computed ones like used and available.
+var datasetProps = map[string]propSpec{
+	"compression":     {kindEnum, "LZ4", true, true, true},
+	"sync":            {kindEnum, "STANDARD", true, true, true},
+	"deduplication":   {kindEnum, "OFF", true, true, true},
+	"checksum":        {kindEnum, "ON", true, true, true},
+	"readonly":        {kindOnOff, "OFF", true, true, true},
+	"copies":          {kindNumber, 1, true, true, true},
+	"reservation":     {kindSize, 0, false, true, true},
+	"refreservation":  {kindSize, 0, false, true, true},
+	"comments":        {kindString, "", false, true, true},
+	"atime":           {kindOnOff, "ON", true, true, false},
+	"exec":            {kindOnOff, "ON", true, true, false},
+	"snapdir":         {kindEnum, "HIDDEN", true, true, false},
+	"acltype":         {kindEnum, "POSIX", true, true, false},
+	"aclmode":         {kindEnum, "DISCARD", true, true, false},
+	"casesensitivity": {kindEnum, "SENSITIVE", false, true, false},
+	"recordsize":      {kindSize, 131072, true, true, false},
+	"quota":           {kindSize, 0, false, true, false},
+	"refquota":        {kindSize, 0, false, true, false},
+	"share_type":      {kindEnum, "GENERIC", false, true, false},
+	"volsize":         {kindSize, 0, false, false, true},
+	"volblocksize":    {kindSize, 16384, false, false, true},
+	"snapdev":         {kindEnum, "HIDDEN", true, false, true},
+}
+
+// createOnlyFields are the fields of pool.dataset.create and pool.dataset.update that are not properties.
+var createOnlyFields = map[string]bool{
+	"name": true, "type": true, "create_ancestors": true, "sparse": true, "force_size": true,
+	"user_properties": true, "user_properties_update": true, "inherit_encryption": true,
+	"encryption": true, "encryption_options": true,
+}
+
+const (
+	filesystemUsed = 98304
+	poolAvailable  = 1 << 40
+)
+
+// AddPool creates a pool, with its root dataset.
+func (s *Server) AddPool(name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.pools[name] = true
+	if _, exists := s.datasets[name]; !exists {
+		s.txg++
+		s.datasets[name] = &dataset{name: name, typ: "FILESYSTEM", props: make(map[string]interface{}), userProps: make(map[string]string), createtxg: s.txg}
+	}
+}
+
+// Datasets returns the names of every dataset, in order.
+func (s *Server) Datasets() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return sortedKeys(s.datasets)
+}
+
+// Snapshots returns the names of every snapshot, in order.
+func (s *Server) Snapshots() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return sortedKeys(s.snapshots)
+}
+
+func (s *Server) registerDatasetMethods() {
+	s.handlers["pool.dataset.query"] = s.queryDatasets
+	s.handlers["pool.dataset.create"] = s.createDataset
+	s.handlers["pool.dataset.update"] = s.updateDataset
+	s.handlers["pool.dataset.delete"] = s.deleteDataset
+	s.handlers["pool.dataset.promote"] = s.promoteDataset
+	s.handlers["zfs.dataset.rename"] = s.renameDatasetOrSnapshot
+	s.handlers["zfs.snapshot.query"] = s.querySnapshots
+	s.handlers["zfs.snapshot.create"] = s.createSnapshot
+	s.handlers["zfs.snapshot.delete"] = s.deleteSnapshot
+	s.handlers["zfs.snapshot.rollback"] = s.rollbackSnapshot
+	s.handlers["zfs.snapshot.clone"] = s.cloneSnapshot
+	s.handlers["zfs.snapshot.rename"] = s.renameDatasetOrSnapshot
+}
+
+// queryExtra holds the "extra" query-options of pool.dataset.query and zfs.snapshot.query.
+type queryExtra struct {
+	flat             bool
+	retrieveChildren bool
+	properties       []string
+	allProperties    bool
+	userProperties   bool
+}
+
+func getQueryExtra(options interface{}) queryExtra {
+	extra := queryExtra{flat: true, retrieveChildren: true, allProperties: true, userProperties: true}
+	opts, _ := options.(map[string]interface{})
+	extraObj, _ := opts["extra"].(map[string]interface{})
+	if value, ok := extraObj["flat"].(bool); ok {
+		extra.flat = value
+	}
+	if value, ok := extraObj["retrieve_children"].(bool); ok {
+		extra.retrieveChildren = value
+	}
+	if value, ok := extraObj["user_properties"].(bool); ok {
+		extra.userProperties = value
+	}
+	if list, ok := extraObj["properties"].([]interface{}); ok {
+		extra.allProperties = false
+		for _, p := range list {
+			if name, ok := p.(string); ok {
+				extra.properties = append(extra.properties, name)
+			}
+		}
+	}
+	return extra
+}
+
+// withoutExtra removes the "extra" options, which queryItems does not understand.
+func withoutExtra(options interface{}) interface{} {
+	opts, ok := options.(map[string]interface{})
+	if !ok {
+		return options
+	}
+	out := make(map[string]interface{}, len(opts))
+	for k, v := range opts {
+		if k != "extra" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func (s *Server) queryDatasets(call *Call) (interface{}, error) {
+	extra := getQueryExtra(call.Param(1))
+	names := sortedKeys(s.datasets)
+
+	items := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		items = append(items, s.datasetItemLocked(s.datasets[name], extra, false))
+	}
+	matched, err := queryItems(items, call.Param(0), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// results that are not flat hold their children, so any child that matched too is left out
+	matchedList := matched.([]interface{})
+	if !extra.flat && extra.retrieveChildren {
+		matchedNames := make(map[string]bool)
+		for _, item := range matchedList {
+			matchedNames[item.(map[string]interface{})["name"].(string)] = true
+		}
+		nested := make([]interface{}, 0, len(matchedList))
+		for _, item := range matchedList {
+			name := item.(map[string]interface{})["name"].(string)
+			if !hasMatchedAncestor(name, matchedNames) {
+				nested = append(nested, s.datasetItemLocked(s.datasets[name], extra, true))
+			}
+		}
+		matchedList = nested
+	}
+
+	return queryItems(matchedList, nil, withoutExtra(call.Param(1)))
+}
+
+func hasMatchedAncestor(name string, matched map[string]bool) bool {
+	for parent := parentName(name); parent != ""; parent = parentName(parent) {
+		if matched[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+func parentName(name string) string {
+	if idx := strings.LastIndex(name, "/"); idx >= 0 {
+		return name[:idx]
+	}
+	return ""
+}
+
+func poolName(name string) string {
+	return strings.SplitN(strings.SplitN(name, "@", 2)[0], "/", 2)[0]
+}
+
+func (s *Server) datasetItemLocked(ds *dataset, extra queryExtra, nestChildren bool) map[string]interface{} {
+	item := map[string]interface{}{
+		"id":              ds.name,
+		"name":            ds.name,
+		"pool":            poolName(ds.name),
+		"type":            ds.typ,
+		"mountpoint":      nil,
+		"encrypted":       false,
+		"encryption_root": nil,
+		"key_loaded":      false,
+		"locked":          false,
+		"children":        []interface{}{},
+	}
+	if ds.typ == "FILESYSTEM" {
+		item["mountpoint"] = "/mnt/" + ds.name
+	}
+
+	for _, name := range s.datasetPropNamesLocked(ds) {
+		if !extra.allProperties && !containsString(extra.properties, name) {
+			continue
+		}
+		item[name] = s.datasetPropLocked(ds, name)
+	}
+	if extra.userProperties {
+		item["user_properties"] = s.datasetUserPropsLocked(ds)
+	}
+
+	if nestChildren {
+		children := make([]interface{}, 0)
+		for _, name := range sortedKeys(s.datasets) {
+			if parentName(name) == ds.name {
+				children = append(children, s.datasetItemLocked(s.datasets[name], extra, true))
+			}
+		}
+		item["children"] = children
+	}
+	return item
+}
+
+func (s *Server) datasetPropNamesLocked(ds *dataset) []string {
+	names := []string{"used", "available", "referenced", "usedbydataset", "createtxg", "origin"}
+	for name, spec := range datasetProps {
+		if (ds.typ == "VOLUME" && spec.volume) || (ds.typ == "FILESYSTEM" && spec.filesystem) {
+			names = append(names, name)
+		}
+	}
+	for name := range ds.props {
+		if _, known := datasetProps[name]; !known {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// datasetPropLocked reports a property as {value, rawvalue, parsed, source}, following its inheritance.
+func (s *Server) datasetPropLocked(ds *dataset, name string) map[string]interface{} {
+	switch name {
+	case "used", "referenced", "usedbydataset":
+		return makeProp(kindSize, s.datasetUsedLocked(ds, name == "used"), "NONE")
+	case "available":
+		return makeProp(kindSize, poolAvailable, "NONE")
+	case "createtxg":
+		return makeProp(kindNumber, ds.createtxg, "NONE")
+	case "origin":
+		return makeProp(kindString, ds.origin, "NONE")
+	}
+
+	spec, known := datasetProps[name]
+	if !known {
+		spec = propSpec{kind: kindString, defaultVal: ""}
+		if _, isNumber := ds.props[name].(float64); isNumber {
+			spec.kind = kindNumber
+		}
+	}
+	if value, exists := ds.props[name]; exists {
+		return makeProp(spec.kind, value, "LOCAL")
+	}
+	if spec.inherit {
+		for parent := parentName(ds.name); parent != ""; parent = parentName(parent) {
+			if p, exists := s.datasets[parent]; exists {
+				if value, exists := p.props[name]; exists {
+					return makeProp(spec.kind, value, "INHERITED")
+				}
+			}
+		}
+	}
+	return makeProp(spec.kind, spec.defaultVal, "DEFAULT")
+}
+
+func (s *Server) datasetUsedLocked(ds *dataset, includeChildren bool) int64 {
+	var used int64 = filesystemUsed
+	if ds.typ == "VOLUME" {
+		used = toInt64(ds.props["volsize"])
+	}
+	if includeChildren {
+		for name, child := range s.datasets {
+			if parentName(name) == ds.name {
+				used += s.datasetUsedLocked(child, true)
+			}
+		}
+	}
+	return used
+}
+
+func (s *Server) datasetUserPropsLocked(ds *dataset) map[string]interface{} {
+	out := make(map[string]interface{})
+	for parent := parentName(ds.name); parent != ""; parent = parentName(parent) {
+		if p, exists := s.datasets[parent]; exists {
+			for key, value := range p.userProps {
+				if _, exists := out[key]; !exists {
+					out[key] = makeProp(kindString, value, "INHERITED")
+				}
+			}
+		}
+	}
+	for key, value := range ds.userProps {
+		out[key] = makeProp(kindString, value, "LOCAL")
+	}
+	return out
+}
+
+func makeProp(kind propKind, value interface{}, source string) map[string]interface{} {
+	prop := map[string]interface{}{"source": source}
+	switch kind {
+	case kindEnum, kindOnOff:
+		str := strings.ToUpper(fmt.Sprint(value))
+		prop["value"] = str
+		prop["rawvalue"] = strings.ToLower(str)
+		prop["parsed"] = strings.ToLower(str)
+		if kind == kindOnOff {
+			prop["parsed"] = str == "ON"
+		}
+	case kindSize, kindNumber:
+		n := toInt64(value)
+		prop["value"] = strconv.FormatInt(n, 10)
+		if kind == kindSize {
+			prop["value"] = humanSize(n)
+		}
+		prop["rawvalue"] = strconv.FormatInt(n, 10)
+		prop["parsed"] = n
+	default:
+		str := fmt.Sprint(value)
+		prop["value"] = str
+		prop["rawvalue"] = str
+		prop["parsed"] = str
+	}
+	return prop
+}
+
+// humanSize formats a size the way `zfs get` does, eg. 1.50K, 96K or 1G.
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < 5 {
+		value /= 1024
+		unit++
+	}
+	suffix := string("BKMGTP"[unit])
+	switch {
+	case value == float64(int64(value)):
+		return fmt.Sprintf("%d%s", int64(value), suffix)
+	case value < 10:
+		return fmt.Sprintf("%.2f%s", value, suffix)
+	case value < 100:
+		return fmt.Sprintf("%.1f%s", value, suffix)
+	}
+	return fmt.Sprintf("%.0f%s", value, suffix)
+}
+
+// toInt64 reads a number or a size string such as "16K".
+func toInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case string:
+		str := strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(v, "B"), "b"))
+		multiplier := int64(1)
+		if idx := strings.IndexAny(str, "KMGTP"); idx >= 0 {
+			multiplier = int64(1) << (10 * (strings.IndexByte("KMGTP", str[idx]) + 1))
+			str = str[:idx]
+		}
+		f, _ := strconv.ParseFloat(str, 64)
+		return int64(f * float64(multiplier))
+	}
+	return 0
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) createDataset(call *Call) (interface{}, error) {
+	params := call.ObjectParam(0)
+	name, _ := params["name"].(string)
+	if name == "" || strings.ContainsAny(name, "@ ") || strings.HasPrefix(name, "/") {
+		return nil, errInvalid("pool.dataset.create.name: Invalid dataset name %q", name)
+	}
+	if !s.pools[poolName(name)] {
+		return nil, errInvalid("pool.dataset.create.name: Pool %s does not exist", poolName(name))
+	}
+	if _, exists := s.datasets[name]; exists {
+		return nil, errExists("Path %s already exists", name)
+	}
+
+	typ := "FILESYSTEM"
+	if t, ok := params["type"].(string); ok {
+		typ = strings.ToUpper(t)
+	}
+	if typ != "FILESYSTEM" && typ != "VOLUME" {
+		return nil, errInvalid("pool.dataset.create.type: Invalid choice: %s", typ)
+	}
+	if typ == "VOLUME" {
+		if toInt64(params["volsize"]) <= 0 {
+			return nil, errInvalid("pool.dataset.create.volsize: This field is required for VOLUME")
+		}
+	} else if _, exists := params["volsize"]; exists {
+		return nil, errInvalid("pool.dataset.create.volsize: This field is not valid for FILESYSTEM")
+	}
+
+	parent := parentName(name)
+	createAncestors, _ := params["create_ancestors"].(bool)
+	missing := make([]string, 0)
+	for p := parent; p != ""; p = parentName(p) {
+		if pds, exists := s.datasets[p]; exists {
+			if pds.typ == "VOLUME" {
+				return nil, errInvalid("pool.dataset.create.name: Parent %s is a volume", p)
+			}
+			break
+		}
+		missing = append(missing, p)
+	}
+	if len(missing) > 0 && !createAncestors {
+		return nil, errInvalid("pool.dataset.create.name: Parent dataset %s does not exist", parent)
+	}
+
+	ds := &dataset{name: name, typ: typ, props: make(map[string]interface{}), userProps: make(map[string]string)}
+	if err := setDatasetProps(ds, params, "pool.dataset.create", false); err != nil {
+		return nil, err
+	}
+	if err := setUserProps(ds, params, "pool.dataset.create"); err != nil {
+		return nil, err
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		s.txg++
+		s.datasets[missing[i]] = &dataset{name: missing[i], typ: "FILESYSTEM", props: make(map[string]interface{}), userProps: make(map[string]string), createtxg: s.txg}
+		s.queueEventLocked("pool.dataset.query", "added", missing[i], nil)
+	}
+	s.txg++
+	ds.createtxg = s.txg
+	s.datasets[name] = ds
+
+	item := s.datasetItemLocked(ds, getQueryExtra(nil), false)
+	s.queueEventLocked("pool.dataset.query", "added", name, item)
+	return item, nil
+}
+
+func setDatasetProps(ds *dataset, params map[string]interface{}, method string, isUpdate bool) error {
+	for key, value := range params {
+		if createOnlyFields[key] || strings.HasPrefix(key, "quota_") || strings.HasPrefix(key, "refquota_") {
+			continue
+		}
+		spec, known := datasetProps[key]
+		if known && ((ds.typ == "VOLUME" && !spec.volume) || (ds.typ == "FILESYSTEM" && !spec.filesystem)) {
+			return errInvalid("%s.%s: This field is not valid for %s", method, key, ds.typ)
+		}
+		if key == "volsize" && isUpdate && toInt64(value) < toInt64(ds.props["volsize"]) {
+			return errInvalid("%s.volsize: Shrinking a volume is not allowed", method)
+		}
+		if known {
+			if str, ok := value.(string); ok && strings.EqualFold(str, "INHERIT") {
+				delete(ds.props, key)
+				continue
+			}
+		}
+		ds.props[key] = value
+	}
+	return nil
+}
+
+func setUserProps(ds *dataset, params map[string]interface{}, method string) error {
+	for _, field := range []string{"user_properties", "user_properties_update"} {
+		list, exists := params[field]
+		if !exists {
+			continue
+		}
+		props, ok := list.([]interface{})
+		if !ok {
+			return errInvalid("%s.%s: Not a list", method, field)
+		}
+		for _, p := range props {
+			obj, _ := p.(map[string]interface{})
+			key, _ := obj["key"].(string)
+			if !strings.Contains(key, ":") {
+				return errInvalid("%s.%s: User property %q must contain a colon", method, field, key)
+			}
+			if remove, _ := obj["remove"].(bool); remove {
+				delete(ds.userProps, key)
+				continue
+			}
+			ds.userProps[key] = fmt.Sprint(obj["value"])
+		}
+	}
+	return nil
+}
+
+func (s *Server) getDatasetLocked(id interface{}) (*dataset, error) {
+	name, _ := id.(string)
+	ds, exists := s.datasets[name]
+	if !exists {
+		return nil, errNotFound("Dataset %s does not exist", name)
+	}
+	return ds, nil
+}
+
+func (s *Server) updateDataset(call *Call) (interface{}, error) {
+	ds, err := s.getDatasetLocked(call.Param(0))
+	if err != nil {
+		return nil, err
+	}
+	params := call.ObjectParam(1)
+	for _, field := range []string{"name", "type", "create_ancestors", "sparse"} {
+		if _, exists := params[field]; exists {
+			return nil, errInvalid("pool.dataset.update.%s: Field was not expected", field)
+		}
+	}
+
+	updated := &dataset{name: ds.name, typ: ds.typ, props: copyMap(ds.props), userProps: copyMap(ds.userProps), createtxg: ds.createtxg, origin: ds.origin}
+	if err = setDatasetProps(updated, params, "pool.dataset.update", true); err != nil {
+		return nil, err
+	}
+	if err = setUserProps(updated, params, "pool.dataset.update"); err != nil {
+		return nil, err
+	}
+	*ds = *updated
+
+	item := s.datasetItemLocked(ds, getQueryExtra(nil), false)
+	s.queueEventLocked("pool.dataset.query", "changed", ds.name, item)
+	return item, nil
+}
+
+func copyMap[T any](m map[string]T) map[string]T {
+	out := make(map[string]T, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func isWithin(name, parent string) bool {
+	return name == parent || strings.HasPrefix(name, parent+"/") || strings.HasPrefix(name, parent+"@")
+}
+
+func (s *Server) deleteDataset(call *Call) (interface{}, error) {
+	ds, err := s.getDatasetLocked(call.Param(0))
+	if err != nil {
+		return nil, err
+	}
+	opts := call.ObjectParam(1)
+	recursive, _ := opts["recursive"].(bool)
+	isRoot := parentName(ds.name) == ""
+	if isRoot && !recursive {
+		return nil, errInvalid("pool.dataset.delete: The root dataset of pool %s cannot be deleted", ds.name)
+	}
+
+	doomed := make([]string, 0)
+	for _, name := range sortedKeys(s.datasets) {
+		if isWithin(name, ds.name) && (!isRoot || name != ds.name) {
+			doomed = append(doomed, name)
+		}
+	}
+	if !recursive && len(doomed) > 1 {
+		return nil, errBusy("Failed to delete dataset: cannot destroy '%s': filesystem has children", ds.name)
+	}
+	doomedSnaps := make([]string, 0)
+	for _, snapName := range sortedKeys(s.snapshots) {
+		for _, name := range doomed {
+			if strings.HasPrefix(snapName, name+"@") {
+				doomedSnaps = append(doomedSnaps, snapName)
+			}
+		}
+	}
+	if !recursive && len(doomedSnaps) > 0 {
+		return nil, errBusy("Failed to delete dataset: cannot destroy '%s': filesystem has snapshots", ds.name)
+	}
+	for _, other := range s.datasets {
+		if other.origin != "" && containsString(doomedSnaps, other.origin) && !containsString(doomed, other.name) {
+			return nil, errBusy("Failed to delete dataset: cannot destroy '%s': snapshot %s has dependent clones", ds.name, other.origin)
+		}
+	}
+
+	for _, name := range doomedSnaps {
+		delete(s.snapshots, name)
+		s.queueEventLocked("zfs.snapshot.query", "removed", name, nil)
+	}
+	for i := len(doomed) - 1; i >= 0; i-- {
+		s.removeAttachmentsLocked(s.datasets[doomed[i]])
+		delete(s.datasets, doomed[i])
+		s.queueEventLocked("pool.dataset.query", "removed", doomed[i], nil)
+	}
+	return true, nil
+}
+
+// removeAttachmentsLocked deletes the NFS shares and iSCSI extents of a dataset that is being deleted, as the middleware does.
+func (s *Server) removeAttachmentsLocked(ds *dataset) {
+	if ds.typ == "FILESYSTEM" {
+		mountpoint := "/mnt/" + ds.name
+		nfs := s.crud["sharing.nfs"]
+		for _, id := range nfs.ids() {
+			path, _ := nfs.items[id]["path"].(string)
+			if path == mountpoint || strings.HasPrefix(path, mountpoint+"/") {
+				nfs.removeLocked(s, id)
+			}
+		}
+	} else {
+		extents := s.crud["iscsi.extent"]
+		for _, id := range extents.ids() {
+			if extents.items[id]["disk"] == "zvol/"+ds.name {
+				s.removeExtentLocked(id)
+			}
+		}
+	}
+}
+
+func (s *Server) promoteDataset(call *Call) (interface{}, error) {
+	ds, err := s.getDatasetLocked(call.Param(0))
+	if err != nil {
+		return nil, err
+	}
+	if ds.origin == "" {
+		return nil, errInvalid("pool.dataset.promote: %s is not a clone", ds.name)
+	}
+
+	originSnap := s.snapshots[ds.origin]
+	originDsName := strings.SplitN(ds.origin, "@", 2)[0]
+	originDs := s.datasets[originDsName]
+
+	// the origin's snapshots up to the one that was cloned move over to the clone
+	renames := make(map[string]string)
+	for _, name := range sortedKeys(s.snapshots) {
+		snap := s.snapshots[name]
+		if strings.HasPrefix(name, originDsName+"@") && originSnap != nil && snap.createtxg <= originSnap.createtxg {
+			newName := ds.name + name[len(originDsName):]
+			if _, exists := s.snapshots[newName]; exists {
+				return nil, errExists("Snapshot %s already exists", newName)
+			}
+			renames[name] = newName
+		}
+	}
+	for oldName, newName := range renames {
+		snap := s.snapshots[oldName]
+		delete(s.snapshots, oldName)
+		snap.name = newName
+		s.snapshots[newName] = snap
+		s.queueEventLocked("zfs.snapshot.query", "removed", oldName, nil)
+		s.queueEventLocked("zfs.snapshot.query", "added", newName, nil)
+	}
+	for _, other := range s.datasets {
+		if newName, moved := renames[other.origin]; moved && other != ds {
+			other.origin = newName
+		}
+	}
+
+	newOrigin := renames[ds.origin]
+	ds.origin = ""
+	if originDs != nil {
+		originDs.origin = newOrigin
+		s.queueEventLocked("pool.dataset.query", "changed", originDs.name, nil)
+	}
+	s.queueEventLocked("pool.dataset.query", "changed", ds.name, nil)
+	return nil, nil
+}
+
+func (s *Server) renameDatasetOrSnapshot(call *Call) (interface{}, error) {
+	name, _ := call.Param(0).(string)
+	newName, _ := call.ObjectParam(1)["new_name"].(string)
+	if newName == "" {
+		return nil, errInvalid("%s.new_name: This field is required", call.Method)
+	}
+
+	if strings.Contains(name, "@") {
+		snap, exists := s.snapshots[name]
+		if !exists {
+			return nil, errNotFound("Snapshot %s does not exist", name)
+		}
+		if strings.SplitN(newName, "@", 2)[0] != strings.SplitN(name, "@", 2)[0] {
+			return nil, errInvalid("%s.new_name: Snapshots can only be renamed within the same dataset", call.Method)
+		}
+		if _, exists = s.snapshots[newName]; exists {
+			return nil, errExists("Snapshot %s already exists", newName)
+		}
+		delete(s.snapshots, name)
+		snap.name = newName
+		s.snapshots[newName] = snap
+		for _, ds := range s.datasets {
+			if ds.origin == name {
+				ds.origin = newName
+			}
+		}
+		s.queueEventLocked("zfs.snapshot.query", "removed", name, nil)
+		s.queueEventLocked("zfs.snapshot.query", "added", newName, nil)
+		return nil, nil
+	}
+
+	ds, err := s.getDatasetLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	if parentName(ds.name) == "" {
+		return nil, errInvalid("%s: The root dataset of a pool cannot be renamed", call.Method)
+	}
+	if poolName(newName) != poolName(name) || strings.Contains(newName, "@") {
+		return nil, errInvalid("%s.new_name: Datasets can only be renamed within the same pool", call.Method)
+	}
+	if _, exists := s.datasets[newName]; exists {
+		return nil, errExists("Path %s already exists", newName)
+	}
+	if isWithin(newName, name) {
+		return nil, errInvalid("%s.new_name: A dataset cannot be moved into itself", call.Method)
+	}
+	if _, exists := s.datasets[parentName(newName)]; !exists {
+		return nil, errInvalid("%s.new_name: Parent dataset %s does not exist", call.Method, parentName(newName))
+	}
+
+	rename := func(old string) string {
+		if isWithin(old, name) {
+			return newName + old[len(name):]
+		}
+		return old
+	}
+	for _, oldName := range sortedKeys(s.datasets) {
+		if isWithin(oldName, name) {
+			child := s.datasets[oldName]
+			delete(s.datasets, oldName)
+			child.name = rename(oldName)
+			s.datasets[child.name] = child
+			s.queueEventLocked("pool.dataset.query", "removed", oldName, nil)
+			s.queueEventLocked("pool.dataset.query", "added", child.name, nil)
+		}
+	}
+	for _, oldName := range sortedKeys(s.snapshots) {
+		if isWithin(oldName, name) {
+			snap := s.snapshots[oldName]
+			delete(s.snapshots, oldName)
+			snap.name = rename(oldName)
+			s.snapshots[snap.name] = snap
+		}
+	}
+	for _, other := range s.datasets {
+		other.origin = rename(other.origin)
+	}
+	return nil, nil
+}
+
+func (s *Server) snapshotItemLocked(snap *snapshot, extra queryExtra) map[string]interface{} {
+	parts := strings.SplitN(snap.name, "@", 2)
+	properties := map[string]interface{}{
+		"createtxg":  makeProp(kindNumber, snap.createtxg, "NONE"),
+		"used":       makeProp(kindSize, 0, "NONE"),
+		"referenced": makeProp(kindSize, filesystemUsed, "NONE"),
+	}
+	if !extra.allProperties {
+		for name := range properties {
+			if !containsString(extra.properties, name) {
+				delete(properties, name)
+			}
+		}
+	}
+	item := map[string]interface{}{
+		"id":            snap.name,
+		"name":          snap.name,
+		"dataset":       parts[0],
+		"snapshot_name": parts[1],
+		"pool":          poolName(snap.name),
+		"type":          "SNAPSHOT",
+		"createtxg":     strconv.FormatInt(snap.createtxg, 10),
+		"properties":    properties,
+	}
+	if extra.userProperties {
+		userProps := make(map[string]interface{})
+		for key, value := range snap.userProps {
+			userProps[key] = makeProp(kindString, value, "LOCAL")
+		}
+		item["user_properties"] = userProps
+	}
+	return item
+}
+
+func (s *Server) querySnapshots(call *Call) (interface{}, error) {
+	extra := getQueryExtra(call.Param(1))
+	names := sortedKeys(s.snapshots)
+	items := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		items = append(items, s.snapshotItemLocked(s.snapshots[name], extra))
+	}
+	return queryItems(items, call.Param(0), withoutExtra(call.Param(1)))
+}
+
+func (s *Server) createSnapshot(call *Call) (interface{}, error) {
+	params := call.ObjectParam(0)
+	dsName, _ := params["dataset"].(string)
+	snapName, _ := params["name"].(string)
+	if snapName == "" || strings.ContainsAny(snapName, "@/ ") {
+		return nil, errInvalid("zfs.snapshot.create.name: Invalid snapshot name %q", snapName)
+	}
+	if _, err := s.getDatasetLocked(dsName); err != nil {
+		return nil, err
+	}
+
+	targets := []string{dsName}
+	if recursive, _ := params["recursive"].(bool); recursive {
+		excluded := make([]string, 0)
+		if list, ok := params["exclude"].([]interface{}); ok {
+			for _, e := range list {
+				excluded = append(excluded, fmt.Sprint(e))
+			}
+		}
+		for _, name := range sortedKeys(s.datasets) {
+			if name != dsName && isWithin(name, dsName) && !containsString(excluded, name) {
+				targets = append(targets, name)
+			}
+		}
+	}
+	for _, target := range targets {
+		if _, exists := s.snapshots[target+"@"+snapName]; exists {
+			return nil, errExists("Snapshot %s@%s already exists", target, snapName)
+		}
+	}
+
+	userProps := make(map[string]string)
+	if props, ok := params["properties"].(map[string]interface{}); ok {
+		for key, value := range props {
+			userProps[key] = fmt.Sprint(value)
+		}
+	}
+
+	s.txg++
+	for _, target := range targets {
+		snap := &snapshot{name: target + "@" + snapName, createtxg: s.txg, userProps: copyMap(userProps)}
+		s.snapshots[snap.name] = snap
+		s.queueEventLocked("zfs.snapshot.query", "added", snap.name, nil)
+	}
+	return s.snapshotItemLocked(s.snapshots[dsName+"@"+snapName], getQueryExtra(nil)), nil
+}
+
+func (s *Server) getSnapshotLocked(id interface{}) (*snapshot, error) {
+	name, _ := id.(string)
+	snap, exists := s.snapshots[name]
+	if !exists {
+		return nil, errNotFound("Snapshot %s does not exist", name)
+	}
+	return snap, nil
+}
+
+func (s *Server) snapshotClonesLocked(snapName string) []string {
+	clones := make([]string, 0)
+	for _, name := range sortedKeys(s.datasets) {
+		if s.datasets[name].origin == snapName {
+			clones = append(clones, name)
+		}
+	}
+	return clones
+}
+
+func (s *Server) deleteSnapshot(call *Call) (interface{}, error) {
+	snap, err := s.getSnapshotLocked(call.Param(0))
+	if err != nil {
+		return nil, err
+	}
+	opts := call.ObjectParam(1)
+	parts := strings.SplitN(snap.name, "@", 2)
+
+	doomed := []string{snap.name}
+	if recursive, _ := opts["recursive"].(bool); recursive {
+		for _, name := range sortedKeys(s.snapshots) {
+			if name != snap.name && strings.HasPrefix(name, parts[0]+"/") && strings.HasSuffix(name, "@"+parts[1]) {
+				doomed = append(doomed, name)
+			}
+		}
+	}
+	for _, name := range doomed {
+		if len(s.snapshotClonesLocked(name)) > 0 {
+			if deferDelete, _ := opts["defer"].(bool); deferDelete {
+				// the snapshot is destroyed once its last clone is, which the fake does not track
+				return true, nil
+			}
+			return nil, errBusy("Failed to delete snapshot: cannot destroy '%s': snapshot has dependent clones", name)
+		}
+	}
+	for _, name := range doomed {
+		delete(s.snapshots, name)
+		s.queueEventLocked("zfs.snapshot.query", "removed", name, nil)
+	}
+	return true, nil
+}
+
+func (s *Server) rollbackSnapshot(call *Call) (interface{}, error) {
+	snap, err := s.getSnapshotLocked(call.Param(0))
+	if err != nil {
+		return nil, err
+	}
+	opts := call.ObjectParam(1)
+	recursive, _ := opts["recursive"].(bool)
+	recursiveClones, _ := opts["recursive_clones"].(bool)
+	recursiveRollback, _ := opts["recursive_rollback"].(bool)
+
+	parts := strings.SplitN(snap.name, "@", 2)
+	targets := []*snapshot{snap}
+	if recursiveRollback {
+		for _, name := range sortedKeys(s.datasets) {
+			if strings.HasPrefix(name, parts[0]+"/") {
+				child, exists := s.snapshots[name+"@"+parts[1]]
+				if !exists {
+					return nil, errNotFound("Snapshot %s@%s does not exist", name, parts[1])
+				}
+				targets = append(targets, child)
+			}
+		}
+	}
+
+	doomedSnaps := make([]string, 0)
+	doomedClones := make([]string, 0)
+	for _, target := range targets {
+		dsName := strings.SplitN(target.name, "@", 2)[0]
+		for _, name := range sortedKeys(s.snapshots) {
+			if strings.HasPrefix(name, dsName+"@") && s.snapshots[name].createtxg > target.createtxg {
+				if !recursive && !recursiveClones {
+					return nil, newCallError(14, "EFAULT", "Failed to rollback snapshot: cannot rollback to '%s': more recent snapshots or bookmarks exist", target.name)
+				}
+				clones := s.snapshotClonesLocked(name)
+				if len(clones) > 0 && !recursiveClones {
+					return nil, errBusy("Failed to rollback snapshot: cannot rollback to '%s': clones of previous snapshots exist", target.name)
+				}
+				doomedSnaps = append(doomedSnaps, name)
+				doomedClones = append(doomedClones, clones...)
+			}
+		}
+	}
+
+	for _, name := range doomedClones {
+		s.removeAttachmentsLocked(s.datasets[name])
+		delete(s.datasets, name)
+		s.queueEventLocked("pool.dataset.query", "removed", name, nil)
+	}
+	for _, name := range doomedSnaps {
+		delete(s.snapshots, name)
+		s.queueEventLocked("zfs.snapshot.query", "removed", name, nil)
+	}
+	for _, target := range targets {
+		s.queueEventLocked("pool.dataset.query", "changed", strings.SplitN(target.name, "@", 2)[0], nil)
+	}
+	return nil, nil
+}
+
+func (s *Server) cloneSnapshot(call *Call) (interface{}, error) {
+	params := call.ObjectParam(0)
+	snap, err := s.getSnapshotLocked(params["snapshot"])
+	if err != nil {
+		return nil, err
+	}
+	dest, _ := params["dataset_dst"].(string)
+	if dest == "" || strings.Contains(dest, "@") {
+		return nil, errInvalid("zfs.snapshot.clone.dataset_dst: Invalid dataset name %q", dest)
+	}
+	if poolName(dest) != poolName(snap.name) {
+		return nil, errInvalid("zfs.snapshot.clone.dataset_dst: Clones must be in the same pool as their snapshot")
+	}
+	if _, exists := s.datasets[dest]; exists {
+		return nil, errExists("Path %s already exists", dest)
+	}
+	if _, exists := s.datasets[parentName(dest)]; !exists {
+		return nil, errInvalid("zfs.snapshot.clone.dataset_dst: Parent dataset %s does not exist", parentName(dest))
+	}
+
+	source := s.datasets[strings.SplitN(snap.name, "@", 2)[0]]
+	clone := &dataset{name: dest, typ: source.typ, props: make(map[string]interface{}), userProps: make(map[string]string), origin: snap.name}
+	for _, key := range []string{"volsize", "volblocksize"} {
+		if value, exists := source.props[key]; exists {
+			clone.props[key] = value
+		}
+	}
+	if props, ok := params["dataset_properties"].(map[string]interface{}); ok {
+		if err = setDatasetProps(clone, props, "zfs.snapshot.clone", false); err != nil {
+			return nil, err
+		}
+	}
+	s.txg++
+	clone.createtxg = s.txg
+	s.datasets[dest] = clone
+	s.queueEventLocked("pool.dataset.query", "added", dest, nil)
+	return true, nil
+}
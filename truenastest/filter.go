@@ -0,0 +1,254 @@
+package truenastest
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// queryItems applies query-filters and query-options to normalized items, the way the middleware's query methods do.
+// Supported options are get, count, limit, offset, order_by and select.
+func queryItems(items []interface{}, filters interface{}, options interface{}) (interface{}, error) {
+	filterList, _ := filters.([]interface{})
+	opts, _ := options.(map[string]interface{})
+	if opts == nil {
+		opts = make(map[string]interface{})
+	}
+
+	matched := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		obj, _ := normalize(item).(map[string]interface{})
+		ok, err := matchesAll(obj, filterList)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, obj)
+		}
+	}
+
+	if orderBy, ok := opts["order_by"].([]interface{}); ok {
+		sortItems(matched, orderBy)
+	}
+	if offset, ok := opts["offset"].(float64); ok && offset > 0 {
+		if int(offset) >= len(matched) {
+			matched = matched[:0]
+		} else {
+			matched = matched[int(offset):]
+		}
+	}
+	if limit, ok := opts["limit"].(float64); ok && limit > 0 && int(limit) < len(matched) {
+		matched = matched[:int(limit)]
+	}
+	if selected, ok := opts["select"].([]interface{}); ok && len(selected) != 0 {
+		for i, item := range matched {
+			obj := item.(map[string]interface{})
+			out := make(map[string]interface{})
+			for _, field := range selected {
+				if name, ok := field.(string); ok {
+					if value, exists := lookupField(obj, name); exists {
+						out[name] = value
+					}
+				}
+			}
+			matched[i] = out
+		}
+	}
+
+	if count, _ := opts["count"].(bool); count {
+		return len(matched), nil
+	}
+	if get, _ := opts["get"].(bool); get {
+		if len(matched) == 0 {
+			return nil, errNotFound("Object not found")
+		}
+		return matched[0], nil
+	}
+	return matched, nil
+}
+
+func matchesAll(obj map[string]interface{}, filters []interface{}) (bool, error) {
+	for _, f := range filters {
+		ok, err := matchesFilter(obj, f)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchesFilter(obj map[string]interface{}, filter interface{}) (bool, error) {
+	parts, ok := filter.([]interface{})
+	if !ok {
+		return false, errInvalid("Invalid filter %v", filter)
+	}
+
+	if len(parts) == 2 && parts[0] == "OR" {
+		branches, ok := parts[1].([]interface{})
+		if !ok {
+			return false, errInvalid("Invalid OR filter %v", filter)
+		}
+		for _, branch := range branches {
+			// a branch is either a single filter or a list of filters that must all match
+			var ok bool
+			var err error
+			if inner, isList := branch.([]interface{}); isList && len(inner) != 0 {
+				if _, isNested := inner[0].([]interface{}); isNested {
+					ok, err = matchesAll(obj, inner)
+				} else {
+					ok, err = matchesFilter(obj, branch)
+				}
+			}
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if len(parts) != 3 {
+		return false, errInvalid("Invalid filter %v", filter)
+	}
+	field, ok := parts[0].(string)
+	if !ok {
+		return false, errInvalid("Invalid filter %v", filter)
+	}
+	op, ok := parts[1].(string)
+	if !ok {
+		return false, errInvalid("Invalid filter %v", filter)
+	}
+
+	value, _ := lookupField(obj, field)
+	return compareFilter(value, op, parts[2])
+}
+
+// lookupField resolves a dotted path such as "properties.volsize.parsed".
+func lookupField(obj map[string]interface{}, field string) (interface{}, bool) {
+	if value, exists := obj[field]; exists {
+		return value, true
+	}
+	var current interface{} = obj
+	for _, key := range strings.Split(field, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func compareFilter(value interface{}, op string, operand interface{}) (bool, error) {
+	switch op {
+	case "=":
+		return reflect.DeepEqual(value, operand), nil
+	case "!=":
+		return !reflect.DeepEqual(value, operand), nil
+	case ">", ">=", "<", "<=":
+		cmp, ok := compareOrdered(value, operand)
+		if !ok {
+			return false, nil
+		}
+		switch op {
+		case ">":
+			return cmp > 0, nil
+		case ">=":
+			return cmp >= 0, nil
+		case "<":
+			return cmp < 0, nil
+		}
+		return cmp <= 0, nil
+	case "in", "nin":
+		list, ok := operand.([]interface{})
+		if !ok {
+			return false, errInvalid("The operand of %s must be a list", op)
+		}
+		return containsValue(list, value) == (op == "in"), nil
+	case "rin", "rnin":
+		list, _ := value.([]interface{})
+		return containsValue(list, operand) == (op == "rin"), nil
+	case "^", "!^", "$", "!$":
+		str, ok1 := value.(string)
+		affix, ok2 := operand.(string)
+		if !ok1 || !ok2 {
+			return op[0] == '!', nil
+		}
+		var matched bool
+		if strings.HasSuffix(op, "^") {
+			matched = strings.HasPrefix(str, affix)
+		} else {
+			matched = strings.HasSuffix(str, affix)
+		}
+		return matched != (op[0] == '!'), nil
+	case "~":
+		str, _ := value.(string)
+		pattern, _ := operand.(string)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, errInvalid("Invalid regular expression %q", pattern)
+		}
+		return re.MatchString(str), nil
+	}
+	return false, errInvalid("Invalid operation %q", op)
+}
+
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareOrdered(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if x < y {
+			return -1, true
+		} else if x > y {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
+
+func sortItems(items []interface{}, orderBy []interface{}) {
+	sort.SliceStable(items, func(i, j int) bool {
+		a := items[i].(map[string]interface{})
+		b := items[j].(map[string]interface{})
+		for _, o := range orderBy {
+			field, _ := o.(string)
+			descending := strings.HasPrefix(field, "-")
+			field = strings.TrimPrefix(field, "-")
+			va, _ := lookupField(a, field)
+			vb, _ := lookupField(b, field)
+			cmp, ok := compareOrdered(va, vb)
+			if !ok {
+				cmp = strings.Compare(fmt.Sprint(va), fmt.Sprint(vb))
+			}
+			if cmp != 0 {
+				return (cmp < 0) != descending
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,331 @@
+package truenastest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// JobFunc does the work of a job, reporting its progress with Job.Step.
+// Its result, or its error, becomes the result of the job.
+type JobFunc func(job *Job) (interface{}, error)
+
+// Job is a job run by the server, eg. core.bulk or core.job_wait.
+type Job struct {
+	id        int64
+	method    string
+	arguments []interface{}
+	server    *Server
+	fn        JobFunc
+
+	// guarded by the server's mtx
+	state        string
+	percent      float64
+	description  string
+	result       interface{}
+	errStr       string
+	timeStarted  time.Time
+	timeFinished time.Time
+	aborted      bool
+
+	abortCh chan struct{}
+	done    chan struct{}
+}
+
+var errJobAborted = errors.New("Job aborted")
+
+// StartJob creates a job for the call, which is started once the call has been answered.
+// A handler returns the job's ID as its result, the way the middleware's job methods do.
+func (c *Call) StartJob(fn JobFunc) int64 {
+	s := c.server
+	job := &Job{
+		id:          s.nextJobId,
+		method:      c.Method,
+		arguments:   c.Params,
+		server:      s,
+		fn:          fn,
+		state:       "WAITING",
+		timeStarted: time.Now(),
+		abortCh:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	s.nextJobId++
+	s.jobs[job.id] = job
+	c.jobs = append(c.jobs, job)
+	return job.id
+}
+
+// ID returns the job's ID.
+func (j *Job) ID() int64 {
+	return j.id
+}
+
+// Step reports the job's progress, then waits for the server's job step delay.
+// It returns an error once the job has been aborted, which the job should return.
+func (j *Job) Step(percent float64, description string) error {
+	s := j.server
+	s.mtx.Lock()
+	if j.aborted {
+		s.mtx.Unlock()
+		return errJobAborted
+	}
+	j.percent = percent
+	j.description = description
+	s.queueJobEventLocked(j)
+	delay := s.jobStepDelay
+	s.mtx.Unlock()
+	s.flushEvents()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-j.abortCh:
+			return errJobAborted
+		}
+	}
+	return nil
+}
+
+func (j *Job) run() {
+	s := j.server
+	s.mtx.Lock()
+	j.state = "RUNNING"
+	s.queueJobEventLocked(j)
+	s.mtx.Unlock()
+	s.flushEvents()
+
+	result, err := j.fn(j)
+
+	s.mtx.Lock()
+	j.timeFinished = time.Now()
+	if j.aborted || errors.Is(err, errJobAborted) {
+		j.state = "ABORTED"
+		j.errStr = errJobAborted.Error()
+	} else if err != nil {
+		j.state = "FAILED"
+		j.errStr = err.Error()
+	} else {
+		j.state = "SUCCESS"
+		j.percent = 100
+		j.result = normalize(result)
+	}
+	s.queueJobEventLocked(j)
+	s.mtx.Unlock()
+	s.flushEvents()
+
+	close(j.done)
+}
+
+func (j *Job) isFinishedLocked() bool {
+	return j.state == "SUCCESS" || j.state == "FAILED" || j.state == "ABORTED"
+}
+
+// fieldsLocked returns the job as core.get_jobs reports it.
+func (j *Job) fieldsLocked() map[string]interface{} {
+	fields := map[string]interface{}{
+		"id":          j.id,
+		"method":      j.method,
+		"arguments":   j.arguments,
+		"transient":   false,
+		"description": nil,
+		"abortable":   true,
+		"logs_path":   nil,
+		"progress": map[string]interface{}{
+			"percent":     j.percent,
+			"description": j.description,
+			"extra":       nil,
+		},
+		"result":        j.result,
+		"error":         nil,
+		"exception":     nil,
+		"exc_info":      nil,
+		"state":         j.state,
+		"time_started":  map[string]interface{}{"$date": j.timeStarted.UnixMilli()},
+		"time_finished": nil,
+	}
+	if j.errStr != "" {
+		fields["error"] = j.errStr
+		fields["exception"] = "Traceback (most recent call last):\n" + j.errStr
+	}
+	if !j.timeFinished.IsZero() {
+		fields["time_finished"] = map[string]interface{}{"$date": j.timeFinished.UnixMilli()}
+	}
+	return fields
+}
+
+// Job returns a job as core.get_jobs would, and whether it exists.
+func (s *Server) Job(id int64) (map[string]interface{}, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	job, exists := s.jobs[id]
+	if !exists {
+		return nil, false
+	}
+	return normalize(job.fieldsLocked()).(map[string]interface{}), true
+}
+
+// WaitForJob blocks until a job has finished, and returns false if it does not exist or did not finish in time.
+func (s *Server) WaitForJob(id int64, timeout time.Duration) bool {
+	s.mtx.Lock()
+	job, exists := s.jobs[id]
+	s.mtx.Unlock()
+	if !exists {
+		return false
+	}
+	select {
+	case <-job.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (s *Server) queueJobEventLocked(j *Job) {
+	s.queueEventLocked("core.get_jobs", "changed", j.id, j.fieldsLocked())
+}
+
+// callFromJob makes a call on behalf of a job, eg. one of the calls of core.bulk.
+// If the call starts a job of its own, that job is waited for and its ID returned.
+func (s *Server) callFromJob(method string, params []interface{}) (interface{}, int64, error) {
+	result, call, err := s.dispatch(method, params)
+	s.flushEvents()
+	if err != nil || call == nil || len(call.jobs) == 0 {
+		return result, -1, err
+	}
+
+	subJob := call.jobs[0]
+	call.startJobs()
+	<-subJob.done
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if subJob.errStr != "" {
+		return nil, subJob.id, errors.New(subJob.errStr)
+	}
+	return subJob.result, subJob.id, nil
+}
+
+func (s *Server) registerCoreMethods() {
+	s.handlers["core.get_jobs"] = func(call *Call) (interface{}, error) {
+		ids := make([]int64, 0, len(s.jobs))
+		for id := range s.jobs {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+
+		items := make([]interface{}, 0, len(ids))
+		for _, id := range ids {
+			items = append(items, s.jobs[id].fieldsLocked())
+		}
+		return queryItems(items, call.Param(0), call.Param(1))
+	}
+
+	s.handlers["core.job_wait"] = func(call *Call) (interface{}, error) {
+		target, err := s.getJobParamLocked(call)
+		if err != nil {
+			return nil, err
+		}
+		return call.StartJob(func(job *Job) (interface{}, error) {
+			<-target.done
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			if target.errStr != "" {
+				return nil, errors.New(target.errStr)
+			}
+			return target.result, nil
+		}), nil
+	}
+
+	s.handlers["core.job_abort"] = func(call *Call) (interface{}, error) {
+		target, err := s.getJobParamLocked(call)
+		if err != nil {
+			return nil, err
+		}
+		if !target.isFinishedLocked() && !target.aborted {
+			target.aborted = true
+			close(target.abortCh)
+		}
+		return nil, nil
+	}
+
+	s.handlers["core.bulk"] = func(call *Call) (interface{}, error) {
+		method, ok := call.Param(0).(string)
+		if !ok || method == "" {
+			return nil, errInvalid("core.bulk.method: A method name is required")
+		}
+		paramsList, ok := call.Param(1).([]interface{})
+		if !ok {
+			return nil, errInvalid("core.bulk.params: A list of parameters is required")
+		}
+		if _, exists := s.handlers[method]; !exists {
+			return nil, errInvalid("core.bulk.method: Method %s not found", method)
+		}
+
+		return call.StartJob(func(job *Job) (interface{}, error) {
+			n := len(paramsList)
+			statuses := make([]interface{}, 0, n)
+			for i, p := range paramsList {
+				if err := job.Step(float64(i)*100/float64(n), fmt.Sprintf("%d/%d: %s", i+1, n, method)); err != nil {
+					return nil, err
+				}
+				params, _ := p.([]interface{})
+				if params == nil {
+					params = []interface{}{}
+				}
+				result, subJobId, err := s.callFromJob(method, params)
+				status := map[string]interface{}{"job_id": nil, "result": result, "error": nil}
+				if subJobId >= 0 {
+					status["job_id"] = subJobId
+				}
+				if err != nil {
+					status["error"] = err.Error()
+				}
+				statuses = append(statuses, status)
+			}
+			return statuses, nil
+		}), nil
+	}
+}
+
+func (s *Server) getJobParamLocked(call *Call) (*Job, error) {
+	idFloat, ok := call.Param(0).(float64)
+	if !ok {
+		return nil, errInvalid("%s: A job ID is required", call.Method)
+	}
+	job, exists := s.jobs[int64(idFloat)]
+	if !exists {
+		return nil, errNotFound("Job %d does not exist", int64(idFloat))
+	}
+	return job, nil
+}
+
+type pendingEvent struct {
+	collection string
+	msg        string
+	id         interface{}
+	fields     map[string]interface{}
+}
+
+func (s *Server) queueEventLocked(collection, msg string, id interface{}, fields map[string]interface{}) {
+	var normalized map[string]interface{}
+	if fields != nil {
+		normalized, _ = normalize(fields).(map[string]interface{})
+	}
+	s.pendingEvents = append(s.pendingEvents, pendingEvent{collection, msg, id, normalized})
+}
+
+// flushEvents sends the queued events in order. It must be called without the state locked.
+func (s *Server) flushEvents() {
+	s.emitMtx.Lock()
+	defer s.emitMtx.Unlock()
+
+	s.mtx.Lock()
+	events := s.pendingEvents
+	s.pendingEvents = nil
+	s.mtx.Unlock()
+
+	for _, e := range events {
+		s.Emit(e.collection, e.msg, e.id, e.fields)
+	}
+}
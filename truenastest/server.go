@@ -0,0 +1,486 @@
+// Package truenastest runs an in-process fake of the TrueNAS middleware's websocket JSON-RPC API for tests,
+// in the spirit of net/http/httptest.
+//
+// The fake keeps its pools, datasets, snapshots, NFS shares, iSCSI objects, services and jobs in memory,
+// validates calls the way the middleware does, and sends collection_update events for jobs and changed objects
+// to the connections that subscribed to them. RealSession, the connection daemon and the truenas_api client
+// can all be pointed at it:
+//
+//	server := truenastest.NewServer()
+//	defer server.Close()
+//	server.AddPool("dozer")
+//	api := &core.RealSession{HostName: server.HostName(), ApiKey: truenastest.ApiKey, AllowInsecure: true}
+package truenastest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ApiKey is accepted by auth.login_with_api_key on every new server.
+const ApiKey = "1-truenastest"
+
+// Username and Password are accepted by auth.login and auth.login_ex on every new server.
+const (
+	Username = "truenas_admin"
+	Password = "truenastest"
+)
+
+// HandlerFunc answers a call with its result, or with an error that is sent back as a JSON-RPC error.
+// Handlers are called with the server's state locked, so they must not block.
+type HandlerFunc func(call *Call) (interface{}, error)
+
+// Call is a method call being answered by the server.
+type Call struct {
+	Method string
+	Params []interface{}
+	server *Server
+	// jobs are started once the call has been answered, so that the caller sees the job ID before any of its events
+	jobs []*Job
+}
+
+// Server is a fake TrueNAS host. Its methods are safe to call from multiple goroutines.
+type Server struct {
+	httpServer *httptest.Server
+	upgrader   websocket.Upgrader
+
+	// mtx guards everything below, including the state of the fake pools
+	mtx          sync.Mutex
+	apiKeys      map[string]bool
+	nextApiKeyId int
+	otp          string
+	handlers     map[string]HandlerFunc
+	callCounts   map[string]int
+	jobStepDelay time.Duration
+	nextJobId    int64
+	jobs         map[int64]*Job
+	txg          int64
+	pools        map[string]bool
+	datasets     map[string]*dataset
+	snapshots    map[string]*snapshot
+	crud         map[string]*crudCollection
+	services     []map[string]interface{}
+	// pendingEvents are sent by flushEvents once the state is unlocked
+	pendingEvents []pendingEvent
+
+	// emitMtx keeps events in the order they were queued
+	emitMtx   sync.Mutex
+	connsMtx  sync.Mutex
+	conns     map[*conn]bool
+	nextSubId int
+}
+
+type conn struct {
+	ws            *websocket.Conn
+	writeMtx      sync.Mutex
+	authenticated bool
+	// awaitingOtp is set while a password login waits for auth.login_ex_continue
+	awaitingOtp bool
+	// subscriptions maps subscription IDs to the collection they are for
+	subscriptions map[string]string
+}
+
+// NewServer starts a fake TrueNAS host with TLS, which the client must be told to trust (eg. AllowInsecure).
+// It has no pools until AddPool is called.
+func NewServer() *Server {
+	return newServer(nil)
+}
+
+// NewServerRequiringClientCert starts a fake TrueNAS host that, like a reverse proxy set up for mutual TLS,
+// only accepts clients with a certificate issued by one of clientCAs.
+func NewServerRequiringClientCert(clientCAs *x509.CertPool) *Server {
+	return newServer(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs})
+}
+
+func newServer(tlsConfig *tls.Config) *Server {
+	s := &Server{
+		apiKeys:    map[string]bool{ApiKey: true},
+		handlers:   make(map[string]HandlerFunc),
+		callCounts: make(map[string]int),
+		nextJobId:  1,
+		jobs:       make(map[int64]*Job),
+		txg:        1000,
+		pools:      make(map[string]bool),
+		datasets:   make(map[string]*dataset),
+		snapshots:  make(map[string]*snapshot),
+		conns:      make(map[*conn]bool),
+	}
+	s.registerCoreMethods()
+	s.registerAuthMethods()
+	s.registerDatasetMethods()
+	s.registerShareMethods()
+	s.registerServiceMethods()
+	s.httpServer = httptest.NewUnstartedServer(http.HandlerFunc(s.serveWebsocket))
+	s.httpServer.TLS = tlsConfig
+	// clients that don't trust the server, or aren't trusted by it, are expected in tests
+	s.httpServer.Config.ErrorLog = log.New(io.Discard, "", 0)
+	s.httpServer.StartTLS()
+	return s
+}
+
+// HostName returns the host and port to give as RealSession.HostName.
+func (s *Server) HostName() string {
+	return strings.TrimPrefix(s.httpServer.URL, "https://")
+}
+
+// URL returns the websocket URL of the API.
+func (s *Server) URL() string {
+	return "wss://" + s.HostName() + "/api/current"
+}
+
+// Certificate returns the server's self-signed certificate, eg. for pinning it or trusting it as a CA.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.httpServer.Certificate()
+}
+
+// Close drops every connection and stops the server.
+func (s *Server) Close() {
+	s.DropConnections()
+	s.httpServer.Close()
+}
+
+// DropConnections closes every websocket connection without a close message, as if the network had gone away.
+// The server keeps running, so clients can reconnect.
+func (s *Server) DropConnections() {
+	s.connsMtx.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.connsMtx.Unlock()
+
+	for _, c := range conns {
+		_ = c.ws.Close()
+	}
+}
+
+// AddApiKey makes the server accept another API key.
+func (s *Server) AddApiKey(key string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.apiKeys[key] = true
+}
+
+// Handle adds a method to the server, or replaces one of its own.
+func (s *Server) Handle(method string, handler HandlerFunc) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.handlers[method] = handler
+}
+
+// SetJobStepDelay slows down every step of a job, eg. each of the calls made by core.bulk,
+// so that tests can watch its progress or abort it.
+func (s *Server) SetJobStepDelay(delay time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.jobStepDelay = delay
+}
+
+// CallCount returns how many times a method has been called, including by core.bulk.
+func (s *Server) CallCount(method string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.callCounts[method]
+}
+
+// Call makes a call directly, without a connection, eg. to set up the state for a test.
+// Any job started by the call is run, and its ID returned as the result.
+func (s *Server) Call(method string, params ...interface{}) (interface{}, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	result, call, err := s.dispatch(method, normalize(params).([]interface{}))
+	s.flushEvents()
+	if call != nil {
+		call.startJobs()
+	}
+	return result, err
+}
+
+// Emit sends a collection_update event to the connections subscribed to collection, eg.
+// Emit("pool.dataset.query", "changed", "dozer/a", map[string]interface{}{"name": "dozer/a"}).
+func (s *Server) Emit(collection string, msg string, id interface{}, fields map[string]interface{}) {
+	params := map[string]interface{}{
+		"msg":        msg,
+		"collection": collection,
+		"id":         id,
+	}
+	if fields != nil {
+		params["fields"] = fields
+	}
+	message := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "collection_update",
+		"params":  params,
+	}
+
+	s.connsMtx.Lock()
+	targets := make([]*conn, 0)
+	for c := range s.conns {
+		for _, subCollection := range c.subscriptions {
+			if subCollection == collection {
+				targets = append(targets, c)
+				break
+			}
+		}
+	}
+	s.connsMtx.Unlock()
+
+	for _, c := range targets {
+		_ = c.writeJSON(message)
+	}
+}
+
+func (s *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{ws: ws, subscriptions: make(map[string]string)}
+
+	s.connsMtx.Lock()
+	s.conns[c] = true
+	s.connsMtx.Unlock()
+
+	defer func() {
+		s.connsMtx.Lock()
+		delete(s.conns, c)
+		s.connsMtx.Unlock()
+		_ = ws.Close()
+	}()
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var request map[string]interface{}
+		if err = json.Unmarshal(message, &request); err != nil {
+			_ = c.writeJSON(makeErrorResponse(nil, &Error{Code: -32700, Message: "Parse error"}))
+			continue
+		}
+		s.handleRequest(c, request)
+	}
+}
+
+func (s *Server) handleRequest(c *conn, request map[string]interface{}) {
+	id := request["id"]
+	method, _ := request["method"].(string)
+	params, _ := request["params"].([]interface{})
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	var result interface{}
+	var call *Call
+	var err error
+
+	switch {
+	case strings.HasPrefix(method, "auth.login"):
+		result, err = s.login(c, method, params)
+	case method == "core.ping":
+		result = "pong"
+	case !c.authenticated:
+		err = &Error{Code: -32001, Message: "Method call error", Errno: 13, Errname: "ENOTAUTHENTICATED", Reason: "Not authenticated"}
+	case method == "core.subscribe":
+		result, err = s.subscribe(c, params)
+	case method == "core.unsubscribe":
+		result, err = s.unsubscribe(c, params)
+	default:
+		result, call, err = s.dispatch(method, params)
+	}
+
+	if id != nil {
+		if err != nil {
+			_ = c.writeJSON(makeErrorResponse(id, err))
+		} else {
+			_ = c.writeJSON(map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": result})
+		}
+	}
+	s.flushEvents()
+	if call != nil {
+		call.startJobs()
+	}
+}
+
+func (s *Server) subscribe(c *conn, params []interface{}) (interface{}, error) {
+	collection, ok := getParam(params, 0).(string)
+	if !ok || collection == "" {
+		return nil, errInvalid("core.subscribe expects the name of a collection")
+	}
+
+	s.mtx.Lock()
+	s.callCounts["core.subscribe"]++
+	s.mtx.Unlock()
+
+	s.connsMtx.Lock()
+	defer s.connsMtx.Unlock()
+	s.nextSubId++
+	subId := fmt.Sprintf("sub-%d", s.nextSubId)
+	c.subscriptions[subId] = collection
+	return subId, nil
+}
+
+func (s *Server) unsubscribe(c *conn, params []interface{}) (interface{}, error) {
+	subId, _ := getParam(params, 0).(string)
+
+	s.connsMtx.Lock()
+	defer s.connsMtx.Unlock()
+	if _, exists := c.subscriptions[subId]; !exists {
+		return nil, errNotFound("Subscription %s does not exist", subId)
+	}
+	delete(c.subscriptions, subId)
+	return nil, nil
+}
+
+// dispatch runs the handler of a method with the state locked.
+// The returned call holds any jobs that the handler created, which must be started once the call has been answered.
+func (s *Server) dispatch(method string, params []interface{}) (interface{}, *Call, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.dispatchLocked(method, params)
+}
+
+func (s *Server) dispatchLocked(method string, params []interface{}) (interface{}, *Call, error) {
+	s.callCounts[method]++
+	handler, exists := s.handlers[method]
+	if !exists {
+		return nil, nil, &Error{Code: -32601, Message: "Method not found", Reason: fmt.Sprintf("Method %s not found", method)}
+	}
+	call := &Call{Method: method, Params: params, server: s}
+	result, err := handler(call)
+	if err != nil {
+		return nil, nil, err
+	}
+	return normalize(result), call, nil
+}
+
+// Param returns the call's i'th parameter, or nil if there are not that many.
+func (c *Call) Param(i int) interface{} {
+	return getParam(c.Params, i)
+}
+
+// ObjectParam returns the call's i'th parameter as an object, or an empty one if it is missing or not an object.
+func (c *Call) ObjectParam(i int) map[string]interface{} {
+	if obj, ok := c.Param(i).(map[string]interface{}); ok {
+		return obj
+	}
+	return make(map[string]interface{})
+}
+
+func (c *Call) startJobs() {
+	for _, job := range c.jobs {
+		go job.run()
+	}
+	c.jobs = nil
+}
+
+func (c *conn) writeJSON(message interface{}) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	return c.ws.WriteJSON(message)
+}
+
+// Error is a failed call, reported the way the middleware does.
+type Error struct {
+	// Code is the JSON-RPC error code, eg. -32001 for a method call error or -32601 for an unknown method.
+	Code    int
+	Message string
+	// Errno and Errname describe the cause, eg. 22 and "EINVAL".
+	Errno   int
+	Errname string
+	Reason  string
+}
+
+func (e *Error) Error() string {
+	if e.Errname != "" {
+		return fmt.Sprintf("[%s] %s", e.Errname, e.Reason)
+	}
+	if e.Reason != "" {
+		return e.Reason
+	}
+	return e.Message
+}
+
+func newCallError(errno int, errname string, format string, args ...interface{}) *Error {
+	return &Error{Code: -32001, Message: "Method call error", Errno: errno, Errname: errname, Reason: fmt.Sprintf(format, args...)}
+}
+
+func errInvalid(format string, args ...interface{}) *Error {
+	return newCallError(22, "EINVAL", format, args...)
+}
+
+func errNotFound(format string, args ...interface{}) *Error {
+	return newCallError(2, "ENOENT", format, args...)
+}
+
+func errExists(format string, args ...interface{}) *Error {
+	return newCallError(17, "EEXIST", format, args...)
+}
+
+func errBusy(format string, args ...interface{}) *Error {
+	return newCallError(16, "EBUSY", format, args...)
+}
+
+func makeErrorResponse(id interface{}, err error) map[string]interface{} {
+	var callErr *Error
+	if !errors.As(err, &callErr) {
+		callErr = newCallError(14, "EFAULT", "%s", err.Error())
+	}
+	errorObj := map[string]interface{}{
+		"code":    callErr.Code,
+		"message": callErr.Message,
+	}
+	if callErr.Errname != "" || callErr.Reason != "" {
+		errorObj["data"] = map[string]interface{}{
+			"error":   callErr.Errno,
+			"errname": callErr.Errname,
+			"reason":  callErr.Reason,
+			"trace":   nil,
+			"extra":   []interface{}{},
+		}
+	}
+	return map[string]interface{}{"jsonrpc": "2.0", "id": id, "error": errorObj}
+}
+
+func getParam(params []interface{}, i int) interface{} {
+	if i < len(params) {
+		return params[i]
+	}
+	return nil
+}
+
+// normalize converts a value to the types that encoding/json decodes into, so that results and filters can be compared.
+func normalize(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var out interface{}
+	if err = json.Unmarshal(data, &out); err != nil {
+		return value
+	}
+	return out
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,221 @@
+package truenastest
+
+import (
+	"encoding/json"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	"truenas/truenas_incus_ctl/truenas_api"
+)
+
+func AssertEqual[T comparable](test *testing.T, a T, b T) {
+	if a != b {
+		test.Errorf("\nFailure: %v != %v\n%s", a, b, string(debug.Stack()))
+	}
+}
+
+func mustCall(t *testing.T, server *Server, method string, params ...interface{}) interface{} {
+	t.Helper()
+	result, err := server.Call(method, params...)
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	return result
+}
+
+func decodeResponse(t *testing.T, data json.RawMessage) map[string]interface{} {
+	t.Helper()
+	var response map[string]interface{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func getErrname(response map[string]interface{}) string {
+	errorObj, _ := response["error"].(map[string]interface{})
+	data, _ := errorObj["data"].(map[string]interface{})
+	errname, _ := data["errname"].(string)
+	return errname
+}
+
+func TestLoginIsRequired(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	client, err := truenas_api.NewClient(server.URL(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	out, err := client.Call("pool.dataset.query", 10, []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, getErrname(decodeResponse(t, out)), "ENOTAUTHENTICATED")
+
+	if err = client.Login("", "", "1-wrong"); err == nil {
+		t.Fatal("expected a wrong API key to be rejected")
+	}
+	if err = client.Login("", "", ApiKey); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = client.Call("no.such.method", 10, []interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorObj, _ := decodeResponse(t, out)["error"].(map[string]interface{})
+	AssertEqual(t, errorObj["code"], interface{}(float64(-32601)))
+	AssertEqual(t, server.CallCount("auth.login_with_api_key"), 2)
+}
+
+func TestDatasetQueryNestsChildrenAndInheritsProperties(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+
+	mustCall(t, server, "pool.dataset.create", map[string]interface{}{"name": "dozer/a", "compression": "ZSTD"})
+	mustCall(t, server, "pool.dataset.create", map[string]interface{}{"name": "dozer/a/b"})
+	mustCall(t, server, "pool.dataset.create", map[string]interface{}{"name": "dozer/vol", "type": "VOLUME", "volsize": 1 << 30})
+
+	result := mustCall(t, server, "pool.dataset.query",
+		[]interface{}{[]interface{}{"name", "^", "dozer/a"}},
+		map[string]interface{}{"extra": map[string]interface{}{
+			"flat": false, "retrieve_children": true, "properties": []interface{}{"compression"}, "user_properties": false,
+		}})
+
+	list := result.([]interface{})
+	AssertEqual(t, len(list), 1)
+	a := list[0].(map[string]interface{})
+	AssertEqual(t, a["id"], interface{}("dozer/a"))
+	AssertEqual(t, a["mountpoint"], interface{}("/mnt/dozer/a"))
+	AssertEqual(t, a["compression"].(map[string]interface{})["value"], interface{}("ZSTD"))
+	AssertEqual(t, a["compression"].(map[string]interface{})["source"], interface{}("LOCAL"))
+	if _, exists := a["atime"]; exists {
+		t.Error("atime was returned without being asked for")
+	}
+
+	children := a["children"].([]interface{})
+	AssertEqual(t, len(children), 1)
+	b := children[0].(map[string]interface{})
+	AssertEqual(t, b["id"], interface{}("dozer/a/b"))
+	AssertEqual(t, b["compression"].(map[string]interface{})["rawvalue"], interface{}("zstd"))
+	AssertEqual(t, b["compression"].(map[string]interface{})["source"], interface{}("INHERITED"))
+
+	vol := mustCall(t, server, "pool.dataset.query",
+		[]interface{}{[]interface{}{"name", "=", "dozer/vol"}},
+		map[string]interface{}{"get": true}).(map[string]interface{})
+	AssertEqual(t, vol["type"], interface{}("VOLUME"))
+	AssertEqual(t, vol["mountpoint"], nil)
+	AssertEqual(t, vol["volsize"].(map[string]interface{})["value"], interface{}("1G"))
+	AssertEqual(t, vol["volsize"].(map[string]interface{})["parsed"], interface{}(float64(1<<30)))
+}
+
+func TestDatasetValidationAndCascadingDelete(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+
+	_, err := server.Call("pool.dataset.create", map[string]interface{}{"name": "dozer/x/y"})
+	if err == nil || !strings.Contains(err.Error(), "EINVAL") {
+		t.Fatalf("expected EINVAL for a missing parent, got %v", err)
+	}
+	mustCall(t, server, "pool.dataset.create", map[string]interface{}{"name": "dozer/x/y", "create_ancestors": true})
+	_, err = server.Call("pool.dataset.create", map[string]interface{}{"name": "dozer/x"})
+	if err == nil || !strings.Contains(err.Error(), "EEXIST") {
+		t.Fatalf("expected EEXIST for an existing dataset, got %v", err)
+	}
+
+	share := mustCall(t, server, "sharing.nfs.create", map[string]interface{}{"path": "/mnt/dozer/x/y"}).(map[string]interface{})
+	AssertEqual(t, share["id"], interface{}(float64(1)))
+	_, err = server.Call("sharing.nfs.create", map[string]interface{}{"path": "/mnt/dozer/x/y"})
+	if err == nil {
+		t.Fatal("expected a second share of the same path to be rejected")
+	}
+
+	_, err = server.Call("pool.dataset.delete", "dozer/x")
+	if err == nil || !strings.Contains(err.Error(), "EBUSY") {
+		t.Fatalf("expected EBUSY for a dataset with children, got %v", err)
+	}
+	mustCall(t, server, "pool.dataset.delete", "dozer/x", map[string]interface{}{"recursive": true})
+
+	AssertEqual(t, strings.Join(server.Datasets(), ","), "dozer")
+	shares := mustCall(t, server, "sharing.nfs.query").([]interface{})
+	AssertEqual(t, len(shares), 0)
+}
+
+func TestBulkJobSendsEvents(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+	mustCall(t, server, "zfs.snapshot.create", map[string]interface{}{"dataset": "dozer", "name": "taken"})
+
+	updates := make(chan map[string]interface{}, 100)
+	client, err := truenas_api.NewClientWithCallback(server.URL(), true, func(waitingId int64, innerId int64, fields map[string]interface{}) {
+		if waitingId == innerId {
+			updates <- fields
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = client.Login("", "", ApiKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.SubscribeToJobs(); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := client.CallWithJob("core.bulk", []interface{}{"zfs.snapshot.create", []interface{}{
+		[]interface{}{map[string]interface{}{"dataset": "dozer", "name": "new"}},
+		[]interface{}{map[string]interface{}{"dataset": "dozer", "name": "taken"}},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	for fields == nil {
+		select {
+		case update := <-updates:
+			if update["id"] == float64(job.ID) && update["state"] == "SUCCESS" {
+				fields = update
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the job to finish")
+		}
+	}
+
+	statuses := fields["result"].([]interface{})
+	AssertEqual(t, len(statuses), 2)
+	AssertEqual(t, statuses[0].(map[string]interface{})["error"], nil)
+	if errStr, _ := statuses[1].(map[string]interface{})["error"].(string); !strings.Contains(errStr, "EEXIST") {
+		t.Errorf("expected the second snapshot to fail with EEXIST, got %q", errStr)
+	}
+	AssertEqual(t, strings.Join(server.Snapshots(), ","), "dozer@new,dozer@taken")
+}
+
+func TestJobAbort(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.AddPool("dozer")
+	server.SetJobStepDelay(time.Minute)
+
+	jobId := mustCall(t, server, "core.bulk", "pool.dataset.create", []interface{}{
+		[]interface{}{map[string]interface{}{"name": "dozer/a"}},
+		[]interface{}{map[string]interface{}{"name": "dozer/b"}},
+	}).(float64)
+
+	mustCall(t, server, "core.job_abort", jobId)
+	if !server.WaitForJob(int64(jobId), 5*time.Second) {
+		t.Fatal("the aborted job did not finish")
+	}
+	job, _ := server.Job(int64(jobId))
+	AssertEqual(t, job["state"], interface{}("ABORTED"))
+	AssertEqual(t, len(server.Datasets()), 1)
+}
@@ -0,0 +1,101 @@
+package truenastest
+
+import "strings"
+
+// defaultServices are the services of a new server, all stopped and disabled.
+var defaultServices = []string{"nfs", "iscsitarget", "smb", "ssh"}
+
+// SetServiceState sets whether a service is running, eg. to test a command against a host where NFS is already started.
+func (s *Server) SetServiceState(service string, running bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if svc := s.getServiceLocked(service); svc != nil {
+		s.setServiceStateLocked(svc, running)
+	}
+}
+
+func (s *Server) getServiceLocked(nameOrId interface{}) map[string]interface{} {
+	for _, svc := range s.services {
+		if svc["service"] == nameOrId || svc["id"] == nameOrId {
+			return svc
+		}
+	}
+	return nil
+}
+
+func (s *Server) setServiceStateLocked(svc map[string]interface{}, running bool) {
+	svc["state"] = "STOPPED"
+	svc["pids"] = []interface{}{}
+	if running {
+		svc["state"] = "RUNNING"
+		svc["pids"] = []interface{}{float64(4000) + svc["id"].(float64)}
+	}
+	s.queueEventLocked("service.query", "changed", svc["id"], svc)
+}
+
+func (s *Server) registerServiceMethods() {
+	for i, name := range defaultServices {
+		s.services = append(s.services, map[string]interface{}{
+			"id":      float64(i + 1),
+			"service": name,
+			"enable":  false,
+			"state":   "STOPPED",
+			"pids":    []interface{}{},
+		})
+	}
+
+	s.handlers["service.query"] = func(call *Call) (interface{}, error) {
+		items := make([]interface{}, 0, len(s.services))
+		for _, svc := range s.services {
+			items = append(items, svc)
+		}
+		return queryItems(items, call.Param(0), call.Param(1))
+	}
+
+	s.handlers["service.started"] = func(call *Call) (interface{}, error) {
+		svc, err := s.getServiceParamLocked(call)
+		if err != nil {
+			return nil, err
+		}
+		return svc["state"] == "RUNNING", nil
+	}
+
+	s.handlers["service.update"] = func(call *Call) (interface{}, error) {
+		svc, err := s.getServiceParamLocked(call)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range call.ObjectParam(1) {
+			if key != "enable" {
+				return nil, errInvalid("service_update.%s: Field was not expected", key)
+			}
+			enable, ok := value.(bool)
+			if !ok {
+				return nil, errInvalid("service_update.enable: Not a boolean")
+			}
+			svc["enable"] = enable
+		}
+		s.queueEventLocked("service.query", "changed", svc["id"], svc)
+		return svc["id"], nil
+	}
+
+	for _, action := range []string{"start", "stop", "restart", "reload"} {
+		running := action != "stop"
+		s.handlers["service."+action] = func(call *Call) (interface{}, error) {
+			svc, err := s.getServiceParamLocked(call)
+			if err != nil {
+				return nil, err
+			}
+			s.setServiceStateLocked(svc, running)
+			return true, nil
+		}
+	}
+}
+
+func (s *Server) getServiceParamLocked(call *Call) (map[string]interface{}, error) {
+	svc := s.getServiceLocked(call.Param(0))
+	if svc == nil {
+		return nil, errNotFound("%s: Service %v does not exist", strings.TrimPrefix(call.Method, "service."), call.Param(0))
+	}
+	return svc, nil
+}
@@ -0,0 +1,331 @@
+package truenastest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// crudCollection is a collection of objects with numeric IDs, such as NFS shares or iSCSI targets,
+// answering <name>.query, .get_instance, .create, .update and .delete.
+type crudCollection struct {
+	name     string
+	nextId   int
+	items    map[int]map[string]interface{}
+	defaults map[string]interface{}
+	// validate checks an object before it is created or updated, and may fill in computed fields. id is -1 on create.
+	validate func(id int, item map[string]interface{}) error
+	// onDelete removes any objects that depend on the one being deleted.
+	onDelete func(id int)
+}
+
+func (c *crudCollection) ids() []int {
+	ids := make([]int, 0, len(c.items))
+	for id := range c.items {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (c *crudCollection) removeLocked(s *Server, id int) {
+	if _, exists := c.items[id]; !exists {
+		return
+	}
+	delete(c.items, id)
+	if c.onDelete != nil {
+		c.onDelete(id)
+	}
+	s.queueEventLocked(c.name+".query", "removed", id, nil)
+}
+
+func (s *Server) addCrudCollection(name string, defaults map[string]interface{}, validate func(int, map[string]interface{}) error) *crudCollection {
+	c := &crudCollection{name: name, nextId: 1, items: make(map[int]map[string]interface{}), defaults: defaults, validate: validate}
+	if s.crud == nil {
+		s.crud = make(map[string]*crudCollection)
+	}
+	s.crud[name] = c
+
+	s.handlers[name+".query"] = func(call *Call) (interface{}, error) {
+		items := make([]interface{}, 0, len(c.items))
+		for _, id := range c.ids() {
+			items = append(items, c.items[id])
+		}
+		return queryItems(items, call.Param(0), call.Param(1))
+	}
+
+	s.handlers[name+".get_instance"] = func(call *Call) (interface{}, error) {
+		item, err := c.getLocked(call.Param(0))
+		if err != nil {
+			return nil, err
+		}
+		return item, nil
+	}
+
+	s.handlers[name+".create"] = func(call *Call) (interface{}, error) {
+		item := normalize(c.defaults).(map[string]interface{})
+		for key, value := range call.ObjectParam(0) {
+			if _, known := c.defaults[key]; !known {
+				return nil, errInvalid("%s.create.%s: Field was not expected", name, key)
+			}
+			item[key] = value
+		}
+		if err := c.validate(-1, item); err != nil {
+			return nil, err
+		}
+		item["id"] = float64(c.nextId)
+		c.items[c.nextId] = item
+		c.nextId++
+		s.queueEventLocked(name+".query", "added", item["id"], item)
+		return item, nil
+	}
+
+	s.handlers[name+".update"] = func(call *Call) (interface{}, error) {
+		existing, err := c.getLocked(call.Param(0))
+		if err != nil {
+			return nil, err
+		}
+		id := int(existing["id"].(float64))
+		item := normalize(existing).(map[string]interface{})
+		for key, value := range call.ObjectParam(1) {
+			if _, known := c.defaults[key]; !known {
+				return nil, errInvalid("%s.update.%s: Field was not expected", name, key)
+			}
+			item[key] = value
+		}
+		if err = c.validate(id, item); err != nil {
+			return nil, err
+		}
+		c.items[id] = item
+		s.queueEventLocked(name+".query", "changed", item["id"], item)
+		return item, nil
+	}
+
+	s.handlers[name+".delete"] = func(call *Call) (interface{}, error) {
+		existing, err := c.getLocked(call.Param(0))
+		if err != nil {
+			return nil, err
+		}
+		c.removeLocked(s, int(existing["id"].(float64)))
+		return true, nil
+	}
+
+	return c
+}
+
+func (c *crudCollection) getLocked(id interface{}) (map[string]interface{}, error) {
+	idFloat, ok := id.(float64)
+	if !ok {
+		return nil, errInvalid("%s: An ID is required", c.name)
+	}
+	item, exists := c.items[int(idFloat)]
+	if !exists {
+		return nil, errNotFound("%s %d does not exist", c.name, int(idFloat))
+	}
+	return item, nil
+}
+
+// isDuplicate reports whether another object than id has the same value for field.
+func (c *crudCollection) isDuplicate(id int, field string, value interface{}) bool {
+	for otherId, other := range c.items {
+		if otherId != id && fmt.Sprint(other[field]) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) registerShareMethods() {
+	nfs := s.addCrudCollection("sharing.nfs", map[string]interface{}{
+		"path": "", "aliases": []interface{}{}, "comment": "", "networks": []interface{}{}, "hosts": []interface{}{},
+		"ro": false, "maproot_user": nil, "maproot_group": nil, "mapall_user": nil, "mapall_group": nil,
+		"security": []interface{}{}, "enabled": true, "locked": false, "expose_snapshots": false,
+	}, nil)
+	nfs.validate = func(id int, item map[string]interface{}) error {
+		path, _ := item["path"].(string)
+		if !strings.HasPrefix(path, "/mnt/") {
+			return errInvalid("sharingnfs.path: Path must be within a pool, eg. /mnt/dozer/share")
+		}
+		if !s.isFilesystemPathLocked(path) {
+			return errInvalid("sharingnfs.path: Path %s does not exist", path)
+		}
+		if nfs.isDuplicate(id, "path", path) {
+			return errInvalid("sharingnfs.path: Another NFS share already exports this dataset")
+		}
+		return nil
+	}
+
+	portals := s.addCrudCollection("iscsi.portal", map[string]interface{}{
+		"tag": 0, "comment": "", "listen": []interface{}{},
+	}, nil)
+	portals.validate = func(id int, item map[string]interface{}) error {
+		listen, _ := item["listen"].([]interface{})
+		if len(listen) == 0 {
+			return errInvalid("iscsiportal.listen: At least one listen address is required")
+		}
+		for i, l := range listen {
+			obj, _ := l.(map[string]interface{})
+			if _, ok := obj["ip"].(string); !ok {
+				return errInvalid("iscsiportal.listen.%d.ip: This field is required", i)
+			}
+		}
+		if id < 0 {
+			item["tag"] = float64(portals.nextId)
+		}
+		return nil
+	}
+
+	initiators := s.addCrudCollection("iscsi.initiator", map[string]interface{}{
+		"initiators": []interface{}{}, "comment": "",
+	}, func(id int, item map[string]interface{}) error {
+		if _, ok := item["initiators"].([]interface{}); !ok {
+			return errInvalid("iscsi_initiator.initiators: Not a list")
+		}
+		return nil
+	})
+
+	s.addCrudCollection("iscsi.auth", map[string]interface{}{
+		"tag": 0, "user": "", "secret": "", "peeruser": "", "peersecret": "",
+	}, func(id int, item map[string]interface{}) error {
+		secret, _ := item["secret"].(string)
+		if user, _ := item["user"].(string); user == "" {
+			return errInvalid("iscsi_auth.user: This field is required")
+		}
+		if len(secret) < 12 || len(secret) > 16 {
+			return errInvalid("iscsi_auth.secret: Secret must be between 12 and 16 characters")
+		}
+		return nil
+	})
+
+	targets := s.addCrudCollection("iscsi.target", map[string]interface{}{
+		"name": "", "alias": nil, "mode": "ISCSI", "groups": []interface{}{}, "auth_networks": []interface{}{},
+	}, nil)
+	targets.validate = func(id int, item map[string]interface{}) error {
+		name, _ := item["name"].(string)
+		if name == "" || strings.ContainsAny(name, " _") || name != strings.ToLower(name) {
+			return errInvalid("iscsi_target_create.name: Lowercase alphanumeric characters plus dot (.), dash (-), and colon (:) are allowed")
+		}
+		if targets.isDuplicate(id, "name", name) {
+			return errInvalid("iscsi_target_create.name: Target name already exists")
+		}
+		groups, _ := item["groups"].([]interface{})
+		for i, g := range groups {
+			group, _ := g.(map[string]interface{})
+			if _, err := portals.getLocked(group["portal"]); err != nil {
+				return errInvalid("iscsi_target_create.groups.%d.portal: Portal %v does not exist", i, group["portal"])
+			}
+			if initiator, exists := group["initiator"]; exists && initiator != nil {
+				if _, err := initiators.getLocked(initiator); err != nil {
+					return errInvalid("iscsi_target_create.groups.%d.initiator: Initiator %v does not exist", i, initiator)
+				}
+			}
+		}
+		return nil
+	}
+
+	extents := s.addCrudCollection("iscsi.extent", map[string]interface{}{
+		"name": "", "type": "DISK", "disk": nil, "path": nil, "filesize": 0, "serial": nil, "naa": nil,
+		"blocksize": 512, "pblocksize": false, "avail_threshold": nil, "comment": "", "insecure_tpc": true,
+		"xen": false, "rpm": "SSD", "ro": false, "enabled": true, "vendor": "TrueNAS", "product_id": nil, "locked": false,
+	}, nil)
+	extents.validate = func(id int, item map[string]interface{}) error {
+		name, _ := item["name"].(string)
+		if name == "" {
+			return errInvalid("iscsi_extent_create.name: This field is required")
+		}
+		if extents.isDuplicate(id, "name", name) {
+			return errInvalid("iscsi_extent_create.name: Extent name must be unique")
+		}
+		if strings.ToUpper(fmt.Sprint(item["type"])) == "DISK" {
+			disk, _ := item["disk"].(string)
+			ds, exists := s.datasets[strings.TrimPrefix(disk, "zvol/")]
+			if !strings.HasPrefix(disk, "zvol/") || !exists || ds.typ != "VOLUME" {
+				return errInvalid("iscsi_extent_create.disk: Disk %q does not exist", disk)
+			}
+			if extents.isDuplicate(id, "disk", disk) {
+				return errInvalid("iscsi_extent_create.disk: Disk currently in use by another extent")
+			}
+		} else if path, _ := item["path"].(string); !strings.HasPrefix(path, "/mnt/") {
+			return errInvalid("iscsi_extent_create.path: Path must be within a pool")
+		}
+		if item["serial"] == nil {
+			sum := sha256.Sum256([]byte(name))
+			item["serial"] = fmt.Sprintf("%x", sum[:7])
+			item["naa"] = fmt.Sprintf("0x6589cfc000000%x", sum[7:16])
+		}
+		return nil
+	}
+
+	targetExtents := s.addCrudCollection("iscsi.targetextent", map[string]interface{}{
+		"target": nil, "extent": nil, "lunid": nil,
+	}, nil)
+	targetExtents.validate = func(id int, item map[string]interface{}) error {
+		if _, err := targets.getLocked(item["target"]); err != nil {
+			return errInvalid("iscsi_targetextent_create.target: Target %v does not exist", item["target"])
+		}
+		if _, err := extents.getLocked(item["extent"]); err != nil {
+			return errInvalid("iscsi_targetextent_create.extent: Extent %v does not exist", item["extent"])
+		}
+		usedLuns := make(map[float64]bool)
+		for otherId, other := range targetExtents.items {
+			if otherId == id {
+				continue
+			}
+			if other["extent"] == item["extent"] {
+				return errInvalid("iscsi_targetextent_create.extent: Extent is already in use")
+			}
+			if other["target"] == item["target"] {
+				usedLuns[other["lunid"].(float64)] = true
+			}
+		}
+		if item["lunid"] == nil {
+			lunid := float64(0)
+			for usedLuns[lunid] {
+				lunid++
+			}
+			item["lunid"] = lunid
+		} else if lunid, ok := item["lunid"].(float64); !ok || usedLuns[lunid] {
+			return errInvalid("iscsi_targetextent_create.lunid: LUN ID is already being used for this target")
+		}
+		return nil
+	}
+
+	// associations go along with their target or extent
+	removeAssociations := func(field string, id int) {
+		for _, teId := range targetExtents.ids() {
+			if targetExtents.items[teId][field] == float64(id) {
+				targetExtents.removeLocked(s, teId)
+			}
+		}
+	}
+	targets.onDelete = func(id int) { removeAssociations("target", id) }
+	extents.onDelete = func(id int) { removeAssociations("extent", id) }
+
+	s.handlers["iscsi.global.config"] = func(call *Call) (interface{}, error) {
+		return map[string]interface{}{
+			"id":                   1,
+			"basename":             "iqn.2005-10.org.freenas.ctl",
+			"isns_servers":         []interface{}{},
+			"listen_port":          3260,
+			"pool_avail_threshold": nil,
+			"alua":                 false,
+		}, nil
+	}
+}
+
+// removeExtentLocked deletes an extent, along with its associations.
+func (s *Server) removeExtentLocked(id int) {
+	s.crud["iscsi.extent"].removeLocked(s, id)
+}
+
+// isFilesystemPathLocked reports whether path is the mountpoint of a filesystem, or within one.
+func (s *Server) isFilesystemPathLocked(path string) bool {
+	name := strings.TrimSuffix(strings.TrimPrefix(path, "/mnt/"), "/")
+	for ; name != ""; name = parentName(name) {
+		if ds, exists := s.datasets[name]; exists {
+			return ds.typ == "FILESYSTEM"
+		}
+	}
+	return false
+}